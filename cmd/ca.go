@@ -0,0 +1,36 @@
+/*
+Copyright © 2022 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+// caCmd groups the certificate commands and the commands operating on the local CA folder
+var caCmd = &cobra.Command{
+	Use:   "ca",
+	Short: "work with the CA",
+	Long: `sign, get, list, revoke, crl, bundle, export, expiring and verify talk to a running caserver over gRPC or HTTP,
+inspect reads local files, join-token and rollover work directly on the CA files under the cert folder`,
+}
+
+func init() {
+	rootCmd.AddCommand(caCmd)
+}
+
+/*
+以缩进的json打印结果
+*/
+func printJSON(v interface{}) error {
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
@@ -5,11 +5,27 @@ Copyright © 2022 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
 	"github.com/spf13/cobra"
 
+	"github.com/jackyzhangfudan/sidecar/pkg/auth"
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+	"github.com/jackyzhangfudan/sidecar/pkg/discovery"
 	grpcserver "github.com/jackyzhangfudan/sidecar/pkg/grpc/server"
+	"github.com/jackyzhangfudan/sidecar/pkg/ha"
 	"github.com/jackyzhangfudan/sidecar/pkg/httpserver"
+	"github.com/jackyzhangfudan/sidecar/pkg/notify"
 	"github.com/jackyzhangfudan/sidecar/pkg/util"
+	"github.com/jackyzhangfudan/sidecar/pkg/webhook"
+	workloadserver "github.com/jackyzhangfudan/sidecar/pkg/workloadapi/server"
 )
 
 // caserverCmd represents the caserver command
@@ -24,6 +40,29 @@ var caserverCmd = &cobra.Command{
 
 var useGRPC *bool
 var useMTLS *bool
+var trustDomain *string
+var federatedBundles *map[string]string
+var workloadOpts workloadserver.Options
+var rolloverCheckInterval time.Duration
+var keyTTL time.Duration
+var authConfig string
+var limits ca.Limits
+var keyPoolOpts ca.KeyPoolOptions
+var keyPoolAlgorithms []string
+var serverAddress string
+var registry discovery.Registry
+var advertiseAddress string
+var haOpts ha.Options
+var raftPeers string
+var httpMTLS bool
+var expiryOpts ca.ExpiryOptions
+var expiryThresholds []string
+var expiryLog bool
+var expiryWebhooks []string
+var smtpOpts notify.SMTPOptions
+var smtpPasswordFile string
+var webhookConfigFile string
+var webhookQueue string
 
 func init() {
 	rootCmd.AddCommand(caserverCmd)
@@ -39,15 +78,249 @@ func init() {
 	// caserverCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 	useGRPC = caserverCmd.Flags().Bool("grpc", true, "enable the gRPC instead of http1.1")
 	useMTLS = caserverCmd.Flags().Bool("mtls", true, "enable the mtls for gRPC, no effect when don't use gRPC")
+	caserverCmd.Flags().BoolVar(&httpMTLS, "http-mtls", false, "serve http over TLS with the local certificate, client certificates are verified when given, no effect when use gRPC")
+	trustDomain = caserverCmd.Flags().String("trust-domain", "", "SPIFFE trust domain of this CA, X.509-SVIDs are issued only when it is set")
+	federatedBundles = caserverCmd.Flags().StringToString("federate", nil, "trust bundles of federated trust domains, e.g. --federate=other.org=bundle.pem")
+	caserverCmd.Flags().StringVar(&workloadOpts.SocketPath, "workload-socket", "", "serve the SPIFFE Workload API on this unix domain socket, needs --trust-domain")
+	caserverCmd.Flags().StringVar(&workloadOpts.RulesFile, "workload-rules", "workload-rules.json", "attestation rules mapping peer uid/gid/path to SPIFFE IDs")
+	caserverCmd.Flags().StringVar(&authConfig, "auth-config", "", "JSON file with the authenticators (tokens, jwt, kubernetes) and the RBAC roles and bindings, every caller is allowed without it")
+	caserverCmd.Flags().DurationVar(&keyTTL, "key-ttl", ca.DefaultKeyTTL, "private keys generated by the CA are deleted when not fetched within this time")
+	caserverCmd.Flags().DurationVar(&rolloverCheckInterval, "rollover-check-interval", 30*time.Second, "how often the root CA rollover state is checked")
+	caserverCmd.Flags().Float64Var(&limits.Rate, "rate-limit", 0, "certificates each caller can request per second, anonymous callers are limited by address, 0 means unlimited")
+	caserverCmd.Flags().IntVar(&limits.Burst, "rate-burst", 10, "burst of certificate requests allowed for each caller")
+	caserverCmd.Flags().Float64Var(&limits.GlobalRate, "global-rate-limit", 0, "certificates all callers together can request per second, 0 means unlimited")
+	caserverCmd.Flags().IntVar(&limits.GlobalBurst, "global-rate-burst", 50, "burst of certificate requests allowed for all callers together")
+	caserverCmd.Flags().IntVar(&limits.MaxConcurrentKeygen, "max-concurrent-keygen", runtime.NumCPU(), "private keys generated at the same time, 0 means unlimited")
+	caserverCmd.Flags().DurationVar(&limits.KeygenWait, "keygen-wait", 5*time.Second, "how long a request waits for a key generation slot before it is rejected")
+	caserverCmd.Flags().IntVar(&limits.MaxActiveCertificates, "max-active-certs", 0, "unexpired and unrevoked certificates each authenticated caller can hold, 0 means unlimited")
+	caserverCmd.Flags().IntVar(&keyPoolOpts.Size, "key-pool-size", 0, "private keys generated in advance for each algorithm, 0 disables the key pool")
+	caserverCmd.Flags().Float64Var(&keyPoolOpts.RefillRate, "key-pool-refill-rate", 5, "private keys added to the pool per second for each algorithm")
+	caserverCmd.Flags().StringSliceVar(&keyPoolAlgorithms, "key-pool-algorithms", []string{"rsa"}, "algorithms the key pool prepares keys for: rsa, ecdsa, ed25519")
+	caserverCmd.Flags().StringVar(&serverAddress, "address", "", "address the server listens on, default :8112 for gRPC and :8111 for http")
+	caserverCmd.Flags().StringVar(&registry.Dir, "registry-dir", "", "register this replica in the local service registry in this folder, clients find it with registry:///ca")
+	caserverCmd.Flags().StringVar(&advertiseAddress, "advertise-address", "", "address clients use to reach this replica, default localhost with the port of --address")
+	caserverCmd.Flags().DurationVar(&workloadOpts.SVIDTTL, "svid-ttl", time.Hour, "lifetime of the X.509-SVIDs served by the Workload API, they are rotated at half of it")
+	caserverCmd.Flags().StringVar(&haOpts.Address, "raft-address", "", "replicate the CA state with the other replicas over raft on this address, e.g. 127.0.0.1:7001")
+	caserverCmd.Flags().StringVar(&haOpts.NodeID, "raft-id", "", "id of this replica in the raft cluster, default --raft-address")
+	caserverCmd.Flags().StringVar(&haOpts.Dir, "raft-dir", "raft", "folder of the raft log and snapshots")
+	caserverCmd.Flags().DurationVar(&expiryOpts.Interval, "expiry-check-interval", time.Hour, "how often the certificates of the CA are checked for expiry")
+	caserverCmd.Flags().DurationVar(&expiryOpts.Timeout, "expiry-check-timeout", ca.DefaultExpiryScanTimeout, "cancel an expiry check and the notifications it sends after this long, at most --expiry-check-interval")
+	caserverCmd.Flags().StringSliceVar(&expiryThresholds, "expiry-thresholds", []string{"30d", "7d", "1d"}, "notify once when a certificate is about to expire within each of these times")
+	caserverCmd.Flags().BoolVar(&expiryLog, "expiry-log", true, "write the expiry notifications to the server log")
+	caserverCmd.Flags().StringSliceVar(&expiryWebhooks, "expiry-webhook", nil, "POST the expiry notifications as JSON to these URLs")
+	caserverCmd.Flags().StringVar(&smtpOpts.Address, "expiry-smtp-address", "", "mail the expiry notifications through this SMTP server, e.g. smtp.example.com:587")
+	caserverCmd.Flags().StringVar(&smtpOpts.From, "expiry-smtp-from", "", "sender of the expiry mails")
+	caserverCmd.Flags().StringSliceVar(&smtpOpts.To, "expiry-smtp-to", nil, "recipients of the expiry mails")
+	caserverCmd.Flags().StringVar(&smtpOpts.Username, "expiry-smtp-username", "", "SMTP user, no authentication without it")
+	caserverCmd.Flags().StringVar(&smtpPasswordFile, "expiry-smtp-password-file", "", "file holding the password of the SMTP user")
+	caserverCmd.Flags().DurationVar(&smtpOpts.Timeout, "expiry-smtp-timeout", notify.DefaultSMTPTimeout, "give up sending an expiry mail after this long, it is sent again at the next check")
+	caserverCmd.Flags().StringVar(&webhookConfigFile, "webhook-config", "", "JSON file with the webhook endpoints certificate issued, renewed, revoked and expiring events are sent to")
+	caserverCmd.Flags().StringVar(&webhookQueue, "webhook-queue", "webhook-queue", "folder of the webhook deliveries not sent yet, they are sent after a restart")
+	caserverCmd.Flags().StringVar(&raftPeers, "raft-peers", "", "all replicas of a new cluster including this one, e.g. ca1=127.0.0.1:7001,ca2=127.0.0.1:7002,ca3=127.0.0.1:7003")
+	caserverCmd.Flags().StringVar(&haOpts.CertFile, "raft-cert", "", "PEM certificate this replica presents to the other replicas, its SPIFFE ID or CN must be the --raft-id")
+	caserverCmd.Flags().StringVar(&haOpts.KeyFile, "raft-key", "", "PEM private key of --raft-cert")
+	caserverCmd.Flags().StringVar(&haOpts.CAFile, "raft-ca", "", "PEM bundle of the CA certificates the replica certificates are verified with")
+	caserverCmd.Flags().StringVar(&rootKeyPassphraseFile, "root-key-passphrase-file", "", "file holding the passphrase the root CA private key is encrypted with, required with --raft-address")
 }
 
 /*
 start the http server
 */
 func startServer() {
+	if err := loadRootKeyPassphrase(); err != nil {
+		log.Fatal(err)
+	}
+	//多副本时根证书私钥随raft日志和快照复制，不能明文保存
+	if haOpts.Address != "" && !ca.CA.RootKeyEncrypted() {
+		log.Fatal("--root-key-passphrase-file is required with --raft-address, the root CA private key is replicated to the other replicas")
+	}
+	//没有根证书时自签一个
+	if err := ca.CA.Load(true); err != nil {
+		log.Fatalf("load the CA fail: %v", err)
+	}
+	if *trustDomain != "" {
+		if err := ca.CA.SetTrustDomain(*trustDomain); err != nil {
+			log.Fatalf("invalid trust domain: %v", err)
+		}
+	}
+	for td, bundleFile := range *federatedBundles {
+		if err := ca.CA.LoadFederatedBundle(td, bundleFile); err != nil {
+			log.Fatalf("load trust bundle of %v fail: %v", td, err)
+		}
+	}
+
+	//超过限流和配额的请求返回 429 / ResourceExhausted
+	ca.CA.SetLimits(limits)
+
+	//预先生成私钥，签发证书时不用再等
+	for _, name := range keyPoolAlgorithms {
+		alg, err := ca.ParseKeyAlgorithm(name)
+		if err != nil {
+			log.Fatalf("invalid --key-pool-algorithms: %v", err)
+		}
+		keyPoolOpts.Algorithms = append(keyPoolOpts.Algorithms, alg)
+	}
+	if err := ca.CA.SetKeyPool(keyPoolOpts); err != nil {
+		log.Fatalf("create key pool fail: %v", err)
+	}
+	go ca.CA.RunKeyPool(util.Shutdown())
+
+	//多副本时证书、吊销记录、join token和审计日志都通过raft复制，只有leader接受修改
+	if haOpts.Address != "" {
+		startReplication()
+	}
+	if err := ca.CA.MarkReplicated(haOpts.Address); err != nil {
+		log.Fatalf("mark the CA store fail: %v", err)
+	}
+
+	//CA生成的私钥在被取走之前最多保留 --key-ttl
+	ca.CA.KeyTTL = keyTTL
+	go ca.CA.RunKeySweeper(time.Minute, util.Shutdown())
+
+	//到了约定时间自动切换到新的根证书，也让CLI做的轮换对运行中的server生效
+	go ca.CA.RunRolloverScheduler(rolloverCheckInterval, util.Shutdown())
+
+	//签发、续签、吊销和到期的事件发给配置的webhook
+	if webhookConfigFile != "" {
+		startWebhooks()
+	}
+
+	//根证书、本地server的证书和签发的证书快要到期时通知
+	startExpiryScanner()
+
+	if workloadOpts.SocketPath != "" {
+		go workloadserver.Run(workloadOpts, util.Shutdown())
+	}
+
+	var authorizer *auth.Authorizer
+	if authConfig != "" {
+		var err error
+		if authorizer, err = auth.Load(authConfig); err != nil {
+			log.Fatalf("load auth config fail: %v", err)
+		}
+	} else {
+		log.Print("no --auth-config, every caller is allowed to use the CA API")
+	}
+
+	if registry.Dir != "" {
+		if err := registerReplica(); err != nil {
+			log.Fatalf("register in %v fail: %v", registry.Dir, err)
+		}
+	}
+
 	if *useGRPC {
-		grpcserver.Run(*useMTLS, util.Shutdown())
+		grpcserver.Run(serverAddress, *useMTLS, authorizer, util.Shutdown())
 	} else {
-		httpserver.Run()
+		var tlsConfig *tls.Config
+		if httpMTLS {
+			var err error
+			if tlsConfig, err = ca.CA.ServerTLSConfig(); err != nil {
+				log.Fatalf("load local certificate fail: %v", err)
+			}
+		}
+		httpserver.Run(serverAddress, tlsConfig, authorizer, util.Shutdown())
+	}
+}
+
+/*
+按 --webhook-config 发送事件，到期通知也通过它发送
+*/
+func startWebhooks() {
+	config, err := webhook.Load(webhookConfigFile)
+	if err != nil {
+		log.Fatalf("load webhook config fail: %v", err)
+	}
+	dispatcher, err := webhook.NewDispatcher(config, webhookQueue)
+	if err != nil {
+		log.Fatalf("start webhooks fail: %v", err)
+	}
+	//签发和吊销的事件和证书一起写进发件箱，崩溃也不会丢
+	ca.CA.EnableOutbox()
+	expiryOpts.Notifiers = append(expiryOpts.Notifiers, dispatcher)
+	go dispatcher.Run(util.Shutdown())
+}
+
+/*
+按 --expiry-* 设置到期通知的渠道，metrics总是记录
+*/
+func startExpiryScanner() {
+	for _, value := range expiryThresholds {
+		threshold, err := util.ParseDuration(value)
+		if err != nil || threshold <= 0 {
+			log.Fatalf("invalid --expiry-thresholds %v", value)
+		}
+		expiryOpts.Thresholds = append(expiryOpts.Thresholds, threshold)
+	}
+	if expiryLog {
+		expiryOpts.Notifiers = append(expiryOpts.Notifiers, notify.Log{})
+	}
+	for _, url := range expiryWebhooks {
+		expiryOpts.Notifiers = append(expiryOpts.Notifiers, notify.NewWebhook(url, 10*time.Second))
+	}
+	if smtpOpts.Address != "" {
+		if smtpPasswordFile != "" {
+			contents, err := os.ReadFile(smtpPasswordFile)
+			if err != nil {
+				log.Fatalf("read --expiry-smtp-password-file fail: %v", err)
+			}
+			smtpOpts.Password = strings.TrimRight(string(contents), "\r\n")
+		}
+		mail, err := notify.NewSMTP(smtpOpts)
+		if err != nil {
+			log.Fatalf("invalid --expiry-smtp-*: %v", err)
+		}
+		expiryOpts.Notifiers = append(expiryOpts.Notifiers, mail)
+	}
+	metrics, err := notify.NewMetrics()
+	if err != nil {
+		log.Fatalf("create expiry metrics fail: %v", err)
+	}
+	expiryOpts.Notifiers = append(expiryOpts.Notifiers, metrics)
+	go ca.CA.RunExpiryScanner(expiryOpts, util.Shutdown())
+}
+
+/*
+加入raft集群，follower的健康检查是NOT_SERVING，客户端的负载均衡只把请求发给leader
+*/
+func startReplication() {
+	peers, err := ha.ParsePeers(raftPeers)
+	if err != nil {
+		log.Fatalf("invalid --raft-peers: %v", err)
+	}
+	haOpts.Peers = peers
+	haOpts.OnLeaderChange = grpcserver.SetServing
+	node, err := ha.Start(haOpts)
+	if err != nil {
+		log.Fatalf("start raft on %v fail: %v", haOpts.Address, err)
+	}
+	ca.CA.SetStore(node)
+	go func() {
+		<-util.Shutdown()
+		node.Shutdown()
+	}()
+}
+
+/*
+把这个副本登记到本地服务注册表，停机时注销
+*/
+func registerReplica() error {
+	address := advertiseAddress
+	if address == "" {
+		port := "8112"
+		if !*useGRPC {
+			port = "8111"
+		}
+		if serverAddress != "" {
+			_, p, err := net.SplitHostPort(serverAddress)
+			if err != nil {
+				return err
+			}
+			port = p
+		}
+		address = net.JoinHostPort("localhost", port)
 	}
+	hostname, _ := os.Hostname()
+	id := fmt.Sprintf("%v-%v", hostname, strings.ReplaceAll(address, ":", "-"))
+	log.Printf("register %v as %v in %v", address, id, registry.Dir)
+	return registry.Register("ca", discovery.Instance{ID: id, Address: address}, util.Shutdown())
 }
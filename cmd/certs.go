@@ -0,0 +1,544 @@
+/*
+Copyright © 2022 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+	mygrpc "github.com/jackyzhangfudan/sidecar/pkg/grpc"
+	myclient "github.com/jackyzhangfudan/sidecar/pkg/grpc/client"
+	"github.com/jackyzhangfudan/sidecar/pkg/inspect"
+)
+
+// signCmd asks the CA server to sign a certificate
+var signCmd = &cobra.Command{
+	Use:   "sign",
+	Short: "ask the CA server to sign a certificate, from flags, a JSON CSR or a PKCS#10 request",
+	Long: `The request comes from the flags, or from --file: a JSON CertificateSigningRequest (see the gRPC API)
+or a PEM/DER PKCS#10 request. The CA generates the private key except for PKCS#10 requests.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withCA(func(ctx context.Context, client caRemote) error {
+			var cert *myclient.Certificate
+			var err error
+			if signFile == "" {
+				keyAlg, ok := mygrpc.PublicKeyAlgorithm_UnknownPublicKeyAlgorithm, signKeyAlg == ""
+				for name, value := range mygrpc.PublicKeyAlgorithm_value {
+					if strings.EqualFold(name, signKeyAlg) {
+						keyAlg, ok = mygrpc.PublicKeyAlgorithm(value), true
+					}
+				}
+				if !ok {
+					return fmt.Errorf("unknown key algorithm %v", signKeyAlg)
+				}
+				cert, err = client.Sign(ctx, &mygrpc.CertificateSigningRequest{
+					SubjectCommonName:   signCN,
+					SubjectOrganization: signOrg,
+					DNSNames:            signDNS,
+					IPAddresses:         signIPs,
+					URIs:                signURIs,
+					EmailAddresses:      signEmails,
+					PublicKeyAlg:        keyAlg,
+					Profile:             signProfile,
+				})
+			} else {
+				cert, err = signFromFile(ctx, client)
+			}
+			if err != nil {
+				return err
+			}
+			return printSigned(cert)
+		})
+	},
+}
+
+/*
+--file是JSON时作为CertificateSigningRequest签发，否则作为PKCS#10
+*/
+func signFromFile(ctx context.Context, client caRemote) (*myclient.Certificate, error) {
+	contents, err := readInput(userPath(signFile))
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(bytes.TrimSpace(contents), []byte("{")) {
+		return client.SignPKCS10(ctx, contents, signProfile)
+	}
+	csr := &mygrpc.CertificateSigningRequest{}
+	if err := protojson.Unmarshal(contents, csr); err != nil {
+		return nil, fmt.Errorf("parse %v fail: %v", signFile, err)
+	}
+	if signProfile != "" {
+		csr.Profile = signProfile
+	}
+	return client.Sign(ctx, csr)
+}
+
+func printSigned(cert *myclient.Certificate) error {
+	if signOut != "" {
+		if err := os.WriteFile(userPath(signOut)+".crt", cert.CertificatePEM, 0644); err != nil {
+			return err
+		}
+		if cert.PrivateKeyPEM != nil {
+			if err := os.WriteFile(userPath(signOut)+".key", cert.PrivateKeyPEM, 0600); err != nil {
+				return err
+			}
+		}
+	}
+	switch outputFormat {
+	case "json":
+		return printJSON(map[string]string{"id": cert.ID, "certificate": string(cert.CertificatePEM), "privateKey": string(cert.PrivateKeyPEM)})
+	case "pem":
+		os.Stdout.Write(cert.CertificatePEM)
+		_, err := os.Stdout.Write(cert.PrivateKeyPEM)
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSUBJECT\tNOT AFTER\tFILES")
+	files := "-"
+	if signOut != "" {
+		files = signOut + ".crt"
+		if cert.PrivateKeyPEM != nil {
+			files += ", " + signOut + ".key"
+		}
+	}
+	fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", cert.ID, cert.Certificate.Subject, cert.Certificate.NotAfter.Format(time.RFC3339), files)
+	return w.Flush()
+}
+
+// getCmd shows an issued certificate
+var getCmd = &cobra.Command{
+	Use:   "get <certificate id>",
+	Short: "show an issued certificate and its revocation status",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withCA(func(ctx context.Context, client caRemote) error {
+			if outputFormat == "pem" {
+				cert, err := client.GetCertificate(ctx, args[0])
+				if err != nil {
+					return err
+				}
+				_, err = os.Stdout.Write(cert.CertificatePEM)
+				return err
+			}
+			info, err := client.DescribeCertificate(ctx, args[0])
+			if err != nil {
+				return err
+			}
+			if outputFormat == "json" {
+				return printJSON(fromProtoInfo(info))
+			}
+			return printInfo(fromProtoInfo(info))
+		})
+	},
+}
+
+// listCmd lists the issued certificates
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list the issued certificates",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withCA(func(ctx context.Context, client caRemote) error {
+			infos, err := client.ListCertificates(ctx, listStatus, listIdentity)
+			if err != nil {
+				return err
+			}
+			result := make([]*ca.CertificateInfo, 0, len(infos))
+			for _, info := range infos {
+				result = append(result, fromProtoInfo(info))
+			}
+			if outputFormat == "json" {
+				return printJSON(result)
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "ID\tIDENTITY\tPROFILE\tSTATUS\tNOT AFTER\tSERIAL")
+			for _, info := range result {
+				fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n", info.ID, info.Identity, info.Profile, info.Status, info.NotAfter.Format(time.RFC3339), info.SerialNumber)
+			}
+			return w.Flush()
+		})
+	},
+}
+
+// revokeCmd revokes an issued certificate
+var revokeCmd = &cobra.Command{
+	Use:   "revoke <certificate id>",
+	Short: "revoke an issued certificate, it is listed in the CRL until it expires",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withCA(func(ctx context.Context, client caRemote) error {
+			revokedAt, err := client.Revoke(ctx, args[0], revokeReason)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("certificate %v revoked at %v\n", args[0], revokedAt.Format(time.RFC3339))
+			return nil
+		})
+	},
+}
+
+// crlCmd downloads the current CRL
+var crlCmd = &cobra.Command{
+	Use:   "crl",
+	Short: "download the CRL of the CA",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withCA(func(ctx context.Context, client caRemote) error {
+			crl, err := client.CRL(ctx)
+			if err != nil {
+				return err
+			}
+			objects, err := inspect.Parse(crl.DER)
+			if err != nil {
+				return err
+			}
+			switch outputFormat {
+			case "der":
+				_, err = os.Stdout.Write(crl.DER)
+				return err
+			case "pem":
+				//根证书轮换期间把另一个根证书的CRL也写出来，verify --crl 可以直接使用
+				contents := objects[0].PEM()
+				for _, other := range crl.Others {
+					contents = append(contents, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: other})...)
+				}
+				_, err = os.Stdout.Write(contents)
+				return err
+			case "json":
+				return printJSON(inspect.Describe(objects[0]))
+			}
+			fmt.Printf("CRL number %v\n", crl.Number)
+			return printDescription(inspect.Describe(objects[0]))
+		})
+	},
+}
+
+// bundleCmd downloads the trust bundle
+var bundleCmd = &cobra.Command{
+	Use:   "bundle",
+	Short: "download the trust bundle of the CA, it has both roots during a root rollover",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withCA(func(ctx context.Context, client caRemote) error {
+			bundle, err := client.TrustBundle(ctx)
+			if err != nil {
+				return err
+			}
+			if outputFormat == "pem" {
+				_, err = os.Stdout.Write(bundle.PEM)
+				return err
+			}
+			var descriptions []*inspect.Description
+			for _, cert := range bundle.Certificates {
+				descriptions = append(descriptions, inspect.Describe(&inspect.Object{Kind: inspect.KindCertificate, DER: cert.Raw, Certificate: cert}))
+			}
+			if outputFormat == "json" {
+				return printJSON(map[string]interface{}{"version": bundle.Version, "certificates": descriptions})
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "SUBJECT\tNOT AFTER\tSHA256 FINGERPRINT")
+			for _, d := range descriptions {
+				fmt.Fprintf(w, "%v\t%v\t%v\n", d.Subject, d.NotAfter.Format(time.RFC3339), d.SHA256Fingerprint)
+			}
+			return w.Flush()
+		})
+	},
+}
+
+// inspectCmd pretty-prints local certificates, CSRs and CRLs
+var inspectCmd = &cobra.Command{
+	Use:   "inspect <file>",
+	Short: "print the certificates, CSRs or CRLs in a PEM or DER file, - for stdin",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		contents, err := readInput(args[0])
+		if err != nil {
+			return err
+		}
+		objects, err := inspect.Parse(contents)
+		if err != nil {
+			return err
+		}
+		if outputFormat == "pem" {
+			for _, object := range objects {
+				os.Stdout.Write(object.PEM())
+			}
+			return nil
+		}
+		descriptions := make([]*inspect.Description, 0, len(objects))
+		for _, object := range objects {
+			descriptions = append(descriptions, inspect.Describe(object))
+		}
+		if outputFormat == "json" {
+			return printJSON(descriptions)
+		}
+		for i, d := range descriptions {
+			if i > 0 {
+				fmt.Println()
+			}
+			if err := printDescription(d); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+// verifyCmd verifies a certificate against the trust bundle and CRL of the CA
+var verifyCmd = &cobra.Command{
+	Use:   "verify <certificate file>",
+	Short: "verify the chain of a certificate with the CA trust bundle and check it against the CRL",
+	Long: `The first certificate in the file is verified, the others are used as intermediates.
+The trust bundle and the CRL are downloaded from the CA server, --crl uses a local CRL instead.
+Exits with an error when the certificate is not valid.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		contents, err := readInput(args[0])
+		if err != nil {
+			return err
+		}
+		objects, err := inspect.Parse(contents)
+		if err != nil {
+			return err
+		}
+		opts := inspect.VerifyOptions{DNSName: verifyDNSName}
+		var leaf *inspect.Object
+		for _, object := range objects {
+			if object.Kind != inspect.KindCertificate {
+				continue
+			}
+			if leaf == nil {
+				leaf = object
+			} else {
+				opts.Intermediates = append(opts.Intermediates, object.Certificate)
+			}
+		}
+		if leaf == nil {
+			return fmt.Errorf("no certificate in %v", args[0])
+		}
+		if verifyCRL != "" {
+			if opts.CRLs, err = readCRLs(verifyCRL); err != nil {
+				return err
+			}
+		}
+
+		err = withCA(func(ctx context.Context, client caRemote) error {
+			bundle, err := client.TrustBundle(ctx)
+			if err != nil {
+				return err
+			}
+			opts.Roots = bundle.CertPool()
+			if opts.CRLs == nil {
+				crl, err := client.CRL(ctx)
+				if err != nil {
+					return err
+				}
+				opts.CRLs = append([][]byte{crl.DER}, crl.Others...)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		result := inspect.Verify(leaf.Certificate, opts)
+		if outputFormat == "json" {
+			err = printJSON(result)
+		} else {
+			err = printVerifyResult(result)
+		}
+		if err != nil {
+			return err
+		}
+		if result.Status != inspect.VerifyValid {
+			cmd.SilenceUsage = true
+			return fmt.Errorf("certificate %v is %v", leaf.Certificate.Subject, result.Status)
+		}
+		return nil
+	},
+}
+
+func printVerifyResult(result *inspect.VerifyResult) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Status:\t%v\n", result.Status)
+	for i, subject := range result.Chain {
+		fmt.Fprintf(w, "Chain[%d]:\t%v\n", i, subject)
+	}
+	fmt.Fprintf(w, "Revocation checked:\t%v\n", result.RevocationChecked)
+	if result.Status == inspect.VerifyRevoked {
+		fmt.Fprintf(w, "Revoked at:\t%v\n", result.RevokedAt.Format(time.RFC3339))
+		fmt.Fprintf(w, "Reason:\t%v\n", result.Reason)
+	}
+	if result.Error != "" {
+		fmt.Fprintf(w, "Error:\t%v\n", result.Error)
+	}
+	return w.Flush()
+}
+
+/*
+读取CRL文件，PEM时转为DER，一个PEM文件中可以有多份CRL（例如根证书轮换期间新旧根证书各一份）
+*/
+func readCRLs(file string) ([][]byte, error) {
+	contents, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var crls [][]byte
+	for block, rest := pem.Decode(contents); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "X509 CRL" {
+			crls = append(crls, block.Bytes)
+		}
+	}
+	if crls == nil {
+		//不是PEM时当作一份DER
+		crls = [][]byte{contents}
+	}
+	return crls, nil
+}
+
+/*
+读取文件，-表示标准输入
+*/
+func readInput(file string) ([]byte, error) {
+	if file == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(file)
+}
+
+func fromProtoInfo(info *mygrpc.CertificateInfo) *ca.CertificateInfo {
+	result := &ca.CertificateInfo{
+		ID:           info.Id,
+		CommonName:   info.CommonName,
+		Identity:     info.Identity,
+		Profile:      info.Profile,
+		SerialNumber: info.SerialNumber,
+		Issuer:       info.Issuer,
+		SANs:         info.SANs,
+		NotBefore:    time.Unix(info.NotBefore, 0),
+		NotAfter:     time.Unix(info.NotAfter, 0),
+		Status:       info.Status,
+	}
+	if info.Status == ca.StatusRevoked {
+		result.Revocation = &ca.Revocation{CertificateID: info.Id, Reason: info.RevocationReason, RevokedAt: time.Unix(info.RevokedAt, 0)}
+	}
+	return result
+}
+
+func printInfo(info *ca.CertificateInfo) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "ID:\t%v\n", info.ID)
+	fmt.Fprintf(w, "Common name:\t%v\n", info.CommonName)
+	fmt.Fprintf(w, "Identity:\t%v\n", info.Identity)
+	fmt.Fprintf(w, "Profile:\t%v\n", info.Profile)
+	fmt.Fprintf(w, "Serial number:\t%v\n", info.SerialNumber)
+	fmt.Fprintf(w, "Issuer:\t%v\n", info.Issuer)
+	fmt.Fprintf(w, "SANs:\t%v\n", strings.Join(info.SANs, ", "))
+	fmt.Fprintf(w, "Not before:\t%v\n", info.NotBefore.Format(time.RFC3339))
+	fmt.Fprintf(w, "Not after:\t%v\n", info.NotAfter.Format(time.RFC3339))
+	fmt.Fprintf(w, "Status:\t%v\n", info.Status)
+	if info.Revocation != nil {
+		fmt.Fprintf(w, "Revoked at:\t%v\n", info.Revocation.RevokedAt.Format(time.RFC3339))
+		fmt.Fprintf(w, "Reason:\t%v\n", info.Revocation.Reason)
+	}
+	return w.Flush()
+}
+
+func printDescription(d *inspect.Description) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Kind:\t%v\n", d.Kind)
+	printField := func(name string, value string) {
+		if value != "" {
+			fmt.Fprintf(w, "%v:\t%v\n", name, value)
+		}
+	}
+	printTime := func(name string, t *time.Time) {
+		if t != nil {
+			printField(name, t.Format(time.RFC3339))
+		}
+	}
+	printField("Subject", d.Subject)
+	printField("Issuer", d.Issuer)
+	printField("Serial number", d.SerialNumber)
+	printTime("Not before", d.NotBefore)
+	printTime("Not after", d.NotAfter)
+	printTime("This update", d.ThisUpdate)
+	printTime("Next update", d.NextUpdate)
+	if d.Kind == inspect.KindCertificate {
+		printField("CA", fmt.Sprint(d.IsCA))
+	}
+	printField("Public key", d.PublicKey)
+	printField("Signature algorithm", d.SignatureAlgorithm)
+	printField("SANs", strings.Join(d.SANs, ", "))
+	printField("Key usage", strings.Join(d.KeyUsage, ", "))
+	printField("Ext key usage", strings.Join(d.ExtKeyUsage, ", "))
+	printField("Subject key id", d.SubjectKeyID)
+	printField("Authority key id", d.AuthorityKeyID)
+	printField("SHA256 fingerprint", d.SHA256Fingerprint)
+	if d.Kind == inspect.KindCRL {
+		fmt.Fprintf(w, "Revoked:\t%d\n", len(d.Revoked))
+		for _, entry := range d.Revoked {
+			fmt.Fprintf(w, "  %v\t%v %v\n", entry.SerialNumber, entry.RevokedAt.Format(time.RFC3339), entry.Reason)
+		}
+	}
+	return w.Flush()
+}
+
+var signCN string
+var signOrg []string
+var signDNS []string
+var signIPs []string
+var signURIs []string
+var signEmails []string
+var signKeyAlg string
+var signProfile string
+var signFile string
+var signOut string
+var listStatus string
+var listIdentity string
+var revokeReason string
+var verifyDNSName string
+var verifyCRL string
+
+func init() {
+	caCmd.AddCommand(signCmd, getCmd, listCmd, revokeCmd, crlCmd, bundleCmd, inspectCmd, verifyCmd)
+
+	addRemoteFlags(signCmd, "table", "json", "pem")
+	signCmd.Flags().StringVar(&signCN, "cn", "", "subject common name")
+	signCmd.Flags().StringSliceVar(&signOrg, "org", nil, "subject organization")
+	signCmd.Flags().StringSliceVar(&signDNS, "dns", nil, "DNS SANs")
+	signCmd.Flags().StringSliceVar(&signIPs, "ip", nil, "IP SANs")
+	signCmd.Flags().StringSliceVar(&signURIs, "uri", nil, "URI SANs, e.g. a SPIFFE ID")
+	signCmd.Flags().StringSliceVar(&signEmails, "email", nil, "email SANs")
+	signCmd.Flags().StringVar(&signKeyAlg, "key-alg", "", "key generated by the CA: RSA, ECDSA or Ed25519, defaults to the CA's choice")
+	signCmd.Flags().StringVar(&signProfile, "profile", "", "certificate profile: default, server or client")
+	signCmd.Flags().StringVarP(&signFile, "file", "f", "", "JSON CertificateSigningRequest or PKCS#10 request, - for stdin, the other request flags are ignored")
+	signCmd.Flags().StringVar(&signOut, "out", "", "write the certificate and key to <out>.crt and <out>.key")
+
+	addRemoteFlags(getCmd, "table", "json", "pem")
+
+	addRemoteFlags(listCmd, "table", "json")
+	listCmd.Flags().StringVar(&listStatus, "status", "", "only list valid, expired or revoked certificates")
+	listCmd.Flags().StringVar(&listIdentity, "identity", "", "only list certificates of this SPIFFE ID or common name")
+
+	addRemoteFlags(revokeCmd)
+	revokeCmd.Flags().StringVar(&revokeReason, "reason", "unspecified", "RFC 5280 reason, e.g. keyCompromise, superseded or cessationOfOperation")
+
+	addRemoteFlags(crlCmd, "table", "json", "pem", "der")
+	addRemoteFlags(bundleCmd, "pem", "table", "json")
+	addOutputFlag(inspectCmd, "table", "json", "pem")
+
+	addRemoteFlags(verifyCmd, "table", "json")
+	verifyCmd.Flags().StringVar(&verifyDNSName, "dns-name", "", "also check the certificate is valid for this name")
+	verifyCmd.Flags().StringVar(&verifyCRL, "crl", "", "PEM or DER CRL file used instead of the CA's current CRL")
+}
@@ -0,0 +1,70 @@
+/*
+Copyright © 2022 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+	"github.com/jackyzhangfudan/sidecar/pkg/util"
+)
+
+// expiringCmd reports the certificates of the CA expiring soon
+var expiringCmd = &cobra.Command{
+	Use:   "expiring",
+	Short: "list the root, intermediate, local server and issued certificates expiring within --within",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		within, err := util.ParseDuration(expiringWithin)
+		if err != nil {
+			return fmt.Errorf("invalid --within: %v", err)
+		}
+		return withCA(func(ctx context.Context, client caRemote) error {
+			expiring, err := client.ListExpiring(ctx, within)
+			if err != nil {
+				return err
+			}
+			result := make([]*ca.ExpiringCertificate, 0, len(expiring))
+			for _, cert := range expiring {
+				result = append(result, &ca.ExpiringCertificate{
+					Kind:         cert.Kind,
+					ID:           cert.Id,
+					Subject:      cert.Subject,
+					Identity:     cert.Identity,
+					SerialNumber: cert.SerialNumber,
+					NotBefore:    time.Unix(cert.NotBefore, 0),
+					NotAfter:     time.Unix(cert.NotAfter, 0),
+				})
+			}
+			if outputFormat == "json" {
+				return printJSON(result)
+			}
+			if len(result) == 0 {
+				fmt.Printf("no certificate expires within %v\n", expiringWithin)
+				return nil
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "KIND\tID\tSUBJECT\tEXPIRES IN\tNOT AFTER\tSERIAL")
+			for _, cert := range result {
+				fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n", cert.Kind, cert.ID, cert.Subject, util.FormatDuration(time.Until(cert.NotAfter)), cert.NotAfter.Format(time.RFC3339), cert.SerialNumber)
+			}
+			return w.Flush()
+		})
+	},
+}
+
+var expiringWithin string
+
+func init() {
+	caCmd.AddCommand(expiringCmd)
+
+	addRemoteFlags(expiringCmd, "table", "json")
+	expiringCmd.Flags().StringVar(&expiringWithin, "within", "30d", "report certificates expiring within this time, e.g. 30d, 12h, 1d12h")
+}
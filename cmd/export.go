@@ -0,0 +1,85 @@
+/*
+Copyright © 2022 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+	mygrpc "github.com/jackyzhangfudan/sidecar/pkg/grpc"
+	myclient "github.com/jackyzhangfudan/sidecar/pkg/grpc/client"
+)
+
+// exportCmd exports an issued certificate in the format a consumer needs
+var exportCmd = &cobra.Command{
+	Use:   "export <certificate id>",
+	Short: "export an issued certificate as PEM, fullchain, DER, PKCS#12 or PKCS#8",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		format, ok := mygrpc.ExportFormat(-1), false
+		for value, name := range myclient.ExportFormatNames {
+			if name == exportFormat {
+				format, ok = value, true
+			}
+		}
+		if !ok {
+			return fmt.Errorf("unknown export format %v", exportFormat)
+		}
+		password := exportPassword
+		if exportPasswordFile != "" {
+			contents, err := os.ReadFile(exportPasswordFile)
+			if err != nil {
+				return err
+			}
+			password = strings.TrimRight(string(contents), "\r\n")
+		}
+
+		return withCA(func(ctx context.Context, client caRemote) error {
+			export, err := client.Export(ctx, &mygrpc.ExportRequest{Id: args[0], Format: format, Password: password, KeySecret: exportKeySecret})
+			if err != nil {
+				return err
+			}
+			out := userPath(exportOut)
+			if out == "" {
+				out = userPath(export.FileName)
+			}
+			if out == "-" {
+				_, err = os.Stdout.Write(export.Contents)
+				return err
+			}
+			if err := os.WriteFile(out, export.Contents, 0600); err != nil {
+				return err
+			}
+			fmt.Printf("exported %v as %v to %v\n", args[0], exportFormat, out)
+			return nil
+		})
+	},
+}
+
+var exportFormat string
+var exportPassword string
+var exportPasswordFile string
+var exportOut string
+var exportKeySecret string
+
+func init() {
+	caCmd.AddCommand(exportCmd)
+
+	formats := make([]string, 0, len(ca.ExportFormats))
+	for _, format := range ca.ExportFormats {
+		formats = append(formats, string(format))
+	}
+	addRemoteFlags(exportCmd)
+	exportCmd.Flags().StringVar(&exportFormat, "format", string(ca.ExportPEM), "one of "+strings.Join(formats, ", "))
+	exportCmd.Flags().StringVar(&exportPassword, "password", "", "password protecting pkcs12, pkcs12-legacy and truststore, encrypts pkcs8 when given")
+	exportCmd.Flags().StringVar(&exportPasswordFile, "password-file", "", "read the password from this file instead of the command line")
+	exportCmd.Flags().StringVar(&exportKeySecret, "key-secret", "", "key secret returned when the certificate was signed, needed by pkcs12, pkcs12-legacy and pkcs8")
+	exportCmd.Flags().StringVarP(&exportOut, "out", "o", "", "output file, - for stdout, defaults to a name derived from the id and format")
+}
@@ -5,6 +5,7 @@ Copyright © 2022 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
+	mygrpc "github.com/jackyzhangfudan/sidecar/pkg/grpc"
 	myclient "github.com/jackyzhangfudan/sidecar/pkg/grpc/client"
 	"github.com/spf13/cobra"
 )
@@ -20,7 +21,9 @@ var grpcclientCmd = &cobra.Command{
 	},
 }
 
-var certId *string
+var certId string
+var enrollCN string
+var clientOpts myclient.Options
 
 func init() {
 	rootCmd.AddCommand(grpcclientCmd)
@@ -33,10 +36,30 @@ func init() {
 
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
-	certId = grpcclientCmd.LocalFlags().String("certid", "", "id of the client certificate")
-	grpcclientCmd.MarkFlagRequired("certid")
+	grpcclientCmd.Flags().StringVar(&certId, "certid", "", "id of a client certificate in cert/clientCert, shortcut of --cert and --key")
+	grpcclientCmd.Flags().StringVar(&clientOpts.CertFile, "cert", "", "PEM file of the client certificate")
+	grpcclientCmd.Flags().StringVar(&clientOpts.KeyFile, "key", "", "PEM file of the client private key")
+	grpcclientCmd.Flags().StringVar(&clientOpts.RootCAFile, "ca-bundle", myclient.DefaultRootCAFile, "PEM file of the root CA certificates trusted for the CA server")
+	grpcclientCmd.Flags().StringVar(&clientOpts.BearerToken, "token", "", "bearer token used when there is no client certificate")
+	grpcclientCmd.Flags().StringVar(&clientOpts.JoinToken, "join-token", "", "enroll with this join token when --cert doesn't exist, the certificate is saved to --cert and --key")
+	grpcclientCmd.Flags().StringVar(&enrollCN, "cn", "", "common name requested when enrolling with --join-token")
+	grpcclientCmd.Flags().DurationVar(&clientOpts.Timeout, "timeout", myclient.DefaultTimeout, "timeout of each attempt of a call")
+	grpcclientCmd.Flags().IntVar(&clientOpts.Retry.MaxAttempts, "max-attempts", 4, "attempts of a call when the CA is unavailable")
+
+	grpcclientCmd.Flags().StringVar(&clientOpts.Target, "target", ":8112", "CA address: host:port, dns:///host:port, static:///a:8112,b:8112, file:///path or registry:///ca")
+	grpcclientCmd.Flags().StringVar(&clientOpts.ServerName, "server-name", myclient.DefaultServerName, "name in the certificates of the CA replicas")
+	grpcclientCmd.Flags().StringVar(&clientOpts.Balancer, "lb", myclient.BalancerRoundRobin, "how requests are spread over the CA replicas: pick_first, round_robin or least_request")
+	grpcclientCmd.Flags().BoolVar(&clientOpts.HealthCheck, "health-check", true, "skip CA replicas whose gRPC health check is not SERVING")
+	grpcclientCmd.Flags().StringVar(&clientOpts.RegistryDir, "registry-dir", "registry", "local service registry used by registry:/// targets")
 }
 
 func Run() {
-	myclient.Run(*certId)
+	if certId != "" {
+		clientOpts.CertFile = "cert/clientCert/" + certId + ".crt"
+		clientOpts.KeyFile = "cert/clientCert/" + certId + ".key"
+	}
+	if clientOpts.JoinToken != "" {
+		clientOpts.Enrollment = &mygrpc.CertificateSigningRequest{SubjectCommonName: enrollCN}
+	}
+	myclient.Run(clientOpts)
 }
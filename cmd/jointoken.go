@@ -0,0 +1,99 @@
+/*
+Copyright © 2022 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+)
+
+// joinTokenCmd manages the bootstrap tokens for first-time certificate requests
+var joinTokenCmd = &cobra.Command{
+	Use:   "join-token",
+	Short: "manage join tokens for workloads requesting their first certificate",
+}
+
+var joinTokenCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "create a join token, it is printed only once",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := openLocalCA(); err != nil {
+			return err
+		}
+		token, record, err := ca.CA.CreateJoinToken(ca.WithCaller(context.Background(), ca.LocalOperator), joinTokenSpec)
+		if err != nil {
+			return err
+		}
+		fmt.Println(token)
+		fmt.Fprintf(os.Stderr, "token %v allows %d use(s) of profile %v until %v\n", record.ID, record.MaxUses, record.Profile, record.ExpiresAt.Format(time.RFC3339))
+		return nil
+	},
+}
+
+var joinTokenListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list the join tokens",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := openLocalCA(); err != nil {
+			return err
+		}
+		tokens, err := ca.CA.ListJoinTokens()
+		if err != nil {
+			return err
+		}
+		if joinTokenJSON {
+			return printJSON(tokens)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tSTATE\tPROFILE\tUSES\tEXPIRES\tSANS")
+		for _, token := range tokens {
+			sans := append(append(append([]string{}, token.DNSNames...), token.IPAddresses...), token.URIs...)
+			fmt.Fprintf(w, "%v\t%v\t%v\t%d/%d\t%v\t%v\n", token.ID, token.State(), token.Profile, token.Uses, token.MaxUses, token.ExpiresAt.Format(time.RFC3339), sans)
+		}
+		return w.Flush()
+	},
+}
+
+var joinTokenRevokeCmd = &cobra.Command{
+	Use:   "revoke <token id>",
+	Short: "revoke a join token",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := openLocalCA(); err != nil {
+			return err
+		}
+		token, err := ca.CA.RevokeJoinToken(ca.WithCaller(context.Background(), ca.LocalOperator), args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("join token %v revoked at %v\n", token.ID, token.RevokedAt.Format(time.RFC3339))
+		return nil
+	},
+}
+
+var joinTokenSpec ca.JoinTokenSpec
+var joinTokenJSON bool
+
+func init() {
+	caCmd.AddCommand(joinTokenCmd)
+	joinTokenCmd.AddCommand(joinTokenCreateCmd, joinTokenListCmd, joinTokenRevokeCmd)
+
+	flags := joinTokenCreateCmd.Flags()
+	flags.StringVar(&joinTokenSpec.Profile, "profile", ca.DefaultProfile, "profile of the certificate: default, server or client")
+	flags.StringVar(&joinTokenSpec.CommonName, "cn", "", "required subject CN, when empty the CN must be empty or one of --dns")
+	flags.StringSliceVar(&joinTokenSpec.DNSNames, "dns", nil, "allowed DNS SANs, *.example.com allows one level of subdomains")
+	flags.StringSliceVar(&joinTokenSpec.IPAddresses, "ip", nil, "allowed IP SANs")
+	flags.StringSliceVar(&joinTokenSpec.URIs, "uri", nil, "allowed URI SANs, e.g. a SPIFFE ID")
+	flags.DurationVar(&joinTokenSpec.TTL, "ttl", time.Hour, "how long the token can be used")
+	flags.IntVar(&joinTokenSpec.MaxUses, "uses", 1, "how many certificates can be requested with the token")
+	joinTokenListCmd.Flags().BoolVar(&joinTokenJSON, "json", false, "print the tokens as JSON")
+}
@@ -0,0 +1,245 @@
+/*
+Copyright © 2022 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+	mygrpc "github.com/jackyzhangfudan/sidecar/pkg/grpc"
+	myclient "github.com/jackyzhangfudan/sidecar/pkg/grpc/client"
+	grpcserver "github.com/jackyzhangfudan/sidecar/pkg/grpc/server"
+	"github.com/jackyzhangfudan/sidecar/pkg/inspect"
+)
+
+// initCmd creates a new CA store
+var initCmd = &cobra.Command{
+	Use:   "init",
+	Short: "create a new CA with a self-signed root in --local, or in the current folder",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if localStore != "" {
+			if err := os.MkdirAll(localStore, 0700); err != nil {
+				return err
+			}
+		}
+		if err := loadRootKeyPassphrase(); err != nil {
+			return err
+		}
+		if err := enterLocalStore(); err != nil {
+			return err
+		}
+		if err := ca.CA.Init(); err != nil {
+			return err
+		}
+		dir, _ := os.Getwd()
+		root := ca.CA.CurrentTrustBundle().Roots[0]
+		fmt.Printf("CA created in %v\n", dir)
+		return printDescription(inspect.Describe(&inspect.Object{Kind: inspect.KindCertificate, DER: root.Raw, Certificate: root}))
+	},
+}
+
+var localStore string
+var workDir string
+var rootKeyPassphraseFile string
+var crlValidity time.Duration
+
+/*
+切换到 --local 给出的CA目录，caserver也是以工作目录下的 cert/ 作为CA的存储
+命令行中给出的相对路径要用 userPath 转换
+*/
+func enterLocalStore() error {
+	if localStore == "" {
+		return nil
+	}
+	var err error
+	if workDir, err = os.Getwd(); err != nil {
+		return err
+	}
+	if err := os.Chdir(localStore); err != nil {
+		return fmt.Errorf("open the CA store %v fail: %v", localStore, err)
+	}
+	return nil
+}
+
+/*
+打开 --local 的CA目录（没有给出时是当前目录），没有根证书时返回错误
+*/
+func openLocalCA() error {
+	if err := loadRootKeyPassphrase(); err != nil {
+		return err
+	}
+	if err := enterLocalStore(); err != nil {
+		return err
+	}
+	return ca.CA.Load(false)
+}
+
+/*
+读出 --root-key-passphrase-file 中加密根证书私钥的口令，要在切换到CA目录之前调用
+*/
+func loadRootKeyPassphrase() error {
+	if rootKeyPassphraseFile == "" {
+		return nil
+	}
+	contents, err := os.ReadFile(rootKeyPassphraseFile)
+	if err != nil {
+		return fmt.Errorf("read the root key passphrase fail: %v", err)
+	}
+	passphrase := strings.TrimRight(string(contents), "\r\n")
+	if passphrase == "" {
+		return fmt.Errorf("the root key passphrase in %v is empty", rootKeyPassphraseFile)
+	}
+	ca.CA.SetRootKeyPassphrase([]byte(passphrase))
+	return nil
+}
+
+/*
+命令行中给出的相对路径是相对于切换到CA目录之前的工作目录
+*/
+func userPath(path string) string {
+	if workDir == "" || path == "" || path == "-" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(workDir, path)
+}
+
+/*
+--local 模式：不经过caserver，直接通过 pkg/ca 操作CA目录，写文件时和caserver共用存储的锁
+*/
+type localCA struct {
+	ctx context.Context
+}
+
+func newLocalCA() (*localCA, error) {
+	if err := openLocalCA(); err != nil {
+		return nil, err
+	}
+	return &localCA{ctx: ca.WithCaller(context.Background(), ca.LocalOperator)}, nil
+}
+
+func (l *localCA) Sign(ctx context.Context, csr *mygrpc.CertificateSigningRequest) (*myclient.Certificate, error) {
+	req, violations := grpcserver.FromProtoCSR(csr)
+	if len(violations) > 0 {
+		return nil, ca.InvalidArgument("INVALID_CSR", violations...)
+	}
+	signed, err := ca.CA.SignX509(l.ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	certPEM, err := ca.CA.GetCertFile(signed.ID)
+	if err != nil {
+		return nil, err
+	}
+	//私钥和远程签发时一样，用key secret解密后从CA目录中删除
+	keyPEM, err := ca.CA.FetchKey(l.ctx, signed.ID)
+	if err != nil {
+		return nil, err
+	}
+	return myclient.NewCertificate(signed.ID, certPEM, keyPEM, signed.KeySecret)
+}
+
+func (l *localCA) SignPKCS10(ctx context.Context, csr []byte, profile string) (*myclient.Certificate, error) {
+	signed, err := ca.CA.SignPKCS10(l.ctx, csr, profile)
+	if err != nil {
+		return nil, err
+	}
+	return l.GetCertificate(ctx, signed.ID)
+}
+
+func (l *localCA) GetCertificate(ctx context.Context, id string) (*myclient.Certificate, error) {
+	certPEM, err := ca.CA.GetCertFile(id)
+	if err != nil {
+		return nil, err
+	}
+	return myclient.NewCertificate(id, certPEM, nil, "")
+}
+
+func (l *localCA) DescribeCertificate(ctx context.Context, id string) (*mygrpc.CertificateInfo, error) {
+	info, err := ca.CA.DescribeCertificate(id)
+	if err != nil {
+		return nil, err
+	}
+	return grpcserver.ToProtoInfo(info), nil
+}
+
+func (l *localCA) ListCertificates(ctx context.Context, status string, identity string) ([]*mygrpc.CertificateInfo, error) {
+	infos, err := ca.CA.ListCertificates(ca.ListOptions{Status: status, Identity: identity})
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*mygrpc.CertificateInfo, 0, len(infos))
+	for _, info := range infos {
+		result = append(result, grpcserver.ToProtoInfo(info))
+	}
+	return result, nil
+}
+
+func (l *localCA) ListExpiring(ctx context.Context, within time.Duration) ([]*mygrpc.ExpiringCertificate, error) {
+	expiring, err := ca.CA.ExpiringCertificates(within)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*mygrpc.ExpiringCertificate, 0, len(expiring))
+	for _, cert := range expiring {
+		result = append(result, grpcserver.ToProtoExpiring(cert))
+	}
+	return result, nil
+}
+
+func (l *localCA) Revoke(ctx context.Context, id string, reason string) (time.Time, error) {
+	revocation, err := ca.CA.Revoke(l.ctx, id, reason)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return revocation.RevokedAt, nil
+}
+
+func (l *localCA) Export(ctx context.Context, req *mygrpc.ExportRequest) (*mygrpc.ExportResponse, error) {
+	export, err := ca.CA.ExportCertificate(l.ctx, req.Id, ca.ExportOptions{
+		Format:    ca.ExportFormat(myclient.ExportFormatNames[req.Format]),
+		Password:  req.Password,
+		KeySecret: req.KeySecret,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &mygrpc.ExportResponse{Format: req.Format, Contents: export.Contents, ContentType: export.ContentType, FileName: export.FileName}, nil
+}
+
+func (l *localCA) TrustBundle(ctx context.Context) (*myclient.Bundle, error) {
+	bundle := ca.CA.CurrentTrustBundle()
+	return myclient.ParseBundle(bundle.PEM(), bundle.Version)
+}
+
+func (l *localCA) CRL(ctx context.Context) (*myclient.CRL, error) {
+	crls, err := ca.CA.CRLs(crlValidity)
+	if err != nil {
+		return nil, err
+	}
+	crl := crls[0]
+	result := &myclient.CRL{DER: crl.DER, Number: crl.Number.String(), ThisUpdate: crl.ThisUpdate, NextUpdate: crl.NextUpdate}
+	for _, other := range crls[1:] {
+		result.Others = append(result.Others, other.DER)
+	}
+	return result, nil
+}
+
+func (l *localCA) Close() error {
+	return nil
+}
+
+func init() {
+	caCmd.AddCommand(initCmd)
+	caCmd.PersistentFlags().StringVar(&rootKeyPassphraseFile, "root-key-passphrase-file", "", "file holding the passphrase of the root CA private key, needed by the commands working on the CA files when the key is encrypted")
+	caCmd.PersistentFlags().StringVar(&localStore, "local", "", "work directly on the CA store in this folder (the one holding cert/) instead of a caserver, join-token and rollover use the current folder without it")
+	crlCmd.Flags().DurationVar(&crlValidity, "validity", ca.DefaultCRLValidity, "how long a CRL generated with --local is valid")
+}
@@ -0,0 +1,125 @@
+/*
+Copyright © 2022 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/proxy"
+	"github.com/jackyzhangfudan/sidecar/pkg/util"
+)
+
+// proxyCmd runs the sidecar data plane in front of the local application
+var proxyCmd = &cobra.Command{
+	Use:   "proxy",
+	Short: "terminate inbound mTLS for the local application and originate mTLS for its outbound calls",
+	Long: `The proxy gets its certificate from the CA, either through the SPIFFE Workload API or by enrolling with a join token,
+and rotates it before it expires. Peer identity of HTTP requests is passed to the application in X-Forwarded-Client-Cert,
+X-Peer-Subject, X-Peer-Sans and X-Peer-Spiffe-Id headers.
+With --egress-config the application can call other services in plaintext on local ports or host names,
+the proxy connects to them with mTLS and verifies their identities.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runProxy()
+	},
+}
+
+var inboundOpts proxy.InboundOptions
+var proxyCAOpts proxy.CAOptions
+var proxyWorkloadSocket string
+var egressConfigFile string
+var policyFile string
+var policyDryRun bool
+var policyReloadInterval time.Duration
+
+func init() {
+	rootCmd.AddCommand(proxyCmd)
+
+	proxyCmd.Flags().StringVar(&inboundOpts.Listen, "listen", ":15443", "address accepting inbound mTLS connections, empty disables the inbound proxy")
+	proxyCmd.Flags().StringVar(&inboundOpts.Upstream, "upstream", "127.0.0.1:8080", "address of the local application")
+	proxyCmd.Flags().StringVar(&inboundOpts.Mode, "mode", proxy.ModeHTTP, "http forwards HTTP/1.1 and HTTP/2 with peer identity headers, tcp forwards raw bytes")
+	proxyCmd.Flags().BoolVar(&inboundOpts.UpstreamH2C, "upstream-h2c", false, "talk cleartext HTTP/2 to the local application, e.g. a gRPC server")
+	proxyCmd.Flags().StringVar(&policyFile, "policy", "", "JSON file with the allow/deny rules for inbound traffic, every authenticated peer is allowed without it")
+	proxyCmd.Flags().BoolVar(&policyDryRun, "policy-dry-run", false, "only log the requests the policy would deny")
+	proxyCmd.Flags().DurationVar(&policyReloadInterval, "policy-reload-interval", 5*time.Second, "how often the policy file is checked for changes")
+	proxyCmd.Flags().StringVar(&egressConfigFile, "egress-config", "", "JSON file with the outbound routes, the egress proxy is disabled without it")
+	proxyCmd.Flags().StringVar(&proxyWorkloadSocket, "workload-socket", "", "get the certificate from the SPIFFE Workload API on this unix domain socket")
+	proxyCmd.Flags().StringVar(&proxyCAOpts.Address, "ca-address", "localhost:8112", "gRPC address of the CA")
+	proxyCmd.Flags().StringVar(&proxyCAOpts.ServerName, "ca-server-name", "localhost", "name in the certificate of the CA's gRPC server")
+	proxyCmd.Flags().StringVar(&proxyCAOpts.BundleFile, "ca-bundle", "cert/rootCA/root.crt", "root certificate verifying the CA before the proxy has its own certificate")
+	proxyCmd.Flags().StringVar(&proxyCAOpts.JoinToken, "join-token", "", "join token requesting the first certificate from the CA")
+	proxyCmd.Flags().StringVar(&proxyCAOpts.CommonName, "cn", "", "common name of the requested certificate")
+	proxyCmd.Flags().StringSliceVar(&proxyCAOpts.DNSNames, "dns", nil, "DNS names of the requested certificate")
+	proxyCmd.Flags().StringVar(&proxyCAOpts.StateDir, "state-dir", "proxy-state", "keep the certificate here so a restarted proxy doesn't enroll again")
+}
+
+func runProxy() error {
+	var egressConfig *proxy.EgressConfig
+	if egressConfigFile != "" {
+		var err error
+		if egressConfig, err = proxy.LoadEgressConfig(egressConfigFile); err != nil {
+			return err
+		}
+	}
+	if inboundOpts.Listen == "" && egressConfig == nil {
+		return fmt.Errorf("nothing to proxy, set --listen or --egress-config")
+	}
+	stopCh := util.Shutdown()
+	if policyFile != "" {
+		policy, err := proxy.LoadPolicy(policyFile, policyDryRun)
+		if err != nil {
+			return err
+		}
+		inboundOpts.Policy = policy
+		go policy.Run(policyReloadInterval, stopCh)
+	}
+
+	var source proxy.Source
+	switch {
+	case proxyWorkloadSocket != "" && proxyCAOpts.JoinToken != "":
+		return fmt.Errorf("use either --workload-socket or --join-token")
+	case proxyWorkloadSocket != "":
+		source = proxy.NewWorkloadSource(proxyWorkloadSocket)
+	default:
+		//没有join token时只能用--state-dir中保存的证书
+		source = proxy.NewCASource(proxyCAOpts)
+	}
+
+	go source.Run(stopCh)
+
+	//拿不到证书时一直重试，直到收到停机信号
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	if err := proxy.WaitReady(ctx, source); err != nil {
+		return fmt.Errorf("no certificate for the proxy: %v", err)
+	}
+	log.Print("proxy certificate is ready")
+
+	//任何一个方向出错都退出
+	errCh := make(chan error, 2)
+	if inboundOpts.Listen != "" {
+		go func() { errCh <- proxy.RunInbound(inboundOpts, source, stopCh) }()
+	}
+	if egressConfig != nil {
+		go func() { errCh <- proxy.RunEgress(egressConfig, source, stopCh) }()
+	}
+	select {
+	case err := <-errCh:
+		return err
+	case <-stopCh:
+		return nil
+	}
+}
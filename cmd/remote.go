@@ -0,0 +1,114 @@
+/*
+Copyright © 2022 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	mygrpc "github.com/jackyzhangfudan/sidecar/pkg/grpc"
+	myclient "github.com/jackyzhangfudan/sidecar/pkg/grpc/client"
+	"github.com/jackyzhangfudan/sidecar/pkg/httpclient"
+)
+
+/*
+ca命令通过gRPC或者HTTP访问caserver时用到的方法，pkg/grpc/client 和 pkg/httpclient 的Client都实现了它
+*/
+type caRemote interface {
+	Sign(ctx context.Context, csr *mygrpc.CertificateSigningRequest) (*myclient.Certificate, error)
+	SignPKCS10(ctx context.Context, csr []byte, profile string) (*myclient.Certificate, error)
+	GetCertificate(ctx context.Context, id string) (*myclient.Certificate, error)
+	DescribeCertificate(ctx context.Context, id string) (*mygrpc.CertificateInfo, error)
+	ListCertificates(ctx context.Context, status string, identity string) ([]*mygrpc.CertificateInfo, error)
+	ListExpiring(ctx context.Context, within time.Duration) ([]*mygrpc.ExpiringCertificate, error)
+	Revoke(ctx context.Context, id string, reason string) (time.Time, error)
+	Export(ctx context.Context, req *mygrpc.ExportRequest) (*mygrpc.ExportResponse, error)
+	TrustBundle(ctx context.Context) (*myclient.Bundle, error)
+	CRL(ctx context.Context) (*myclient.CRL, error)
+	Close() error
+}
+
+var remoteServer string
+var remoteCert string
+var remoteKey string
+var remoteCABundle string
+var remoteToken string
+var remoteServerName string
+var remoteTimeout time.Duration
+var outputFormat string
+
+/*
+给访问caserver的命令加上连接参数，outputs是命令支持的输出格式，第一个是默认值
+*/
+func addRemoteFlags(cmd *cobra.Command, outputs ...string) {
+	cmd.Flags().StringVar(&remoteServer, "server", ":8112", "gRPC target of the CA, or http://host:port / https://host:port of a caserver serving HTTP")
+	cmd.Flags().StringVar(&remoteCert, "cert", "", "PEM file of the client certificate for mTLS")
+	cmd.Flags().StringVar(&remoteKey, "key", "", "PEM file of the client private key")
+	cmd.Flags().StringVar(&remoteCABundle, "ca-bundle", myclient.DefaultRootCAFile, "PEM file of the root CA certificates trusted for the CA server")
+	cmd.Flags().StringVar(&remoteToken, "token", "", "bearer token used when there is no client certificate")
+	cmd.Flags().StringVar(&remoteServerName, "server-name", myclient.DefaultServerName, "name in the certificate of the CA server, gRPC only")
+	cmd.Flags().DurationVar(&remoteTimeout, "timeout", myclient.DefaultTimeout, "timeout of each call")
+	if len(outputs) > 0 {
+		addOutputFlag(cmd, outputs...)
+	}
+}
+
+func addOutputFlag(cmd *cobra.Command, outputs ...string) {
+	//每个命令的默认格式不同，不能共用一个变量绑定flag
+	output := cmd.Flags().String("output", outputs[0], "output format: "+strings.Join(outputs, ", "))
+	cmd.PreRunE = func(cmd *cobra.Command, args []string) error {
+		outputFormat = *output
+		for _, output := range outputs {
+			if outputFormat == output {
+				return nil
+			}
+		}
+		return fmt.Errorf("unknown output format %v, must be one of %v", outputFormat, strings.Join(outputs, ", "))
+	}
+}
+
+/*
+按 --server 连接caserver：http://或https://开头时走HTTP接口，否则走gRPC；给出 --local 时直接操作CA目录
+*/
+func connectCA() (caRemote, error) {
+	if localStore != "" {
+		return newLocalCA()
+	}
+	if strings.HasPrefix(remoteServer, "http://") || strings.HasPrefix(remoteServer, "https://") {
+		return httpclient.New(httpclient.Options{
+			URL:         remoteServer,
+			RootCAFile:  remoteCABundle,
+			CertFile:    remoteCert,
+			KeyFile:     remoteKey,
+			BearerToken: remoteToken,
+			Timeout:     remoteTimeout,
+		})
+	}
+	opts := myclient.Options{
+		RootCAFile:  remoteCABundle,
+		CertFile:    remoteCert,
+		KeyFile:     remoteKey,
+		BearerToken: remoteToken,
+		Timeout:     remoteTimeout,
+	}
+	opts.Target, opts.ServerName = remoteServer, remoteServerName
+	return myclient.New(opts)
+}
+
+/*
+连接caserver，执行f之后关闭连接
+*/
+func withCA(f func(ctx context.Context, client caRemote) error) error {
+	client, err := connectCA()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return f(context.Background(), client)
+}
@@ -0,0 +1,98 @@
+/*
+Copyright © 2022 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+)
+
+// rolloverCmd represents the root CA rollover commands
+var rolloverCmd = &cobra.Command{
+	Use:   "rollover",
+	Short: "rotate the root CA key",
+	Long: `Rotate the root CA in three steps: prepare publishes a new cross-signed root,
+activate switches issuance to it, retire drops the old root from the trust bundle`,
+}
+
+var rolloverPrepareCmd = &cobra.Command{
+	Use:   "prepare",
+	Short: "create the new root CA and the cross-signed certificates",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := openLocalCA(); err != nil {
+			return err
+		}
+		status, err := ca.CA.PrepareRollover(time.Now().Add(rolloverSwitchAfter))
+		if err != nil {
+			return err
+		}
+		return printJSON(status)
+	},
+}
+
+var rolloverActivateCmd = &cobra.Command{
+	Use:   "activate",
+	Short: "issue certificates with the new root CA",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := openLocalCA(); err != nil {
+			return err
+		}
+		//修改要经过raft复制，只能由caserver的leader在约定时间执行
+		if address := ca.CA.ReplicatedBy(); address != "" {
+			return fmt.Errorf("the CA store is replicated by the caserver on %v, its leader activates the rollover at the switch time; prepare the rollover with a shorter --switch-after to switch earlier", address)
+		}
+		status, err := ca.CA.ActivateRollover(rolloverForce)
+		if err != nil {
+			return err
+		}
+		return printJSON(status)
+	},
+}
+
+var rolloverRetireCmd = &cobra.Command{
+	Use:   "retire",
+	Short: "remove the old root CA from the trust bundle",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := openLocalCA(); err != nil {
+			return err
+		}
+		status, err := ca.CA.RetireRollover(rolloverForce)
+		if err != nil {
+			return err
+		}
+		return printJSON(status)
+	},
+}
+
+var rolloverStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "show the state of the root CA rollover",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := openLocalCA(); err != nil {
+			return err
+		}
+		status, err := ca.CA.RolloverStatus()
+		if err != nil {
+			return err
+		}
+		return printJSON(status)
+	},
+}
+
+var rolloverSwitchAfter time.Duration
+var rolloverForce bool
+
+func init() {
+	caCmd.AddCommand(rolloverCmd)
+	rolloverCmd.AddCommand(rolloverPrepareCmd, rolloverActivateCmd, rolloverRetireCmd, rolloverStatusCmd)
+
+	rolloverPrepareCmd.Flags().DurationVar(&rolloverSwitchAfter, "switch-after", 24*time.Hour, "how long the new root is only distributed before it starts issuing, give relying parties time to fetch the new bundle")
+	rolloverActivateCmd.Flags().BoolVar(&rolloverForce, "force", false, "activate before the scheduled switch time")
+	rolloverRetireCmd.Flags().BoolVar(&rolloverForce, "force", false, "retire even if certificates issued by the old root are still valid")
+}
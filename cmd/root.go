@@ -5,8 +5,12 @@ Copyright © 2022 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
+	"context"
+	"log"
 	"os"
+	"time"
 
+	"github.com/jackyzhangfudan/sidecar/pkg/tracing"
 	"github.com/spf13/cobra"
 )
 
@@ -20,8 +24,39 @@ var rootCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 
 	},
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		var err error
+		traceOpts.ServiceName = "sidecar-" + cmd.Name()
+		shutdownTracing, err = tracing.Setup(context.Background(), traceOpts)
+		if err != nil {
+			return err
+		}
+		metricsOpts.ServiceName = traceOpts.ServiceName
+		metricsOpts.Insecure = traceOpts.Insecure
+		shutdownMetrics, err = tracing.SetupMetrics(context.Background(), metricsOpts)
+		return err
+	},
+	PersistentPostRun: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if shutdownTracing != nil {
+			if err := shutdownTracing(ctx); err != nil {
+				log.Printf("flush traces fail: %v", err)
+			}
+		}
+		if shutdownMetrics != nil {
+			if err := shutdownMetrics(ctx); err != nil {
+				log.Printf("flush metrics fail: %v", err)
+			}
+		}
+	},
 }
 
+var traceOpts tracing.Options
+var shutdownTracing func(context.Context) error
+var metricsOpts tracing.MetricsOptions
+var shutdownMetrics func(context.Context) error
+
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
@@ -38,6 +73,14 @@ func init() {
 	// will be global for your application.
 
 	// rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.sidecar.yaml)")
+	rootCmd.PersistentFlags().StringVar(&traceOpts.Exporter, "trace-exporter", tracing.ExporterNone, "OpenTelemetry span exporter: none, otlp, stdout or file")
+	rootCmd.PersistentFlags().StringVar(&traceOpts.Endpoint, "trace-endpoint", "localhost:4317", "OTLP gRPC collector endpoint, used by the otlp exporter")
+	rootCmd.PersistentFlags().BoolVar(&traceOpts.Insecure, "trace-insecure", true, "connect to the OTLP collector without TLS")
+	rootCmd.PersistentFlags().StringVar(&traceOpts.File, "trace-file", "traces.json", "file to write spans to, used by the file exporter")
+	rootCmd.PersistentFlags().StringVar(&metricsOpts.Exporter, "metrics-exporter", tracing.ExporterNone, "OpenTelemetry metrics exporter: none, otlp, stdout or file")
+	rootCmd.PersistentFlags().StringVar(&metricsOpts.Endpoint, "metrics-endpoint", "localhost:4317", "OTLP gRPC collector endpoint, used by the otlp exporter")
+	rootCmd.PersistentFlags().StringVar(&metricsOpts.File, "metrics-file", "metrics.json", "file to write metrics to, used by the file exporter")
+	rootCmd.PersistentFlags().DurationVar(&metricsOpts.Interval, "metrics-interval", 30*time.Second, "how often metrics are exported")
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
@@ -0,0 +1,81 @@
+/*
+Copyright © 2022 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/webhook"
+)
+
+// webhookCmd groups the commands about the webhooks configured with caserver --webhook-config
+var webhookCmd = &cobra.Command{
+	Use:   "webhook",
+	Short: "work with the webhooks caserver sends certificate events to",
+}
+
+// webhookTestCmd sends a sample event to the configured endpoints
+var webhookTestCmd = &cobra.Command{
+	Use:   "test",
+	Short: "send a signed sample event to the endpoints in --config, once and without the queue",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config, err := webhook.Load(webhookConfig)
+		if err != nil {
+			return err
+		}
+		event, err := webhook.SampleEvent(webhookEvent)
+		if err != nil {
+			return err
+		}
+		client := &http.Client{Timeout: config.SendTimeout()}
+		sent, failed := 0, 0
+		for i := range config.Endpoints {
+			endpoint := &config.Endpoints[i]
+			//指定了endpoint时不管它是否接收这类事件
+			if webhookEndpoint != "" && endpoint.Name != webhookEndpoint {
+				continue
+			}
+			if webhookEndpoint == "" && !endpoint.Accepts(event.Type) {
+				fmt.Printf("%v: skipped, it doesn't receive %v\n", endpoint.Name, event.Type)
+				continue
+			}
+			sent++
+			start := time.Now()
+			if err := webhook.Deliver(context.Background(), client, endpoint, event); err != nil {
+				failed++
+				fmt.Printf("%v: failed: %v\n", endpoint.Name, err)
+				continue
+			}
+			fmt.Printf("%v: delivered %v %v in %v\n", endpoint.Name, event.Type, event.ID, time.Since(start).Round(time.Millisecond))
+		}
+		if sent == 0 {
+			return fmt.Errorf("no endpoint in %v to send %v to", webhookConfig, event.Type)
+		}
+		if failed > 0 {
+			cmd.SilenceUsage = true
+			return fmt.Errorf("%v of %v endpoints failed", failed, sent)
+		}
+		return nil
+	},
+}
+
+var webhookConfig string
+var webhookEndpoint string
+var webhookEvent string
+
+func init() {
+	rootCmd.AddCommand(webhookCmd)
+	webhookCmd.AddCommand(webhookTestCmd)
+
+	webhookTestCmd.Flags().StringVar(&webhookConfig, "config", "webhooks.json", "webhook config file, the same as caserver --webhook-config")
+	webhookTestCmd.Flags().StringVar(&webhookEndpoint, "endpoint", "", "only send to this endpoint, every endpoint receiving --event without it")
+	webhookTestCmd.Flags().StringVar(&webhookEvent, "event", webhook.EventIssued, "event to send: "+strings.Join(webhook.Events, ", "))
+}
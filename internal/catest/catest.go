@@ -0,0 +1,35 @@
+/*
+测试用的CA：pkg/ca 之外的测试共用的 TestMain
+*/
+package catest
+
+import (
+	"log"
+	"os"
+	"testing"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+)
+
+/*
+在一个临时目录中新建 ca.CA，运行测试，结束后删除目录
+setup在CA初始化之后、测试开始之前依次调用，例如设置trust domain
+*/
+func Main(m *testing.M, setup ...func() error) {
+	dir, err := os.MkdirTemp("", "sidecar-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	ca.CA.SetDir(dir)
+	if err := ca.CA.Init(); err != nil {
+		log.Fatal(err)
+	}
+	for _, f := range setup {
+		if err := f(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"context"
+	cx509 "crypto/x509"
+	"strings"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+)
+
+/*
+认证之后得到的调用者
+*/
+type Principal struct {
+	Name   string   //例如 spiffe://example.org/web、cn:localhost、token:ci、system:serviceaccount:default:web
+	Method string   //mtls, token, jwt, kubernetes 或 anonymous
+	Groups []string //由token、JWT的groups claim或者Kubernetes的namespace给出，mTLS证书没有组
+}
+
+const (
+	MethodMTLS       string = "mtls"
+	MethodToken      string = "token"
+	MethodJWT        string = "jwt"
+	MethodKubernetes string = "kubernetes"
+	MethodAnonymous  string = "anonymous"
+)
+
+var Anonymous = &Principal{Name: "anonymous", Method: MethodAnonymous}
+
+func (p *Principal) IsAnonymous() bool {
+	return p == nil || p.Method == MethodAnonymous
+}
+
+/*
+调用者给出的凭证：mTLS客户端证书（已经过TLS验证）和 Authorization: Bearer 中的token
+*/
+type Credentials struct {
+	PeerCertificates []*cx509.Certificate
+	BearerToken      string
+}
+
+/*
+一种认证方式。凭证不是这种方式的（例如JWT的issuer不是它的）时返回 nil, nil，
+凭证是它的但是无效时返回 ErrUnauthenticated
+*/
+type Authenticator interface {
+	Authenticate(creds Credentials) (*Principal, error)
+}
+
+/*
+认证和授权，由 --auth-config 的配置生成
+nil 的 *Authorizer 表示没有启用认证：mTLS证书仍然用来标识调用者，但所有调用都被允许，和以前一样
+*/
+type Authorizer struct {
+	mtls           bool
+	authenticators []Authenticator
+	policy         Policy
+}
+
+/*
+给出token时必须有一种方式认可它，不会退回到mTLS或匿名；没有token时用mTLS证书，都没有时是匿名调用者
+*/
+func (a *Authorizer) Authenticate(creds Credentials) (*Principal, error) {
+	if creds.BearerToken != "" && a != nil {
+		for _, authenticator := range a.authenticators {
+			principal, err := authenticator.Authenticate(creds)
+			if err != nil {
+				return nil, err
+			}
+			if principal != nil {
+				return principal, nil
+			}
+		}
+		return nil, ca.NewError(ca.ErrUnauthenticated, "UNKNOWN_TOKEN", "the bearer token is not accepted by any authenticator")
+	}
+	if len(creds.PeerCertificates) > 0 && (a == nil || a.mtls) {
+		return &Principal{Name: ca.IdentityOf(creds.PeerCertificates[0]), Method: MethodMTLS}, nil
+	}
+	return Anonymous, nil
+}
+
+/*
+检查调用者是否有权限，匿名调用者被拒绝时返回 ErrUnauthenticated，以便客户端去认证
+*/
+func (a *Authorizer) Authorize(principal *Principal, permission string) error {
+	if a == nil || permission == "" || a.policy.allowed(principal, permission) {
+		return nil
+	}
+	if principal.IsAnonymous() {
+		caErr := ca.NewError(ca.ErrUnauthenticated, "AUTHENTICATION_REQUIRED", "%v requires an authenticated caller", permission)
+		caErr.Metadata = map[string]string{"permission": permission}
+		return caErr
+	}
+	caErr := ca.NewError(ca.ErrPermissionDenied, "PERMISSION_DENIED", "%v is not allowed to %v", principal.Name, permission)
+	caErr.Metadata = map[string]string{"permission": permission, "principal": principal.Name}
+	return caErr
+}
+
+type principalKey struct{}
+
+/*
+把调用者放进context，同时设置ca.WithCaller，CA用它判断谁可以取走私钥
+*/
+func WithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	ctx = context.WithValue(ctx, principalKey{}, principal)
+	if principal.IsAnonymous() {
+		return ctx
+	}
+	return ca.WithCaller(ctx, principal.Name)
+}
+
+func PrincipalFrom(ctx context.Context) *Principal {
+	if principal, ok := ctx.Value(principalKey{}).(*Principal); ok {
+		return principal
+	}
+	return Anonymous
+}
+
+/*
+从 Authorization 头中取出 bearer token
+*/
+func BearerToken(authorization string) string {
+	scheme, token, ok := strings.Cut(strings.TrimSpace(authorization), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+)
+
+/*
+--auth-config 指定的JSON文件，例如
+
+	{
+	  "tokens": [{"name": "ci", "sha256": "<token的sha256>", "groups": ["deployers"]}],
+	  "jwt": [{"issuer": "https://login.example.com", "audiences": ["sidecar"], "keysFile": "oidc-jwks.json"}],
+	  "kubernetes": {"keysFile": "sa.pub", "audiences": ["sidecar"]},
+	  "roles": [{"name": "signer", "permissions": ["sign:server", "read"]}],
+	  "bindings": [{"role": "signer", "subjects": ["group:deployers", "spiffe://example.org/web"]}]
+	}
+*/
+type Config struct {
+	DisableMTLS bool              `json:"disableMTLS"` //不用mTLS证书认证调用者
+	Tokens      []TokenConfig     `json:"tokens"`
+	JWT         []JWTConfig       `json:"jwt"`
+	Kubernetes  *KubernetesConfig `json:"kubernetes"`
+	Policy
+}
+
+func Load(file string) (*Authorizer, error) {
+	contents, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var config Config
+	if err := json.Unmarshal(contents, &config); err != nil {
+		return nil, ca.WrapError(ca.ErrInvalidArgument, "INVALID_AUTH_CONFIG", err, "can't parse %v", file)
+	}
+	return New(config)
+}
+
+func New(config Config) (*Authorizer, error) {
+	violations := config.Policy.validate()
+	for _, jwtConfig := range config.JWT {
+		if jwtConfig.Issuer == "" || jwtConfig.KeysFile == "" {
+			violations = append(violations, ca.FieldViolation{Field: "jwt", Description: "issuer and keysFile are required"})
+		}
+	}
+	if config.Kubernetes != nil && config.Kubernetes.KeysFile == "" {
+		violations = append(violations, ca.FieldViolation{Field: "kubernetes", Description: "keysFile is required"})
+	}
+	if len(violations) > 0 {
+		return nil, ca.InvalidArgument("INVALID_AUTH_CONFIG", violations...)
+	}
+
+	authorizer := &Authorizer{mtls: !config.DisableMTLS, policy: config.Policy}
+	if len(config.Tokens) > 0 {
+		authorizer.authenticators = append(authorizer.authenticators, newTokenAuthenticator(config.Tokens))
+	}
+	if config.Kubernetes != nil {
+		authorizer.authenticators = append(authorizer.authenticators, newKubernetesAuthenticator(*config.Kubernetes))
+	}
+	for _, jwtConfig := range config.JWT {
+		authorizer.authenticators = append(authorizer.authenticators, newJWTAuthenticator(jwtConfig))
+	}
+	return authorizer, nil
+}
@@ -0,0 +1,216 @@
+package auth
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+)
+
+/*
+用本地的JWKS文件离线验证的JWT，例如OIDC provider签发的ID token
+*/
+type JWTConfig struct {
+	Issuer         string   `json:"issuer"`
+	Audiences      []string `json:"audiences"`      //token的aud中至少要有一个，为空时不检查
+	KeysFile       string   `json:"keysFile"`       //JWKS，或者PEM格式的公钥、证书
+	UsernameClaim  string   `json:"usernameClaim"`  //默认sub
+	UsernamePrefix string   `json:"usernamePrefix"` //默认 <issuer>#，避免和其他方式的调用者重名
+	GroupsClaim    string   `json:"groupsClaim"`    //默认groups
+}
+
+/*
+只接受非对称签名算法，HS256这类共享密钥的算法不能用公开的JWKS验证
+*/
+var allowedAlgorithms = map[string]bool{
+	string(jose.RS256): true, string(jose.RS384): true, string(jose.RS512): true,
+	string(jose.PS256): true, string(jose.PS384): true, string(jose.PS512): true,
+	string(jose.ES256): true, string(jose.ES384): true, string(jose.ES512): true,
+	string(jose.EdDSA): true,
+}
+
+const jwtLeeway time.Duration = time.Minute
+
+type jwtAuthenticator struct {
+	config JWTConfig
+	keys   *keySource
+}
+
+func newJWTAuthenticator(config JWTConfig) *jwtAuthenticator {
+	if config.UsernameClaim == "" {
+		config.UsernameClaim = "sub"
+	}
+	if config.UsernamePrefix == "" {
+		config.UsernamePrefix = config.Issuer + "#"
+	}
+	if config.GroupsClaim == "" {
+		config.GroupsClaim = "groups"
+	}
+	return &jwtAuthenticator{config: config, keys: &keySource{file: config.KeysFile}}
+}
+
+func (j *jwtAuthenticator) Authenticate(creds Credentials) (*Principal, error) {
+	claims, err := verifyJWT(creds.BearerToken, j.keys, []string{j.config.Issuer}, j.config.Audiences)
+	if err != nil || claims == nil {
+		return nil, err
+	}
+	username, _ := claims[j.config.UsernameClaim].(string)
+	if username == "" {
+		return nil, ca.NewError(ca.ErrUnauthenticated, "INVALID_TOKEN", "the token has no %v claim", j.config.UsernameClaim)
+	}
+	principal := &Principal{Name: j.config.UsernamePrefix + username, Method: MethodJWT}
+	if groups, ok := claims[j.config.GroupsClaim].([]interface{}); ok {
+		for _, group := range groups {
+			if name, ok := group.(string); ok {
+				principal.Groups = append(principal.Groups, name)
+			}
+		}
+	}
+	return principal, nil
+}
+
+/*
+验证JWT的签名、issuer、audience和有效期，返回所有claims
+不是JWT或者issuer不在issuers中时返回 nil, nil，留给其他的认证方式
+*/
+func verifyJWT(token string, keys *keySource, issuers []string, audiences []string) (map[string]interface{}, error) {
+	parsed, err := jwt.ParseSigned(token)
+	if err != nil {
+		return nil, nil
+	}
+	var unverified jwt.Claims
+	if err := parsed.UnsafeClaimsWithoutVerification(&unverified); err != nil {
+		return nil, nil
+	}
+	issuerMatches := false
+	for _, issuer := range issuers {
+		issuerMatches = issuerMatches || issuer == unverified.Issuer
+	}
+	if !issuerMatches {
+		return nil, nil
+	}
+
+	if len(parsed.Headers) != 1 || !allowedAlgorithms[parsed.Headers[0].Algorithm] {
+		return nil, ca.NewError(ca.ErrUnauthenticated, "INVALID_TOKEN", "token signing algorithm is not allowed")
+	}
+	keySet, err := keys.get()
+	if err != nil {
+		return nil, ca.WrapError(ca.ErrInternal, "KEYS_UNAVAILABLE", err, "load the token verification keys fail")
+	}
+	candidates := keySet.Keys
+	if kid := parsed.Headers[0].KeyID; kid != "" {
+		//PEM格式的公钥没有kid，Kubernetes的token却总带着kid，找不到同kid的key时试所有没有kid的key
+		candidates = keySet.Key(kid)
+		if len(candidates) == 0 {
+			candidates = keySet.Key("")
+		}
+	}
+
+	for _, key := range candidates {
+		var standard jwt.Claims
+		claims := map[string]interface{}{}
+		if err := parsed.Claims(key.Key, &standard, &claims); err != nil {
+			continue
+		}
+		if err := standard.ValidateWithLeeway(jwt.Expected{Issuer: unverified.Issuer}, jwtLeeway); err != nil {
+			return nil, ca.WrapError(ca.ErrUnauthenticated, "INVALID_TOKEN", err, "token is not valid")
+		}
+		if standard.Expiry == nil {
+			return nil, ca.NewError(ca.ErrUnauthenticated, "INVALID_TOKEN", "token has no expiry")
+		}
+		if !audienceMatches(standard.Audience, audiences) {
+			return nil, ca.NewError(ca.ErrUnauthenticated, "INVALID_TOKEN", "token audience is not accepted")
+		}
+		return claims, nil
+	}
+	return nil, ca.NewError(ca.ErrUnauthenticated, "INVALID_TOKEN", "token signature can't be verified")
+}
+
+func audienceMatches(tokenAudience jwt.Audience, accepted []string) bool {
+	if len(accepted) == 0 {
+		return true
+	}
+	for _, audience := range accepted {
+		if tokenAudience.Contains(audience) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+验证token用的公钥，文件修改后自动重新加载，不需要重启server
+*/
+type keySource struct {
+	file    string
+	mu      sync.Mutex
+	modTime time.Time
+	keys    jose.JSONWebKeySet
+}
+
+func (s *keySource) get() (jose.JSONWebKeySet, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info, err := os.Stat(s.file)
+	if err != nil {
+		return jose.JSONWebKeySet{}, err
+	}
+	if info.ModTime().Equal(s.modTime) {
+		return s.keys, nil
+	}
+	contents, err := os.ReadFile(s.file)
+	if err != nil {
+		return jose.JSONWebKeySet{}, err
+	}
+	keys, err := parseKeys(contents)
+	if err != nil {
+		return jose.JSONWebKeySet{}, err
+	}
+	s.keys, s.modTime = keys, info.ModTime()
+	return keys, nil
+}
+
+/*
+JWKS，或者一个或多个PEM格式的公钥（PUBLIC KEY、RSA PUBLIC KEY）或证书，
+Kubernetes的service account公钥通常是PEM格式的
+*/
+func parseKeys(contents []byte) (jose.JSONWebKeySet, error) {
+	if !strings.HasPrefix(strings.TrimSpace(string(contents)), "-----BEGIN") {
+		var keySet jose.JSONWebKeySet
+		err := json.Unmarshal(contents, &keySet)
+		return keySet, err
+	}
+
+	var keySet jose.JSONWebKeySet
+	for block, rest := pem.Decode(contents); block != nil; block, rest = pem.Decode(rest) {
+		var key interface{}
+		var err error
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			cert, err = x509.ParseCertificate(block.Bytes)
+			if err == nil {
+				key = cert.PublicKey
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return keySet, err
+		}
+		keySet.Keys = append(keySet.Keys, jose.JSONWebKey{Key: key})
+	}
+	return keySet, nil
+}
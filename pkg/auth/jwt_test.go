@@ -0,0 +1,187 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+)
+
+/*
+测试用的签名key，公钥按JWKS或者PEM写到临时目录里
+*/
+type testIssuer struct {
+	key    *ecdsa.PrivateKey
+	signer jose.Signer
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, (&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", "test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testIssuer{key: key, signer: signer}
+}
+
+func (i *testIssuer) jwksFile(t *testing.T) string {
+	contents, err := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &i.key.PublicKey, KeyID: "test", Algorithm: string(jose.ES256)}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writeTestFile(t, "jwks.json", contents)
+}
+
+func (i *testIssuer) pemFile(t *testing.T) string {
+	der, err := x509.MarshalPKIXPublicKey(&i.key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writeTestFile(t, "sa.pub", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func (i *testIssuer) token(t *testing.T, claims map[string]interface{}) string {
+	token, err := jwt.Signed(i.signer).Claims(claims).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func writeTestFile(t *testing.T, name string, contents []byte) string {
+	file := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(file, contents, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func validClaims(issuer string, subject string) map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"iss": issuer,
+		"sub": subject,
+		"aud": []string{"sidecar"},
+		"iat": now.Unix(),
+		"exp": now.Add(time.Hour).Unix(),
+	}
+}
+
+func TestJWTAuthenticate(t *testing.T) {
+	const issuer = "https://login.example.com"
+	signing := newTestIssuer(t)
+	other := newTestIssuer(t)
+	authenticator := newJWTAuthenticator(JWTConfig{Issuer: issuer, Audiences: []string{"sidecar"}, KeysFile: signing.jwksFile(t)})
+
+	with := func(change func(claims map[string]interface{})) map[string]interface{} {
+		claims := validClaims(issuer, "alice")
+		change(claims)
+		return claims
+	}
+	tests := []struct {
+		name    string
+		token   string
+		want    *Principal
+		wantErr bool
+	}{
+		{
+			name:  "valid token",
+			token: signing.token(t, with(func(c map[string]interface{}) { c["groups"] = []string{"admins"} })),
+			want:  &Principal{Name: issuer + "#alice", Method: MethodJWT, Groups: []string{"admins"}},
+		},
+		{name: "not a JWT", token: "opaque-token"},
+		{name: "other issuer", token: signing.token(t, validClaims("https://other.example.com", "alice"))},
+		{name: "expired", token: signing.token(t, with(func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() })), wantErr: true},
+		{name: "no expiry", token: signing.token(t, with(func(c map[string]interface{}) { delete(c, "exp") })), wantErr: true},
+		{name: "wrong audience", token: signing.token(t, with(func(c map[string]interface{}) { c["aud"] = []string{"other"} })), wantErr: true},
+		{name: "no subject", token: signing.token(t, with(func(c map[string]interface{}) { delete(c, "sub") })), wantErr: true},
+		{name: "signed by another key", token: other.token(t, validClaims(issuer, "alice")), wantErr: true},
+		{name: "HS256", token: hmacToken(t, validClaims(issuer, "alice")), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			principal, err := authenticator.Authenticate(Credentials{BearerToken: tt.token})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Authenticate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr && ca.CodeOf(err) != ca.ErrUnauthenticated {
+				t.Errorf("Authenticate() error = %v, want Unauthenticated", err)
+			}
+			if !samePrincipal(principal, tt.want) {
+				t.Errorf("Authenticate() = %+v, want %+v", principal, tt.want)
+			}
+		})
+	}
+}
+
+/*
+共享密钥签名的token，对方可以拿公开的JWKS当密钥伪造，必须拒绝
+*/
+func hmacToken(t *testing.T, claims map[string]interface{}) string {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: []byte("0123456789abcdef0123456789abcdef")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func samePrincipal(got *Principal, want *Principal) bool {
+	if got == nil || want == nil {
+		return got == want
+	}
+	if got.Name != want.Name || got.Method != want.Method || len(got.Groups) != len(want.Groups) {
+		return false
+	}
+	for i := range got.Groups {
+		if got.Groups[i] != want.Groups[i] {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+换了公钥文件之后不用重启就能验证新key签的token
+*/
+func TestKeySourceReload(t *testing.T) {
+	const issuer = "https://login.example.com"
+	first, second := newTestIssuer(t), newTestIssuer(t)
+	file := first.jwksFile(t)
+	authenticator := newJWTAuthenticator(JWTConfig{Issuer: issuer, KeysFile: file})
+	if _, err := authenticator.Authenticate(Credentials{BearerToken: first.token(t, validClaims(issuer, "alice"))}); err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := os.ReadFile(second.jwksFile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, contents, 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Second)
+	if err := os.Chtimes(file, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authenticator.Authenticate(Credentials{BearerToken: second.token(t, validClaims(issuer, "alice"))}); err != nil {
+		t.Errorf("token of the new key rejected after reload: %v", err)
+	}
+}
@@ -0,0 +1,53 @@
+package auth
+
+import (
+	"strings"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+)
+
+/*
+Kubernetes service account token，用集群签发service account token的公钥离线验证，不访问API server
+*/
+type KubernetesConfig struct {
+	Issuer    string   `json:"issuer"`    //默认 https://kubernetes.default.svc.cluster.local
+	Audiences []string `json:"audiences"` //projected token的audience，为空时不检查
+	KeysFile  string   `json:"keysFile"`  //sa.pub，或者集群 /openid/v1/jwks 的内容
+}
+
+const (
+	defaultKubernetesIssuer string = "https://kubernetes.default.svc.cluster.local"
+	legacyKubernetesIssuer  string = "kubernetes/serviceaccount" //1.21以前的secret token
+)
+
+type kubernetesAuthenticator struct {
+	config KubernetesConfig
+	keys   *keySource
+}
+
+func newKubernetesAuthenticator(config KubernetesConfig) *kubernetesAuthenticator {
+	if config.Issuer == "" {
+		config.Issuer = defaultKubernetesIssuer
+	}
+	return &kubernetesAuthenticator{config: config, keys: &keySource{file: config.KeysFile}}
+}
+
+func (k *kubernetesAuthenticator) Authenticate(creds Credentials) (*Principal, error) {
+	claims, err := verifyJWT(creds.BearerToken, k.keys, []string{k.config.Issuer, legacyKubernetesIssuer}, k.config.Audiences)
+	if err != nil || claims == nil {
+		return nil, err
+	}
+
+	//sub 是 system:serviceaccount:<namespace>:<name>
+	subject, _ := claims["sub"].(string)
+	parts := strings.Split(subject, ":")
+	if len(parts) != 4 || parts[0] != "system" || parts[1] != "serviceaccount" {
+		return nil, ca.NewError(ca.ErrUnauthenticated, "INVALID_TOKEN", "%v is not a service account", subject)
+	}
+	namespace := parts[2]
+	return &Principal{
+		Name:   subject,
+		Method: MethodKubernetes,
+		Groups: []string{"system:serviceaccounts", "system:serviceaccounts:" + namespace},
+	}, nil
+}
@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+)
+
+func TestKubernetesAuthenticate(t *testing.T) {
+	signing := newTestIssuer(t)
+	authenticator := newKubernetesAuthenticator(KubernetesConfig{Audiences: []string{"sidecar"}, KeysFile: signing.pemFile(t)})
+
+	legacy := validClaims(legacyKubernetesIssuer, "system:serviceaccount:kube-system:builder")
+	delete(legacy, "aud")
+	tests := []struct {
+		name    string
+		claims  map[string]interface{}
+		want    *Principal
+		wantErr bool
+	}{
+		{
+			name:   "projected token",
+			claims: validClaims(defaultKubernetesIssuer, "system:serviceaccount:default:web"),
+			want:   &Principal{Name: "system:serviceaccount:default:web", Method: MethodKubernetes, Groups: []string{"system:serviceaccounts", "system:serviceaccounts:default"}},
+		},
+		{
+			name:    "legacy secret token has no audience",
+			claims:  legacy,
+			wantErr: true,
+		},
+		{name: "not a service account", claims: validClaims(defaultKubernetesIssuer, "alice"), wantErr: true},
+		{name: "other issuer", claims: validClaims("https://login.example.com", "system:serviceaccount:default:web")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			principal, err := authenticator.Authenticate(Credentials{BearerToken: signing.token(t, tt.claims)})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Authenticate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr && ca.CodeOf(err) != ca.ErrUnauthenticated {
+				t.Errorf("Authenticate() error = %v, want Unauthenticated", err)
+			}
+			if !samePrincipal(principal, tt.want) {
+				t.Errorf("Authenticate() = %+v, want %+v", principal, tt.want)
+			}
+		})
+	}
+}
+
+func TestKubernetesLegacyToken(t *testing.T) {
+	signing := newTestIssuer(t)
+	//没有配置audience时，1.21以前不带aud的secret token也可以用
+	authenticator := newKubernetesAuthenticator(KubernetesConfig{KeysFile: signing.pemFile(t)})
+	claims := validClaims(legacyKubernetesIssuer, "system:serviceaccount:kube-system:builder")
+	delete(claims, "aud")
+	principal, err := authenticator.Authenticate(Credentials{BearerToken: signing.token(t, claims)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal.Name != "system:serviceaccount:kube-system:builder" || principal.Groups[1] != "system:serviceaccounts:kube-system" {
+		t.Errorf("Authenticate() = %+v", principal)
+	}
+}
@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+)
+
+/*
+权限：sign:<profile>（sign:* 表示所有profile）、revoke、read、admin（包含所有权限）
+*/
+const (
+	PermissionRead   string = "read"
+	PermissionRevoke string = "revoke"
+	PermissionAdmin  string = "admin"
+
+	signPermissionPrefix string = "sign:"
+)
+
+/*
+用某个profile签发证书的权限
+*/
+func SignPermission(profile string) string {
+	if profile == "" {
+		profile = ca.DefaultProfile
+	}
+	return signPermissionPrefix + profile
+}
+
+type Role struct {
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+}
+
+/*
+把角色授予subjects：调用者的名字、group:<组名>、authenticated（所有认证过的调用者）或 anonymous
+*/
+type Binding struct {
+	Role     string   `json:"role"`
+	Subjects []string `json:"subjects"`
+}
+
+type Policy struct {
+	Roles    []Role    `json:"roles"`
+	Bindings []Binding `json:"bindings"`
+}
+
+func (p Policy) allowed(principal *Principal, permission string) bool {
+	for _, binding := range p.Bindings {
+		if !bindingMatches(binding, principal) {
+			continue
+		}
+		for _, role := range p.Roles {
+			if role.Name == binding.Role && roleGrants(role, permission) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func bindingMatches(binding Binding, principal *Principal) bool {
+	for _, subject := range binding.Subjects {
+		switch {
+		case subject == "anonymous":
+			if principal.IsAnonymous() {
+				return true
+			}
+		case principal.IsAnonymous():
+			continue
+		case subject == "authenticated" || subject == principal.Name:
+			return true
+		case strings.HasPrefix(subject, "group:"):
+			for _, group := range principal.Groups {
+				if group == strings.TrimPrefix(subject, "group:") {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func roleGrants(role Role, permission string) bool {
+	for _, granted := range role.Permissions {
+		if granted == PermissionAdmin || granted == permission {
+			return true
+		}
+		if granted == signPermissionPrefix+"*" && strings.HasPrefix(permission, signPermissionPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+检查配置中的角色和权限
+*/
+func (p Policy) validate() []ca.FieldViolation {
+	var violations []ca.FieldViolation
+	roles := map[string]bool{}
+	for i, role := range p.Roles {
+		roles[role.Name] = true
+		for _, permission := range role.Permissions {
+			switch {
+			case permission == PermissionRead, permission == PermissionRevoke, permission == PermissionAdmin:
+			case strings.HasPrefix(permission, signPermissionPrefix):
+				profile := strings.TrimPrefix(permission, signPermissionPrefix)
+				if _, ok := ca.Profiles[profile]; !ok && profile != "*" {
+					violations = append(violations, ca.FieldViolation{Field: rolesField(i), Description: "unknown profile in " + permission})
+				}
+			default:
+				violations = append(violations, ca.FieldViolation{Field: rolesField(i), Description: "unknown permission " + permission})
+			}
+		}
+	}
+	for _, binding := range p.Bindings {
+		if !roles[binding.Role] {
+			violations = append(violations, ca.FieldViolation{Field: "bindings", Description: "unknown role " + binding.Role})
+		}
+	}
+	return violations
+}
+
+func rolesField(i int) string {
+	return fmt.Sprintf("roles[%d]", i)
+}
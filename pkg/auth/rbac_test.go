@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	cx509 "crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"testing"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+)
+
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestAuthorizerAuthenticate(t *testing.T) {
+	peer := []*cx509.Certificate{{Subject: pkix.Name{CommonName: "web"}}}
+	tokens := []TokenConfig{{Name: "ci", SHA256: tokenHash("s3cret"), Groups: []string{"deployers"}}}
+	withMTLS, err := New(Config{Tokens: tokens})
+	if err != nil {
+		t.Fatal(err)
+	}
+	withoutMTLS, err := New(Config{Tokens: tokens, DisableMTLS: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		authorizer *Authorizer
+		creds      Credentials
+		want       *Principal
+		wantErr    bool
+	}{
+		{name: "token", authorizer: withMTLS, creds: Credentials{BearerToken: "s3cret"}, want: &Principal{Name: "token:ci", Method: MethodToken, Groups: []string{"deployers"}}},
+		{name: "token wins over the certificate", authorizer: withMTLS, creds: Credentials{BearerToken: "s3cret", PeerCertificates: peer}, want: &Principal{Name: "token:ci", Method: MethodToken, Groups: []string{"deployers"}}},
+		{name: "unknown token doesn't fall back to mTLS", authorizer: withMTLS, creds: Credentials{BearerToken: "guess", PeerCertificates: peer}, wantErr: true},
+		{name: "certificate", authorizer: withMTLS, creds: Credentials{PeerCertificates: peer}, want: &Principal{Name: "cn:web", Method: MethodMTLS}},
+		{name: "certificate with mTLS disabled", authorizer: withoutMTLS, creds: Credentials{PeerCertificates: peer}, want: Anonymous},
+		{name: "nothing", authorizer: withMTLS, want: Anonymous},
+		{name: "no auth config still names certificates", creds: Credentials{PeerCertificates: peer}, want: &Principal{Name: "cn:web", Method: MethodMTLS}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			principal, err := tt.authorizer.Authenticate(tt.creds)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Authenticate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !samePrincipal(principal, tt.want) {
+				t.Errorf("Authenticate() = %+v, want %+v", principal, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthorizerAuthorize(t *testing.T) {
+	authorizer, err := New(Config{Policy: Policy{
+		Roles: []Role{
+			{Name: "signer", Permissions: []string{SignPermission("server"), PermissionRead}},
+			{Name: "any-signer", Permissions: []string{"sign:*"}},
+			{Name: "admin", Permissions: []string{PermissionAdmin}},
+			{Name: "reader", Permissions: []string{PermissionRead}},
+		},
+		Bindings: []Binding{
+			{Role: "signer", Subjects: []string{"group:deployers"}},
+			{Role: "any-signer", Subjects: []string{"spiffe://example.org/ci"}},
+			{Role: "admin", Subjects: []string{"token:root"}},
+			{Role: "reader", Subjects: []string{"authenticated"}},
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deployer := &Principal{Name: "token:ci", Method: MethodToken, Groups: []string{"deployers"}}
+	ciWorkload := &Principal{Name: "spiffe://example.org/ci", Method: MethodMTLS}
+	root := &Principal{Name: "token:root", Method: MethodToken}
+	someone := &Principal{Name: "cn:web", Method: MethodMTLS}
+
+	tests := []struct {
+		name       string
+		principal  *Principal
+		permission string
+		code       ca.ErrorCode
+		allowed    bool
+	}{
+		{name: "group grants a profile", principal: deployer, permission: SignPermission("server"), allowed: true},
+		{name: "group doesn't grant other profiles", principal: deployer, permission: SignPermission("client"), code: ca.ErrPermissionDenied},
+		{name: "sign:* grants every profile", principal: ciWorkload, permission: SignPermission("client"), allowed: true},
+		{name: "sign:* doesn't grant revoke", principal: ciWorkload, permission: PermissionRevoke, code: ca.ErrPermissionDenied},
+		{name: "admin grants everything", principal: root, permission: PermissionRevoke, allowed: true},
+		{name: "authenticated", principal: someone, permission: PermissionRead, allowed: true},
+		{name: "anonymous isn't authenticated", principal: Anonymous, permission: PermissionRead, code: ca.ErrUnauthenticated},
+		{name: "no permission needed", principal: Anonymous, permission: "", allowed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := authorizer.Authorize(tt.principal, tt.permission)
+			if (err == nil) != tt.allowed {
+				t.Fatalf("Authorize() error = %v, allowed %v", err, tt.allowed)
+			}
+			if !tt.allowed && ca.CodeOf(err) != tt.code {
+				t.Errorf("Authorize() error = %v, want code %v", err, tt.code)
+			}
+		})
+	}
+
+	var disabled *Authorizer
+	if err := disabled.Authorize(Anonymous, PermissionAdmin); err != nil {
+		t.Errorf("no auth config must allow every call, got %v", err)
+	}
+}
+
+func TestNewValidatesPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{name: "valid", config: Config{Policy: Policy{Roles: []Role{{Name: "r", Permissions: []string{"sign:*", SignPermission(""), PermissionRead}}}, Bindings: []Binding{{Role: "r"}}}}},
+		{name: "unknown permission", config: Config{Policy: Policy{Roles: []Role{{Name: "r", Permissions: []string{"write"}}}}}, wantErr: true},
+		{name: "unknown profile", config: Config{Policy: Policy{Roles: []Role{{Name: "r", Permissions: []string{"sign:nope"}}}}}, wantErr: true},
+		{name: "unknown role", config: Config{Policy: Policy{Bindings: []Binding{{Role: "missing"}}}}, wantErr: true},
+		{name: "jwt without keys", config: Config{JWT: []JWTConfig{{Issuer: "https://login.example.com"}}}, wantErr: true},
+		{name: "kubernetes without keys", config: Config{Kubernetes: &KubernetesConfig{}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr && ca.CodeOf(err) != ca.ErrInvalidArgument {
+				t.Errorf("New() error = %v, want InvalidArgument", err)
+			}
+		})
+	}
+}
+
+func TestWithPrincipal(t *testing.T) {
+	tests := []struct {
+		name      string
+		principal *Principal
+		caller    string
+	}{
+		{name: "authenticated", principal: &Principal{Name: "cn:web", Method: MethodMTLS}, caller: "cn:web"},
+		{name: "anonymous has no caller", principal: Anonymous},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := WithPrincipal(context.Background(), tt.principal)
+			if got := ca.CallerFrom(ctx); got != tt.caller {
+				t.Errorf("caller = %q, want %q", got, tt.caller)
+			}
+			if PrincipalFrom(ctx) != tt.principal {
+				t.Error("principal not kept in the context")
+			}
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+/*
+静态的bearer token，配置文件中只保存token的sha256，例如 echo -n <token> | sha256sum
+*/
+type TokenConfig struct {
+	Name   string   `json:"name"`
+	SHA256 string   `json:"sha256"`
+	Groups []string `json:"groups"`
+}
+
+type tokenAuthenticator struct {
+	tokens map[string]TokenConfig //key是token的sha256
+}
+
+func newTokenAuthenticator(tokens []TokenConfig) *tokenAuthenticator {
+	authenticator := &tokenAuthenticator{tokens: map[string]TokenConfig{}}
+	for _, token := range tokens {
+		authenticator.tokens[strings.ToLower(token.SHA256)] = token
+	}
+	return authenticator
+}
+
+func (t *tokenAuthenticator) Authenticate(creds Credentials) (*Principal, error) {
+	sum := sha256.Sum256([]byte(creds.BearerToken))
+	token, ok := t.tokens[hex.EncodeToString(sum[:])]
+	if !ok {
+		return nil, nil
+	}
+	return &Principal{Name: "token:" + token.Name, Method: MethodToken, Groups: token.Groups}, nil
+}
@@ -0,0 +1,76 @@
+package ca
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	auditLogLocation string = "cert/audit.log"
+	//follower上的审计记录只写在本机，不复制，快照和整个目录的复制都不包括它，见 ReadFolder
+	localAuditLogLocation string = storeFolder + "/audit.local.log"
+)
+
+/*
+本机上直接操作CA目录的命令行使用的身份，能读CA目录的人本来就能拿到这些文件
+*/
+const LocalOperator string = "local:operator"
+
+type callerKey struct{}
+
+/*
+把调用者的身份（例如mTLS客户端证书的SPIFFE ID或CN）放到context中
+*/
+func WithCaller(ctx context.Context, identity string) context.Context {
+	return context.WithValue(ctx, callerKey{}, identity)
+}
+
+/*
+取出调用者的身份，匿名调用时为空
+*/
+func CallerFrom(ctx context.Context) string {
+	identity, _ := ctx.Value(callerKey{}).(string)
+	return identity
+}
+
+/*
+审计日志中的一条记录，以json lines格式追加到 cert/audit.log
+*/
+type AuditRecord struct {
+	Time          time.Time `json:"time"`
+	Action        string    `json:"action"`
+	CertificateID string    `json:"certificateId,omitempty"`
+	Caller        string    `json:"caller,omitempty"`
+	Owner         string    `json:"owner,omitempty"`
+	Allowed       bool      `json:"allowed"`
+	Reason        string    `json:"reason,omitempty"`
+}
+
+var auditMu sync.Mutex
+
+func (ca *CertificateAuthority) audit(record AuditRecord) {
+	if record.Time.IsZero() {
+		record.Time = time.Now()
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("marshal audit record fail: %v", err)
+		return
+	}
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	change := FileChange{Op: OpAppend, Path: auditLogLocation, Contents: append(line, '\n'), Perm: 0600}
+	err = ca.storage().Apply([]FileChange{change})
+	if CodeOf(err) == ErrUnavailable {
+		//follower不能修改复制的日志，本地写进复制的日志会让副本之间不一致，改写到本机自己的日志
+		change.Path = localAuditLogLocation
+		err = ca.ApplyLocal([]FileChange{change})
+	}
+	if err != nil {
+		log.Printf("write audit log fail: %v", err)
+	}
+}
@@ -0,0 +1,52 @@
+package ca
+
+import (
+	"os"
+	"testing"
+)
+
+/*
+follower拒绝所有修改，和 pkg/ha 中不是leader的副本一样
+*/
+type followerStore struct{}
+
+func (followerStore) Apply(changes []FileChange) error {
+	return NewError(ErrUnavailable, "NOT_LEADER", "not the leader")
+}
+func (followerStore) Sync(folders ...string) error { return nil }
+func (followerStore) IsLeader() bool               { return false }
+
+func TestAuditLog(t *testing.T) {
+	tests := []struct {
+		name    string
+		store   Store
+		written string
+		skipped string
+	}{
+		{name: "leader", written: auditLogLocation, skipped: localAuditLogLocation},
+		{name: "follower", store: followerStore{}, written: localAuditLogLocation, skipped: auditLogLocation},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authority := New(t.TempDir())
+			authority.SetStore(tt.store)
+			authority.audit(AuditRecord{Action: "fetchKey", CertificateID: "test", Caller: "spiffe://example.org/web"})
+
+			if _, err := os.Stat(authority.path(tt.written)); err != nil {
+				t.Errorf("%v not written: %v", tt.written, err)
+			}
+			if _, err := os.Stat(authority.path(tt.skipped)); !os.IsNotExist(err) {
+				t.Errorf("%v written, want it untouched", tt.skipped)
+			}
+			files, err := authority.ReadFolder(storeFolder)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, file := range files {
+				if file.Path == localAuditLogLocation {
+					t.Error("the local audit log is replicated")
+				}
+			}
+		})
+	}
+}
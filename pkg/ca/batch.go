@@ -0,0 +1,195 @@
+package ca
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	MaxBatchSize            int    = 500 //一次批量签发最多的CSR数
+	DefaultBatchParallelism int    = 4
+	MaxBatchParallelism     int    = 16
+	batchAbortedReason      string = "BATCH_ABORTED"
+)
+
+/*
+批量签发的选项
+AllOrNothing为true时，只要有一个CSR失败，整批都不签发，磁盘上也不会留下任何文件
+*/
+type BatchOptions struct {
+	AllOrNothing bool
+	Parallelism  int //同时签发的CSR数，为0时用DefaultBatchParallelism
+}
+
+/*
+批量签发中一个CSR的结果，Err不为nil时Certificate为nil
+*/
+type BatchResult struct {
+	Certificate *Certificate
+	Err         error
+}
+
+/*
+一次签发一批证书，结果和csrs一一对应
+每个CSR都计入限流，token不够整批时整批拒绝；每张证书仍然计入配额；返回的error只表示整批都没有处理，例如批太大
+*/
+func (ca *CertificateAuthority) SignX509Batch(ctx context.Context, csrs []*CertificateSigningRequest, opts BatchOptions) ([]BatchResult, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "ca.SignX509Batch")
+	defer span.End()
+	span.SetAttributes(attribute.Int("batch.size", len(csrs)), attribute.Bool("batch.allOrNothing", opts.AllOrNothing))
+
+	if len(csrs) == 0 {
+		return nil, recordError(span, InvalidArgument("EMPTY_BATCH", FieldViolation{Field: "Requests", Description: "must not be empty"}))
+	}
+	if len(csrs) > MaxBatchSize {
+		return nil, recordError(span, InvalidArgument("BATCH_TOO_LARGE", FieldViolation{Field: "Requests", Description: "at most " + strconv.Itoa(MaxBatchSize) + " requests in a batch"}))
+	}
+	if err := ca.limiter.allowN(ctx, len(csrs)); err != nil {
+		return nil, recordError(span, err)
+	}
+
+	parallelism := opts.Parallelism
+	if parallelism <= 0 {
+		parallelism = DefaultBatchParallelism
+	}
+	if parallelism > MaxBatchParallelism {
+		parallelism = MaxBatchParallelism
+	}
+
+	//all-or-nothing 时有一个失败就不再签发剩下的
+	issueCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make([]BatchResult, len(csrs))
+	items := make([]*pendingCertificate, len(csrs))
+	var releaseMu sync.Mutex
+	var releases []func()
+	defer func() {
+		for _, release := range releases {
+			release()
+		}
+	}()
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < parallelism; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if issueCtx.Err() != nil {
+					results[i].Err = NewError(ErrFailedPrecondition, batchAbortedReason, "not signed because another request of the batch failed")
+					continue
+				}
+				item, release, err := ca.prepareBatchItem(issueCtx, i, csrs[i])
+				if release != nil {
+					releaseMu.Lock()
+					releases = append(releases, release)
+					releaseMu.Unlock()
+				}
+				if err != nil {
+					results[i].Err = err
+					if opts.AllOrNothing {
+						cancel()
+					}
+					continue
+				}
+				items[i] = item
+			}
+		}()
+	}
+	for i := range csrs {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	if opts.AllOrNothing {
+		if failed := firstFailure(results); failed >= 0 {
+			//已经签好的证书也不保存
+			for i := range results {
+				if results[i].Err == nil {
+					results[i].Err = NewError(ErrFailedPrecondition, batchAbortedReason, "not saved because request %v of the batch failed", failed)
+				}
+			}
+			span.SetAttributes(attribute.Int("batch.failed", len(csrs)))
+			return results, nil
+		}
+		if err := ca.commit(items); err != nil {
+			return nil, recordError(span, storageError(err, "persist the batch fail"))
+		}
+		for i, item := range items {
+			results[i].Certificate = &item.Certificate
+		}
+		return results, nil
+	}
+
+	failed := 0
+	for i, item := range items {
+		if item == nil {
+			failed++
+			continue
+		}
+		if err := ca.commit([]*pendingCertificate{item}); err != nil {
+			results[i].Err = storageError(err, "persist the certificate fail")
+			failed++
+			continue
+		}
+		results[i].Certificate = &item.Certificate
+	}
+	span.SetAttributes(attribute.Int("batch.failed", failed))
+	return results, nil
+}
+
+/*
+签发批中的一张证书并准备好它的文件，返回的release释放配额的预留，要在保存之后调用
+*/
+func (ca *CertificateAuthority) prepareBatchItem(ctx context.Context, index int, csr *CertificateSigningRequest) (*pendingCertificate, func(), error) {
+	ctx, span := tracing.Tracer().Start(ctx, "ca.SignX509Batch.item")
+	defer span.End()
+	span.SetAttributes(attribute.Int("batch.index", index))
+
+	profile, err := ProfileOf(csr)
+	if err != nil {
+		return nil, nil, recordError(span, err)
+	}
+	release, err := ca.limiter.reserve(ctx)
+	if err != nil {
+		return nil, nil, recordError(span, err)
+	}
+	issued, err := ca.issue(ctx, csr, profile.notAfter(time.Now()))
+	if err != nil {
+		return nil, release, recordError(span, err)
+	}
+	item, err := ca.prepare(ctx, issued, true)
+	if err != nil {
+		return nil, release, recordError(span, WrapError(ErrInternal, "STORAGE_FAILED", err, "prepare the certificate fail"))
+	}
+	return item, release, nil
+}
+
+/*
+第一个真正失败（不是因为别的请求失败而放弃）的请求，都成功时返回-1
+调用者取消了请求时，所有的请求都是被放弃的，返回第一个
+*/
+func firstFailure(results []BatchResult) int {
+	aborted := -1
+	for i, result := range results {
+		if result.Err == nil {
+			continue
+		}
+		var caErr *Error
+		if !errors.As(result.Err, &caErr) || caErr.Reason != batchAbortedReason {
+			return i
+		}
+		if aborted < 0 {
+			aborted = i
+		}
+	}
+	return aborted
+}
@@ -0,0 +1,149 @@
+package ca
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	cx509 "crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+)
+
+/*
+客户端需要信任的证书：根证书和中间证书
+根证书轮换期间，新旧根证书会同时出现在Roots中
+*/
+type TrustBundle struct {
+	Roots         []*cx509.Certificate
+	Intermediates []*cx509.Certificate
+	Version       string //由所有证书的内容计算得出，内容不变版本就不变，可以作为ETag
+}
+
+/*
+返回CA当前的trust bundle
+*/
+func (ca *CertificateAuthority) CurrentTrustBundle() *TrustBundle {
+	bundle := &TrustBundle{Roots: ca.trustedRoots(), Intermediates: ca.intermediates()}
+	hash := sha256.New()
+	for _, cert := range bundle.certificates() {
+		hash.Write(cert.Raw)
+	}
+	bundle.Version = hex.EncodeToString(hash.Sum(nil))[:16]
+	return bundle
+}
+
+/*
+当前被信任的根证书，轮换期间包括新旧两张
+*/
+func (ca *CertificateAuthority) trustedRoots() []*cx509.Certificate {
+	ca.mu.RLock()
+	defer ca.mu.RUnlock()
+	roots := []*cx509.Certificate{&ca.RootCA}
+	if ca.rollover != nil {
+		roots = append(roots, ca.rollover.otherRoot)
+	}
+	return roots
+}
+
+/*
+当前的中间证书：我们直接用根证书签发，只有根证书轮换期间才有交叉签名的证书
+*/
+func (ca *CertificateAuthority) intermediates() []*cx509.Certificate {
+	ca.mu.RLock()
+	defer ca.mu.RUnlock()
+	if ca.rollover == nil {
+		return nil
+	}
+	return ca.rollover.crossCerts
+}
+
+/*
+root 在前，intermediate 在后
+*/
+func (b *TrustBundle) certificates() []*cx509.Certificate {
+	certs := make([]*cx509.Certificate, 0, len(b.Roots)+len(b.Intermediates))
+	certs = append(certs, b.Roots...)
+	return append(certs, b.Intermediates...)
+}
+
+func (b *TrustBundle) CertPool() *cx509.CertPool {
+	pool := cx509.NewCertPool()
+	for _, cert := range b.Roots {
+		pool.AddCert(cert)
+	}
+	return pool
+}
+
+func (b *TrustBundle) PEM() []byte {
+	var contents []byte
+	for _, cert := range b.certificates() {
+		contents = append(contents, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	return contents
+}
+
+/*
+所有证书的DER直接拼接在一起，和SPIFFE Workload API中bundle的格式相同
+*/
+func (b *TrustBundle) DER() []byte {
+	var contents []byte
+	for _, cert := range b.certificates() {
+		contents = append(contents, cert.Raw...)
+	}
+	return contents
+}
+
+type jwk struct {
+	Kty string   `json:"kty"`
+	Use string   `json:"use,omitempty"`
+	Kid string   `json:"kid"`
+	X5c []string `json:"x5c"`
+	N   string   `json:"n,omitempty"`
+	E   string   `json:"e,omitempty"`
+	Crv string   `json:"crv,omitempty"`
+	X   string   `json:"x,omitempty"`
+	Y   string   `json:"y,omitempty"`
+}
+
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+/*
+RFC 7517 JWK Set，每张证书一个key，x5c 中是证书的DER
+*/
+func (b *TrustBundle) JWKS() ([]byte, error) {
+	set := jwks{Keys: []jwk{}}
+	for _, cert := range b.certificates() {
+		spkiHash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		key := jwk{
+			Use: "x509-svid",
+			Kid: base64.RawURLEncoding.EncodeToString(spkiHash[:]),
+			X5c: []string{base64.StdEncoding.EncodeToString(cert.Raw)},
+		}
+		switch pub := cert.PublicKey.(type) {
+		case *rsa.PublicKey:
+			key.Kty = "RSA"
+			key.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			key.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case *ecdsa.PublicKey:
+			size := (pub.Curve.Params().BitSize + 7) / 8
+			key.Kty = "EC"
+			key.Crv = pub.Curve.Params().Name
+			key.X = base64.RawURLEncoding.EncodeToString(pub.X.FillBytes(make([]byte, size)))
+			key.Y = base64.RawURLEncoding.EncodeToString(pub.Y.FillBytes(make([]byte, size)))
+		case ed25519.PublicKey:
+			key.Kty = "OKP"
+			key.Crv = "Ed25519"
+			key.X = base64.RawURLEncoding.EncodeToString(pub)
+		default:
+			continue
+		}
+		set.Keys = append(set.Keys, key)
+	}
+	return json.Marshal(set)
+}
@@ -1,21 +1,31 @@
 package ca
 
 import (
+	"context"
 	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	cx509 "crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"fmt"
+	"io/fs"
 	"io/ioutil"
 	"log"
 	"math/big"
 	mathRand "math/rand"
 	"net"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/jackyzhangfudan/sidecar/pkg/tracing"
 	"github.com/youmark/pkcs8"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -32,76 +42,267 @@ const (
 	localCAFolder  string = "cert/localCert"
 )
 
+/*
+包中的CA，使用前要调用 Load 或者 Init 从工作目录（或 SetDir 设置的目录）加载
+*/
 var CA CertificateAuthority
 
-func init() {
-	CA = CertificateAuthority{}
-	CA.load()
+/*
+状态保存在dir下的CA，用于同一个进程中的多个CA（例如测试中的多个副本），dir为空时是工作目录
+*/
+func New(dir string) *CertificateAuthority {
+	return &CertificateAuthority{dir: dir}
 }
 
 type CertificateAuthority struct {
-	RootCA     cx509.Certificate
-	PrivateKey *rsa.PrivateKey
+	RootCA      cx509.Certificate
+	PrivateKey  *rsa.PrivateKey
+	TrustDomain string        //SPIFFE trust domain，为空时不签发X.509-SVID
+	KeyTTL      time.Duration //CA生成的私钥在被取走之前最多保留多久，为0时用DefaultKeyTTL
+
+	federatedBundles map[string][]*cx509.Certificate
+	bundleMu         sync.RWMutex //保护 federatedBundles
+	events           eventHub
+	mu               sync.RWMutex   //保护 RootCA、PrivateKey 和 rollover
+	rollover         *rolloverState //根证书轮换进行中时不为空
+	keyMu            sync.Mutex     //保证私钥只被取走一次
+	joinMu           sync.Mutex     //保证join token不会被多用
+	crlMu            sync.Mutex     //同一时间只生成一份CRL，CRL number不会重复
+	revokeMu         sync.Mutex     //保证一张证书只被吊销一次，检查和写入之间不会插进别的吊销
+	revoked          revokedSerials //吊销证书的序列号，见 IsRevoked
+	limiter          *limiter       //签发证书的限流和配额，为nil时不限制
+	keyPool          *keyPool       //预先生成的私钥，为nil时现场生成
+	store            Store          //CA状态的存储，为nil时直接写本地磁盘
+	rootPassphrase   []byte         //加密根证书私钥的口令，为空时私钥不加密
+	outbox           int32          //为1时签发和吊销的事件写进发件箱，见 EnableOutbox
+	dir              string         //CA状态所在的目录，cert/ 在它下面，为空时是工作目录
+	storeMu          sync.Mutex     //同一进程中修改存储的goroutine在这里排队，见 lockStore
+}
+
+/*
+设置加密根证书私钥的口令，要在 Load 或 Init 之前调用
+设置以后新生成的根证书私钥都加密保存，已有的未加密私钥在加载时改为加密保存
+多副本时根证书私钥随raft日志和快照复制，必须设置，所有副本用同一个口令
+*/
+func (ca *CertificateAuthority) SetRootKeyPassphrase(passphrase []byte) {
+	ca.rootPassphrase = passphrase
+}
+
+/*
+是否设置了加密根证书私钥的口令
+*/
+func (ca *CertificateAuthority) RootKeyEncrypted() bool {
+	return len(ca.rootPassphrase) > 0
+}
+
+/*
+从CA目录下的 cert/ 加载根证书和私钥信息，缺少本地server的证书时为它签发一张
+create为true时，没有根证书就自签一个（caserver启动时这样做），否则返回错误
+*/
+func (ca *CertificateAuthority) Load(create bool) error {
+	return ca.withStoreLock(func() error {
+		//如果没有配置根证书，我们自签一个
+		if !checkFileExist(ca.path(rootCALocation)) || !checkFileExist(ca.path(rsaPrivateKeyLocation)) {
+			if !create {
+				dir, _ := filepath.Abs(ca.path(rootCAFolder))
+				return NewError(ErrFailedPrecondition, "CA_NOT_INITIALIZED", "no root CA in %v, run sidecar ca init first", dir)
+			}
+			if err := ca.makeRootCA(); err != nil {
+				return err
+			}
+		}
+		return ca.load()
+	})
 }
 
 /*
-从磁盘加载根证书和私钥信息
+在CA目录下新建一个CA：自签根证书，并签发本地server的证书，已经有根证书时返回错误
 */
-func (ca *CertificateAuthority) load() {
-	//如果没有配置根证书，我们自签一个
-	if !checkFileExist(rootCALocation) || !checkFileExist(rsaPrivateKeyLocation) {
+func (ca *CertificateAuthority) Init() error {
+	return ca.withStoreLock(func() error {
+		if checkFileExist(ca.path(rootCALocation)) || checkFileExist(ca.path(rsaPrivateKeyLocation)) {
+			dir, _ := filepath.Abs(ca.path(rootCAFolder))
+			return NewError(ErrAlreadyExists, "CA_ALREADY_INITIALIZED", "a root CA already exists in %v", dir)
+		}
 		if err := ca.makeRootCA(); err != nil {
-			log.Print("can't create self-signed root CA")
-			return
+			return err
+		}
+		return ca.load()
+	})
+}
+
+/*
+加载根证书、私钥和轮换状态，调用者持有存储的锁
+*/
+func (ca *CertificateAuthority) load() error {
+	rootCA, privateKey, err := ca.loadCAKeyPair(rootCALocation, rsaPrivateKeyLocation)
+	if err != nil {
+		return WrapError(ErrInternal, "ROOT_CA_INVALID", err, "load the root CA fail")
+	}
+	if err := ca.encryptRootKeys(); err != nil {
+		return WrapError(ErrInternal, "STORAGE_FAILED", err, "encrypt the root CA private keys fail")
+	}
+	ca.mu.Lock()
+	ca.RootCA = *rootCA
+	ca.PrivateKey = privateKey
+	ca.mu.Unlock()
+
+	//根证书轮换进行中时，加载新旧根证书和交叉签名的证书
+	if err := ca.loadRollover(); err != nil {
+		log.Printf("can't load root CA rollover state: %v", err)
+	}
+
+	//我们检查是否需要生成本地server的certificate
+	//调用者已经持有存储的锁，直接写本地磁盘
+	if !checkFileExist(ca.path(localCertLocation)) || !checkFileExist(ca.path(localKeyLocation)) {
+		changes, err := ca.localCertChanges()
+		if err == nil {
+			err = ca.applyLocal(changes)
+		}
+		if err != nil {
+			log.Print("can't create local certificate")
+			return WrapError(ErrInternal, "LOCAL_CERT_FAILED", err, "create the local certificate fail")
 		}
-		//我们需要同时签发本地server的certificate，用于后续的mTLS
-		os.Remove(localCertLocation)
-		os.Remove(localKeyLocation)
 	}
+	return nil
+}
 
+/*
+加载一对CA证书和私钥，私钥是PKCS#8格式，路径相对于CA目录
+*/
+func (ca *CertificateAuthority) loadCAKeyPair(certPath string, keyPath string) (*cx509.Certificate, *rsa.PrivateKey, error) {
 	//加载 rootCA 的 private key
-	bytes, err := ioutil.ReadFile(rsaPrivateKeyLocation)
+	der, encrypted, err := readRootKey(ca.path(keyPath))
 	if err != nil {
-		panic("can't load ca private key")
+		return nil, nil, err
 	}
-	pemBlocks, _ := pem.Decode(bytes)
-	if pemBlocks.Type != "ENCRYPTED PRIVATE KEY" {
-		panic("ca private key type should be ENCRYPTED")
+	var privateKey *rsa.PrivateKey
+	switch {
+	case !encrypted:
+		privateKey, err = pkcs8.ParsePKCS8PrivateKeyRSA(der)
+	case !ca.RootKeyEncrypted():
+		return nil, nil, fmt.Errorf("ca private key %v is encrypted, a passphrase is needed", keyPath)
+	default:
+		privateKey, err = pkcs8.ParsePKCS8PrivateKeyRSA(der, ca.rootPassphrase) //need package pkcs8 to parse
 	}
-	data, err := pkcs8.ParsePKCS8PrivateKeyRSA(pemBlocks.Bytes) //need package pkcs8 to parse
 	if err != nil {
-		panic("can't parse private key bytes via pkcs8")
+		return nil, nil, fmt.Errorf("can't parse private key bytes via pkcs8, is the passphrase right?")
 	}
-	ca.PrivateKey = data
 	//加载 rootCA
-	rootCABytes, err := ioutil.ReadFile(rootCALocation)
+	cert, err := loadCertificateFile(ca.path(certPath))
 	if err != nil {
-		panic("can't load root ca")
+		return nil, nil, err
 	}
-	pemBlocks, _ = pem.Decode(rootCABytes)
-	rootCA, err := cx509.ParseCertificate(pemBlocks.Bytes)
+	return cert, privateKey, nil
+}
+
+/*
+读出根证书私钥的DER，encrypted表示它是加密的PKCS#8
+*/
+func readRootKey(keyPath string) ([]byte, bool, error) {
+	bytes, err := ioutil.ReadFile(keyPath)
 	if err != nil {
-		panic("can't parse root ca")
+		return nil, false, fmt.Errorf("can't load ca private key")
 	}
-	ca.RootCA = *rootCA
+	pemBlocks, _ := pem.Decode(bytes)
+	if pemBlocks == nil || pemBlocks.Type != "ENCRYPTED PRIVATE KEY" {
+		return nil, false, fmt.Errorf("ca private key type should be ENCRYPTED")
+	}
+	//没有设置口令时生成的私钥是未加密的PKCS#8
+	_, err = cx509.ParsePKCS8PrivateKey(pemBlocks.Bytes)
+	return pemBlocks.Bytes, err != nil, nil
+}
 
-	//我们检查是否需要生成本地server的certificate
-	if !checkFileExist(localCertLocation) || !checkFileExist(localKeyLocation) {
-		if err := ca.signLocalCert(); err != nil {
-			log.Print("can't create local certificate")
-			return
+/*
+设置了口令时，把 cert/rootCA 下（包括轮换的新旧根证书和归档）未加密的私钥改为加密保存，调用者持有存储的锁
+*/
+func (ca *CertificateAuthority) encryptRootKeys() error {
+	if !ca.RootKeyEncrypted() {
+		return nil
+	}
+	return filepath.WalkDir(ca.path(rootCAFolder), func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || !strings.HasSuffix(path, ".private.key") {
+			return err
+		}
+		der, encrypted, err := readRootKey(path)
+		if err != nil || encrypted {
+			return err
+		}
+		key, err := cx509.ParsePKCS8PrivateKey(der)
+		if err != nil {
+			return err
+		}
+		der, err = pkcs8.MarshalPrivateKey(key, ca.rootPassphrase, nil)
+		if err != nil {
+			return err
 		}
+		if err := writeFileSync(path+".tmp", pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: der}), 0600); err != nil {
+			return err
+		}
+		log.Printf("root CA private key %v is encrypted with the passphrase", path)
+		return os.Rename(path+".tmp", path)
+	})
+}
+
+func loadCertificateFile(path string) (*cx509.Certificate, error) {
+	certBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("can't load certificate %v", path)
+	}
+	pemBlocks, _ := pem.Decode(certBytes)
+	if pemBlocks == nil {
+		return nil, fmt.Errorf("%v is not PEM encoded", path)
 	}
+	cert, err := cx509.ParseCertificate(pemBlocks.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse certificate %v", path)
+	}
+	return cert, nil
+}
+
+/*
+返回当前用于签发证书的CA证书和私钥，根证书轮换时它们会被替换
+*/
+func (ca *CertificateAuthority) issuer() (*cx509.Certificate, *rsa.PrivateKey) {
+	ca.mu.RLock()
+	defer ca.mu.RUnlock()
+	return &ca.RootCA, ca.PrivateKey
 }
 
 /*
 CA 做一个自签名证书，作为自己的根证书，当配置没有在cert\rootCA下提供根证书和私钥时，我们就自己做一个
+调用者持有存储的锁，根证书的文件在一次 applyLocal 中写入
 */
 func (ca *CertificateAuthority) makeRootCA() error {
+	for _, folder := range []string{rootCAFolder, clientCAFolder, localCAFolder} {
+		if err := os.MkdirAll(ca.path(folder), 0700); err != nil {
+			return WrapError(ErrInternal, "STORAGE_FAILED", err, "create %v fail", folder)
+		}
+	}
+	changes, _, _, err := ca.newRootCA(rootCAFolder, "root.crt", "root.private.key")
+	if err != nil {
+		log.Print("can't create self-signed root CA")
+		return WrapError(ErrInternal, "ROOT_GENERATION_FAILED", err, "create the self-signed root CA fail")
+	}
+	//我们需要同时签发本地server的certificate，用于后续的mTLS
+	changes = append(changes,
+		FileChange{Op: OpRemove, Path: localCertLocation},
+		FileChange{Op: OpRemove, Path: localKeyLocation})
+	if err := ca.applyLocal(changes); err != nil {
+		log.Print("persistent the root ca fail")
+		return WrapError(ErrInternal, "STORAGE_FAILED", err, "persist the self-signed root CA fail")
+	}
+	return nil
+}
+
+/*
+生成一张10年有效期的自签名根证书，返回把证书和私钥写到folder下的修改，由调用者决定怎么执行
+*/
+func (ca *CertificateAuthority) newRootCA(folder string, certFile string, keyFile string) ([]FileChange, *cx509.Certificate, *rsa.PrivateKey, error) {
 	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
 		log.Print("error happens when generate private key to create root CA")
-		return err
+		return nil, nil, nil, err
 	}
 
 	mathRand.Seed(time.Now().UnixNano())
@@ -126,36 +327,35 @@ func (ca *CertificateAuthority) makeRootCA() error {
 		NotAfter:              time.Now().AddDate(10, 0, 0),
 		IsCA:                  true,
 		BasicConstraintsValid: true,
+		KeyUsage:              cx509.KeyUsageCertSign | cx509.KeyUsageCRLSign,
 	}
 	buf, err := cx509.CreateCertificate(rand.Reader, &rootCertificateTemplate, &rootCertificateTemplate, &privateKey.PublicKey, privateKey)
 	if err != nil {
 		log.Print("sign the root ca fail")
-		return err
+		return nil, nil, nil, err
 	}
-	err = saveToPEM(buf, rootCAFolder, "root.crt", "CERTIFICATE")
+	cert, err := cx509.ParseCertificate(buf)
 	if err != nil {
-		log.Print("persistent the root ca fail")
-		return err
+		return nil, nil, nil, err
 	}
 
-	buf, err = pkcs8.MarshalPrivateKey(privateKey, nil, nil)
+	keyDER, err := pkcs8.MarshalPrivateKey(privateKey, ca.rootPassphrase, nil)
 	if err != nil {
 		log.Print("marshal ca private key fail")
-		return err
+		return nil, nil, nil, err
 	}
-	err = saveToPEM(buf, rootCAFolder, "root.private.key", "ENCRYPTED PRIVATE KEY")
-	if err != nil {
-		log.Print("persistent the root ca private key fail")
-		return err
+	changes := []FileChange{
+		{Op: OpWrite, Path: folder + "/" + certFile, Contents: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: buf}), Perm: 0644},
+		{Op: OpWrite, Path: folder + "/" + keyFile, Contents: pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: keyDER}), Perm: 0600},
 	}
-
-	return nil
+	return changes, cert, privateKey, nil
 }
 
 /*
-用CA自己的根证书，为自己签发一张证书，用于和客户端做mTLS
+用CA自己的根证书，为自己签发一张证书，用于和客户端做mTLS；返回写证书和私钥的修改
+根证书轮换进行中时，证书文件后面附上由旧根证书签名的新根证书，只信任旧根证书的客户端仍然可以验证它
 */
-func (ca *CertificateAuthority) signLocalCert() error {
+func (ca *CertificateAuthority) localCertChanges() ([]FileChange, error) {
 	csr := &CertificateSigningRequest{
 		SubjectCountry:            []string{"China"},
 		SubjectOrganization:       []string{"Fudan"},
@@ -169,114 +369,259 @@ func (ca *CertificateAuthority) signLocalCert() error {
 		IPAddresses:       []net.IP{[]uint8{0, 0, 0, 0}},
 	}
 
-	cert, err := ca.SignX509(csr)
+	//本地server的私钥不走一次性取回的流程，直接明文保存在 cert/localCert 下
+	issued, err := ca.issue(context.Background(), csr, time.Now().AddDate(1, 0, 0))
+	if err != nil {
+		return nil, err
+	}
+	keyBytes, err := marshalPrivateKey(issued.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: issued.Certificate.Raw})
+
+	ca.mu.RLock()
+	state := ca.rollover
+	ca.mu.RUnlock()
+	if state != nil && state.Phase == RolloverActive {
+		crossCert, err := os.ReadFile(ca.path(rolloverFolder + "/" + newByOldCertFile))
+		if err != nil {
+			return nil, err
+		}
+		certPEM = append(certPEM, crossCert...)
+	}
+
+	return []FileChange{
+		{Op: OpWrite, Path: localCertLocation, Contents: certPEM, Perm: 0644},
+		{Op: OpWrite, Path: localKeyLocation, Contents: pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes}), Perm: 0600},
+	}, nil
+}
+
+/*
+用根证书签署一个证书签发请求CSR。CSR是以我自己的Struct表达的
+每个阶段（keygen, template, sign, persist）都会作为ca.SignX509的子span记录下来
+*/
+func (ca *CertificateAuthority) SignX509(ctx context.Context, csr *CertificateSigningRequest) (*Certificate, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "ca.SignX509")
+	defer span.End()
+
+	if err := ca.limiter.allow(ctx); err != nil {
+		return nil, recordError(span, err)
+	}
+	profile, err := ProfileOf(csr)
+	if err != nil {
+		return nil, recordError(span, err)
+	}
+	release, err := ca.limiter.reserve(ctx)
+	if err != nil {
+		return nil, recordError(span, err)
+	}
+	defer release()
+	issued, err := ca.issue(ctx, csr, profile.notAfter(time.Now()))
 	if err != nil {
-		return err
+		return nil, recordError(span, err)
 	}
 
-	err = os.Rename(clientCAFolder+"/"+cert.ID+".crt", localCertLocation)
+	res, err := ca.persist(ctx, issued, true)
 	if err != nil {
-		log.Print("move local cert file fail")
-		return err
+		return nil, recordError(span, err)
 	}
-	err = os.Rename(clientCAFolder+"/"+cert.ID+".key", localKeyLocation)
+	span.SetAttributes(attribute.String("certificate.id", res.ID))
+	return res, nil
+}
+
+/*
+保存签发的证书，sealKey为true时加密保存私钥等申请者来取，否则私钥由调用者直接交给申请者
+*/
+func (ca *CertificateAuthority) persist(ctx context.Context, issued *IssuedCertificate, sealKey bool) (*Certificate, error) {
+	ctx, persistSpan := tracing.Tracer().Start(ctx, "ca.persist")
+	item, err := ca.prepare(ctx, issued, sealKey)
+	if err == nil {
+		err = ca.commit([]*pendingCertificate{item})
+	}
+	endSpan(persistSpan, err)
 	if err != nil {
-		log.Print("move local key file fail")
-		return err
+		log.Print("persistent generated certificate fail")
+		return nil, storageError(err, "persist the certificate fail")
 	}
+	return &item.Certificate, nil
+}
 
-	return nil
+/*
+签发一张有效期为validity的证书，证书和私钥只在内存中返回，不会写到磁盘上
+用于短期证书，例如通过Workload API下发的X.509-SVID
+*/
+func (ca *CertificateAuthority) IssueX509(ctx context.Context, csr *CertificateSigningRequest, validity time.Duration) (*IssuedCertificate, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "ca.IssueX509")
+	defer span.End()
+
+	issued, err := ca.issue(ctx, csr, time.Now().Add(validity))
+	if err != nil {
+		return nil, recordError(span, err)
+	}
+	return issued, nil
 }
 
 /*
-用根证书签署一个证书签发请求CSR。CSR是以我自己的Struct表达的
+生成私钥并签发证书，ctx中的span是调用者的span
 */
-func (ca *CertificateAuthority) SignX509(csr *CertificateSigningRequest) (*Certificate, error) {
+func (ca *CertificateAuthority) issue(ctx context.Context, csr *CertificateSigningRequest, notAfter time.Time) (*IssuedCertificate, error) {
+	profile, svid, err := ca.checkRequest(ctx, csr)
+	if err != nil {
+		return nil, err
+	}
 
-	csrPrivateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	//优先用私钥池中预先生成的私钥，现场生成RSA私钥很耗CPU，限制同时生成的个数
+	keygenCtx, keygenSpan := tracing.Tracer().Start(ctx, "ca.keygen")
+	keygenSpan.SetAttributes(attribute.String("key.algorithm", keyAlgorithm(csr.PublicKeyAlg).String()))
+	csrPrivateKey, pooled, err := ca.newKey(keygenCtx, csr.PublicKeyAlg)
+	keygenSpan.SetAttributes(attribute.Bool("key.pooled", pooled))
+	endSpan(keygenSpan, err)
 	if err != nil {
 		log.Print("error happens when generate private key to sign CSR")
 		return nil, err
 	}
 
-	cx509CSR := csr.toCX509CSR(csrPrivateKey)
+	_, templateSpan := tracing.Tracer().Start(ctx, "ca.template")
+	cx509CSR, err := csr.toCX509CSR(csrPrivateKey)
+	if err != nil {
+		endSpan(templateSpan, err)
+		return nil, WrapError(ErrInvalidArgument, "INVALID_CSR", err, "can't build certificate request")
+	}
+	endSpan(templateSpan, nil)
+
+	cert, err := ca.sign(ctx, cx509CSR, profile, svid, notAfter)
+	if err != nil {
+		return nil, err
+	}
+	return &IssuedCertificate{Certificate: cert, PrivateKey: csrPrivateKey}, nil
+}
+
+/*
+检查CSR、profile和SPIFFE ID，ctx中的span是调用者的span
+*/
+func (ca *CertificateAuthority) checkRequest(ctx context.Context, csr *CertificateSigningRequest) (Profile, *SPIFFEID, error) {
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.String("csr.subject.cn", csr.SubjectCommonName))
+
+	if _, issuerKey := ca.issuer(); issuerKey == nil {
+		return Profile{}, nil, NewError(ErrFailedPrecondition, "CA_NOT_READY", "root CA is not loaded")
+	}
+	if err := csr.Validate(); err != nil {
+		return Profile{}, nil, err
+	}
+	profile, err := ProfileOf(csr)
+	if err != nil {
+		return Profile{}, nil, err
+	}
+	span.SetAttributes(attribute.String("csr.profile", profile.Name))
+	svid, err := ca.checkSVID(csr)
+	if err != nil {
+		return Profile{}, nil, err
+	}
+	return profile, svid, nil
+}
+
+/*
+按x509 CSR中的subject、SANs和公钥签发证书
+*/
+func (ca *CertificateAuthority) sign(ctx context.Context, cx509CSR *cx509.CertificateRequest, profile Profile, svid *SPIFFEID, notAfter time.Time) (*cx509.Certificate, error) {
+	span := trace.SpanFromContext(ctx)
+	issuerCert, issuerKey := ca.issuer()
 
 	mathRand.Seed(time.Now().UnixNano())
 	cx509CertificateTemplate := cx509.Certificate{
 		Version:            cx509CSR.Version,
 		SerialNumber:       big.NewInt((int64)(mathRand.Int())),
 		Signature:          cx509CSR.Signature,
-		SignatureAlgorithm: cx509CSR.SignatureAlgorithm,
+		SignatureAlgorithm: ca.certificateSignatureAlgorithm(cx509CSR.SignatureAlgorithm),
 		PublicKey:          cx509CSR.PublicKey,
 		PublicKeyAlgorithm: cx509CSR.PublicKeyAlgorithm,
 		Subject:            cx509CSR.Subject,
+		RawSubject:         cx509CSR.RawSubject, //解析后的Subject不含ExtraNames，用原始的DER保留它们
 
 		URIs:           cx509CSR.URIs,
 		DNSNames:       cx509CSR.DNSNames,
 		EmailAddresses: cx509CSR.EmailAddresses,
 		IPAddresses:    cx509CSR.IPAddresses,
 
-		Extensions: cx509CSR.Extensions,
+		//x509只编码ExtraExtensions；CSR中的SANs等由CA决定的扩展不照搬
+		ExtraExtensions: requestedExtensions(cx509CSR.Extensions),
 
 		NotBefore:             time.Now(),
-		NotAfter:              time.Now().AddDate(1, 0, 0),
+		NotAfter:              notAfter,
 		BasicConstraintsValid: true,
 	}
-
-	buf, err := cx509.CreateCertificate(rand.Reader, &cx509CertificateTemplate, &ca.RootCA, cx509CSR.PublicKey, ca.PrivateKey)
-	if err != nil {
-		log.Print("sign the x509 csr fail")
-		return nil, err
+	if svid != nil {
+		//X.509-SVID 规范：叶子证书必须有digitalSignature，不能是CA
+		span.SetAttributes(attribute.String("spiffe.id", svid.String()))
+		cx509CertificateTemplate.KeyUsage = cx509.KeyUsageDigitalSignature
+		if _, ok := cx509CSR.PublicKey.(*rsa.PublicKey); ok {
+			cx509CertificateTemplate.KeyUsage |= cx509.KeyUsageKeyEncipherment
+		}
+		cx509CertificateTemplate.ExtKeyUsage = []cx509.ExtKeyUsage{cx509.ExtKeyUsageServerAuth, cx509.ExtKeyUsageClientAuth}
 	}
-	_, err = cx509.ParseCertificate(buf) //just to verify the generated byte[] is a qualified certification
-	if err != nil {
-		log.Print("verify the cx509 certificate fail")
-		return nil, err
+	if profile.ExtKeyUsage != nil {
+		cx509CertificateTemplate.ExtKeyUsage = profile.ExtKeyUsage
 	}
 
-	var fileNamePrefix string = time.Now().Format("2006-01-02_15-04-05")
-	err = saveToPEM(buf, clientCAFolder, fileNamePrefix+".crt", "CERTIFICATE")
+	_, signSpan := tracing.Tracer().Start(ctx, "ca.sign")
+	buf, err := cx509.CreateCertificate(rand.Reader, &cx509CertificateTemplate, issuerCert, cx509CSR.PublicKey, issuerKey)
 	if err != nil {
-		log.Print("persistent generated certificate file fail")
-		return nil, err
+		endSpan(signSpan, err)
+		log.Print("sign the x509 csr fail")
+		return nil, WrapError(ErrInternal, "SIGNING_FAILED", err, "sign the certificate fail")
 	}
-	err = saveToPEM(cx509.MarshalPKCS1PrivateKey(csrPrivateKey), clientCAFolder, fileNamePrefix+".key", "PRIVATE KEY")
+	cert, err := cx509.ParseCertificate(buf) //just to verify the generated byte[] is a qualified certification
+	endSpan(signSpan, err)
 	if err != nil {
-		log.Print("persistent generated private key file fail")
-		return nil, err
+		log.Print("verify the cx509 certificate fail")
+		return nil, WrapError(ErrInternal, "SIGNING_FAILED", err, "verify the signed certificate fail")
 	}
-
-	res := &Certificate{ID: fileNamePrefix}
-	return res, err
+	return cert, nil
 }
 
 /*
 return the generated client certificate file
 */
 func (ca *CertificateAuthority) GetCertFile(id string) ([]byte, error) {
-	contents, err := os.ReadFile(clientCAFolder + "/" + id + ".crt")
-	if err != nil {
-		return nil, err
-	}
-	return contents, nil
+	return ca.readClientFile(id, ".crt", "CERTIFICATE_NOT_FOUND")
 }
 
 /*
-return the generated client key file
+读取签发给客户端的文件，id 不能包含路径，否则可以借此读到根证书的私钥
 */
-func (ca *CertificateAuthority) GetKeyFile(id string) ([]byte, error) {
-	contents, err := os.ReadFile(clientCAFolder + "/" + id + ".key")
-	if err != nil {
+func (ca *CertificateAuthority) readClientFile(id string, suffix string, notFoundReason string) ([]byte, error) {
+	if err := validateCertificateId(id); err != nil {
 		return nil, err
 	}
+	contents, err := os.ReadFile(ca.path(clientCAFolder + "/" + id + suffix))
+	if os.IsNotExist(err) {
+		caErr := NewError(ErrNotFound, notFoundReason, "no file for certificate id %v", id)
+		caErr.Metadata = map[string]string{"certificateId": id}
+		return nil, caErr
+	}
+	if err != nil {
+		return nil, WrapError(ErrInternal, "STORAGE_FAILED", err, "read file fail")
+	}
 	return contents, nil
 }
 
+func validateCertificateId(id string) error {
+	if id == "" {
+		return InvalidArgument("INVALID_CERTIFICATE_ID", FieldViolation{Field: "Id", Description: "must not be empty"})
+	}
+	if strings.ContainsAny(id, "/\\") || strings.Contains(id, "..") {
+		return InvalidArgument("INVALID_CERTIFICATE_ID", FieldViolation{Field: "Id", Description: "must not contain path elements"})
+	}
+	return nil
+}
+
 /*
 把以我的Struct表述的 CSR 转化为 x509 package 定义的 CSR
 x509包支持的csr属性都在这里了，不支持的没有包含
 */
-func (csr *CertificateSigningRequest) toCX509CSR(signer crypto.Signer) *cx509.CertificateRequest {
+func (csr *CertificateSigningRequest) toCX509CSR(signer crypto.Signer) (*cx509.CertificateRequest, error) {
 	cx509CSR := &cx509.CertificateRequest{
 		SignatureAlgorithm: csr.SignatureAlgorithm,
 
@@ -285,7 +630,8 @@ func (csr *CertificateSigningRequest) toCX509CSR(signer crypto.Signer) *cx509.Ce
 		EmailAddresses: csr.EmailAddresses,
 		IPAddresses:    csr.IPAddresses,
 	}
-	for _, uri := range csr.URIs {
+	for i := range csr.URIs {
+		uri := csr.URIs[i] //不能直接取循环变量的地址，否则每个元素都指向最后一个URI
 		cx509CSR.URIs = append(cx509CSR.URIs, &uri)
 	}
 
@@ -297,9 +643,16 @@ func (csr *CertificateSigningRequest) toCX509CSR(signer crypto.Signer) *cx509.Ce
 	cx509CSR.Subject.Locality = csr.SubjectLocality
 	cx509CSR.Subject.Organization = csr.SubjectOrganization
 	cx509CSR.Subject.OrganizationalUnit = csr.SubjectOrganizationalUnit
+	cx509CSR.Subject.SerialNumber = csr.SubjectSerialNumber
+	for _, name := range csr.SubjectExtraNames {
+		cx509CSR.Subject.ExtraNames = append(cx509CSR.Subject.ExtraNames, pkix.AttributeTypeAndValue{
+			Type:  name.Type,
+			Value: name.Value,
+		})
+	}
 
 	for _, ex := range csr.Extensions {
-		cx509CSR.Extensions = append(cx509CSR.Extensions, pkix.Extension{
+		cx509CSR.ExtraExtensions = append(cx509CSR.ExtraExtensions, pkix.Extension{
 			Id:       ex.ID,
 			Critical: ex.Critical,
 			Value:    ex.Value,
@@ -309,29 +662,31 @@ func (csr *CertificateSigningRequest) toCX509CSR(signer crypto.Signer) *cx509.Ce
 	buf, err := cx509.CreateCertificateRequest(rand.Reader, cx509CSR, signer)
 	if err != nil {
 		log.Print("error when create csr")
-		return nil
+		return nil, err
 	}
 	cx509CSR, err = cx509.ParseCertificateRequest(buf)
 	if err != nil {
 		log.Print("error when parse x50 CSR")
-		return nil
+		return nil, err
 	}
 
-	return cx509CSR
+	return cx509CSR, nil
 }
 
 /*
-保存一个私钥或证书到PEM文件
+结束一个阶段的span，出错时在span上记录错误
 */
-func saveToPEM(bytes []byte, folder string, fileName string, fileType string) error {
-	file, err := os.Create(folder + "/" + fileName)
-	defer file.Close()
+func endSpan(span trace.Span, err error) {
+	recordError(span, err)
+	span.End()
+}
+
+func recordError(span trace.Span, err error) error {
 	if err != nil {
-		return err
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 	}
-
-	pemBlocks := &pem.Block{Bytes: bytes, Type: fileType}
-	return pem.Encode(file, pemBlocks)
+	return err
 }
 
 func checkFileExist(path string) bool {
@@ -0,0 +1,95 @@
+package ca
+
+import (
+	"context"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"testing"
+)
+
+func TestIssueExtensions(t *testing.T) {
+	custom := asn1.ObjectIdentifier{1, 2, 3, 4, 5}
+	tests := []struct {
+		name       string
+		extensions []Extension
+		wantErr    bool
+	}{
+		{name: "custom extension", extensions: []Extension{{ID: custom, Value: []byte{0x05, 0x00}}}},
+		{name: "critical custom extension", extensions: []Extension{{ID: custom, Critical: true, Value: []byte{0x05, 0x00}}}},
+		{name: "basicConstraints", extensions: []Extension{{ID: asn1.ObjectIdentifier{2, 5, 29, 19}, Value: []byte{0x30, 0x03, 0x01, 0x01, 0xff}}}, wantErr: true},
+		{name: "keyUsage", extensions: []Extension{{ID: asn1.ObjectIdentifier{2, 5, 29, 15}, Value: []byte{0x03, 0x02, 0x01, 0x06}}}, wantErr: true},
+		{name: "extKeyUsage", extensions: []Extension{{ID: asn1.ObjectIdentifier{2, 5, 29, 37}, Value: []byte{0x30, 0x00}}}, wantErr: true},
+		{name: "SAN override", extensions: []Extension{{ID: asn1.ObjectIdentifier{2, 5, 29, 17}, Value: []byte{0x30, 0x00}}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			csr := &CertificateSigningRequest{SubjectCommonName: "ext", DNSNames: []string{"ext.local"}, Extensions: tt.extensions}
+			issued, err := CA.IssueX509(context.Background(), csr, DefaultKeyTTL)
+			if tt.wantErr {
+				if CodeOf(err) != ErrInvalidArgument {
+					t.Fatalf("want InvalidArgument, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var found *pkix.Extension
+			for i, ex := range issued.Certificate.Extensions {
+				if ex.Id.Equal(custom) {
+					found = &issued.Certificate.Extensions[i]
+				}
+			}
+			if found == nil {
+				t.Fatalf("extension %v is missing from the certificate", custom)
+			}
+			if found.Critical != tt.extensions[0].Critical {
+				t.Errorf("critical = %v, want %v", found.Critical, tt.extensions[0].Critical)
+			}
+			if len(issued.Certificate.DNSNames) != 1 || issued.Certificate.DNSNames[0] != "ext.local" {
+				t.Errorf("DNSNames = %v", issued.Certificate.DNSNames)
+			}
+			if issued.Certificate.IsCA {
+				t.Error("leaf certificate must not be a CA")
+			}
+		})
+	}
+}
+
+/*
+设置口令之后，加载时把明文的根证书私钥改为加密保存；没有口令时加载不了
+口令在之后的测试中保留，它们加载的是加密的私钥
+*/
+func TestRootKeyEncryption(t *testing.T) {
+	CA.SetRootKeyPassphrase([]byte("test passphrase"))
+	if err := CA.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	_, encrypted, err := readRootKey(CA.path(rsaPrivateKeyLocation))
+	if err != nil || !encrypted {
+		t.Fatalf("root key encrypted = %v, %v", encrypted, err)
+	}
+
+	tests := []struct {
+		name       string
+		passphrase string
+		wantErr    bool
+	}{
+		{"right passphrase", "test passphrase", false},
+		{"wrong passphrase", "wrong", true},
+		{"no passphrase", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			other := New(CA.Dir())
+			other.SetRootKeyPassphrase([]byte(tt.passphrase))
+			_, key, err := other.loadCAKeyPair(rootCALocation, rsaPrivateKeyLocation)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("load: %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !key.Equal(CA.PrivateKey) {
+				t.Error("decrypted a different key")
+			}
+		})
+	}
+}
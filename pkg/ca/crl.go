@@ -0,0 +1,285 @@
+package ca
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	cx509 "crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const DefaultCRLValidity time.Duration = 24 * time.Hour
+
+var oidCRLReason = asn1.ObjectIdentifier{2, 5, 29, 21}
+
+/*
+RFC 5280 的 CRLReason，吊销时给出的原因不在其中时，CRL里不带原因
+*/
+var crlReasonCodes = map[string]int{
+	"unspecified":          0,
+	"keyCompromise":        1,
+	"cACompromise":         2,
+	"affiliationChanged":   3,
+	"superseded":           4,
+	"cessationOfOperation": 5,
+	"certificateHold":      6,
+	"privilegeWithdrawn":   9,
+	"aACompromise":         10,
+}
+
+/*
+CA签发的CRL
+*/
+type CRL struct {
+	DER        []byte
+	Number     *big.Int
+	ThisUpdate time.Time
+	NextUpdate time.Time
+	Entries    int
+}
+
+func (c *CRL) PEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: c.DER})
+}
+
+const (
+	crlFolder    string = storeFolder + "/crl"
+	crlStateFile string = crlFolder + "/state.json"
+)
+
+/*
+每个根证书最近一次生成的CRL，和CRL本身（crl/<根证书指纹>.crl）一起随存储复制
+CRL number 放在复制的状态中，只增不减，所有副本提供的是leader生成的同一份CRL
+*/
+type crlState struct {
+	Number  int64                `json:"number"`  //最近用过的CRL number，所有根证书共用
+	Issuers map[string]crlIssued `json:"issuers"` //key是签发CRL的根证书的sha256指纹
+}
+
+type crlIssued struct {
+	Number      int64         `json:"number"`
+	Revocations string        `json:"revocations"` //生成时吊销记录的摘要，有新的吊销时重新生成
+	Validity    time.Duration `json:"validity"`
+	ThisUpdate  time.Time     `json:"thisUpdate"`
+}
+
+/*
+可以签发CRL的根证书：当前签发证书的根证书，以及根证书轮换期间私钥还在的另一个根证书
+*/
+type crlSigner struct {
+	cert *cx509.Certificate
+	key  *rsa.PrivateKey
+}
+
+func (ca *CertificateAuthority) crlSigners() []crlSigner {
+	issuerCert, issuerKey := ca.issuer()
+	signers := []crlSigner{{issuerCert, issuerKey}}
+	ca.mu.RLock()
+	defer ca.mu.RUnlock()
+	if ca.rollover != nil && ca.rollover.otherKey != nil {
+		signers = append(signers, crlSigner{ca.rollover.otherRoot, ca.rollover.otherKey})
+	}
+	return signers
+}
+
+/*
+当前签发证书的根证书的CRL，包括它签发的、已经吊销但还没有过期的证书
+*/
+func (ca *CertificateAuthority) CRL(validity time.Duration) (*CRL, error) {
+	crls, err := ca.CRLs(validity)
+	if err != nil {
+		return nil, err
+	}
+	return crls[0], nil
+}
+
+/*
+每个还被信任的根证书各自签发的CRL，当前签发证书的根证书的在最前面
+根证书轮换之后，旧根证书签发的证书只出现在旧根证书的CRL中
+保存的CRL过了一半有效期、有新的吊销或者有效期不同时由leader重新生成；follower提供复制过来的CRL
+*/
+func (ca *CertificateAuthority) CRLs(validity time.Duration) ([]*CRL, error) {
+	if validity <= 0 {
+		validity = DefaultCRLValidity
+	}
+	ca.crlMu.Lock()
+	defer ca.crlMu.Unlock()
+
+	digest, err := ca.revocationsDigest()
+	if err != nil {
+		return nil, err
+	}
+	state, err := ca.loadCRLState()
+	if err != nil {
+		state = &crlState{}
+	}
+	next := crlState{Number: state.Number, Issuers: map[string]crlIssued{}}
+	now := time.Now()
+	var crls, stored []*CRL
+	var changes []FileChange
+	for _, signer := range ca.crlSigners() {
+		issuer := fingerprint(signer.cert)
+		issued, ok := state.Issuers[issuer]
+		last, _ := ca.loadCRLFile(issuer)
+		if last != nil {
+			stored = append(stored, last)
+		}
+		if ok && last != nil && issued.Revocations == digest && issued.Validity == validity && now.Before(issued.ThisUpdate.Add(validity/2)) {
+			crls = append(crls, last)
+			next.Issuers[issuer] = issued
+			continue
+		}
+
+		//第一次生成时从当前时间开始，和以前用时间做number的CRL相比也是递增的
+		if next.Number == 0 {
+			next.Number = now.UnixNano()
+		} else {
+			next.Number++
+		}
+		crl, err := ca.buildCRL(signer.cert, signer.key, big.NewInt(next.Number), now, validity)
+		if err != nil {
+			return nil, err
+		}
+		crls = append(crls, crl)
+		next.Issuers[issuer] = crlIssued{Number: next.Number, Revocations: digest, Validity: validity, ThisUpdate: crl.ThisUpdate}
+		changes = append(changes, FileChange{Op: OpWrite, Path: crlFolder + "/" + issuer + ".crl", Contents: crl.DER, Perm: 0644})
+	}
+	if len(changes) == 0 {
+		return crls, nil
+	}
+	//不再被信任的根证书的CRL不再提供
+	for issuer := range state.Issuers {
+		if _, ok := next.Issuers[issuer]; !ok {
+			changes = append(changes, FileChange{Op: OpRemove, Path: crlFolder + "/" + issuer + ".crl"})
+		}
+	}
+	contents, err := json.Marshal(next)
+	if err != nil {
+		return nil, WrapError(ErrInternal, "CRL_FAILED", err, "marshal the CRL state fail")
+	}
+	changes = append(changes, FileChange{Op: OpWrite, Path: crlStateFile, Contents: contents, Perm: 0644})
+	if err := ca.storage().Apply(changes); err != nil {
+		//follower不能生成新的CRL，复制过来的都还没有过期时先用它们
+		if len(stored) == len(crls) && unexpired(stored, now) {
+			return stored, nil
+		}
+		return nil, storageError(err, "persist the CRL fail")
+	}
+	return crls, nil
+}
+
+func unexpired(crls []*CRL, now time.Time) bool {
+	for _, crl := range crls {
+		if !now.Before(crl.NextUpdate) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+用issuer签发一份CRL，包括issuer签发的、已经吊销但还没有过期的证书
+*/
+func (ca *CertificateAuthority) buildCRL(issuerCert *cx509.Certificate, issuerKey *rsa.PrivateKey, number *big.Int, now time.Time, validity time.Duration) (*CRL, error) {
+	files, err := filepath.Glob(ca.path(clientCAFolder + "/*.revoked"))
+	if err != nil {
+		return nil, WrapError(ErrInternal, "STORAGE_FAILED", err, "list revocations fail")
+	}
+	var entries []pkix.RevokedCertificate
+	for _, file := range files {
+		id := strings.TrimSuffix(filepath.Base(file), ".revoked")
+		revocation, err := ca.GetRevocation(id)
+		if err != nil || revocation == nil {
+			continue
+		}
+		cert, err := ca.LoadCertificate(id)
+		if err != nil || now.After(cert.NotAfter) || cert.CheckSignatureFrom(issuerCert) != nil {
+			continue
+		}
+		entry := pkix.RevokedCertificate{SerialNumber: cert.SerialNumber, RevocationTime: revocation.RevokedAt.UTC()}
+		if code, ok := crlReasonCodes[revocation.Reason]; ok && code != 0 {
+			value, err := asn1.Marshal(asn1.Enumerated(code))
+			if err != nil {
+				return nil, WrapError(ErrInternal, "CRL_FAILED", err, "encode CRL reason fail")
+			}
+			entry.Extensions = []pkix.Extension{{Id: oidCRLReason, Value: value}}
+		}
+		entries = append(entries, entry)
+	}
+
+	//没有keyUsage扩展的根证书可以用于任何用途，包括签发CRL，但x509包要求明确给出
+	signer := issuerCert
+	if signer.KeyUsage == 0 {
+		copied := *issuerCert
+		copied.KeyUsage = cx509.KeyUsageCertSign | cx509.KeyUsageCRLSign
+		signer = &copied
+	}
+	crl := &CRL{Number: number, ThisUpdate: now.UTC(), NextUpdate: now.Add(validity).UTC(), Entries: len(entries)}
+	crl.DER, err = cx509.CreateRevocationList(rand.Reader, &cx509.RevocationList{
+		RevokedCertificates: entries,
+		Number:              crl.Number,
+		ThisUpdate:          crl.ThisUpdate,
+		NextUpdate:          crl.NextUpdate,
+	}, signer, issuerKey)
+	if err != nil {
+		return nil, WrapError(ErrInternal, "CRL_FAILED", err, "sign the CRL fail")
+	}
+	return crl, nil
+}
+
+func fingerprint(cert *cx509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+/*
+所有吊销记录的摘要，吊销记录只增不减，有新的吊销时摘要就会变化
+摘要随CRL的状态复制，只用文件名计算，和CA目录在哪里无关
+*/
+func (ca *CertificateAuthority) revocationsDigest() (string, error) {
+	files, err := filepath.Glob(ca.path(clientCAFolder + "/*.revoked"))
+	if err != nil {
+		return "", WrapError(ErrInternal, "STORAGE_FAILED", err, "list revocations fail")
+	}
+	names := make([]string, len(files))
+	for i, file := range files {
+		names[i] = clientCAFolder + "/" + filepath.Base(file)
+	}
+	sort.Strings(names)
+	sum := sha256.Sum256([]byte(strings.Join(names, "\n")))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (ca *CertificateAuthority) loadCRLState() (*crlState, error) {
+	contents, err := os.ReadFile(ca.path(crlStateFile))
+	if err != nil {
+		return nil, err
+	}
+	state := &crlState{}
+	if err := json.Unmarshal(contents, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func (ca *CertificateAuthority) loadCRLFile(issuer string) (*CRL, error) {
+	der, err := os.ReadFile(ca.path(crlFolder + "/" + issuer + ".crl"))
+	if err != nil {
+		return nil, err
+	}
+	list, err := cx509.ParseRevocationList(der)
+	if err != nil {
+		return nil, err
+	}
+	return &CRL{DER: der, Number: list.Number, ThisUpdate: list.ThisUpdate, NextUpdate: list.NextUpdate, Entries: len(list.RevokedCertificates)}, nil
+}
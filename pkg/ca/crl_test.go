@@ -0,0 +1,92 @@
+package ca
+
+import (
+	"context"
+	cx509 "crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/inspect"
+)
+
+func signForCRL(t *testing.T, name string, revoke bool) *cx509.Certificate {
+	cert, err := CA.SignX509(context.Background(), &CertificateSigningRequest{SubjectCommonName: name, DNSNames: []string{name + ".local"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	x509Cert, err := CA.LoadCertificate(cert.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revoke {
+		if _, err := CA.Revoke(context.Background(), cert.ID, "keyCompromise"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return x509Cert
+}
+
+/*
+吊销记录不变时沿用保存的CRL，有新的吊销时换一个更大的number；
+根证书轮换之后旧根证书签发的证书在旧根证书的CRL中
+*/
+func TestCRLs(t *testing.T) {
+	oldRevoked := signForCRL(t, "old-revoked", true)
+	first, err := CA.CRL(DefaultCRLValidity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := CA.CRL(DefaultCRLValidity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Number.Cmp(first.Number) != 0 {
+		t.Errorf("CRL regenerated without a new revocation: number %v -> %v", first.Number, again.Number)
+	}
+
+	if _, err := CA.PrepareRollover(time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	defer CA.RetireRollover(true)
+	if _, err := CA.ActivateRollover(true); err != nil {
+		t.Fatal(err)
+	}
+	newRevoked := signForCRL(t, "new-revoked", true)
+	crls, err := CA.CRLs(DefaultCRLValidity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(crls) != 2 {
+		t.Fatalf("%d CRLs during the rollover, want one per root", len(crls))
+	}
+	if crls[0].Number.Cmp(first.Number) <= 0 {
+		t.Errorf("CRL number %v doesn't increase from %v", crls[0].Number, first.Number)
+	}
+
+	roots := CA.CurrentTrustBundle().CertPool()
+	both := [][]byte{crls[0].DER, crls[1].DER}
+	tests := []struct {
+		name       string
+		cert       *cx509.Certificate
+		crls       [][]byte
+		now        time.Time
+		wantStatus string
+	}{
+		{"issued by the new root", newRevoked, both, time.Time{}, inspect.VerifyRevoked},
+		{"issued by the old root", oldRevoked, both, time.Time{}, inspect.VerifyRevoked},
+		{"old root without its CRL", oldRevoked, both[:1], time.Time{}, inspect.VerifyUnknown},
+		{"expired CRL", newRevoked, both, time.Now().Add(2 * DefaultCRLValidity), inspect.VerifyUnknown},
+		{"not revoked", signForCRL(t, "valid", false), both, time.Time{}, inspect.VerifyValid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := inspect.Verify(tt.cert, inspect.VerifyOptions{Roots: roots, CRLs: tt.crls, Now: tt.now})
+			if result.Status != tt.wantStatus {
+				t.Errorf("status = %v (%v), want %v", result.Status, result.Error, tt.wantStatus)
+			}
+			if tt.wantStatus == inspect.VerifyRevoked && result.Reason != "keyCompromise" {
+				t.Errorf("reason = %q, want keyCompromise", result.Reason)
+			}
+		})
+	}
+}
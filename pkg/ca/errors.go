@@ -0,0 +1,117 @@
+package ca
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+/*
+CA 对外暴露的错误分类，gRPC 和 HTTP 层分别把它映射为 status code 和 http status
+*/
+type ErrorCode int
+
+const (
+	ErrInternal ErrorCode = iota
+	ErrInvalidArgument
+	ErrNotFound
+	ErrAlreadyExists
+	ErrPermissionDenied
+	ErrUnauthenticated
+	ErrFailedPrecondition
+	ErrResourceExhausted
+	ErrUnavailable
+)
+
+var errorCodeNames = map[ErrorCode]string{
+	ErrInternal:           "INTERNAL",
+	ErrInvalidArgument:    "INVALID_ARGUMENT",
+	ErrNotFound:           "NOT_FOUND",
+	ErrAlreadyExists:      "ALREADY_EXISTS",
+	ErrPermissionDenied:   "PERMISSION_DENIED",
+	ErrUnauthenticated:    "UNAUTHENTICATED",
+	ErrFailedPrecondition: "FAILED_PRECONDITION",
+	ErrResourceExhausted:  "RESOURCE_EXHAUSTED",
+	ErrUnavailable:        "UNAVAILABLE",
+}
+
+func (c ErrorCode) String() string {
+	if name, ok := errorCodeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("ErrorCode(%d)", int(c))
+}
+
+// 错误的domain，对应 google.rpc.ErrorInfo 的 domain
+const ErrorDomain string = "ca.sidecar.jackyzhangfudan.github.com"
+
+/*
+描述请求中某一个字段的错误，对应 google.rpc.BadRequest.FieldViolation
+*/
+type FieldViolation struct {
+	Field       string `json:"name"`
+	Description string `json:"reason"`
+}
+
+/*
+CA 的错误类型
+Reason 是机器可读的原因，如 CERTIFICATE_NOT_FOUND；Message 是给人看的描述
+*/
+type Error struct {
+	Code       ErrorCode
+	Reason     string
+	Message    string
+	Violations []FieldViolation
+	Metadata   map[string]string
+	RetryAfter time.Duration //被限流时客户端可以在多久之后重试，为0时不提示
+	Err        error         //底层错误，不会暴露给调用方
+}
+
+func (e *Error) Error() string {
+	msg := e.Message
+	if len(e.Violations) > 0 {
+		fields := make([]string, 0, len(e.Violations))
+		for _, v := range e.Violations {
+			fields = append(fields, v.Field+": "+v.Description)
+		}
+		msg = msg + " (" + strings.Join(fields, "; ") + ")"
+	}
+	if e.Err != nil {
+		msg = msg + ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func NewError(code ErrorCode, reason string, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Reason: reason, Message: fmt.Sprintf(format, args...)}
+}
+
+/*
+包装一个底层错误，底层错误只用于日志，不会返回给调用方
+*/
+func WrapError(code ErrorCode, reason string, err error, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Reason: reason, Message: fmt.Sprintf(format, args...), Err: err}
+}
+
+/*
+请求参数错误，每个出错的字段对应一条 violation
+*/
+func InvalidArgument(reason string, violations ...FieldViolation) *Error {
+	return &Error{Code: ErrInvalidArgument, Reason: reason, Message: "invalid request", Violations: violations}
+}
+
+/*
+返回err对应的 ErrorCode，不是 *Error 的都算作 ErrInternal
+*/
+func CodeOf(err error) ErrorCode {
+	var caErr *Error
+	if errors.As(err, &caErr) {
+		return caErr.Code
+	}
+	return ErrInternal
+}
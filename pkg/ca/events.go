@@ -0,0 +1,112 @@
+package ca
+
+import (
+	cx509 "crypto/x509"
+	"log"
+	"sync"
+	"time"
+)
+
+type EventType int
+
+const (
+	EventIssued EventType = iota
+	EventRevoked
+	EventTrustBundleChanged
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventIssued:
+		return "issued"
+	case EventRevoked:
+		return "revoked"
+	case EventTrustBundleChanged:
+		return "trust-bundle-changed"
+	}
+	return "unknown"
+}
+
+/*
+证书生命周期中的事件，Identity 见 IdentityOf
+*/
+type Event struct {
+	Type          EventType
+	CertificateID string
+	Identity      string
+	Reason        string
+	RenewalOf     string //通过RenewX509续签时是旧证书的ID
+	Owner         string //签发时的申请者，匿名申请时为空
+	Time          time.Time
+}
+
+const subscriberBuffer int = 64
+
+type eventHub struct {
+	mu          sync.Mutex
+	nextID      int
+	subscribers map[int]chan Event
+}
+
+/*
+订阅CA的事件，返回的函数用于取消订阅，取消后channel会被关闭
+订阅者处理太慢时，事件会被丢弃
+*/
+func (ca *CertificateAuthority) Subscribe() (<-chan Event, func()) {
+	hub := &ca.events
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	if hub.subscribers == nil {
+		hub.subscribers = map[int]chan Event{}
+	}
+	id := hub.nextID
+	hub.nextID++
+	ch := make(chan Event, subscriberBuffer)
+	hub.subscribers[id] = ch
+
+	return ch, func() {
+		hub.mu.Lock()
+		defer hub.mu.Unlock()
+		if _, ok := hub.subscribers[id]; ok {
+			delete(hub.subscribers, id)
+			close(ch)
+		}
+	}
+}
+
+func (ca *CertificateAuthority) publish(e Event) {
+	hub := &ca.events
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	for _, ch := range hub.subscribers {
+		select {
+		case ch <- e:
+		default:
+			log.Printf("drop %v event of certificate %v, subscriber is too slow", e.Type, e.CertificateID)
+		}
+	}
+}
+
+/*
+证书代表的身份：有SPIFFE ID的用SPIFFE ID，否则用subject的CN，再没有就用第一个DNS name
+同一个身份的新证书被视为对旧证书的续签
+*/
+func IdentityOf(cert *cx509.Certificate) string {
+	for _, uri := range cert.URIs {
+		if uri.Scheme == spiffeScheme {
+			return uri.String()
+		}
+	}
+	if cert.Subject.CommonName != "" {
+		return "cn:" + cert.Subject.CommonName
+	}
+	if len(cert.DNSNames) > 0 {
+		return "dns:" + cert.DNSNames[0]
+	}
+	return ""
+}
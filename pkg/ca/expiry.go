@@ -0,0 +1,296 @@
+package ca
+
+import (
+	"context"
+	cx509 "crypto/x509"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	KindRoot         string = "root"
+	KindIntermediate string = "intermediate"
+	KindLocal        string = "local"
+	KindLeaf         string = "leaf"
+)
+
+const expiryStateFile string = storeFolder + "/expiry.json"
+
+/*
+默认在证书到期前30天、7天、1天各通知一次
+*/
+var DefaultExpiryThresholds = []time.Duration{30 * 24 * time.Hour, 7 * 24 * time.Hour, 24 * time.Hour}
+
+/*
+一张快要到期的证书，ID只有签发的证书（leaf）才有
+*/
+type ExpiringCertificate struct {
+	Kind         string    `json:"kind"`
+	ID           string    `json:"id,omitempty"`
+	Subject      string    `json:"subject"`
+	Identity     string    `json:"identity,omitempty"`
+	SerialNumber string    `json:"serialNumber"` //十六进制
+	NotBefore    time.Time `json:"notBefore"`
+	NotAfter     time.Time `json:"notAfter"`
+}
+
+func expiringCertificate(kind string, id string, cert *cx509.Certificate) *ExpiringCertificate {
+	return &ExpiringCertificate{
+		Kind:         kind,
+		ID:           id,
+		Subject:      cert.Subject.String(),
+		Identity:     IdentityOf(cert),
+		SerialNumber: cert.SerialNumber.Text(16),
+		NotBefore:    cert.NotBefore,
+		NotAfter:     cert.NotAfter,
+	}
+}
+
+/*
+within之内到期的证书，按到期时间排序
+根证书、交叉签名的证书和本地server的证书已经过期的也列出来；签发的证书只列出没有过期、没有吊销的
+*/
+func (ca *CertificateAuthority) ExpiringCertificates(within time.Duration) ([]*ExpiringCertificate, error) {
+	if within <= 0 {
+		return nil, InvalidArgument("INVALID_WITHIN", FieldViolation{Field: "Within", Description: "must be positive"})
+	}
+	deadline := time.Now().Add(within)
+	var result []*ExpiringCertificate
+	for _, root := range ca.trustedRoots() {
+		if !root.NotAfter.After(deadline) {
+			result = append(result, expiringCertificate(KindRoot, "", root))
+		}
+	}
+	for _, cross := range ca.intermediates() {
+		if !cross.NotAfter.After(deadline) {
+			result = append(result, expiringCertificate(KindIntermediate, "", cross))
+		}
+	}
+	if local, err := loadCertificateFile(ca.path(localCertLocation)); err == nil && !local.NotAfter.After(deadline) {
+		result = append(result, expiringCertificate(KindLocal, "", local))
+	}
+
+	infos, err := ca.ListCertificates(ListOptions{Status: StatusValid})
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		if info.NotAfter.After(deadline) {
+			continue
+		}
+		result = append(result, &ExpiringCertificate{
+			Kind:         KindLeaf,
+			ID:           info.ID,
+			Subject:      "CN=" + info.CommonName,
+			Identity:     info.Identity,
+			SerialNumber: info.SerialNumber,
+			NotBefore:    info.NotBefore,
+			NotAfter:     info.NotAfter,
+		})
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].NotAfter.Before(result[j].NotAfter) })
+	return result, nil
+}
+
+/*
+一张证书越过了一个通知阈值，Remaining小于等于0表示已经过期
+*/
+type ExpiryNotice struct {
+	Certificate *ExpiringCertificate `json:"certificate"`
+	Threshold   time.Duration        `json:"threshold"`
+	Remaining   time.Duration        `json:"remaining"`
+}
+
+/*
+一次扫描的结果：Notices是这个通知渠道还没有通知过的，Expiring是最大阈值之内到期的全部证书
+*/
+type ExpiryReport struct {
+	Time     time.Time              `json:"time"`
+	Notices  []*ExpiryNotice        `json:"notices"`
+	Expiring []*ExpiringCertificate `json:"expiring"`
+}
+
+/*
+证书到期的通知渠道，见 pkg/notify
+每次扫描都会调用Notify，没有新的Notices时也会调用（例如给metrics更新数据）
+返回错误时这次的Notices下次扫描再发
+*/
+type ExpiryNotifier interface {
+	Name() string
+	Notify(ctx context.Context, report *ExpiryReport) error
+}
+
+type ExpiryOptions struct {
+	Thresholds []time.Duration //到期前多久通知，每个阈值通知一次
+	Interval   time.Duration   //多久扫描一次
+	Timeout    time.Duration   //一次扫描（包括发送通知）的超时，默认 DefaultExpiryScanTimeout，不超过Interval
+	Notifiers  []ExpiryNotifier
+}
+
+const DefaultExpiryScanTimeout time.Duration = 5 * time.Minute
+
+/*
+每个通知渠道对每张证书已经通知到的最小阈值，保存在 cert/expiry.json，多副本时随存储复制，换了leader也不会重复通知
+*/
+type expiryState map[string]map[string]time.Duration
+
+func expiryKey(cert *ExpiringCertificate) string {
+	return cert.Kind + "/" + cert.SerialNumber
+}
+
+func (ca *CertificateAuthority) loadExpiryState() (expiryState, error) {
+	state := expiryState{}
+	contents, err := os.ReadFile(ca.path(expiryStateFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(contents, &state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+/*
+启动时扫描一次，之后每隔Interval扫描，直到stopCh关闭；多副本时只有leader扫描
+每次扫描有超时，通知渠道不响应时不会卡住后面的扫描；stopCh关闭时正在进行的扫描也被取消
+*/
+func (ca *CertificateAuthority) RunExpiryScanner(opts ExpiryOptions, stopCh <-chan struct{}) {
+	if len(opts.Thresholds) == 0 || len(opts.Notifiers) == 0 {
+		return
+	}
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = DefaultExpiryScanTimeout
+	}
+	if timeout > opts.Interval {
+		timeout = opts.Interval
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+	for {
+		if ca.IsLeader() {
+			scanCtx, cancelScan := context.WithTimeout(ctx, timeout)
+			if err := ca.ScanExpiry(scanCtx, opts); err != nil {
+				log.Printf("scan expiring certificates fail: %v", err)
+			}
+			cancelScan()
+		}
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+/*
+扫描一次快要到期的证书，把每个渠道没有通知过的阈值发给它
+*/
+func (ca *CertificateAuthority) ScanExpiry(ctx context.Context, opts ExpiryOptions) error {
+	thresholds := append([]time.Duration(nil), opts.Thresholds...)
+	sort.Slice(thresholds, func(i, j int) bool { return thresholds[i] < thresholds[j] })
+	expiring, err := ca.ExpiringCertificates(thresholds[len(thresholds)-1])
+	if err != nil {
+		return err
+	}
+	state, err := ca.loadExpiryState()
+	if err != nil {
+		return WrapError(ErrInternal, "STORAGE_FAILED", err, "load the expiry notification state fail")
+	}
+
+	now := time.Now()
+	changed := false
+	for _, notifier := range opts.Notifiers {
+		notified := state[notifier.Name()]
+		report := &ExpiryReport{Time: now, Expiring: expiring}
+		next := map[string]time.Duration{}
+		for _, cert := range expiring {
+			key := expiryKey(cert)
+			remaining := cert.NotAfter.Sub(now)
+			threshold, ok := crossedThreshold(thresholds, cert, remaining)
+			if !ok {
+				continue
+			}
+			if last, done := notified[key]; done && last <= threshold {
+				next[key] = last
+				continue
+			}
+			report.Notices = append(report.Notices, &ExpiryNotice{Certificate: cert, Threshold: threshold, Remaining: remaining})
+			next[key] = threshold
+		}
+		if err := notifier.Notify(ctx, report); err != nil {
+			log.Printf("send expiry notifications to %v fail: %v", notifier.Name(), err)
+			//没有发出去的通知不记录，下次扫描再发
+			for _, notice := range report.Notices {
+				key := expiryKey(notice.Certificate)
+				if last, done := notified[key]; done {
+					next[key] = last
+				} else {
+					delete(next, key)
+				}
+			}
+		}
+		//不再快要到期（续期、吊销或者过期）的证书不用再记着
+		if !sameExpiryState(notified, next) {
+			changed = true
+		}
+		if len(next) == 0 {
+			delete(state, notifier.Name())
+		} else {
+			state[notifier.Name()] = next
+		}
+	}
+	if !changed {
+		return nil
+	}
+	contents, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := ca.storage().Apply([]FileChange{{Op: OpWrite, Path: expiryStateFile, Contents: contents, Perm: 0644}}); err != nil {
+		return storageError(err, "persist the expiry notification state fail")
+	}
+	return nil
+}
+
+/*
+剩余时间越过的最小阈值；有效期本来就比阈值短的证书（例如短期的SVID）不按这个阈值通知
+*/
+func crossedThreshold(thresholds []time.Duration, cert *ExpiringCertificate, remaining time.Duration) (time.Duration, bool) {
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	for _, threshold := range thresholds {
+		if remaining <= threshold && threshold < lifetime {
+			return threshold, true
+		}
+	}
+	return 0, false
+}
+
+func sameExpiryState(a map[string]time.Duration, b map[string]time.Duration) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if other, ok := b[key]; !ok || other != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,165 @@
+package ca
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	cx509 "crypto/x509"
+	"encoding/pem"
+
+	"github.com/youmark/pkcs8"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+/*
+证书导出的格式
+*/
+type ExportFormat string
+
+const (
+	ExportPEM          ExportFormat = "pem"           //只有证书本身
+	ExportFullchain    ExportFormat = "fullchain"     //证书和它的中间证书，nginx用的fullchain.pem
+	ExportDER          ExportFormat = "der"           //证书本身，DER编码
+	ExportPKCS12       ExportFormat = "pkcs12"        //证书、私钥和证书链，AES-256加密，Java 11+、.NET Core、OpenSSL 3 都可以读
+	ExportPKCS12Legacy ExportFormat = "pkcs12-legacy" //同上，用3DES加密，给Java 8和Windows上的老程序用
+	ExportTruststore   ExportFormat = "truststore"    //只有trust bundle中的根证书，可以直接作为Java的trustStore（storetype PKCS12）
+	ExportPKCS8        ExportFormat = "pkcs8"         //PKCS#8私钥，给了密码就加密
+)
+
+var ExportFormats = []ExportFormat{ExportPEM, ExportFullchain, ExportDER, ExportPKCS12, ExportPKCS12Legacy, ExportTruststore, ExportPKCS8}
+
+type ExportOptions struct {
+	Format    ExportFormat
+	Password  string //pkcs12、pkcs12-legacy、truststore必须给出；pkcs8可选
+	KeySecret string //签发时返回的key secret，需要私钥的格式（pkcs12、pkcs12-legacy、pkcs8）要用它解密私钥
+}
+
+type Export struct {
+	Format      ExportFormat
+	Contents    []byte
+	ContentType string
+	FileName    string //建议的文件名
+}
+
+/*
+以指定的格式导出一张签发过的证书
+需要私钥的格式会取走CA生成的私钥，和FetchKey一样只能由申请者做一次
+*/
+func (ca *CertificateAuthority) ExportCertificate(ctx context.Context, id string, opts ExportOptions) (*Export, error) {
+	cert, err := ca.LoadCertificate(id)
+	if err != nil {
+		return nil, err
+	}
+	result := &Export{Format: opts.Format}
+
+	switch opts.Format {
+	case ExportPEM, "":
+		result.Format = ExportPEM
+		result.Contents = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+		result.ContentType, result.FileName = "application/x-pem-file", id+".crt"
+	case ExportFullchain:
+		result.Contents = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+		for _, chainCert := range ca.ChainOf(cert) {
+			result.Contents = append(result.Contents, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: chainCert.Raw})...)
+		}
+		result.ContentType, result.FileName = "application/x-pem-file", id+".fullchain.pem"
+	case ExportDER:
+		result.Contents = cert.Raw
+		result.ContentType, result.FileName = "application/pkix-cert", id+".der"
+	case ExportPKCS12, ExportPKCS12Legacy:
+		if opts.Password == "" {
+			return nil, InvalidArgument("PASSWORD_REQUIRED", FieldViolation{Field: "Password", Description: "is required by " + string(opts.Format)})
+		}
+		key, err := ca.OpenKey(ctx, id, opts.KeySecret)
+		if err != nil {
+			return nil, err
+		}
+		encoder := pkcs12.Modern2023
+		if opts.Format == ExportPKCS12Legacy {
+			encoder = pkcs12.LegacyDES
+		}
+		//Java的keystore要求证书链一直到根证书
+		caCerts := append(ca.ChainOf(cert), ca.rootOf(cert)...)
+		result.Contents, err = encoder.Encode(key, cert, caCerts, opts.Password)
+		if err != nil {
+			return nil, WrapError(ErrInternal, "EXPORT_FAILED", err, "encode PKCS#12 fail")
+		}
+		result.ContentType, result.FileName = "application/x-pkcs12", id+".p12"
+	case ExportTruststore:
+		if opts.Password == "" {
+			return nil, InvalidArgument("PASSWORD_REQUIRED", FieldViolation{Field: "Password", Description: "is required by " + string(opts.Format)})
+		}
+		result.Contents, err = pkcs12.Modern2023.EncodeTrustStore(ca.CurrentTrustBundle().Roots, opts.Password)
+		if err != nil {
+			return nil, WrapError(ErrInternal, "EXPORT_FAILED", err, "encode PKCS#12 trust store fail")
+		}
+		result.ContentType, result.FileName = "application/x-pkcs12", "truststore.p12"
+	case ExportPKCS8:
+		key, err := ca.OpenKey(ctx, id, opts.KeySecret)
+		if err != nil {
+			return nil, err
+		}
+		blockType := "PRIVATE KEY"
+		var password []byte
+		if opts.Password != "" {
+			blockType, password = "ENCRYPTED PRIVATE KEY", []byte(opts.Password)
+		}
+		//不给密码时pkcs8包输出的就是普通的PKCS#8
+		der, err := pkcs8.MarshalPrivateKey(key, password, nil)
+		if err != nil {
+			return nil, WrapError(ErrInternal, "EXPORT_FAILED", err, "encode PKCS#8 private key fail")
+		}
+		result.Contents = pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+		result.ContentType, result.FileName = "application/x-pem-file", id+".pk8.pem"
+	default:
+		return nil, InvalidArgument("UNKNOWN_EXPORT_FORMAT", FieldViolation{Field: "Format", Description: "must be one of pem, fullchain, der, pkcs12, pkcs12-legacy, truststore or pkcs8"})
+	}
+	return result, nil
+}
+
+func parsePrivateKey(der []byte) (crypto.Signer, error) {
+	if key, err := cx509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	key, err := cx509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case *ecdsa.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	}
+	return nil, NewError(ErrInternal, "CORRUPTED_KEY", "unsupported private key type %T", key)
+}
+
+/*
+证书的中间证书，不包括根证书。我们直接用根证书签发，只有在根证书轮换期间，
+才会带上把签发它的根证书链到另一张根证书的交叉签名证书
+*/
+func (ca *CertificateAuthority) ChainOf(cert *cx509.Certificate) []*cx509.Certificate {
+	var chain []*cx509.Certificate
+	for _, intermediate := range ca.intermediates() {
+		if cert.CheckSignatureFrom(intermediate) == nil {
+			chain = append(chain, intermediate)
+		}
+	}
+	return chain
+}
+
+/*
+签发这张证书的根证书
+*/
+func (ca *CertificateAuthority) rootOf(cert *cx509.Certificate) []*cx509.Certificate {
+	for _, root := range ca.trustedRoots() {
+		if cert.CheckSignatureFrom(root) == nil {
+			return []*cx509.Certificate{root}
+		}
+	}
+	return nil
+}
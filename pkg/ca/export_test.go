@@ -0,0 +1,105 @@
+package ca
+
+import (
+	"crypto"
+	cx509 "crypto/x509"
+	"encoding/pem"
+	"reflect"
+	"testing"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+func TestExportCertificate(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      ExportOptions
+		wantErr   bool
+		code      ErrorCode
+		keyOpened bool
+	}{
+		{name: "default is pem", opts: ExportOptions{}},
+		{name: "pem", opts: ExportOptions{Format: ExportPEM}},
+		{name: "fullchain", opts: ExportOptions{Format: ExportFullchain}},
+		{name: "der", opts: ExportOptions{Format: ExportDER}},
+		{name: "truststore", opts: ExportOptions{Format: ExportTruststore, Password: "changeit"}},
+		{name: "truststore without a password", opts: ExportOptions{Format: ExportTruststore}, wantErr: true, code: ErrInvalidArgument},
+		{name: "pkcs12 without a password", opts: ExportOptions{Format: ExportPKCS12}, wantErr: true, code: ErrInvalidArgument},
+		{name: "pkcs12", opts: ExportOptions{Format: ExportPKCS12, Password: "changeit"}, keyOpened: true},
+		{name: "pkcs12 legacy", opts: ExportOptions{Format: ExportPKCS12Legacy, Password: "changeit"}, keyOpened: true},
+		{name: "pkcs8", opts: ExportOptions{Format: ExportPKCS8}, keyOpened: true},
+		{name: "pkcs8 with a wrong key secret", opts: ExportOptions{Format: ExportPKCS8, KeySecret: "wrong"}, wantErr: true, code: ErrPermissionDenied},
+		{name: "unknown format", opts: ExportOptions{Format: "jks"}, wantErr: true, code: ErrInvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert := signOwned(t, "alice")
+			issued, err := CA.LoadCertificate(cert.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts := tt.opts
+			if opts.KeySecret == "" {
+				opts.KeySecret = cert.KeySecret
+			}
+			export, err := CA.ExportCertificate(callerContext("alice"), cert.ID, opts)
+			if (err != nil) != tt.wantErr || (tt.wantErr && CodeOf(err) != tt.code) {
+				t.Fatalf("ExportCertificate() error = %v, want code %v", err, tt.code)
+			}
+			//导出失败或者不需要私钥时，私钥仍然留在CA上
+			_, fetchErr := CA.FetchKey(callerContext("alice"), cert.ID)
+			if opened := CodeOf(fetchErr) == ErrNotFound; opened != tt.keyOpened {
+				t.Errorf("key taken = %v, want %v", opened, tt.keyOpened)
+			}
+			if err != nil {
+				return
+			}
+
+			switch export.Format {
+			case ExportPEM, ExportFullchain:
+				block, _ := pem.Decode(export.Contents)
+				if block == nil || !reflect.DeepEqual(block.Bytes, issued.Raw) {
+					t.Error("the first PEM block isn't the certificate")
+				}
+			case ExportDER:
+				if !reflect.DeepEqual(export.Contents, issued.Raw) {
+					t.Error("DER isn't the certificate")
+				}
+			case ExportTruststore:
+				roots, err := pkcs12.DecodeTrustStore(export.Contents, opts.Password)
+				if err != nil || len(roots) == 0 {
+					t.Errorf("decode trust store: %d roots, %v", len(roots), err)
+				}
+			case ExportPKCS12, ExportPKCS12Legacy:
+				key, leaf, _, err := pkcs12.DecodeChain(export.Contents, opts.Password)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(leaf.Raw, issued.Raw) || !samePublicKey(key, issued) {
+					t.Error("the PKCS#12 doesn't hold the certificate and its key")
+				}
+			case ExportPKCS8:
+				block, _ := pem.Decode(export.Contents)
+				if block == nil || block.Type != "PRIVATE KEY" {
+					t.Fatal("not a PKCS#8 PEM")
+				}
+				key, err := cx509.ParsePKCS8PrivateKey(block.Bytes)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !samePublicKey(key, issued) {
+					t.Error("the PKCS#8 key doesn't match the certificate")
+				}
+			}
+		})
+	}
+}
+
+func samePublicKey(key interface{}, cert *cx509.Certificate) bool {
+	signer, ok := key.(interface{ Public() crypto.PublicKey })
+	if !ok {
+		return false
+	}
+	pub, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+	return ok && pub.Equal(cert.PublicKey)
+}
@@ -0,0 +1,128 @@
+package ca
+
+import (
+	cx509 "crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	StatusValid   string = "valid"
+	StatusExpired string = "expired"
+	StatusRevoked string = "revoked"
+)
+
+/*
+一张签发过的证书的概要，用于列表和查询
+*/
+type CertificateInfo struct {
+	ID           string      `json:"id"`
+	CommonName   string      `json:"commonName"`
+	Identity     string      `json:"identity"`
+	Profile      string      `json:"profile"`
+	SerialNumber string      `json:"serialNumber"` //十六进制
+	Issuer       string      `json:"issuer"`
+	SANs         []string    `json:"sans,omitempty"`
+	NotBefore    time.Time   `json:"notBefore"`
+	NotAfter     time.Time   `json:"notAfter"`
+	Status       string      `json:"status"`
+	Revocation   *Revocation `json:"revocation,omitempty"`
+}
+
+type ListOptions struct {
+	Status   string //valid、expired或revoked，为空时列出全部
+	Identity string //只列出这个身份（SPIFFE ID或subject CN）的证书
+}
+
+func describe(id string, cert *cx509.Certificate, revocation *Revocation, now time.Time) *CertificateInfo {
+	info := &CertificateInfo{
+		ID:           id,
+		CommonName:   cert.Subject.CommonName,
+		Identity:     IdentityOf(cert),
+		Profile:      ProfileOfCertificate(cert),
+		SerialNumber: cert.SerialNumber.Text(16),
+		Issuer:       cert.Issuer.CommonName,
+		NotBefore:    cert.NotBefore,
+		NotAfter:     cert.NotAfter,
+		Status:       StatusValid,
+		Revocation:   revocation,
+	}
+	info.SANs = append(info.SANs, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		info.SANs = append(info.SANs, ip.String())
+	}
+	info.SANs = append(info.SANs, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		info.SANs = append(info.SANs, uri.String())
+	}
+	switch {
+	case revocation != nil:
+		info.Status = StatusRevoked
+	case now.After(cert.NotAfter):
+		info.Status = StatusExpired
+	}
+	return info
+}
+
+/*
+一张证书的概要和吊销状态
+*/
+func (ca *CertificateAuthority) DescribeCertificate(id string) (*CertificateInfo, error) {
+	cert, err := ca.LoadCertificate(id)
+	if err != nil {
+		return nil, err
+	}
+	revocation, err := ca.GetRevocation(id)
+	if err != nil {
+		return nil, err
+	}
+	return describe(id, cert, revocation, time.Now()), nil
+}
+
+/*
+列出签发过的证书，按签发时间排序
+*/
+func (ca *CertificateAuthority) ListCertificates(opts ListOptions) ([]*CertificateInfo, error) {
+	switch opts.Status {
+	case "", StatusValid, StatusExpired, StatusRevoked:
+	default:
+		return nil, InvalidArgument("INVALID_STATUS", FieldViolation{Field: "Status", Description: "must be valid, expired or revoked"})
+	}
+	files, err := filepath.Glob(ca.path(clientCAFolder + "/*.crt"))
+	if err != nil {
+		return nil, WrapError(ErrInternal, "STORAGE_FAILED", err, "list certificates fail")
+	}
+	sort.Strings(files)
+
+	now := time.Now()
+	var result []*CertificateInfo
+	for _, file := range files {
+		id := strings.TrimSuffix(filepath.Base(file), ".crt")
+		contents, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		block, _ := pem.Decode(contents)
+		if block == nil {
+			continue
+		}
+		cert, err := cx509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+		if opts.Identity != "" && IdentityOf(cert) != opts.Identity {
+			continue
+		}
+		revocation, _ := ca.GetRevocation(id)
+		info := describe(id, cert, revocation, now)
+		if opts.Status != "" && info.Status != opts.Status {
+			continue
+		}
+		result = append(result, info)
+	}
+	return result, nil
+}
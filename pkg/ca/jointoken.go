@@ -0,0 +1,340 @@
+package ca
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/tracing"
+)
+
+/*
+join token让还没有证书的工作负载申请它的第一张证书：
+管理员生成token时限定profile和SANs，token只能用有限的次数，有有效期，可以吊销，每次使用都会审计
+token的形式是 <id>.<secret>，CA只保存secret的sha256
+*/
+const joinTokenFolder string = "cert/joinTokens"
+
+type JoinTokenSpec struct {
+	Profile     string        `json:"profile"`
+	CommonName  string        `json:"commonName,omitempty"` //为空时CN只能是空的或者DNSNames中的一个
+	DNSNames    []string      `json:"dnsNames,omitempty"`   //CSR中的SANs只能是这些中的，*.example.com 匹配一级子域名
+	IPAddresses []string      `json:"ipAddresses,omitempty"`
+	URIs        []string      `json:"uris,omitempty"`
+	TTL         time.Duration `json:"-"`
+	MaxUses     int           `json:"maxUses"`
+}
+
+type JoinTokenRedemption struct {
+	Time          time.Time `json:"time"`
+	CertificateID string    `json:"certificateId"`
+}
+
+type JoinToken struct {
+	ID           string `json:"id"`
+	SecretSHA256 string `json:"secretSha256"`
+	JoinTokenSpec
+	Uses        int                   `json:"uses"`
+	CreatedAt   time.Time             `json:"createdAt"`
+	ExpiresAt   time.Time             `json:"expiresAt"`
+	CreatedBy   string                `json:"createdBy,omitempty"`
+	RevokedAt   *time.Time            `json:"revokedAt,omitempty"`
+	Redemptions []JoinTokenRedemption `json:"redemptions,omitempty"`
+}
+
+/*
+token是否还能用，不能用时给出原因
+*/
+func (t *JoinToken) State() string {
+	switch {
+	case t.RevokedAt != nil:
+		return "revoked"
+	case t.Uses >= t.MaxUses:
+		return "used"
+	case time.Now().After(t.ExpiresAt):
+		return "expired"
+	}
+	return "active"
+}
+
+/*
+用join token签发的证书，私钥不在CA上保存，直接交给申请者
+*/
+type EnrolledCertificate struct {
+	Certificate
+	Issued *IssuedCertificate
+}
+
+/*
+生成一个join token，返回的token只出现这一次
+*/
+func (ca *CertificateAuthority) CreateJoinToken(ctx context.Context, spec JoinTokenSpec) (string, *JoinToken, error) {
+	if spec.Profile == "" {
+		spec.Profile = DefaultProfile
+	}
+	if _, ok := Profiles[spec.Profile]; !ok {
+		return "", nil, InvalidArgument("UNKNOWN_PROFILE", FieldViolation{Field: "Profile", Description: "must be default, server or client"})
+	}
+	if spec.MaxUses <= 0 {
+		spec.MaxUses = 1
+	}
+	if spec.TTL <= 0 {
+		return "", nil, InvalidArgument("INVALID_JOIN_TOKEN", FieldViolation{Field: "TTL", Description: "must be positive"})
+	}
+	for _, ip := range spec.IPAddresses {
+		if net.ParseIP(ip) == nil {
+			return "", nil, InvalidArgument("INVALID_JOIN_TOKEN", FieldViolation{Field: "IPAddresses", Description: ip + " is not an IP address"})
+		}
+	}
+
+	idBytes, secretBytes := make([]byte, 8), make([]byte, 32)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", nil, WrapError(ErrInternal, "RANDOM_FAILED", err, "generate join token fail")
+	}
+	if _, err := rand.Read(secretBytes); err != nil {
+		return "", nil, WrapError(ErrInternal, "RANDOM_FAILED", err, "generate join token fail")
+	}
+	secret := base64.RawURLEncoding.EncodeToString(secretBytes)
+	sum := sha256.Sum256([]byte(secret))
+	now := time.Now()
+	token := &JoinToken{
+		ID:            hex.EncodeToString(idBytes),
+		SecretSHA256:  hex.EncodeToString(sum[:]),
+		JoinTokenSpec: spec,
+		CreatedAt:     now,
+		ExpiresAt:     now.Add(spec.TTL),
+		CreatedBy:     CallerFrom(ctx),
+	}
+
+	ca.joinMu.Lock()
+	defer ca.joinMu.Unlock()
+	if err := ca.saveJoinToken(token); err != nil {
+		return "", nil, err
+	}
+	ca.audit(AuditRecord{Action: "jointoken.create", Caller: token.CreatedBy, Allowed: true, Reason: "token " + token.ID})
+	return token.ID + "." + secret, token, nil
+}
+
+/*
+所有的join token，包括用完、过期和吊销了的，按生成时间排序
+*/
+func (ca *CertificateAuthority) ListJoinTokens() ([]*JoinToken, error) {
+	files, err := filepath.Glob(ca.path(joinTokenFolder + "/*.json"))
+	if err != nil {
+		return nil, WrapError(ErrInternal, "STORAGE_FAILED", err, "list join tokens fail")
+	}
+	tokens := []*JoinToken{}
+	for _, file := range files {
+		token, err := ca.loadJoinToken(strings.TrimSuffix(filepath.Base(file), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreatedAt.Before(tokens[j].CreatedAt) })
+	return tokens, nil
+}
+
+func (ca *CertificateAuthority) RevokeJoinToken(ctx context.Context, id string) (*JoinToken, error) {
+	ca.joinMu.Lock()
+	defer ca.joinMu.Unlock()
+	token, err := ca.loadJoinToken(id)
+	if err != nil {
+		return nil, err
+	}
+	if token.RevokedAt == nil {
+		now := time.Now()
+		token.RevokedAt = &now
+		if err := ca.saveJoinToken(token); err != nil {
+			return nil, err
+		}
+	}
+	ca.audit(AuditRecord{Action: "jointoken.revoke", Caller: CallerFrom(ctx), Allowed: true, Reason: "token " + id})
+	return token, nil
+}
+
+/*
+用join token申请证书：token必须有效，CSR的profile和SANs必须在token允许的范围内
+*/
+func (ca *CertificateAuthority) Enroll(ctx context.Context, rawToken string, csr *CertificateSigningRequest) (*EnrolledCertificate, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "ca.Enroll")
+	defer span.End()
+
+	//限流也让猜测token变得更难
+	if err := ca.limiter.allow(ctx); err != nil {
+		return nil, recordError(span, err)
+	}
+
+	ca.joinMu.Lock()
+	defer ca.joinMu.Unlock()
+
+	id, secret, _ := strings.Cut(rawToken, ".")
+	token, err := ca.checkJoinToken(id, secret)
+	if err != nil {
+		ca.audit(AuditRecord{Action: "jointoken.redeem", Caller: CallerFrom(ctx), Reason: "token " + id + ": " + err.Error()})
+		return nil, recordError(span, err)
+	}
+	if csr.Profile == "" {
+		csr.Profile = token.Profile
+	}
+	if violations := token.check(csr); len(violations) > 0 {
+		ca.audit(AuditRecord{Action: "jointoken.redeem", Caller: CallerFrom(ctx), Reason: "token " + id + ": CSR out of the token's constraints"})
+		return nil, recordError(span, InvalidArgument("CSR_NOT_ALLOWED_BY_TOKEN", violations...))
+	}
+
+	profile, _ := ProfileOf(csr)
+	issued, err := ca.issue(ctx, csr, profile.notAfter(time.Now()))
+	if err != nil {
+		return nil, recordError(span, err)
+	}
+	item, err := ca.prepare(ctx, issued, false)
+	if err != nil {
+		return nil, recordError(span, storageError(err, "persist the certificate fail"))
+	}
+
+	//证书和token的使用次数在同一批修改中保存，不会有不计次数的证书
+	token.Uses++
+	token.Redemptions = append(token.Redemptions, JoinTokenRedemption{Time: time.Now(), CertificateID: item.ID})
+	tokenFile, err := joinTokenChange(token)
+	if err != nil {
+		return nil, recordError(span, err)
+	}
+	if err := ca.commit([]*pendingCertificate{item}, tokenFile); err != nil {
+		return nil, recordError(span, storageError(err, "persist the certificate fail"))
+	}
+	ca.audit(AuditRecord{Action: "jointoken.redeem", CertificateID: item.ID, Caller: CallerFrom(ctx), Allowed: true, Reason: "token " + id})
+	return &EnrolledCertificate{Certificate: item.Certificate, Issued: issued}, nil
+}
+
+func (ca *CertificateAuthority) checkJoinToken(id string, secret string) (*JoinToken, error) {
+	invalid := NewError(ErrUnauthenticated, "INVALID_JOIN_TOKEN", "the join token is not valid")
+	if id == "" || secret == "" || validateCertificateId(id) != nil {
+		return nil, invalid
+	}
+	token, err := ca.loadJoinToken(id)
+	if err != nil {
+		if CodeOf(err) == ErrNotFound {
+			return nil, invalid
+		}
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(secret))
+	if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(token.SecretSHA256)) != 1 {
+		return nil, invalid
+	}
+	if state := token.State(); state != "active" {
+		caErr := NewError(ErrFailedPrecondition, "JOIN_TOKEN_"+strings.ToUpper(state), "the join token is %v", state)
+		caErr.Metadata = map[string]string{"tokenId": id}
+		return nil, caErr
+	}
+	return token, nil
+}
+
+/*
+检查CSR是否在token的限定之内
+*/
+func (t *JoinToken) check(csr *CertificateSigningRequest) []FieldViolation {
+	var violations []FieldViolation
+	if csr.Profile != t.Profile {
+		violations = append(violations, FieldViolation{Field: "Profile", Description: "the token only allows " + t.Profile})
+	}
+	if t.CommonName != "" && csr.SubjectCommonName != t.CommonName {
+		violations = append(violations, FieldViolation{Field: "SubjectCommonName", Description: "must be " + t.CommonName})
+	}
+	if t.CommonName == "" && csr.SubjectCommonName != "" && !dnsNameAllowed(csr.SubjectCommonName, t.DNSNames) {
+		violations = append(violations, FieldViolation{Field: "SubjectCommonName", Description: "must be one of the allowed DNS names"})
+	}
+	for _, name := range csr.DNSNames {
+		if !dnsNameAllowed(name, t.DNSNames) {
+			violations = append(violations, FieldViolation{Field: "DNSNames", Description: name + " is not allowed by the token"})
+		}
+	}
+	for _, ip := range csr.IPAddresses {
+		allowed := false
+		for _, allowedIP := range t.IPAddresses {
+			allowed = allowed || net.ParseIP(allowedIP).Equal(ip)
+		}
+		if !allowed {
+			violations = append(violations, FieldViolation{Field: "IPAddresses", Description: ip.String() + " is not allowed by the token"})
+		}
+	}
+	for _, uri := range csr.URIs {
+		allowed := false
+		for _, allowedURI := range t.URIs {
+			allowed = allowed || allowedURI == uri.String()
+		}
+		if !allowed {
+			violations = append(violations, FieldViolation{Field: "URIs", Description: uri.String() + " is not allowed by the token"})
+		}
+	}
+	if len(csr.EmailAddresses) > 0 {
+		violations = append(violations, FieldViolation{Field: "EmailAddresses", Description: "not allowed with a join token"})
+	}
+	return violations
+}
+
+func dnsNameAllowed(name string, allowed []string) bool {
+	name = strings.ToLower(name)
+	for _, pattern := range allowed {
+		pattern = strings.ToLower(pattern)
+		if pattern == name {
+			return true
+		}
+		if strings.HasPrefix(pattern, "*.") {
+			prefix, rest, ok := strings.Cut(name, ".")
+			if ok && prefix != "" && prefix != "*" && rest == pattern[2:] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (ca *CertificateAuthority) loadJoinToken(id string) (*JoinToken, error) {
+	if err := validateCertificateId(id); err != nil {
+		return nil, err
+	}
+	contents, err := os.ReadFile(ca.path(joinTokenFolder + "/" + id + ".json"))
+	if os.IsNotExist(err) {
+		caErr := NewError(ErrNotFound, "JOIN_TOKEN_NOT_FOUND", "no join token %v", id)
+		caErr.Metadata = map[string]string{"tokenId": id}
+		return nil, caErr
+	}
+	if err != nil {
+		return nil, WrapError(ErrInternal, "STORAGE_FAILED", err, "read join token fail")
+	}
+	token := &JoinToken{}
+	if err := json.Unmarshal(contents, token); err != nil {
+		return nil, WrapError(ErrInternal, "STORAGE_FAILED", err, "parse join token %v fail", id)
+	}
+	return token, nil
+}
+
+func (ca *CertificateAuthority) saveJoinToken(token *JoinToken) error {
+	change, err := joinTokenChange(token)
+	if err != nil {
+		return err
+	}
+	if err := ca.storage().Apply([]FileChange{change}); err != nil {
+		return storageError(err, "persist join token fail")
+	}
+	return nil
+}
+
+func joinTokenChange(token *JoinToken) (FileChange, error) {
+	contents, err := json.MarshalIndent(token, "", "  ")
+	if err != nil {
+		return FileChange{}, WrapError(ErrInternal, "STORAGE_FAILED", err, "marshal join token fail")
+	}
+	return FileChange{Op: OpWrite, Path: joinTokenFolder + "/" + token.ID + ".json", Contents: contents, Perm: 0600}, nil
+}
@@ -0,0 +1,117 @@
+package ca
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestDNSNameAllowed(t *testing.T) {
+	allowed := []string{"api.example.com", "*.svc.example.com"}
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{name: "api.example.com", want: true},
+		{name: "API.Example.com", want: true},
+		{name: "web.example.com"},
+		{name: "db.svc.example.com", want: true},
+		{name: "svc.example.com"},
+		{name: "a.b.svc.example.com"},
+		{name: "*.svc.example.com", want: true},
+		{name: ".svc.example.com"},
+		{name: "db.svc.example.com.evil.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := dnsNameAllowed(tt.name, allowed); got != tt.want {
+				t.Errorf("dnsNameAllowed(%q) = %v, want %v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJoinTokenCheck(t *testing.T) {
+	token := &JoinToken{JoinTokenSpec: JoinTokenSpec{
+		Profile:     "server",
+		DNSNames:    []string{"*.svc.example.com"},
+		IPAddresses: []string{"10.0.0.1"},
+		URIs:        []string{"spiffe://example.org/web"},
+	}}
+	web, _ := url.Parse("spiffe://example.org/web")
+	db, _ := url.Parse("spiffe://example.org/db")
+	tests := []struct {
+		name   string
+		csr    CertificateSigningRequest
+		fields []string
+	}{
+		{name: "allowed", csr: CertificateSigningRequest{Profile: "server", SubjectCommonName: "web.svc.example.com", DNSNames: []string{"web.svc.example.com"},
+			IPAddresses: []net.IP{net.ParseIP("10.0.0.1")}, URIs: []url.URL{*web}}},
+		{name: "empty CN", csr: CertificateSigningRequest{Profile: "server", DNSNames: []string{"web.svc.example.com"}}},
+		{name: "other profile", csr: CertificateSigningRequest{Profile: "client"}, fields: []string{"Profile"}},
+		{name: "CN not allowed", csr: CertificateSigningRequest{Profile: "server", SubjectCommonName: "admin"}, fields: []string{"SubjectCommonName"}},
+		{name: "DNS name not allowed", csr: CertificateSigningRequest{Profile: "server", DNSNames: []string{"web.svc.example.com", "example.com"}}, fields: []string{"DNSNames"}},
+		{name: "IP not allowed", csr: CertificateSigningRequest{Profile: "server", IPAddresses: []net.IP{net.ParseIP("10.0.0.2")}}, fields: []string{"IPAddresses"}},
+		{name: "URI not allowed", csr: CertificateSigningRequest{Profile: "server", URIs: []url.URL{*db}}, fields: []string{"URIs"}},
+		{name: "email", csr: CertificateSigningRequest{Profile: "server", EmailAddresses: []string{"a@example.com"}}, fields: []string{"EmailAddresses"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			violations := token.check(&tt.csr)
+			if len(violations) != len(tt.fields) {
+				t.Fatalf("violations = %v, want fields %v", violations, tt.fields)
+			}
+			for i, v := range violations {
+				if v.Field != tt.fields[i] {
+					t.Errorf("violation %d is on %v, want %v", i, v.Field, tt.fields[i])
+				}
+			}
+		})
+	}
+
+	constrained := &JoinToken{JoinTokenSpec: JoinTokenSpec{Profile: "server", CommonName: "web"}}
+	if violations := constrained.check(&CertificateSigningRequest{Profile: "server", SubjectCommonName: "db"}); len(violations) != 1 {
+		t.Errorf("CN other than the token's: violations = %v", violations)
+	}
+}
+
+func TestEnrollCountsUses(t *testing.T) {
+	raw, _, err := CA.CreateJoinToken(context.Background(), JoinTokenSpec{Profile: "server", DNSNames: []string{"*.svc.example.com"}, TTL: time.Hour, MaxUses: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		wantErr  bool
+		wantUses int
+	}{
+		{name: "first use", wantUses: 1},
+		{name: "second use", wantUses: 2},
+		{name: "used up", wantErr: true, wantUses: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enrolled, err := CA.Enroll(context.Background(), raw, &CertificateSigningRequest{DNSNames: []string{"web.svc.example.com"}})
+			if tt.wantErr {
+				if CodeOf(err) != ErrFailedPrecondition {
+					t.Fatalf("want FailedPrecondition, got %v", err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			tokens, err := CA.ListJoinTokens()
+			if err != nil {
+				t.Fatal(err)
+			}
+			token := tokens[len(tokens)-1]
+			if token.Uses != tt.wantUses || len(token.Redemptions) != tt.wantUses {
+				t.Fatalf("uses = %d, redemptions = %d, want %d", token.Uses, len(token.Redemptions), tt.wantUses)
+			}
+			if enrolled != nil && token.Redemptions[tt.wantUses-1].CertificateID != enrolled.ID {
+				t.Error("the redemption doesn't record the enrolled certificate")
+			}
+		})
+	}
+}
@@ -0,0 +1,246 @@
+package ca
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/youmark/pkcs8"
+)
+
+/*
+CA为申请者生成的私钥不能一直留在 cert/clientCert 中：
+私钥用一个随机的key secret加密后保存，key secret只在签发时返回给申请者，CA不保存；
+只有申请者本人可以取，取过一次或者过了KeyTTL之后就被删除；每次访问都记入审计日志
+*/
+const DefaultKeyTTL time.Duration = 15 * time.Minute
+
+const keySecretBytes int = 32
+
+/*
+与 <id>.key 一起保存的 <id>.key.json
+*/
+type keyRecord struct {
+	CertificateID string    `json:"certificateId"`
+	Owner         string    `json:"owner,omitempty"` //申请证书的调用者，匿名申请时为空，这时只有本机的命令行能取
+	CreatedAt     time.Time `json:"createdAt"`
+	ExpiresAt     time.Time `json:"expiresAt"`
+}
+
+func (ca *CertificateAuthority) keyTTL() time.Duration {
+	if ca.KeyTTL <= 0 {
+		return DefaultKeyTTL
+	}
+	return ca.KeyTTL
+}
+
+/*
+加密私钥，返回加密用的key secret，以及要保存的 <id>.key.json 和 <id>.key
+*/
+func (ca *CertificateAuthority) sealKey(ctx context.Context, id string, key crypto.Signer) (string, []pendingFile, error) {
+	secretBytes := make([]byte, keySecretBytes)
+	if _, err := rand.Read(secretBytes); err != nil {
+		return "", nil, err
+	}
+	secret := base64.RawURLEncoding.EncodeToString(secretBytes)
+	der, err := pkcs8.MarshalPrivateKey(key, []byte(secret), nil)
+	if err != nil {
+		return "", nil, err
+	}
+
+	now := time.Now()
+	record := keyRecord{CertificateID: id, Owner: CallerFrom(ctx), CreatedAt: now, ExpiresAt: now.Add(ca.keyTTL())}
+	contents, err := json.Marshal(record)
+	if err != nil {
+		return "", nil, err
+	}
+	return secret, []pendingFile{
+		{name: id + ".key.json", contents: contents, perm: 0600},
+		{name: id + ".key", contents: pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: der}), perm: 0600},
+	}, nil
+}
+
+/*
+取走CA生成的私钥，返回的仍是加密的PKCS#8，用签发时得到的key secret解密
+只有申请者可以取，取走后私钥从CA上删除
+*/
+func (ca *CertificateAuthority) FetchKey(ctx context.Context, id string) ([]byte, error) {
+	ca.keyMu.Lock()
+	defer ca.keyMu.Unlock()
+
+	contents, record, err := ca.checkKeyAccess(ctx, id, "key.fetch")
+	if err != nil {
+		return nil, err
+	}
+	if err := ca.removeKey(id); err != nil {
+		return nil, storageError(err, "remove fetched private key fail")
+	}
+	ca.audit(AuditRecord{Action: "key.fetch", CertificateID: id, Caller: CallerFrom(ctx), Owner: record.Owner, Allowed: true})
+	return contents, nil
+}
+
+/*
+在CA上用key secret解密私钥并取走，用于需要私钥的导出格式
+key secret不对时私钥不会被删除
+*/
+func (ca *CertificateAuthority) OpenKey(ctx context.Context, id string, secret string) (crypto.Signer, error) {
+	ca.keyMu.Lock()
+	defer ca.keyMu.Unlock()
+
+	contents, record, err := ca.checkKeyAccess(ctx, id, "key.open")
+	if err != nil {
+		return nil, err
+	}
+	key, err := decryptKey(contents, secret)
+	if err != nil {
+		ca.audit(AuditRecord{Action: "key.open", CertificateID: id, Caller: CallerFrom(ctx), Owner: record.Owner, Reason: "wrong key secret"})
+		caErr := WrapError(ErrPermissionDenied, "WRONG_KEY_SECRET", err, "can't decrypt the private key of %v", id)
+		caErr.Metadata = map[string]string{"certificateId": id}
+		return nil, caErr
+	}
+	if err := ca.removeKey(id); err != nil {
+		return nil, storageError(err, "remove opened private key fail")
+	}
+	ca.audit(AuditRecord{Action: "key.open", CertificateID: id, Caller: CallerFrom(ctx), Owner: record.Owner, Allowed: true})
+	return key, nil
+}
+
+/*
+检查调用者能否取这把私钥，过期的私钥会被删除
+只有申请者本人和本机的命令行可以取；匿名调用者谁也证明不了自己是申请者，一律拒绝
+没有 .key.json 的私钥是以前签发的，没有申请者的记录，以文件的修改时间计算过期，也只有本机的命令行能取
+*/
+func (ca *CertificateAuthority) checkKeyAccess(ctx context.Context, id string, action string) ([]byte, *keyRecord, error) {
+	caller := CallerFrom(ctx)
+	contents, err := ca.readClientFile(id, ".key", "KEY_NOT_FOUND")
+	if err != nil {
+		if CodeOf(err) == ErrNotFound {
+			ca.audit(AuditRecord{Action: action, CertificateID: id, Caller: caller, Reason: "not found, fetched or expired"})
+		}
+		return nil, nil, err
+	}
+	record, err := ca.loadKeyRecord(id)
+	if err != nil {
+		return nil, nil, WrapError(ErrInternal, "STORAGE_FAILED", err, "read private key record fail")
+	}
+
+	if time.Now().After(record.ExpiresAt) {
+		ca.removeKey(id)
+		ca.audit(AuditRecord{Action: "key.expire", CertificateID: id, Caller: caller, Owner: record.Owner, Allowed: true})
+		caErr := NewError(ErrNotFound, "KEY_EXPIRED", "the private key of %v expired at %v and was deleted", id, record.ExpiresAt)
+		caErr.Metadata = map[string]string{"certificateId": id}
+		return nil, nil, caErr
+	}
+	if caller == "" {
+		ca.audit(AuditRecord{Action: action, CertificateID: id, Owner: record.Owner, Reason: "anonymous caller"})
+		caErr := NewError(ErrUnauthenticated, "AUTHENTICATION_REQUIRED", "fetching the private key of %v requires an authenticated caller", id)
+		caErr.Metadata = map[string]string{"certificateId": id}
+		return nil, nil, caErr
+	}
+	if caller != record.Owner && caller != LocalOperator {
+		ca.audit(AuditRecord{Action: action, CertificateID: id, Caller: caller, Owner: record.Owner, Reason: "not the requester"})
+		caErr := NewError(ErrPermissionDenied, "NOT_KEY_OWNER", "only the requester of %v can fetch its private key", id)
+		caErr.Metadata = map[string]string{"certificateId": id}
+		return nil, nil, caErr
+	}
+	return contents, record, nil
+}
+
+func (ca *CertificateAuthority) loadKeyRecord(id string) (*keyRecord, error) {
+	contents, err := os.ReadFile(ca.path(clientCAFolder + "/" + id + ".key.json"))
+	if os.IsNotExist(err) {
+		info, err := os.Stat(ca.path(clientCAFolder + "/" + id + ".key"))
+		if err != nil {
+			return nil, err
+		}
+		return &keyRecord{CertificateID: id, CreatedAt: info.ModTime(), ExpiresAt: info.ModTime().Add(ca.keyTTL())}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	record := &keyRecord{}
+	if err := json.Unmarshal(contents, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+func (ca *CertificateAuthority) removeKey(id string) error {
+	changes := []FileChange{
+		{Op: OpRemove, Path: clientCAFolder + "/" + id + ".key"},
+		{Op: OpRemove, Path: clientCAFolder + "/" + id + ".key.json"},
+	}
+	if store, ok := ca.storage().(PurgingStore); ok {
+		return store.ApplyAndPurge(changes)
+	}
+	return ca.storage().Apply(changes)
+}
+
+/*
+解密PKCS#8私钥；以前签发的私钥没有加密，直接解析
+*/
+func decryptKey(contents []byte, secret string) (crypto.Signer, error) {
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return nil, NewError(ErrInternal, "CORRUPTED_KEY", "private key is not PEM encoded")
+	}
+	if block.Type != "ENCRYPTED PRIVATE KEY" {
+		return parsePrivateKey(block.Bytes)
+	}
+	key, err := pkcs8.ParsePKCS8PrivateKey(block.Bytes, []byte(secret))
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, NewError(ErrInternal, "CORRUPTED_KEY", "unsupported private key type %T", key)
+	}
+	return signer, nil
+}
+
+/*
+定期删除过期的私钥，多副本时只有leader删除
+*/
+func (ca *CertificateAuthority) RunKeySweeper(interval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			if ca.IsLeader() {
+				ca.sweepKeys()
+			}
+		}
+	}
+}
+
+func (ca *CertificateAuthority) sweepKeys() {
+	files, err := filepath.Glob(ca.path(clientCAFolder + "/*.key"))
+	if err != nil {
+		return
+	}
+	ca.keyMu.Lock()
+	defer ca.keyMu.Unlock()
+	for _, file := range files {
+		id := strings.TrimSuffix(filepath.Base(file), ".key")
+		record, err := ca.loadKeyRecord(id)
+		if err != nil || time.Now().Before(record.ExpiresAt) {
+			continue
+		}
+		if err := ca.removeKey(id); err != nil {
+			log.Printf("remove expired private key %v fail: %v", id, err)
+			continue
+		}
+		ca.audit(AuditRecord{Action: "key.expire", CertificateID: id, Owner: record.Owner, Allowed: true})
+	}
+}
@@ -0,0 +1,132 @@
+package ca
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func signOwned(t *testing.T, owner string) *Certificate {
+	ctx := context.Background()
+	if owner != "" {
+		ctx = WithCaller(ctx, owner)
+	}
+	cert, err := CA.SignX509(ctx, &CertificateSigningRequest{SubjectCommonName: "key-delivery"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func callerContext(caller string) context.Context {
+	if caller == "" {
+		return context.Background()
+	}
+	return WithCaller(context.Background(), caller)
+}
+
+/*
+只有申请者和本机的命令行能取走私钥，取走之后就不在了；被拒绝的调用不会删除私钥
+*/
+func TestFetchKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		owner   string
+		caller  string
+		wantErr bool
+		code    ErrorCode
+	}{
+		{name: "requester", owner: "alice", caller: "alice"},
+		{name: "local operator", owner: "alice", caller: LocalOperator},
+		{name: "other caller", owner: "alice", caller: "bob", wantErr: true, code: ErrPermissionDenied},
+		{name: "anonymous caller", owner: "alice", wantErr: true, code: ErrUnauthenticated},
+		{name: "anonymous caller of an anonymous request", wantErr: true, code: ErrUnauthenticated},
+		{name: "named caller of an anonymous request", caller: "alice", wantErr: true, code: ErrPermissionDenied},
+		{name: "local operator of an anonymous request", caller: LocalOperator},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert := signOwned(t, tt.owner)
+			_, err := CA.FetchKey(callerContext(tt.caller), cert.ID)
+			if (err != nil) != tt.wantErr || (tt.wantErr && CodeOf(err) != tt.code) {
+				t.Fatalf("FetchKey() error = %v, want code %v", err, tt.code)
+			}
+
+			operator := callerContext(LocalOperator)
+			if tt.wantErr {
+				if _, err := CA.FetchKey(operator, cert.ID); err != nil {
+					t.Fatalf("key removed by a rejected fetch: %v", err)
+				}
+			}
+			if _, err := CA.FetchKey(operator, cert.ID); CodeOf(err) != ErrNotFound {
+				t.Errorf("second fetch error = %v, want NotFound", err)
+			}
+		})
+	}
+}
+
+func TestFetchExpiredKey(t *testing.T) {
+	cert := signOwned(t, "alice")
+	record, err := CA.loadKeyRecord(cert.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record.ExpiresAt = record.CreatedAt.Add(-1)
+	contents, err := json.Marshal(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CA.ApplyLocal([]FileChange{{Op: OpWrite, Path: clientCAFolder + "/" + cert.ID + ".key.json", Contents: contents, Perm: 0600}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := CA.FetchKey(callerContext("alice"), cert.ID); CodeOf(err) != ErrNotFound {
+		t.Errorf("FetchKey() error = %v, want NotFound", err)
+	}
+	if _, err := CA.loadKeyRecord(cert.ID); err == nil {
+		t.Error("the expired key is kept")
+	}
+}
+
+/*
+记录哪些修改要求复制的存储purge
+*/
+type purgingStore struct {
+	localStore
+	purged []string
+}
+
+func (s *purgingStore) ApplyAndPurge(changes []FileChange) error {
+	for _, change := range changes {
+		s.purged = append(s.purged, change.Path)
+	}
+	return s.localStore.Apply(changes)
+}
+
+/*
+取走的私钥通过ApplyAndPurge删除，复制的存储据此丢掉日志中的私钥
+*/
+func TestFetchKeyPurges(t *testing.T) {
+	authority := New(t.TempDir())
+	if err := authority.Init(); err != nil {
+		t.Fatal(err)
+	}
+	store := &purgingStore{localStore: localStore{authority}}
+	authority.SetStore(store)
+
+	cert, err := authority.SignX509(callerContext("alice"), &CertificateSigningRequest{SubjectCommonName: "key-delivery"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(store.purged) != 0 {
+		t.Fatalf("signing purged %v", store.purged)
+	}
+	if _, err := authority.FetchKey(callerContext("alice"), cert.ID); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{clientCAFolder + "/" + cert.ID + ".key", clientCAFolder + "/" + cert.ID + ".key.json"}
+	if !reflect.DeepEqual(store.purged, want) {
+		t.Errorf("purged %v, want %v", store.purged, want)
+	}
+}
@@ -0,0 +1,167 @@
+package ca
+
+import (
+	"context"
+	"crypto"
+	cx509 "crypto/x509"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+/*
+等到池子里有n个私钥
+*/
+func waitPoolDepth(t *testing.T, keys chan crypto.Signer, n int) {
+	deadline := time.Now().Add(10 * time.Second)
+	for len(keys) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("key pool has %d keys, want %d", len(keys), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+/*
+每个私钥只被取走一次，取走之后池子会补充新的私钥
+*/
+func TestKeyPoolHandsOutOnce(t *testing.T) {
+	authority := &CertificateAuthority{}
+	if err := authority.SetKeyPool(KeyPoolOptions{Algorithms: []cx509.PublicKeyAlgorithm{cx509.ECDSA}, Size: 2, RefillRate: 100}); err != nil {
+		t.Fatal(err)
+	}
+	defer authority.SetKeyPool(KeyPoolOptions{})
+	stopCh := make(chan struct{})
+	go authority.RunKeyPool(stopCh)
+	keys := authority.keyPool.keys[cx509.ECDSA]
+
+	seen := map[crypto.Signer]bool{}
+	for round := 0; round < 3; round++ {
+		waitPoolDepth(t, keys, cap(keys))
+		for i := 0; i < cap(keys); i++ {
+			key := authority.keyPool.take(context.Background(), cx509.ECDSA)
+			if key == nil {
+				t.Fatalf("round %d: no pooled key", round)
+			}
+			if seen[key] {
+				t.Fatalf("round %d: a pooled key is handed out twice", round)
+			}
+			seen[key] = true
+		}
+	}
+
+	close(stopCh)
+	//停止补充之后取空，池子没有私钥时返回nil，由调用者现场生成
+	time.Sleep(50 * time.Millisecond)
+	for len(keys) > 0 {
+		<-keys
+	}
+	if key := authority.keyPool.take(context.Background(), cx509.ECDSA); key != nil {
+		t.Error("empty pool handed out a key")
+	}
+	if key := authority.keyPool.take(context.Background(), cx509.RSA); key != nil {
+		t.Error("pool handed out a key of an algorithm it doesn't keep")
+	}
+}
+
+/*
+重新设置池子之后，只上报新池子的深度
+*/
+func TestKeyPoolGaugeReconfigure(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	saved := otel.GetMeterProvider()
+	otel.SetMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+	defer otel.SetMeterProvider(saved)
+
+	authority := &CertificateAuthority{}
+	defer authority.SetKeyPool(KeyPoolOptions{})
+	for _, alg := range []cx509.PublicKeyAlgorithm{cx509.RSA, cx509.Ed25519, cx509.ECDSA} {
+		if err := authority.SetKeyPool(KeyPoolOptions{Algorithms: []cx509.PublicKeyAlgorithm{alg}, Size: 1, RefillRate: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var data metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &data); err != nil {
+		t.Fatal(err)
+	}
+	var reported []string
+	for _, scope := range data.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			if m.Name != "sidecar.ca.keypool.depth" {
+				continue
+			}
+			for _, point := range m.Data.(metricdata.Gauge[int64]).DataPoints {
+				alg, _ := point.Attributes.Value(attribute.Key("key.algorithm"))
+				reported = append(reported, alg.AsString())
+			}
+		}
+	}
+	if len(reported) != 1 || reported[0] != cx509.ECDSA.String() {
+		t.Errorf("depth reported for %v, want only %v", reported, cx509.ECDSA)
+	}
+}
+
+/*
+池子命中时的签发：几个预先生成的私钥被反复放回池子，计时中不包括生成私钥
+*/
+func BenchmarkIssuePooled(b *testing.B) {
+	if err := CA.SetKeyPool(KeyPoolOptions{Algorithms: []cx509.PublicKeyAlgorithm{cx509.RSA}, Size: 16, RefillRate: 1}); err != nil {
+		b.Fatal(err)
+	}
+	defer CA.SetKeyPool(KeyPoolOptions{})
+	keys := CA.keyPool.keys[cx509.RSA]
+	var ready []crypto.Signer
+	for i := 0; i < cap(keys); i++ {
+		key, err := generateKey(cx509.RSA)
+		if err != nil {
+			b.Fatal(err)
+		}
+		ready = append(ready, key)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case keys <- ready[i%len(ready)]:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	benchmarkIssue(b)
+}
+
+/*
+没有池子时的签发，每张证书都现场生成RSA私钥
+*/
+func BenchmarkIssueInline(b *testing.B) {
+	if err := CA.SetKeyPool(KeyPoolOptions{}); err != nil {
+		b.Fatal(err)
+	}
+	benchmarkIssue(b)
+}
+
+func benchmarkIssue(b *testing.B) {
+	saved := CA.limiter
+	defer func() { CA.limiter = saved }()
+	CA.limiter = nil
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			csr := &CertificateSigningRequest{SubjectCommonName: "bench", DNSNames: []string{"bench.local"}}
+			if _, err := CA.IssueX509(context.Background(), csr, DefaultKeyTTL); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
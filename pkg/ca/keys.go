@@ -0,0 +1,68 @@
+package ca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	cx509 "crypto/x509"
+)
+
+const rsaKeyBits int = 2048
+
+/*
+CSR 没有指定算法时，我们用RSA
+*/
+func keyAlgorithm(alg cx509.PublicKeyAlgorithm) cx509.PublicKeyAlgorithm {
+	if alg == cx509.UnknownPublicKeyAlgorithm {
+		return cx509.RSA
+	}
+	return alg
+}
+
+/*
+按CSR要求的算法为申请者生成私钥，RSA 2048，ECDSA P-256，或 Ed25519
+*/
+func generateKey(alg cx509.PublicKeyAlgorithm) (crypto.Signer, error) {
+	switch keyAlgorithm(alg) {
+	case cx509.ECDSA:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case cx509.Ed25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	default:
+		return rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	}
+}
+
+/*
+RSA 私钥仍然用 PKCS#1，和以前生成的文件保持一致；其他算法用 PKCS#8
+*/
+func marshalPrivateKey(key crypto.Signer) ([]byte, error) {
+	if rsaKey, ok := key.(*rsa.PrivateKey); ok {
+		return cx509.MarshalPKCS1PrivateKey(rsaKey), nil
+	}
+	return cx509.MarshalPKCS8PrivateKey(key)
+}
+
+var rsaSignatureAlgorithms = map[cx509.SignatureAlgorithm]bool{
+	cx509.SHA256WithRSA:    true,
+	cx509.SHA384WithRSA:    true,
+	cx509.SHA512WithRSA:    true,
+	cx509.SHA256WithRSAPSS: true,
+	cx509.SHA384WithRSAPSS: true,
+	cx509.SHA512WithRSAPSS: true,
+}
+
+/*
+CSR 中的签名算法是申请者自签CSR用的，证书则由CA的RSA私钥签名，
+只有当申请的算法是CA私钥能用的算法时才采用，否则让x509包选默认值
+*/
+func (ca *CertificateAuthority) certificateSignatureAlgorithm(requested cx509.SignatureAlgorithm) cx509.SignatureAlgorithm {
+	if rsaSignatureAlgorithms[requested] {
+		return requested
+	}
+	return cx509.UnknownSignatureAlgorithm
+}
@@ -0,0 +1,195 @@
+package ca
+
+import (
+	"context"
+	cx509 "crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+吊销记录，和证书放在同一个目录下，文件名为 <id>.revoked
+*/
+type Revocation struct {
+	CertificateID string    `json:"certificateId"`
+	Reason        string    `json:"reason"`
+	RevokedAt     time.Time `json:"revokedAt"`
+}
+
+/*
+读取并解析一张签发过的证书
+*/
+func (ca *CertificateAuthority) LoadCertificate(id string) (*cx509.Certificate, error) {
+	contents, err := ca.GetCertFile(id)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return nil, NewError(ErrInternal, "CORRUPTED_CERTIFICATE", "certificate %v is not PEM encoded", id)
+	}
+	cert, err := cx509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, WrapError(ErrInternal, "CORRUPTED_CERTIFICATE", err, "can't parse certificate %v", id)
+	}
+	return cert, nil
+}
+
+/*
+吊销一张证书，已经吊销的证书再次吊销会返回 ErrFailedPrecondition
+*/
+func (ca *CertificateAuthority) Revoke(ctx context.Context, id string, reason string) (*Revocation, error) {
+	cert, err := ca.LoadCertificate(id)
+	if err != nil {
+		return nil, err
+	}
+	ca.revokeMu.Lock()
+	defer ca.revokeMu.Unlock()
+	if revocation, _ := ca.GetRevocation(id); revocation != nil {
+		return nil, NewError(ErrFailedPrecondition, "ALREADY_REVOKED", "certificate %v was revoked at %v", id, revocation.RevokedAt)
+	}
+
+	revocation := &Revocation{CertificateID: id, Reason: reason, RevokedAt: time.Now()}
+	contents, err := json.Marshal(revocation)
+	if err != nil {
+		return nil, WrapError(ErrInternal, "STORAGE_FAILED", err, "marshal revocation fail")
+	}
+	changes := []FileChange{{Op: OpWrite, Path: clientCAFolder + "/" + id + ".revoked", Contents: contents, Perm: 0644}}
+	event := Event{Type: EventRevoked, CertificateID: id, Identity: IdentityOf(cert), Reason: reason, Time: revocation.RevokedAt}
+	change, ok, err := ca.outboxChange(&event)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		changes = append(changes, change)
+	}
+	if err := ca.storage().Apply(changes); err != nil {
+		log.Print("persistent revocation fail")
+		return nil, storageError(err, "persist the revocation fail")
+	}
+	ca.limiter.forget(id)
+
+	ca.publish(event)
+	return revocation, nil
+}
+
+/*
+返回证书的吊销记录，没有被吊销时返回nil
+*/
+func (ca *CertificateAuthority) GetRevocation(id string) (*Revocation, error) {
+	if err := validateCertificateId(id); err != nil {
+		return nil, err
+	}
+	contents, err := os.ReadFile(ca.path(clientCAFolder + "/" + id + ".revoked"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, WrapError(ErrInternal, "STORAGE_FAILED", err, "read revocation fail")
+	}
+	revocation := &Revocation{}
+	if err := json.Unmarshal(contents, revocation); err != nil {
+		return nil, WrapError(ErrInternal, "STORAGE_FAILED", err, "parse revocation fail")
+	}
+	return revocation, nil
+}
+
+/*
+吊销证书的序列号。mTLS客户端只给出证书，吊销记录却以证书id保存，
+吊销记录只增不减，按id缓存读过的证书，每次只读新出现的吊销记录
+*/
+type revokedSerials struct {
+	mu      sync.Mutex
+	byID    map[string]bool
+	serials map[string]bool
+}
+
+/*
+证书是否已经被吊销，CA的server用它拒绝吊销了的mTLS客户端证书
+*/
+func (ca *CertificateAuthority) IsRevoked(cert *cx509.Certificate) (bool, error) {
+	files, err := filepath.Glob(ca.path(clientCAFolder + "/*.revoked"))
+	if err != nil {
+		return false, WrapError(ErrInternal, "STORAGE_FAILED", err, "list revocations fail")
+	}
+	revoked := &ca.revoked
+	revoked.mu.Lock()
+	defer revoked.mu.Unlock()
+	if revoked.byID == nil {
+		revoked.byID, revoked.serials = map[string]bool{}, map[string]bool{}
+	}
+	for _, file := range files {
+		id := strings.TrimSuffix(filepath.Base(file), ".revoked")
+		if revoked.byID[id] {
+			continue
+		}
+		revokedCert, err := ca.LoadCertificate(id)
+		if err != nil {
+			return false, err
+		}
+		revoked.byID[id] = true
+		revoked.serials[revokedCert.SerialNumber.Text(16)] = true
+	}
+	return revoked.serials[cert.SerialNumber.Text(16)], nil
+}
+
+/*
+按旧证书的subject和SANs重新签发一张证书，私钥也会重新生成
+和取私钥一样，只有原来的申请者和本机的命令行可以续签，有签发权限不代表能续签别人的证书
+*/
+func (ca *CertificateAuthority) RenewX509(ctx context.Context, id string) (*Certificate, error) {
+	cert, err := ca.LoadCertificate(id)
+	if err != nil {
+		return nil, err
+	}
+	if caller := CallerFrom(ctx); caller != LocalOperator && (caller == "" || caller != ca.OwnerOf(id)) {
+		caErr := NewError(ErrPermissionDenied, "NOT_CERTIFICATE_OWNER", "only the requester of %v can renew it", id)
+		caErr.Metadata = map[string]string{"certificateId": id}
+		return nil, caErr
+	}
+	if revocation, _ := ca.GetRevocation(id); revocation != nil {
+		return nil, NewError(ErrFailedPrecondition, "ALREADY_REVOKED", "revoked certificate %v can't be renewed", id)
+	}
+	return ca.SignX509(context.WithValue(ctx, renewalKey{}, id), csrFromCertificate(cert))
+}
+
+type renewalKey struct{}
+
+/*
+RenewX509签发新证书时，context中带着旧证书的ID
+*/
+func renewalFrom(ctx context.Context) string {
+	id, _ := ctx.Value(renewalKey{}).(string)
+	return id
+}
+
+func csrFromCertificate(cert *cx509.Certificate) *CertificateSigningRequest {
+	csr := &CertificateSigningRequest{
+		SubjectCountry:            cert.Subject.Country,
+		SubjectOrganization:       cert.Subject.Organization,
+		SubjectOrganizationalUnit: cert.Subject.OrganizationalUnit,
+		SubjectLocality:           cert.Subject.Locality,
+		SubjectProvince:           cert.Subject.Province,
+		SubjectStreetAddress:      cert.Subject.StreetAddress,
+		SubjectPostalCode:         cert.Subject.PostalCode,
+		SubjectSerialNumber:       cert.Subject.SerialNumber,
+		SubjectCommonName:         cert.Subject.CommonName,
+
+		PublicKeyAlg: cert.PublicKeyAlgorithm,
+		Profile:      ProfileOfCertificate(cert),
+
+		DNSNames:       cert.DNSNames,
+		EmailAddresses: cert.EmailAddresses,
+		IPAddresses:    cert.IPAddresses,
+	}
+	for _, uri := range cert.URIs {
+		csr.URIs = append(csr.URIs, *uri)
+	}
+	return csr
+}
@@ -0,0 +1,68 @@
+package ca
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+/*
+同时吊销同一张证书，只有一个能成功，其他的都返回 ErrFailedPrecondition
+*/
+func TestRevokeOnce(t *testing.T) {
+	cert, err := CA.SignX509(context.Background(), &CertificateSigningRequest{SubjectCommonName: "revoke-once"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const callers = 8
+	errs := make([]error, callers)
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = CA.Revoke(context.Background(), cert.ID, "keyCompromise")
+		}(i)
+	}
+	wg.Wait()
+
+	revoked := 0
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			revoked++
+		case CodeOf(err) != ErrFailedPrecondition:
+			t.Errorf("Revoke() error = %v, want ErrFailedPrecondition", err)
+		}
+	}
+	if revoked != 1 {
+		t.Errorf("%d revocations succeeded, want 1", revoked)
+	}
+}
+
+func TestRenewOwnership(t *testing.T) {
+	tests := []struct {
+		name    string
+		owner   string
+		caller  string
+		wantErr bool
+	}{
+		{name: "requester", owner: "alice", caller: "alice"},
+		{name: "local operator", owner: "alice", caller: LocalOperator},
+		{name: "other caller", owner: "alice", caller: "bob", wantErr: true},
+		{name: "anonymous caller", owner: "alice", wantErr: true},
+		{name: "anonymous caller of an anonymous request", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert := signOwned(t, tt.owner)
+			_, err := CA.RenewX509(callerContext(tt.caller), cert.ID)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RenewX509() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr && CodeOf(err) != ErrPermissionDenied {
+				t.Errorf("RenewX509() error = %v, want PermissionDenied", err)
+			}
+		})
+	}
+}
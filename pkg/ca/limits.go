@@ -0,0 +1,373 @@
+package ca
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+/*
+签发证书的限流和配额，值为0的项不限制
+*/
+type Limits struct {
+	Rate                  float64       //每个调用者每秒可以申请的证书数（token bucket）
+	Burst                 int           //每个调用者的突发上限
+	GlobalRate            float64       //所有调用者加起来每秒可以申请的证书数
+	GlobalBurst           int           //所有调用者加起来的突发上限
+	MaxConcurrentKeygen   int           //同时生成私钥的个数
+	KeygenWait            time.Duration //排队等待生成私钥的最长时间
+	MaxActiveCertificates int           //每个调用者持有的未过期、未吊销的证书数，匿名调用者不计
+}
+
+const (
+	//调用者的bucket闲置这么久之后已经是满的，可以丢掉
+	idleBucketTTL time.Duration = 10 * time.Minute
+	//超过这么多bucket时清理一次闲置的
+	maxIdleBuckets int = 4096
+)
+
+type clientAddressKey struct{}
+
+/*
+把调用者的网络地址放到context中，匿名调用者按地址限流
+*/
+func WithClientAddress(ctx context.Context, addr string) context.Context {
+	return context.WithValue(ctx, clientAddressKey{}, addr)
+}
+
+/*
+限流用的key：认证过的调用者按身份，匿名调用者按地址
+*/
+func rateKey(ctx context.Context) string {
+	if caller := CallerFrom(ctx); caller != "" {
+		return caller
+	}
+	if addr, _ := ctx.Value(clientAddressKey{}).(string); addr != "" {
+		return "addr:" + addr
+	}
+	return "anonymous"
+}
+
+/*
+设置签发证书的限流和配额，要在server开始服务之前调用
+*/
+func (ca *CertificateAuthority) SetLimits(limits Limits) {
+	l := &limiter{
+		ca:      ca,
+		Limits:  limits,
+		callers: map[string]*callerBucket{},
+		owners:  map[string]map[string]time.Time{},
+		pending: map[string]int{},
+	}
+	if limits.GlobalRate > 0 {
+		l.global = rate.NewLimiter(rate.Limit(limits.GlobalRate), maxInt(limits.GlobalBurst, 1))
+	}
+	if limits.MaxConcurrentKeygen > 0 {
+		l.keygen = make(chan struct{}, limits.MaxConcurrentKeygen)
+	}
+	ca.limiter = l
+}
+
+/*
+为nil时不做任何限制
+*/
+type limiter struct {
+	Limits
+	ca *CertificateAuthority //从它的目录加载签发记录
+
+	mu      sync.Mutex
+	global  *rate.Limiter
+	callers map[string]*callerBucket
+	keygen  chan struct{}
+
+	//每个调用者持有的有效证书：owner -> 证书id -> 过期时间，第一次检查配额时从磁盘加载
+	ownersLoaded bool
+	owners       map[string]map[string]time.Time
+	pending      map[string]int //正在签发、还没保存的证书
+}
+
+type callerBucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+/*
+检查调用者和全局的token bucket，被限流时返回客户端可以重试的时间
+*/
+func (l *limiter) allow(ctx context.Context) error {
+	return l.allowN(ctx, 1)
+}
+
+/*
+一次取n个token，例如批量签发的每个CSR一个，不够时一个都不取
+n超过bucket的突发上限时永远取不到，直接拒绝
+*/
+func (l *limiter) allowN(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	now := time.Now()
+	var callerReservation *rate.Reservation
+	if l.Rate > 0 {
+		callerReservation = l.bucket(rateKey(ctx), now).ReserveN(now, n)
+		if !callerReservation.OK() {
+			return tooManyAtOnce("caller", n, maxInt(l.Burst, 1))
+		}
+		if delay := callerReservation.DelayFrom(now); delay > 0 {
+			callerReservation.CancelAt(now)
+			return rateLimited("caller", delay)
+		}
+	}
+	if l.global != nil {
+		r := l.global.ReserveN(now, n)
+		if !r.OK() || r.DelayFrom(now) > 0 {
+			//被全局限流的请求不消耗调用者自己的额度
+			if callerReservation != nil {
+				callerReservation.CancelAt(now)
+			}
+			if !r.OK() {
+				return tooManyAtOnce("global", n, l.global.Burst())
+			}
+			delay := r.DelayFrom(now)
+			r.CancelAt(now)
+			return rateLimited("global", delay)
+		}
+	}
+	return nil
+}
+
+func (l *limiter) bucket(key string, now time.Time) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.callers[key]
+	if !ok {
+		if len(l.callers) >= maxIdleBuckets {
+			for k, idle := range l.callers {
+				if now.Sub(idle.lastSeen) > idleBucketTTL {
+					delete(l.callers, k)
+				}
+			}
+		}
+		b = &callerBucket{limiter: rate.NewLimiter(rate.Limit(l.Rate), maxInt(l.Burst, 1))}
+		l.callers[key] = b
+	}
+	b.lastSeen = now
+	return b.limiter
+}
+
+func rateLimited(scope string, retryAfter time.Duration) error {
+	caErr := NewError(ErrResourceExhausted, "RATE_LIMITED", "too many certificate requests, retry after %v", retryAfter.Round(time.Millisecond))
+	caErr.Metadata = map[string]string{"scope": scope}
+	caErr.RetryAfter = retryAfter
+	return caErr
+}
+
+func tooManyAtOnce(scope string, n int, burst int) error {
+	caErr := NewError(ErrResourceExhausted, "RATE_LIMITED", "%v certificates requested at once, the rate limit allows at most %v", n, burst)
+	caErr.Metadata = map[string]string{"scope": scope, "burst": strconv.Itoa(burst)}
+	return caErr
+}
+
+/*
+占用一个生成私钥的名额，最多等待KeygenWait，返回的函数释放名额
+*/
+func (l *limiter) acquireKeygen(ctx context.Context) (func(), error) {
+	if l == nil || l.keygen == nil {
+		return func() {}, nil
+	}
+	release := func() { <-l.keygen }
+	select {
+	case l.keygen <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	timer := time.NewTimer(l.KeygenWait)
+	defer timer.Stop()
+	select {
+	case l.keygen <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	caErr := NewError(ErrResourceExhausted, "KEYGEN_BUSY", "too many private keys are being generated, retry later")
+	caErr.Metadata = map[string]string{"maxConcurrentKeygen": strconv.Itoa(l.MaxConcurrentKeygen)}
+	caErr.RetryAfter = time.Second
+	return nil, caErr
+}
+
+/*
+检查调用者的有效证书数，没有超过配额时预留一个名额，返回的函数释放预留
+本机操作员和匿名调用者不受配额限制
+*/
+func (l *limiter) reserve(ctx context.Context) (func(), error) {
+	owner := CallerFrom(ctx)
+	if l == nil || l.MaxActiveCertificates <= 0 || owner == "" || owner == LocalOperator {
+		return func() {}, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.loadOwners()
+	now := time.Now()
+	var nextExpiry time.Time
+	for id, notAfter := range l.owners[owner] {
+		if !notAfter.After(now) {
+			delete(l.owners[owner], id)
+			continue
+		}
+		if nextExpiry.IsZero() || notAfter.Before(nextExpiry) {
+			nextExpiry = notAfter
+		}
+	}
+	active := len(l.owners[owner])
+	if active+l.pending[owner] >= l.MaxActiveCertificates {
+		caErr := NewError(ErrResourceExhausted, "QUOTA_EXCEEDED", "%v already holds %v active certificates, revoke some of them or wait for them to expire", owner, active)
+		caErr.Metadata = map[string]string{"limit": strconv.Itoa(l.MaxActiveCertificates), "active": strconv.Itoa(active)}
+		if !nextExpiry.IsZero() {
+			caErr.RetryAfter = nextExpiry.Sub(now)
+		}
+		return nil, caErr
+	}
+
+	l.pending[owner]++
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.pending[owner]--; l.pending[owner] <= 0 {
+			delete(l.pending, owner)
+		}
+	}, nil
+}
+
+/*
+记录一张新签发的证书
+*/
+func (l *limiter) record(owner string, id string, notAfter time.Time) {
+	if l == nil || owner == "" {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.ownersLoaded {
+		return //加载时会从磁盘读到它
+	}
+	if l.owners[owner] == nil {
+		l.owners[owner] = map[string]time.Time{}
+	}
+	l.owners[owner][id] = notAfter
+}
+
+/*
+证书被吊销后不再占用配额
+*/
+func (l *limiter) forget(id string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, certs := range l.owners {
+		delete(certs, id)
+	}
+}
+
+/*
+磁盘上的签发记录被其他副本修改过，下次检查配额时重新加载
+*/
+func (l *limiter) reset() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.ownersLoaded = false
+	l.owners = map[string]map[string]time.Time{}
+}
+
+/*
+从每张证书的签发记录中加载调用者持有的有效证书，调用者持有l.mu
+*/
+func (l *limiter) loadOwners() {
+	if l.ownersLoaded {
+		return
+	}
+	l.ownersLoaded = true
+	files, err := filepath.Glob(l.ca.path(clientCAFolder + "/*" + issueRecordSuffix))
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	for _, file := range files {
+		id := strings.TrimSuffix(filepath.Base(file), issueRecordSuffix)
+		record, err := l.ca.loadIssueRecord(id)
+		if err != nil {
+			log.Printf("load issue record of %v fail: %v", id, err)
+			continue
+		}
+		if !record.NotAfter.After(now) || checkFileExist(l.ca.path(clientCAFolder+"/"+id+".revoked")) {
+			continue
+		}
+		if l.owners[record.Owner] == nil {
+			l.owners[record.Owner] = map[string]time.Time{}
+		}
+		l.owners[record.Owner][id] = record.NotAfter
+	}
+}
+
+const issueRecordSuffix string = ".issued.json"
+
+/*
+证书的签发记录，记下申请者用于配额统计，匿名申请的证书没有这个记录
+*/
+type issueRecord struct {
+	CertificateID string    `json:"certificateId"`
+	Owner         string    `json:"owner"`
+	NotAfter      time.Time `json:"notAfter"`
+}
+
+func issueRecordFile(record issueRecord) (pendingFile, error) {
+	contents, err := json.Marshal(record)
+	if err != nil {
+		return pendingFile{}, err
+	}
+	return pendingFile{name: record.CertificateID + issueRecordSuffix, contents: contents, perm: 0644}, nil
+}
+
+func (ca *CertificateAuthority) loadIssueRecord(id string) (*issueRecord, error) {
+	contents, err := os.ReadFile(ca.path(clientCAFolder + "/" + id + issueRecordSuffix))
+	if err != nil {
+		return nil, err
+	}
+	record := &issueRecord{}
+	if err := json.Unmarshal(contents, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+/*
+证书的申请者，匿名申请或者没有签发记录时为空
+*/
+func (ca *CertificateAuthority) OwnerOf(id string) string {
+	record, err := ca.loadIssueRecord(id)
+	if err != nil {
+		return ""
+	}
+	return record.Owner
+}
+
+func maxInt(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,108 @@
+package ca
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLimiterAllow(t *testing.T) {
+	alice := WithCaller(context.Background(), "alice")
+	bob := WithCaller(context.Background(), "bob")
+	anonymous := WithClientAddress(context.Background(), "10.0.0.1")
+	tests := []struct {
+		name     string
+		limits   Limits
+		requests []context.Context
+		allowed  int
+		scope    string
+	}{
+		{name: "unlimited", requests: []context.Context{alice, alice, alice, alice}, allowed: 4},
+		{name: "caller burst", limits: Limits{Rate: 0.001, Burst: 2}, requests: []context.Context{alice, alice, alice}, allowed: 2, scope: "caller"},
+		{name: "callers have their own buckets", limits: Limits{Rate: 0.001, Burst: 1}, requests: []context.Context{alice, bob, anonymous}, allowed: 3},
+		{name: "global burst", limits: Limits{GlobalRate: 0.001, GlobalBurst: 2}, requests: []context.Context{alice, bob, anonymous}, allowed: 2, scope: "global"},
+		{name: "zero burst allows one", limits: Limits{Rate: 0.001}, requests: []context.Context{alice, alice}, allowed: 1, scope: "caller"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := CA.limiter
+			defer func() { CA.limiter = saved }()
+			CA.SetLimits(tt.limits)
+
+			allowed := 0
+			for _, ctx := range tt.requests {
+				err := CA.limiter.allow(ctx)
+				if err == nil {
+					allowed++
+					continue
+				}
+				caErr, ok := err.(*Error)
+				if !ok || caErr.Code != ErrResourceExhausted || caErr.Metadata["scope"] != tt.scope {
+					t.Fatalf("want a %v rate limit, got %v", tt.scope, err)
+				}
+				if caErr.RetryAfter <= 0 {
+					t.Errorf("RetryAfter = %v, want positive", caErr.RetryAfter)
+				}
+			}
+			if allowed != tt.allowed {
+				t.Errorf("allowed %d requests, want %d", allowed, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestLimiterGlobalRejectionKeepsCallerTokens(t *testing.T) {
+	saved := CA.limiter
+	defer func() { CA.limiter = saved }()
+	CA.SetLimits(Limits{Rate: 0.001, Burst: 1, GlobalRate: 0.001, GlobalBurst: 1})
+
+	bob := WithCaller(context.Background(), "bob")
+	if err := CA.limiter.allow(WithCaller(context.Background(), "alice")); err != nil {
+		t.Fatal(err)
+	}
+	if err := CA.limiter.allow(bob); err == nil {
+		t.Fatal("want the global limit to reject bob")
+	}
+	//全局的bucket重新装满后，bob自己的额度还在
+	CA.limiter.global.SetBurstAt(time.Now(), 2)
+	CA.limiter.global.SetLimitAt(time.Now(), 1000)
+	time.Sleep(10 * time.Millisecond)
+	if err := CA.limiter.allow(bob); err != nil {
+		t.Fatalf("bob's own token was consumed by the rejected request: %v", err)
+	}
+}
+
+func TestLimiterAllowN(t *testing.T) {
+	tests := []struct {
+		name    string
+		limits  Limits
+		batches []int
+		allowed []bool
+		retry   bool
+	}{
+		{name: "unlimited", batches: []int{500, 500}, allowed: []bool{true, true}},
+		{name: "within the caller burst", limits: Limits{Rate: 0.001, Burst: 10}, batches: []int{4, 6}, allowed: []bool{true, true}},
+		{name: "not enough caller tokens", limits: Limits{Rate: 0.001, Burst: 10}, batches: []int{8, 3, 2}, allowed: []bool{true, false, true}, retry: true},
+		{name: "larger than the caller burst", limits: Limits{Rate: 0.001, Burst: 10}, batches: []int{11, 10}, allowed: []bool{false, true}},
+		{name: "not enough global tokens", limits: Limits{GlobalRate: 0.001, GlobalBurst: 5}, batches: []int{3, 3, 2}, allowed: []bool{true, false, true}, retry: true},
+		{name: "larger than the global burst", limits: Limits{Rate: 0.001, Burst: 10, GlobalRate: 0.001, GlobalBurst: 5}, batches: []int{6, 5}, allowed: []bool{false, true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := CA.limiter
+			defer func() { CA.limiter = saved }()
+			CA.SetLimits(tt.limits)
+
+			ctx := WithCaller(context.Background(), "alice")
+			for i, n := range tt.batches {
+				err := CA.limiter.allowN(ctx, n)
+				if (err == nil) != tt.allowed[i] {
+					t.Fatalf("batch %d of %d: err = %v, want allowed %v", i, n, err, tt.allowed[i])
+				}
+				if err != nil && (CodeOf(err) != ErrResourceExhausted || (err.(*Error).RetryAfter > 0) != tt.retry) {
+					t.Errorf("batch %d of %d: err = %v, RetryAfter expected %v", i, n, err, tt.retry)
+				}
+			}
+		})
+	}
+}
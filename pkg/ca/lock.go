@@ -0,0 +1,47 @@
+package ca
+
+import (
+	"os"
+)
+
+const storeLockFile string = storeFolder + "/store.lock"
+
+/*
+锁住CA目录下的存储，caserver和 ca --local 这类直接操作目录的命令共用这个锁
+每批文件修改、根证书的生成和轮换都在锁中执行，返回的函数释放锁
+同一个CA的goroutine先在 ca.storeMu 上排队，flock只在进程之间互斥
+*/
+func (ca *CertificateAuthority) lockStore() (func(), error) {
+	ca.storeMu.Lock()
+	if err := os.MkdirAll(ca.path(storeFolder), 0700); err != nil {
+		ca.storeMu.Unlock()
+		return nil, err
+	}
+	file, err := os.OpenFile(ca.path(storeLockFile), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		ca.storeMu.Unlock()
+		return nil, err
+	}
+	if err := lockFile(file); err != nil {
+		file.Close()
+		ca.storeMu.Unlock()
+		return nil, err
+	}
+	return func() {
+		unlockFile(file)
+		file.Close()
+		ca.storeMu.Unlock()
+	}, nil
+}
+
+/*
+在存储的锁中执行f
+*/
+func (ca *CertificateAuthority) withStoreLock(f func() error) error {
+	unlock, err := ca.lockStore()
+	if err != nil {
+		return WrapError(ErrInternal, "STORE_LOCK_FAILED", err, "lock the CA store fail")
+	}
+	defer unlock()
+	return f()
+}
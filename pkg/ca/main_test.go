@@ -0,0 +1,24 @@
+package ca
+
+import (
+	"log"
+	"os"
+	"testing"
+)
+
+/*
+所有测试共用临时目录中的 CA；其他包的测试用 internal/catest
+*/
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "sidecar-ca-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	CA.SetDir(dir)
+	if err := CA.Init(); err != nil {
+		log.Fatal(err)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
@@ -0,0 +1,90 @@
+package ca
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const outboxFolder string = storeFolder + "/outbox"
+
+/*
+发件箱中的一个事件，ID是文件名，按写入的顺序排序
+*/
+type OutboxEntry struct {
+	ID    string `json:"id"`
+	Event Event  `json:"event"`
+}
+
+/*
+打开事件的发件箱：签发和吊销的事件和证书、吊销记录在同一次 storage().Apply 中写进 cert/outbox，
+server崩溃或者订阅者太慢都不会丢；消费者（见 pkg/webhook）把事件放进自己持久的队列之后用 AckOutbox 删除
+多副本时发件箱随存储复制，由leader消费。要在server开始服务之前调用
+*/
+func (ca *CertificateAuthority) EnableOutbox() {
+	atomic.StoreInt32(&ca.outbox, 1)
+}
+
+/*
+事件在发件箱中的文件，没有打开发件箱时ok为false
+*/
+func (ca *CertificateAuthority) outboxChange(e *Event) (FileChange, bool, error) {
+	if atomic.LoadInt32(&ca.outbox) == 0 {
+		return FileChange{}, false, nil
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	entry := OutboxEntry{ID: fmt.Sprintf("%020d-%v-%v", e.Time.UnixNano(), e.Type, e.CertificateID), Event: *e}
+	contents, err := json.Marshal(entry)
+	if err != nil {
+		return FileChange{}, false, WrapError(ErrInternal, "STORAGE_FAILED", err, "marshal the outbox entry fail")
+	}
+	return FileChange{Op: OpWrite, Path: outboxFolder + "/" + entry.ID + ".json", Contents: contents, Perm: 0600}, true, nil
+}
+
+/*
+发件箱中还没有被确认的事件，按写入的顺序
+*/
+func (ca *CertificateAuthority) Outbox() ([]*OutboxEntry, error) {
+	files, err := filepath.Glob(ca.path(outboxFolder + "/*.json"))
+	if err != nil {
+		return nil, WrapError(ErrInternal, "STORAGE_FAILED", err, "list the outbox fail")
+	}
+	sort.Strings(files)
+	var entries []*OutboxEntry
+	for _, file := range files {
+		contents, err := os.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, WrapError(ErrInternal, "STORAGE_FAILED", err, "read %v fail", file)
+		}
+		entry := &OutboxEntry{}
+		if err := json.Unmarshal(contents, entry); err != nil {
+			return nil, WrapError(ErrInternal, "STORAGE_FAILED", err, "parse %v fail", file)
+		}
+		entry.ID = strings.TrimSuffix(filepath.Base(file), ".json")
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+/*
+消费者处理完一个事件之后从发件箱删除它，follower上返回 ErrUnavailable
+*/
+func (ca *CertificateAuthority) AckOutbox(id string) error {
+	if strings.ContainsAny(id, "/\\") || strings.Contains(id, "..") {
+		return InvalidArgument("INVALID_OUTBOX_ID", FieldViolation{Field: "id", Description: "invalid outbox entry " + id})
+	}
+	if err := ca.storage().Apply([]FileChange{{Op: OpRemove, Path: outboxFolder + "/" + id + ".json"}}); err != nil {
+		return storageError(err, "remove the outbox entry fail")
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package ca
+
+import (
+	"context"
+	"crypto/rsa"
+	cx509 "crypto/x509"
+	"encoding/pem"
+	"time"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const minRSAKeyBits int = 2048
+
+/*
+签署申请者自己生成私钥的PKCS#10 CSR（DER或PEM），私钥不经过CA
+subject和SANs按CSR中的使用，和SignX509一样检查profile、SPIFFE ID、限流和配额
+*/
+func (ca *CertificateAuthority) SignPKCS10(ctx context.Context, csrBytes []byte, profileName string) (*Certificate, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "ca.SignPKCS10")
+	defer span.End()
+
+	if err := ca.limiter.allow(ctx); err != nil {
+		return nil, recordError(span, err)
+	}
+	req, err := ParsePKCS10(csrBytes)
+	if err != nil {
+		return nil, recordError(span, err)
+	}
+	csr := fromCX509CSR(req)
+	csr.Profile = profileName
+	profile, svid, err := ca.checkRequest(ctx, csr)
+	if err != nil {
+		return nil, recordError(span, err)
+	}
+	release, err := ca.limiter.reserve(ctx)
+	if err != nil {
+		return nil, recordError(span, err)
+	}
+	defer release()
+
+	cert, err := ca.sign(ctx, req, profile, svid, profile.notAfter(time.Now()))
+	if err != nil {
+		return nil, recordError(span, err)
+	}
+	res, err := ca.persist(ctx, &IssuedCertificate{Certificate: cert}, false)
+	if err != nil {
+		return nil, recordError(span, err)
+	}
+	span.SetAttributes(attribute.String("certificate.id", res.ID))
+	return res, nil
+}
+
+/*
+解析DER或PEM编码的PKCS#10 CSR并检查它的签名，RSA公钥至少2048位
+*/
+func ParsePKCS10(csrBytes []byte) (*cx509.CertificateRequest, error) {
+	if block, _ := pem.Decode(csrBytes); block != nil {
+		if block.Type != "CERTIFICATE REQUEST" && block.Type != "NEW CERTIFICATE REQUEST" {
+			return nil, InvalidArgument("INVALID_CSR", FieldViolation{Field: "Csr", Description: "PEM block should be CERTIFICATE REQUEST, got " + block.Type})
+		}
+		csrBytes = block.Bytes
+	}
+	req, err := cx509.ParseCertificateRequest(csrBytes)
+	if err != nil {
+		return nil, InvalidArgument("INVALID_CSR", FieldViolation{Field: "Csr", Description: "not a PKCS#10 certificate request: " + err.Error()})
+	}
+	if err := req.CheckSignature(); err != nil {
+		return nil, InvalidArgument("INVALID_CSR_SIGNATURE", FieldViolation{Field: "Csr", Description: "signature doesn't match the public key: " + err.Error()})
+	}
+	if key, ok := req.PublicKey.(*rsa.PublicKey); ok && key.N.BitLen() < minRSAKeyBits {
+		return nil, InvalidArgument("WEAK_KEY", FieldViolation{Field: "Csr", Description: "RSA keys must have at least 2048 bits"})
+	}
+	return req, nil
+}
+
+/*
+把x509的CSR转化为我的Struct，用于和SignX509相同的检查
+*/
+func fromCX509CSR(req *cx509.CertificateRequest) *CertificateSigningRequest {
+	csr := &CertificateSigningRequest{
+		Version:                   req.Version,
+		SubjectCountry:            req.Subject.Country,
+		SubjectOrganization:       req.Subject.Organization,
+		SubjectOrganizationalUnit: req.Subject.OrganizationalUnit,
+		SubjectLocality:           req.Subject.Locality,
+		SubjectProvince:           req.Subject.Province,
+		SubjectStreetAddress:      req.Subject.StreetAddress,
+		SubjectPostalCode:         req.Subject.PostalCode,
+		SubjectSerialNumber:       req.Subject.SerialNumber,
+		SubjectCommonName:         req.Subject.CommonName,
+		PublicKeyAlg:              req.PublicKeyAlgorithm,
+		SignatureAlgorithm:        req.SignatureAlgorithm,
+		DNSNames:                  req.DNSNames,
+		EmailAddresses:            req.EmailAddresses,
+		IPAddresses:               req.IPAddresses,
+	}
+	for _, uri := range req.URIs {
+		csr.URIs = append(csr.URIs, *uri)
+	}
+	return csr
+}
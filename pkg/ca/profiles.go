@@ -0,0 +1,59 @@
+package ca
+
+import (
+	cx509 "crypto/x509"
+	"time"
+)
+
+/*
+签发证书的模板：有效期和用途，授权时按profile分配签发的权限（sign:<profile>）
+*/
+type Profile struct {
+	Name        string
+	Validity    time.Duration //为0时是一年，和以前签发的证书一样
+	ExtKeyUsage []cx509.ExtKeyUsage
+}
+
+const DefaultProfile string = "default"
+
+var Profiles = map[string]Profile{
+	DefaultProfile: {Name: DefaultProfile},
+	"server":       {Name: "server", Validity: 90 * 24 * time.Hour, ExtKeyUsage: []cx509.ExtKeyUsage{cx509.ExtKeyUsageServerAuth}},
+	"client":       {Name: "client", Validity: 90 * 24 * time.Hour, ExtKeyUsage: []cx509.ExtKeyUsage{cx509.ExtKeyUsageClientAuth}},
+}
+
+/*
+CSR选择的profile，没有选时用default
+*/
+func ProfileOf(csr *CertificateSigningRequest) (Profile, error) {
+	name := csr.Profile
+	if name == "" {
+		name = DefaultProfile
+	}
+	profile, ok := Profiles[name]
+	if !ok {
+		return Profile{}, InvalidArgument("UNKNOWN_PROFILE", FieldViolation{Field: "Profile", Description: "must be default, server or client"})
+	}
+	return profile, nil
+}
+
+/*
+从证书的用途推断签发它的profile，用于续签
+*/
+func ProfileOfCertificate(cert *cx509.Certificate) string {
+	if len(cert.ExtKeyUsage) == 1 {
+		for _, profile := range Profiles {
+			if len(profile.ExtKeyUsage) == 1 && profile.ExtKeyUsage[0] == cert.ExtKeyUsage[0] {
+				return profile.Name
+			}
+		}
+	}
+	return DefaultProfile
+}
+
+func (p Profile) notAfter(from time.Time) time.Time {
+	if p.Validity == 0 {
+		return from.AddDate(1, 0, 0)
+	}
+	return from.Add(p.Validity)
+}
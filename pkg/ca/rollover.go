@@ -0,0 +1,542 @@
+package ca
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	cx509 "crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"log"
+	"math/big"
+	mathRand "math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+/*
+根证书轮换分三个阶段：
+prepared：生成了新的根证书，新旧根证书互相交叉签名，并一起出现在trust bundle中，仍用旧根证书签发
+active：到了约定的时间，改用新根证书签发，旧根证书仍被信任，用旧根证书签发的证书仍然有效
+retire 之后：旧根证书和交叉签名证书从trust bundle中移除，轮换结束，回到idle
+*/
+type RolloverPhase string
+
+const (
+	RolloverIdle     RolloverPhase = "idle"
+	RolloverPrepared RolloverPhase = "prepared"
+	RolloverActive   RolloverPhase = "active"
+)
+
+const (
+	rolloverFolder    string = rootCAFolder + "/rollover"
+	rolloverStateFile string = rolloverFolder + "/state.json"
+
+	newRootFile      string = "new.crt"
+	newRootKeyFile   string = "new.private.key"
+	oldRootFile      string = "old.crt"
+	oldRootKeyFile   string = "old.private.key"
+	newByOldCertFile string = "new-by-old.crt" //新根证书的公钥，由旧根证书签名，只信任旧根证书的客户端靠它验证新证书
+	oldByNewCertFile string = "old-by-new.crt" //旧根证书的公钥，由新根证书签名，只信任新根证书的客户端靠它验证旧证书
+)
+
+/*
+持久化在 state.json 中的轮换状态
+*/
+type rolloverRecord struct {
+	Phase       RolloverPhase `json:"phase"`
+	SwitchAt    time.Time     `json:"switchAt"`
+	PreparedAt  time.Time     `json:"preparedAt"`
+	ActivatedAt time.Time     `json:"activatedAt,omitempty"`
+}
+
+type rolloverState struct {
+	rolloverRecord
+	otherRoot  *cx509.Certificate //prepared时是新根证书，active时是旧根证书
+	otherKey   *rsa.PrivateKey    //另一个根证书的私钥，prepared时激活要用，active时用来签旧根证书的CRL
+	crossCerts []*cx509.Certificate
+	modTime    time.Time //state.json 的修改时间，用来发现CLI做的修改
+}
+
+/*
+一张CA证书的概要
+*/
+type CAInfo struct {
+	Subject      string    `json:"subject"`
+	Issuer       string    `json:"issuer"`
+	SerialNumber string    `json:"serialNumber"`
+	Fingerprint  string    `json:"sha256Fingerprint"`
+	NotBefore    time.Time `json:"notBefore"`
+	NotAfter     time.Time `json:"notAfter"`
+}
+
+/*
+根证书轮换的状态
+*/
+type RolloverStatus struct {
+	Phase             RolloverPhase `json:"phase"`
+	SwitchAt          *time.Time    `json:"switchAt,omitempty"`
+	PreparedAt        *time.Time    `json:"preparedAt,omitempty"`
+	ActivatedAt       *time.Time    `json:"activatedAt,omitempty"`
+	IssuingRoot       CAInfo        `json:"issuingRoot"`
+	NextRoot          *CAInfo       `json:"nextRoot,omitempty"`     //prepared 阶段
+	PreviousRoot      *CAInfo       `json:"previousRoot,omitempty"` //active 阶段
+	CrossCertificates []CAInfo      `json:"crossCertificates,omitempty"`
+	PreviousRootLeafs int           `json:"previousRootValidLeafs"` //active 阶段仍未过期、由旧根证书签发的证书数
+}
+
+func caInfo(cert *cx509.Certificate) CAInfo {
+	fingerprint := sha256.Sum256(cert.Raw)
+	return CAInfo{
+		Subject:      cert.Subject.String(),
+		Issuer:       cert.Issuer.String(),
+		SerialNumber: cert.SerialNumber.String(),
+		Fingerprint:  hex.EncodeToString(fingerprint[:]),
+		NotBefore:    cert.NotBefore,
+		NotAfter:     cert.NotAfter,
+	}
+}
+
+/*
+第一步：生成新的根证书和交叉签名证书，并发布到trust bundle中，switchAt之后改用新根证书签发
+新根证书、交叉签名证书和轮换状态在一次 storage().Apply 中写入，多副本时通过raft复制
+*/
+func (ca *CertificateAuthority) PrepareRollover(switchAt time.Time) (*RolloverStatus, error) {
+	var changes []FileChange
+	//只在锁中检查状态、生成证书，Apply自己会拿存储的锁
+	err := ca.withStoreLock(func() error {
+		//另一个进程（caserver或命令行）可能已经修改了根证书目录
+		if err := ca.reload(); err != nil {
+			return WrapError(ErrInternal, "STORAGE_FAILED", err, "load the root CA fail")
+		}
+		ca.mu.Lock()
+		if ca.rollover != nil {
+			ca.mu.Unlock()
+			return NewError(ErrFailedPrecondition, "ROLLOVER_IN_PROGRESS", "a rollover is already %v", ca.rollover.Phase)
+		}
+		oldRoot, oldKey := &ca.RootCA, ca.PrivateKey
+		ca.mu.Unlock()
+
+		rootChanges, newRoot, newKey, err := ca.newRootCA(rolloverFolder, newRootFile, newRootKeyFile)
+		if err != nil {
+			return WrapError(ErrInternal, "ROOT_GENERATION_FAILED", err, "create the new root CA fail")
+		}
+		newByOld, err := crossSign(newRoot, oldRoot, oldKey, newByOldCertFile)
+		if err != nil {
+			return err
+		}
+		oldByNew, err := crossSign(oldRoot, newRoot, newKey, oldByNewCertFile)
+		if err != nil {
+			return err
+		}
+		record, err := rolloverRecordChange(rolloverRecord{Phase: RolloverPrepared, SwitchAt: switchAt, PreparedAt: time.Now()})
+		if err != nil {
+			return err
+		}
+		changes = append(rootChanges, newByOld, oldByNew, record)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := ca.storage().Apply(changes); err != nil {
+		return nil, storageError(err, "persist the new root CA fail")
+	}
+	err = ca.withStoreLock(func() error {
+		if err := ca.reload(); err != nil {
+			return WrapError(ErrInternal, "STORAGE_FAILED", err, "load the rollover state fail")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("root CA rollover prepared, issuance switches to the new root at %v", switchAt)
+	ca.publish(Event{Type: EventTrustBundleChanged, Reason: "root CA rollover prepared"})
+	return ca.RolloverStatus()
+}
+
+/*
+第二步：改用新根证书签发，时间没到switchAt时需要force
+新旧根证书文件的交换和轮换状态的修改在一次 storage().Apply 中完成，失败时整批回滚，多副本时通过raft复制
+本地server的证书会用新根证书重新签发，并带上交叉签名证书，只信任旧根证书的客户端仍然可以验证它
+*/
+func (ca *CertificateAuthority) ActivateRollover(force bool) (*RolloverStatus, error) {
+	var changes []FileChange
+	//只在锁中检查状态、读出文件，Apply自己会拿存储的锁
+	err := ca.withStoreLock(func() error {
+		if err := ca.reload(); err != nil {
+			return WrapError(ErrInternal, "STORAGE_FAILED", err, "load the root CA fail")
+		}
+		ca.mu.RLock()
+		state := ca.rollover
+		ca.mu.RUnlock()
+		if state == nil || state.Phase != RolloverPrepared {
+			return NewError(ErrFailedPrecondition, "ROLLOVER_NOT_PREPARED", "no prepared rollover to activate")
+		}
+		if !force && time.Now().Before(state.SwitchAt) {
+			return NewError(ErrFailedPrecondition, "ROLLOVER_NOT_DUE", "issuance switches to the new root at %v", state.SwitchAt)
+		}
+
+		var err error
+		changes, err = ca.activationChanges(state.rolloverRecord)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := ca.storage().Apply(changes); err != nil {
+		return nil, storageError(err, "switch the root CA files fail")
+	}
+	err = ca.withStoreLock(func() error {
+		if err := ca.reload(); err != nil {
+			return WrapError(ErrInternal, "STORAGE_FAILED", err, "load the root CA fail")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := ca.resignLocalCert(); err != nil {
+		log.Printf("re-sign the local certificate with the new root fail: %v", err)
+	}
+	log.Print("root CA rollover activated, new certificates are issued by the new root")
+	ca.publish(Event{Type: EventTrustBundleChanged, Reason: "root CA rollover activated"})
+	return ca.RolloverStatus()
+}
+
+/*
+激活轮换的一批修改：旧根证书移到 rollover/old.*，新根证书移到根证书的位置，状态改为active
+*/
+func (ca *CertificateAuthority) activationChanges(record rolloverRecord) ([]FileChange, error) {
+	moves := [][2]string{
+		{rootCALocation, rolloverFolder + "/" + oldRootFile},
+		{rsaPrivateKeyLocation, rolloverFolder + "/" + oldRootKeyFile},
+		{rolloverFolder + "/" + newRootFile, rootCALocation},
+		{rolloverFolder + "/" + newRootKeyFile, rsaPrivateKeyLocation},
+	}
+	var changes []FileChange
+	for _, move := range moves {
+		info, err := os.Stat(ca.path(move[0]))
+		if err != nil {
+			return nil, WrapError(ErrInternal, "STORAGE_FAILED", err, "read %v fail", move[0])
+		}
+		contents, err := os.ReadFile(ca.path(move[0]))
+		if err != nil {
+			return nil, WrapError(ErrInternal, "STORAGE_FAILED", err, "read %v fail", move[0])
+		}
+		changes = append(changes, FileChange{Op: OpWrite, Path: move[1], Contents: contents, Perm: info.Mode().Perm()})
+	}
+	changes = append(changes,
+		FileChange{Op: OpRemove, Path: rolloverFolder + "/" + newRootFile},
+		FileChange{Op: OpRemove, Path: rolloverFolder + "/" + newRootKeyFile})
+
+	record.Phase = RolloverActive
+	record.ActivatedAt = time.Now()
+	change, err := rolloverRecordChange(record)
+	if err != nil {
+		return nil, err
+	}
+	return append(changes, change), nil
+}
+
+/*
+第三步：不再信任旧根证书。还有未过期的、由旧根证书签发的证书时需要force
+旧的文件会被移到 rollover/retired-<时间> 下，而不是删除，移动在一次 storage().Apply 中完成
+*/
+func (ca *CertificateAuthority) RetireRollover(force bool) (*RolloverStatus, error) {
+	var archive string
+	var changes []FileChange
+	err := ca.withStoreLock(func() error {
+		if err := ca.reload(); err != nil {
+			return WrapError(ErrInternal, "STORAGE_FAILED", err, "load the root CA fail")
+		}
+		status, err := ca.RolloverStatus()
+		if err != nil {
+			return err
+		}
+		if status.Phase != RolloverActive {
+			return NewError(ErrFailedPrecondition, "ROLLOVER_NOT_ACTIVE", "the rollover must be active before the old root is retired")
+		}
+		if status.PreviousRootLeafs > 0 && !force {
+			caErr := NewError(ErrFailedPrecondition, "OLD_ROOT_IN_USE", "%d valid certificates are still issued by the old root", status.PreviousRootLeafs)
+			caErr.Metadata = map[string]string{"validLeafs": strconv.Itoa(status.PreviousRootLeafs)}
+			return caErr
+		}
+
+		archive = rolloverFolder + "/retired-" + time.Now().Format("2006-01-02_15-04-05")
+		for _, file := range []string{oldRootFile, oldRootKeyFile, newByOldCertFile, oldByNewCertFile, "state.json"} {
+			from := rolloverFolder + "/" + file
+			info, err := os.Stat(ca.path(from))
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return WrapError(ErrInternal, "STORAGE_FAILED", err, "read %v fail", from)
+			}
+			contents, err := os.ReadFile(ca.path(from))
+			if err != nil {
+				return WrapError(ErrInternal, "STORAGE_FAILED", err, "read %v fail", from)
+			}
+			changes = append(changes,
+				FileChange{Op: OpWrite, Path: archive + "/" + file, Contents: contents, Perm: info.Mode().Perm()},
+				FileChange{Op: OpRemove, Path: from})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := ca.storage().Apply(changes); err != nil {
+		return nil, storageError(err, "archive the old root CA fail")
+	}
+	err = ca.withStoreLock(func() error {
+		if err := ca.reload(); err != nil {
+			return WrapError(ErrInternal, "STORAGE_FAILED", err, "load the root CA fail")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	//本地证书不再需要交叉签名证书
+	if err := ca.resignLocalCert(); err != nil {
+		log.Printf("re-sign the local certificate fail: %v", err)
+	}
+	log.Printf("old root CA retired, archived at %v", archive)
+	ca.publish(Event{Type: EventTrustBundleChanged, Reason: "old root CA retired"})
+	return ca.RolloverStatus()
+}
+
+/*
+返回根证书轮换的状态
+加载之后的rolloverState不会再被修改，统计旧根证书签发的证书要扫描整个目录，放在锁外做
+*/
+func (ca *CertificateAuthority) RolloverStatus() (*RolloverStatus, error) {
+	ca.mu.RLock()
+	status := &RolloverStatus{Phase: RolloverIdle, IssuingRoot: caInfo(&ca.RootCA)}
+	state := ca.rollover
+	ca.mu.RUnlock()
+	if state == nil {
+		return status, nil
+	}
+	status.Phase = state.Phase
+	status.SwitchAt = &state.SwitchAt
+	status.PreparedAt = &state.PreparedAt
+	if state.Phase == RolloverActive {
+		status.ActivatedAt = &state.ActivatedAt
+	}
+	other := caInfo(state.otherRoot)
+	if state.Phase == RolloverPrepared {
+		status.NextRoot = &other
+	} else {
+		status.PreviousRoot = &other
+		status.PreviousRootLeafs = ca.countValidLeafs(state.otherRoot)
+	}
+	for _, cert := range state.crossCerts {
+		status.CrossCertificates = append(status.CrossCertificates, caInfo(cert))
+	}
+	return status, nil
+}
+
+/*
+定期检查轮换状态：到了switchAt就改用新根证书签发；CLI修改了磁盘上的状态时重新加载
+多副本时只有leader切换根证书，CLI要在leader所在的机器上执行，leader重新加载后把根证书目录复制给其他副本
+*/
+func (ca *CertificateAuthority) RunRolloverScheduler(interval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		if ca.rolloverChangedOnDisk() {
+			if err := ca.reload(); err != nil {
+				log.Printf("reload root CA fail: %v", err)
+				continue
+			}
+			log.Print("root CA rollover state changed on disk, reloaded")
+			ca.publish(Event{Type: EventTrustBundleChanged, Reason: "root CA reloaded"})
+			ca.syncRootCA()
+		}
+
+		ca.mu.RLock()
+		due := ca.IsLeader() && ca.rollover != nil && ca.rollover.Phase == RolloverPrepared && !time.Now().Before(ca.rollover.SwitchAt)
+		ca.mu.RUnlock()
+		if due {
+			if _, err := ca.ActivateRollover(false); err != nil {
+				log.Printf("activate root CA rollover fail: %v", err)
+			}
+		}
+	}
+}
+
+func (ca *CertificateAuthority) rolloverChangedOnDisk() bool {
+	info, err := os.Stat(ca.path(rolloverStateFile))
+	ca.mu.RLock()
+	defer ca.mu.RUnlock()
+	if err != nil {
+		return ca.rollover != nil
+	}
+	return ca.rollover == nil || !info.ModTime().Equal(ca.rollover.modTime)
+}
+
+/*
+重新从磁盘加载根证书和轮换状态
+*/
+func (ca *CertificateAuthority) reload() error {
+	rootCA, privateKey, err := ca.loadCAKeyPair(rootCALocation, rsaPrivateKeyLocation)
+	if err != nil {
+		return err
+	}
+	//复制过来的可能是还没有加密的私钥
+	if err := ca.encryptRootKeys(); err != nil {
+		return err
+	}
+	ca.mu.Lock()
+	ca.RootCA = *rootCA
+	ca.PrivateKey = privateKey
+	ca.mu.Unlock()
+	return ca.loadRollover()
+}
+
+/*
+从磁盘加载轮换状态，没有进行中的轮换时 ca.rollover 为nil
+*/
+func (ca *CertificateAuthority) loadRollover() error {
+	info, err := os.Stat(ca.path(rolloverStateFile))
+	if os.IsNotExist(err) {
+		ca.mu.Lock()
+		ca.rollover = nil
+		ca.mu.Unlock()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	contents, err := os.ReadFile(ca.path(rolloverStateFile))
+	if err != nil {
+		return err
+	}
+	state := &rolloverState{modTime: info.ModTime()}
+	if err := json.Unmarshal(contents, &state.rolloverRecord); err != nil {
+		return err
+	}
+
+	switch state.Phase {
+	case RolloverPrepared:
+		state.otherRoot, state.otherKey, err = ca.loadCAKeyPair(rolloverFolder+"/"+newRootFile, rolloverFolder+"/"+newRootKeyFile)
+	case RolloverActive:
+		//旧根证书的私钥还在时用它给旧根证书签发的证书签CRL
+		state.otherRoot, state.otherKey, err = ca.loadCAKeyPair(rolloverFolder+"/"+oldRootFile, rolloverFolder+"/"+oldRootKeyFile)
+		if err != nil {
+			state.otherRoot, err = loadCertificateFile(ca.path(rolloverFolder + "/" + oldRootFile))
+		}
+	default:
+		return NewError(ErrInternal, "UNKNOWN_ROLLOVER_PHASE", "unknown rollover phase %v", state.Phase)
+	}
+	if err != nil {
+		return err
+	}
+	for _, file := range []string{newByOldCertFile, oldByNewCertFile} {
+		cert, err := loadCertificateFile(ca.path(rolloverFolder + "/" + file))
+		if err != nil {
+			return err
+		}
+		state.crossCerts = append(state.crossCerts, cert)
+	}
+
+	ca.mu.Lock()
+	ca.rollover = state
+	ca.mu.Unlock()
+	return nil
+}
+
+/*
+把轮换状态写进 state.json 的修改
+*/
+func rolloverRecordChange(record rolloverRecord) (FileChange, error) {
+	contents, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return FileChange{}, WrapError(ErrInternal, "STORAGE_FAILED", err, "marshal rollover state fail")
+	}
+	return FileChange{Op: OpWrite, Path: rolloverStateFile, Contents: contents, Perm: 0600}, nil
+}
+
+/*
+用issuer为subject的公钥签发一张CA证书，subject name 和 subject key id 都保持不变，
+这样用subject签发的证书也可以通过它链到issuer；返回把它写到 rollover/fileName 的修改
+*/
+func crossSign(subject *cx509.Certificate, issuer *cx509.Certificate, issuerKey *rsa.PrivateKey, fileName string) (FileChange, error) {
+	notAfter := subject.NotAfter
+	if issuer.NotAfter.Before(notAfter) {
+		notAfter = issuer.NotAfter
+	}
+	mathRand.Seed(time.Now().UnixNano())
+	template := cx509.Certificate{
+		SerialNumber:          big.NewInt((int64)(mathRand.Int())),
+		Subject:               subject.Subject,
+		RawSubject:            subject.RawSubject,
+		SubjectKeyId:          subject.SubjectKeyId,
+		AuthorityKeyId:        issuer.SubjectKeyId, //新旧根证书的名字相同，不显式设置的话会被当成自签名证书
+		NotBefore:             time.Now(),
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              cx509.KeyUsageCertSign | cx509.KeyUsageCRLSign,
+	}
+	buf, err := cx509.CreateCertificate(rand.Reader, &template, issuer, subject.PublicKey, issuerKey)
+	if err != nil {
+		log.Print("cross sign the root ca fail")
+		return FileChange{}, WrapError(ErrInternal, "SIGNING_FAILED", err, "cross sign the root CA fail")
+	}
+	contents := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: buf})
+	return FileChange{Op: OpWrite, Path: rolloverFolder + "/" + fileName, Contents: contents, Perm: 0644}, nil
+}
+
+/*
+用当前的根证书重新签发本地server的证书，通过 storage().Apply 写入，调用者不能持有存储的锁
+*/
+func (ca *CertificateAuthority) resignLocalCert() error {
+	changes, err := ca.localCertChanges()
+	if err != nil {
+		return err
+	}
+	return ca.storage().Apply(changes)
+}
+
+/*
+统计仍未过期、由root签发的证书
+*/
+func (ca *CertificateAuthority) countValidLeafs(root *cx509.Certificate) int {
+	files, err := filepath.Glob(ca.path(clientCAFolder + "/*.crt"))
+	if err != nil {
+		return 0
+	}
+	count := 0
+	now := time.Now()
+	for _, file := range files {
+		contents, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		block, _ := pem.Decode(contents)
+		if block == nil {
+			continue
+		}
+		cert, err := cx509.ParseCertificate(block.Bytes)
+		if err != nil || now.After(cert.NotAfter) {
+			continue
+		}
+		if cert.CheckSignatureFrom(root) == nil {
+			count++
+		}
+	}
+	return count
+}
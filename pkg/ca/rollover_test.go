@@ -0,0 +1,128 @@
+package ca
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestActivateRollover(t *testing.T) {
+	if _, err := CA.ActivateRollover(true); CodeOf(err) != ErrFailedPrecondition {
+		t.Fatalf("activate without a prepared rollover: want FailedPrecondition, got %v", err)
+	}
+	oldRoot := caInfo(&CA.RootCA)
+	prepared, err := CA.PrepareRollover(time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer CA.RetireRollover(true)
+
+	tests := []struct {
+		name    string
+		force   bool
+		wantErr bool
+	}{
+		{name: "before the switch time", wantErr: true},
+		{name: "forced", force: true},
+		{name: "already active", force: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, err := CA.ActivateRollover(tt.force)
+			if tt.wantErr {
+				if CodeOf(err) != ErrFailedPrecondition {
+					t.Fatalf("want FailedPrecondition, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status.Phase != RolloverActive {
+				t.Errorf("phase = %v, want %v", status.Phase, RolloverActive)
+			}
+			if status.IssuingRoot.Fingerprint != prepared.NextRoot.Fingerprint {
+				t.Error("the new root doesn't issue after the activation")
+			}
+			if status.PreviousRoot == nil || status.PreviousRoot.Fingerprint != oldRoot.Fingerprint {
+				t.Error("the old root isn't kept as the previous root")
+			}
+			onDisk, err := loadCertificateFile(CA.path(rootCALocation))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if caInfo(onDisk).Fingerprint != prepared.NextRoot.Fingerprint {
+				t.Error("the new root isn't written to " + rootCALocation)
+			}
+			for _, file := range []string{newRootFile, newRootKeyFile} {
+				if _, err := os.Stat(CA.path(rolloverFolder + "/" + file)); !os.IsNotExist(err) {
+					t.Errorf("%v is left in the rollover folder", file)
+				}
+			}
+		})
+	}
+}
+
+/*
+记下经过Apply的修改，用来检查轮换的每一步都写进了存储，而不是直接改本地文件
+*/
+type recordingStore struct {
+	localStore
+	paths map[string]bool
+}
+
+func (s *recordingStore) Apply(changes []FileChange) error {
+	for _, change := range changes {
+		s.paths[change.Path] = true
+	}
+	return s.localStore.Apply(changes)
+}
+
+func TestRolloverThroughStore(t *testing.T) {
+	authority := New(t.TempDir())
+	if err := authority.Init(); err != nil {
+		t.Fatal(err)
+	}
+	store := &recordingStore{localStore: localStore{authority}, paths: map[string]bool{}}
+	authority.SetStore(store)
+
+	steps := []struct {
+		name  string
+		run   func() (*RolloverStatus, error)
+		paths []string
+	}{
+		{
+			name:  "prepare",
+			run:   func() (*RolloverStatus, error) { return authority.PrepareRollover(time.Now()) },
+			paths: []string{rolloverFolder + "/" + newRootFile, rolloverFolder + "/" + newRootKeyFile, rolloverFolder + "/" + newByOldCertFile, rolloverFolder + "/" + oldByNewCertFile, rolloverStateFile},
+		},
+		{
+			name:  "activate",
+			run:   func() (*RolloverStatus, error) { return authority.ActivateRollover(false) },
+			paths: []string{rootCALocation, rsaPrivateKeyLocation, rolloverStateFile, localCertLocation, localKeyLocation},
+		},
+		{
+			name:  "retire",
+			run:   func() (*RolloverStatus, error) { return authority.RetireRollover(true) },
+			paths: []string{rolloverFolder + "/" + oldRootFile, rolloverStateFile, localCertLocation},
+		},
+	}
+	for _, step := range steps {
+		store.paths = map[string]bool{}
+		if _, err := step.run(); err != nil {
+			t.Fatalf("%v: %v", step.name, err)
+		}
+		for _, path := range step.paths {
+			if !store.paths[path] {
+				t.Errorf("%v didn't write %v through the store", step.name, path)
+			}
+		}
+	}
+	status, err := authority.RolloverStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Phase != RolloverIdle {
+		t.Errorf("phase after retire = %v, want %v", status.Phase, RolloverIdle)
+	}
+}
@@ -0,0 +1,214 @@
+package ca
+
+import (
+	"context"
+	cx509 "crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const spiffeScheme string = "spiffe"
+
+/*
+一个SPIFFE ID，形如 spiffe://trust-domain/path
+*/
+type SPIFFEID struct {
+	TrustDomain string
+	Path        string
+}
+
+func (id SPIFFEID) String() string {
+	return spiffeScheme + "://" + id.TrustDomain + id.Path
+}
+
+func (id SPIFFEID) URL() url.URL {
+	return url.URL{Scheme: spiffeScheme, Host: id.TrustDomain, Path: id.Path}
+}
+
+/*
+按SPIFFE规范解析SPIFFE ID：trust domain只能是小写字母、数字、'.'、'-'、'_'，
+不能有端口、userinfo、query和fragment，path的每一段不能为空，也不能是'.'或'..'
+*/
+func ParseSPIFFEID(s string) (SPIFFEID, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return SPIFFEID{}, fmt.Errorf("%q is not a valid URI", s)
+	}
+	return spiffeIDFromURL(u)
+}
+
+func spiffeIDFromURL(u *url.URL) (SPIFFEID, error) {
+	if u.Scheme != spiffeScheme {
+		return SPIFFEID{}, fmt.Errorf("scheme of %q must be %v", u.String(), spiffeScheme)
+	}
+	if u.User != nil || u.Port() != "" || u.RawQuery != "" || u.Fragment != "" || u.Opaque != "" {
+		return SPIFFEID{}, fmt.Errorf("%q must not have userinfo, port, query or fragment", u.String())
+	}
+	if err := ValidateTrustDomain(u.Host); err != nil {
+		return SPIFFEID{}, err
+	}
+	if u.Path != "" {
+		for _, segment := range strings.Split(strings.TrimPrefix(u.Path, "/"), "/") {
+			if segment == "" || segment == "." || segment == ".." {
+				return SPIFFEID{}, fmt.Errorf("path of %q has an empty, '.' or '..' segment", u.String())
+			}
+			for _, c := range segment {
+				if !isSPIFFEChar(c, true) {
+					return SPIFFEID{}, fmt.Errorf("path of %q contains invalid character %q", u.String(), c)
+				}
+			}
+		}
+	}
+	return SPIFFEID{TrustDomain: u.Host, Path: u.Path}, nil
+}
+
+func ValidateTrustDomain(td string) error {
+	if td == "" {
+		return fmt.Errorf("trust domain must not be empty")
+	}
+	for _, c := range td {
+		if !isSPIFFEChar(c, false) {
+			return fmt.Errorf("trust domain %q contains invalid character %q", td, c)
+		}
+	}
+	return nil
+}
+
+func isSPIFFEChar(c rune, allowUpper bool) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '.', c == '-', c == '_':
+		return true
+	case allowUpper && c >= 'A' && c <= 'Z':
+		return true
+	}
+	return false
+}
+
+/*
+设置CA所在的trust domain，设置以后CA可以签发该trust domain下的X.509-SVID
+*/
+func (ca *CertificateAuthority) SetTrustDomain(td string) error {
+	if err := ValidateTrustDomain(td); err != nil {
+		return err
+	}
+	ca.TrustDomain = td
+	return nil
+}
+
+/*
+加载一个联邦trust domain的根证书（PEM，可以包含多张），和本CA的根证书一起作为trust bundle对外提供
+*/
+func (ca *CertificateAuthority) LoadFederatedBundle(td string, pemFile string) error {
+	if err := ValidateTrustDomain(td); err != nil {
+		return err
+	}
+	if td == ca.TrustDomain {
+		return fmt.Errorf("trust domain %v is served by this CA", td)
+	}
+	contents, err := os.ReadFile(pemFile)
+	if err != nil {
+		return err
+	}
+	var certs []*cx509.Certificate
+	for block, rest := pem.Decode(contents); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := cx509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return fmt.Errorf("no certificate in %v", pemFile)
+	}
+	ca.bundleMu.Lock()
+	if ca.federatedBundles == nil {
+		ca.federatedBundles = map[string][]*cx509.Certificate{}
+	}
+	ca.federatedBundles[td] = certs
+	ca.bundleMu.Unlock()
+	ca.publish(Event{Type: EventTrustBundleChanged, Identity: td})
+	return nil
+}
+
+/*
+返回所有trust domain的trust bundle，key是trust domain
+*/
+func (ca *CertificateAuthority) TrustBundles() map[string][]*cx509.Certificate {
+	bundles := map[string][]*cx509.Certificate{}
+	if ca.TrustDomain != "" {
+		bundles[ca.TrustDomain] = ca.trustedRoots()
+	}
+	ca.bundleMu.RLock()
+	defer ca.bundleMu.RUnlock()
+	for td, certs := range ca.federatedBundles {
+		bundles[td] = certs
+	}
+	return bundles
+}
+
+/*
+返回某个trust domain的trust bundle
+*/
+func (ca *CertificateAuthority) TrustBundle(td string) ([]*cx509.Certificate, error) {
+	certs, ok := ca.TrustBundles()[td]
+	if !ok {
+		caErr := NewError(ErrNotFound, "TRUST_DOMAIN_NOT_FOUND", "no trust bundle for trust domain %v", td)
+		caErr.Metadata = map[string]string{"trustDomain": td}
+		return nil, caErr
+	}
+	return certs, nil
+}
+
+/*
+为一个SPIFFE ID签发X.509-SVID，csr中不能再有别的URI
+*/
+func (ca *CertificateAuthority) SignX509SVID(ctx context.Context, id string, csr *CertificateSigningRequest) (*Certificate, error) {
+	spiffeID, err := ParseSPIFFEID(id)
+	if err != nil {
+		return nil, InvalidArgument("INVALID_SPIFFE_ID", FieldViolation{Field: "URIs", Description: err.Error()})
+	}
+	if len(csr.URIs) > 0 {
+		return nil, InvalidArgument("INVALID_SVID_REQUEST", FieldViolation{Field: "URIs", Description: "an X.509-SVID must have exactly one URI SAN"})
+	}
+	csr.URIs = []url.URL{spiffeID.URL()}
+	return ca.SignX509(ctx, csr)
+}
+
+/*
+如果CSR包含spiffe:// URI，就是在申请X.509-SVID，按规范检查：
+只能有一个URI SAN，必须属于本CA的trust domain
+返回nil表示这不是一个SVID申请
+*/
+func (ca *CertificateAuthority) checkSVID(csr *CertificateSigningRequest) (*SPIFFEID, error) {
+	var spiffeURIs []int
+	for i := range csr.URIs {
+		if csr.URIs[i].Scheme == spiffeScheme {
+			spiffeURIs = append(spiffeURIs, i)
+		}
+	}
+	if len(spiffeURIs) == 0 {
+		return nil, nil
+	}
+	if len(csr.URIs) != 1 {
+		return nil, InvalidArgument("INVALID_SVID_REQUEST", FieldViolation{Field: "URIs", Description: "an X.509-SVID must have exactly one URI SAN"})
+	}
+	id, err := spiffeIDFromURL(&csr.URIs[0])
+	if err != nil {
+		return nil, InvalidArgument("INVALID_SPIFFE_ID", FieldViolation{Field: "URIs[0]", Description: err.Error()})
+	}
+	if ca.TrustDomain == "" {
+		return nil, NewError(ErrFailedPrecondition, "TRUST_DOMAIN_NOT_CONFIGURED", "this CA doesn't issue X.509-SVIDs, no trust domain is configured")
+	}
+	if id.TrustDomain != ca.TrustDomain {
+		caErr := NewError(ErrPermissionDenied, "TRUST_DOMAIN_MISMATCH", "this CA only issues X.509-SVIDs for trust domain %v", ca.TrustDomain)
+		caErr.Metadata = map[string]string{"trustDomain": id.TrustDomain}
+		return nil, caErr
+	}
+	return &id, nil
+}
@@ -0,0 +1,49 @@
+package ca
+
+import "testing"
+
+func TestParseSPIFFEID(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    SPIFFEID
+		wantErr bool
+	}{
+		{in: "spiffe://example.org/web", want: SPIFFEID{TrustDomain: "example.org", Path: "/web"}},
+		{in: "spiffe://example.org", want: SPIFFEID{TrustDomain: "example.org"}},
+		{in: "spiffe://my_td-1.example.org/ns/Prod/sa/Web-1", want: SPIFFEID{TrustDomain: "my_td-1.example.org", Path: "/ns/Prod/sa/Web-1"}},
+		{in: "https://example.org/web", wantErr: true},
+		{in: "spiffe://Example.org/web", wantErr: true},
+		{in: "spiffe:///web", wantErr: true},
+		{in: "spiffe://example.org:443/web", wantErr: true},
+		{in: "spiffe://user@example.org/web", wantErr: true},
+		{in: "spiffe://example.org/web?x=1", wantErr: true},
+		{in: "spiffe://example.org/web#x", wantErr: true},
+		{in: "spiffe://example.org/", wantErr: true},
+		{in: "spiffe://example.org//web", wantErr: true},
+		{in: "spiffe://example.org/web/", wantErr: true},
+		{in: "spiffe://example.org/./web", wantErr: true},
+		{in: "spiffe://example.org/../web", wantErr: true},
+		{in: "spiffe://example.org/we$b", wantErr: true},
+		{in: "spiffe:example.org/web", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseSPIFFEID(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("want an error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			if got.String() != tt.in {
+				t.Errorf("String() = %v, want %v", got.String(), tt.in)
+			}
+		})
+	}
+}
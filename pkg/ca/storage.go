@@ -0,0 +1,131 @@
+package ca
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/pem"
+	"os"
+	"time"
+)
+
+/*
+证书的id：签发时间加上随机数，同一秒内签发多张证书（例如批量签发）也不会重复
+*/
+func newCertificateID() (string, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return time.Now().Format("2006-01-02_15-04-05") + "-" + hex.EncodeToString(suffix), nil
+}
+
+/*
+一个要写到 cert/clientCert 中的文件
+*/
+type pendingFile struct {
+	name     string
+	contents []byte
+	perm     os.FileMode
+}
+
+/*
+签发好、还没有写到磁盘上的证书
+*/
+type pendingCertificate struct {
+	Certificate
+	issued    *IssuedCertificate
+	owner     string
+	sealed    bool
+	renewalOf string
+	files     []pendingFile //.crt 在最后
+}
+
+/*
+准备一张证书要保存的文件，sealKey为true时加密保存私钥等申请者来取，否则私钥由调用者直接交给申请者
+*/
+func (ca *CertificateAuthority) prepare(ctx context.Context, issued *IssuedCertificate, sealKey bool) (*pendingCertificate, error) {
+	id, err := newCertificateID()
+	if err != nil {
+		return nil, err
+	}
+	item := &pendingCertificate{Certificate: Certificate{ID: id}, issued: issued, owner: CallerFrom(ctx), sealed: sealKey, renewalOf: renewalFrom(ctx)}
+	if sealKey {
+		var keyFiles []pendingFile
+		item.KeySecret, keyFiles, err = ca.sealKey(ctx, id, issued.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		item.files = append(item.files, keyFiles...)
+	}
+	if item.owner != "" {
+		//记下申请者，用于统计每个调用者持有的证书数
+		record, err := issueRecordFile(issueRecord{CertificateID: id, Owner: item.owner, NotAfter: issued.Certificate.NotAfter})
+		if err != nil {
+			return nil, err
+		}
+		item.files = append(item.files, record)
+	}
+	item.files = append(item.files, pendingFile{
+		name:     id + ".crt",
+		contents: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: issued.Certificate.Raw}),
+		perm:     0644,
+	})
+	return item, nil
+}
+
+/*
+把一批证书的文件作为一次修改交给存储：先全部写成临时文件，再逐个改名，任何一步失败都删掉这批已经写下的文件，
+不会留下没有私钥的证书或者没有证书的私钥。每张证书的 .crt 最后改名，看到 .crt 就说明它的文件都齐了
+extra是要和证书一起生效的其他修改，例如join token的使用次数
+*/
+func (ca *CertificateAuthority) commit(items []*pendingCertificate, extra ...FileChange) error {
+	var changes []FileChange
+	events := make([]Event, len(items))
+	for i, item := range items {
+		for _, file := range item.files {
+			changes = append(changes, FileChange{Op: OpWrite, Path: clientCAFolder + "/" + file.name, Contents: file.contents, Perm: file.perm})
+		}
+		events[i] = Event{Type: EventIssued, CertificateID: item.ID, Identity: IdentityOf(item.issued.Certificate), RenewalOf: item.renewalOf, Owner: item.owner}
+		//事件和证书一起写入，不会有证书签发了却没有事件的情况
+		change, ok, err := ca.outboxChange(&events[i])
+		if err != nil {
+			return err
+		}
+		if ok {
+			changes = append(changes, change)
+		}
+	}
+	changes = append(changes, extra...)
+	if err := ca.storage().Apply(changes); err != nil {
+		return err
+	}
+
+	for i, item := range items {
+		ca.limiter.record(item.owner, item.ID, item.issued.Certificate.NotAfter)
+		if item.sealed {
+			ca.audit(AuditRecord{Action: "key.issue", CertificateID: item.ID, Caller: item.owner, Owner: item.owner, Allowed: true})
+		}
+		ca.publish(events[i])
+	}
+	return nil
+}
+
+/*
+写文件并落盘，改名之后的文件不会是写了一半的
+*/
+func writeFileSync(path string, contents []byte, perm os.FileMode) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(contents); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
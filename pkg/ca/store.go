@@ -0,0 +1,404 @@
+package ca
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	OpWrite  string = "write"
+	OpAppend string = "append"
+	OpRemove string = "remove"
+)
+
+const storeFolder string = "cert"
+
+// 多副本的caserver在本地 cert/ 下留下的标记，内容是raft地址，不复制给其他副本
+const replicatedMarkerFile string = storeFolder + "/replicated"
+
+/*
+对CA目录的一个修改，Path是相对于CA目录（见 SetDir）、以 / 分隔的路径，必须在 cert/ 下
+每个副本的CA目录可以不同，复制的是相对路径
+*/
+type FileChange struct {
+	Op       string      `json:"op"`
+	Path     string      `json:"path"`
+	Contents []byte      `json:"contents,omitempty"`
+	Perm     os.FileMode `json:"perm,omitempty"`
+}
+
+/*
+CA状态（证书、私钥、吊销记录、join token、审计日志）的存储
+默认直接写本地磁盘；多个CA副本时换成复制的存储（见 pkg/ha），所有副本按相同的顺序执行相同的修改
+*/
+type Store interface {
+	//原子地执行一批修改，不能修改时（例如不是leader）返回 ErrUnavailable
+	Apply(changes []FileChange) error
+	//把本地folders下的文件整个复制到其他副本，用于根证书轮换这类直接操作文件的修改
+	Sync(folders ...string) error
+	//定时任务（轮换、清理私钥）只在leader上执行，单机时总是true
+	IsLeader() bool
+}
+
+/*
+复制的存储可以实现它：和Apply一样执行修改，之后每个副本丢掉日志和快照中这批修改之前的内容
+取走或者过期的私钥用它删除，加密的私钥不会一直留在复制的日志里
+*/
+type PurgingStore interface {
+	ApplyAndPurge(changes []FileChange) error
+}
+
+type localStore struct {
+	ca *CertificateAuthority
+}
+
+func (l localStore) Apply(changes []FileChange) error { return l.ca.ApplyLocal(changes) }
+func (localStore) Sync(folders ...string) error       { return nil }
+func (localStore) IsLeader() bool                     { return true }
+
+/*
+设置CA状态所在的目录，cert/ 在它下面，为空时是工作目录；要在 Load 或 Init 之前调用
+*/
+func (ca *CertificateAuthority) SetDir(dir string) {
+	ca.dir = dir
+}
+
+/*
+CA状态所在的目录，为空时是工作目录
+*/
+func (ca *CertificateAuthority) Dir() string {
+	return ca.dir
+}
+
+/*
+存储中的路径（相对于CA目录、以 / 分隔）在本地磁盘上的位置
+*/
+func (ca *CertificateAuthority) path(name string) string {
+	return filepath.Join(ca.dir, filepath.FromSlash(name))
+}
+
+/*
+设置CA的存储，要在server开始服务之前调用
+*/
+func (ca *CertificateAuthority) SetStore(store Store) {
+	ca.store = store
+}
+
+func (ca *CertificateAuthority) storage() Store {
+	if ca.store == nil {
+		return localStore{ca}
+	}
+	return ca.store
+}
+
+/*
+当前副本是否负责执行定时任务和修改
+*/
+func (ca *CertificateAuthority) IsLeader() bool {
+	return ca.storage().IsLeader()
+}
+
+/*
+caserver启动时登记这个目录是否由raft复制，address为空时清除登记
+命令行据此拒绝绕过raft直接修改复制的状态
+*/
+func (ca *CertificateAuthority) MarkReplicated(address string) error {
+	if address == "" {
+		if err := os.Remove(ca.path(replicatedMarkerFile)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err := os.MkdirAll(ca.path(storeFolder), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(ca.path(replicatedMarkerFile), []byte(address), 0644)
+}
+
+/*
+复制这个目录的caserver的raft地址，没有复制时为空
+*/
+func (ca *CertificateAuthority) ReplicatedBy() string {
+	contents, err := os.ReadFile(ca.path(replicatedMarkerFile))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(contents))
+}
+
+/*
+存储返回的 *Error（例如不是leader）原样返回，其他的都是存储失败
+*/
+func storageError(err error, format string, args ...interface{}) error {
+	if _, ok := err.(*Error); ok {
+		return err
+	}
+	return WrapError(ErrInternal, "STORAGE_FAILED", err, format, args...)
+}
+
+func validateStorePath(path string) error {
+	clean := filepath.ToSlash(filepath.Clean(path))
+	if clean != path || !strings.HasPrefix(clean, storeFolder+"/") || strings.Contains(clean, "..") {
+		return fmt.Errorf("%v is not a file under %v/", path, storeFolder)
+	}
+	return nil
+}
+
+/*
+在本地磁盘上执行一批修改：先把要写的文件全部写成临时文件，再按顺序改名、追加和删除，
+任何一步失败都把这批修改涉及的文件恢复成原来的样子。复制的存储在每个副本上都用它执行修改
+修改在存储的锁中执行，同一目录上的caserver和命令行不会交错地写
+*/
+func (ca *CertificateAuthority) ApplyLocal(changes []FileChange) error {
+	unlock, err := ca.lockStore()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return ca.applyLocal(changes)
+}
+
+/*
+一个文件在这批修改之前的样子，用于回滚
+只有追加的文件（例如审计日志）只记下原来的长度，回滚时截断
+*/
+type previousFile struct {
+	exists     bool
+	appendOnly bool
+	contents   []byte
+	size       int64
+	perm       os.FileMode
+}
+
+/*
+以本地磁盘上的路径为key
+*/
+func (ca *CertificateAuthority) snapshotFiles(changes []FileChange) (map[string]*previousFile, error) {
+	appendOnly := map[string]bool{}
+	for _, change := range changes {
+		path := ca.path(change.Path)
+		if _, ok := appendOnly[path]; !ok {
+			appendOnly[path] = true
+		}
+		if change.Op != OpAppend {
+			appendOnly[path] = false
+		}
+	}
+	previous := map[string]*previousFile{}
+	for path, onlyAppend := range appendOnly {
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			previous[path] = &previousFile{}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		file := &previousFile{exists: true, appendOnly: onlyAppend, size: info.Size(), perm: info.Mode().Perm()}
+		if !onlyAppend {
+			if file.contents, err = os.ReadFile(path); err != nil {
+				return nil, err
+			}
+		}
+		previous[path] = file
+	}
+	return previous, nil
+}
+
+func restoreFiles(previous map[string]*previousFile) {
+	for path := range previous {
+		os.Remove(path + ".tmp")
+	}
+	for path, file := range previous {
+		var err error
+		switch {
+		case !file.exists:
+			if err = os.Remove(path); os.IsNotExist(err) {
+				err = nil
+			}
+		case file.appendOnly:
+			err = os.Truncate(path, file.size)
+		default:
+			if err = writeFileSync(path+".tmp", file.contents, file.perm); err == nil {
+				err = os.Rename(path+".tmp", path)
+			}
+		}
+		if err != nil {
+			log.Printf("restore %v fail, the CA store needs a manual check: %v", path, err)
+		}
+	}
+}
+
+func (ca *CertificateAuthority) applyLocal(changes []FileChange) error {
+	for _, change := range changes {
+		if err := validateStorePath(change.Path); err != nil {
+			return err
+		}
+		if change.Op != OpWrite && change.Op != OpAppend && change.Op != OpRemove {
+			return fmt.Errorf("unknown operation %v on %v", change.Op, change.Path)
+		}
+	}
+	previous, err := ca.snapshotFiles(changes)
+	if err != nil {
+		return err
+	}
+
+	for _, change := range changes {
+		if change.Op != OpWrite {
+			continue
+		}
+		path := ca.path(change.Path)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			restoreFiles(previous)
+			return err
+		}
+		if err := writeFileSync(path+".tmp", change.Contents, change.Perm); err != nil {
+			restoreFiles(previous)
+			return err
+		}
+	}
+
+	for _, change := range changes {
+		path := ca.path(change.Path)
+		var err error
+		switch change.Op {
+		case OpWrite:
+			err = os.Rename(path+".tmp", path)
+		case OpAppend:
+			if err = os.MkdirAll(filepath.Dir(path), 0700); err == nil {
+				err = appendFile(path, change.Contents, change.Perm)
+			}
+		case OpRemove:
+			if err = os.Remove(path); os.IsNotExist(err) {
+				err = nil
+			}
+		}
+		if err != nil {
+			restoreFiles(previous)
+			return err
+		}
+	}
+	return nil
+}
+
+func appendFile(path string, contents []byte, perm os.FileMode) error {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(contents); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+/*
+读出folder下的所有文件（不包括还没改名的临时文件、锁文件、副本的标记和本机的审计日志），用于快照和整个目录的复制
+返回的Path和folder一样是相对于CA目录的路径
+*/
+func (ca *CertificateAuthority) ReadFolder(folder string) ([]FileChange, error) {
+	if folder != storeFolder {
+		if err := validateStorePath(folder); err != nil {
+			return nil, err
+		}
+	}
+	root := ca.path(folder)
+	var files []FileChange
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == root {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		name := folder + "/" + filepath.ToSlash(rel)
+		if entry.IsDir() || strings.HasSuffix(path, ".tmp") || name == storeLockFile || name == replicatedMarkerFile || name == localAuditLogLocation {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		files = append(files, FileChange{Op: OpWrite, Path: name, Contents: contents, Perm: info.Mode().Perm()})
+		return nil
+	})
+	return files, err
+}
+
+/*
+把folder下的文件换成files：写入files中的文件，删除folder下其他的文件
+内容没有变化的文件不重写，修改时间不变，轮换的定时任务不会把它当作CLI做的修改
+*/
+func (ca *CertificateAuthority) ReplaceFolder(folder string, files []FileChange) error {
+	keep := map[string]bool{}
+	var changes []FileChange
+	for _, file := range files {
+		if file.Op != OpWrite || !strings.HasPrefix(file.Path, folder+"/") {
+			return fmt.Errorf("%v is not a file under %v", file.Path, folder)
+		}
+		keep[file.Path] = true
+		if existing, err := os.ReadFile(ca.path(file.Path)); err == nil && bytes.Equal(existing, file.Contents) {
+			continue
+		}
+		changes = append(changes, file)
+	}
+	if err := ca.ApplyLocal(changes); err != nil {
+		return err
+	}
+
+	current, err := ca.ReadFolder(folder)
+	if err != nil {
+		return err
+	}
+	for _, file := range current {
+		if !keep[file.Path] {
+			if err := os.Remove(ca.path(file.Path)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/*
+从磁盘重新加载根证书、轮换状态和配额统计，复制的存储替换了本地文件或者当前副本成为leader之后调用
+*/
+func (ca *CertificateAuthority) Reload() error {
+	before := ca.CurrentTrustBundle().PEM()
+	if err := ca.reload(); err != nil {
+		return err
+	}
+	ca.limiter.reset()
+	if !bytes.Equal(before, ca.CurrentTrustBundle().PEM()) {
+		log.Print("root CA changed in the store, reloaded")
+		ca.publish(Event{Type: EventTrustBundleChanged, Reason: "root CA reloaded"})
+	}
+	return nil
+}
+
+/*
+另一个进程（例如命令行）直接在leader的磁盘上修改了 cert/rootCA 和 cert/localCert，leader重新加载后把它们复制到其他副本
+*/
+func (ca *CertificateAuthority) syncRootCA() {
+	store := ca.storage()
+	if !store.IsLeader() {
+		return
+	}
+	if err := store.Sync(rootCAFolder, localCAFolder); err != nil {
+		log.Printf("replicate the root CA folders fail: %v", err)
+	}
+}
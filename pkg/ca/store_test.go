@@ -0,0 +1,69 @@
+package ca
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestApplyLocalRollback(t *testing.T) {
+	store := New(t.TempDir())
+	folder := storeFolder + "/rollback"
+	if err := os.MkdirAll(store.path(folder), 0700); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		folder + "/overwritten": "old contents",
+		folder + "/log":         "line 1\n",
+		folder + "/removed":     "still here",
+	}
+	for path, contents := range files {
+		if err := os.WriteFile(store.path(path), []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//前三个修改执行之后，folder/dir.tmp 不能改名成已经变成目录的 folder/dir，整批修改失败
+	err := store.ApplyLocal([]FileChange{
+		{Op: OpWrite, Path: folder + "/overwritten", Contents: []byte("new contents"), Perm: 0600},
+		{Op: OpAppend, Path: folder + "/log", Contents: []byte("line 2\n"), Perm: 0600},
+		{Op: OpRemove, Path: folder + "/removed"},
+		{Op: OpWrite, Path: folder + "/created", Contents: []byte("new file"), Perm: 0600},
+		{Op: OpWrite, Path: folder + "/dir", Contents: []byte("file"), Perm: 0600},
+		{Op: OpWrite, Path: folder + "/dir/child", Contents: []byte("child"), Perm: 0600},
+	})
+	if err == nil {
+		t.Fatal("apply should fail")
+	}
+	for path, contents := range files {
+		got, err := os.ReadFile(store.path(path))
+		if err != nil {
+			t.Errorf("%v: %v", filepath.Base(path), err)
+			continue
+		}
+		if string(got) != contents {
+			t.Errorf("%v = %q, want %q", filepath.Base(path), got, contents)
+		}
+	}
+	if _, err := os.Stat(store.path(folder + "/created")); !os.IsNotExist(err) {
+		t.Errorf("created should be removed, stat: %v", err)
+	}
+
+	err = store.ApplyLocal([]FileChange{
+		{Op: OpWrite, Path: folder + "/overwritten", Contents: []byte("new contents"), Perm: 0600},
+		{Op: OpAppend, Path: folder + "/log", Contents: []byte("line 2\n"), Perm: 0600},
+		{Op: OpRemove, Path: folder + "/removed"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(store.path(folder + "/overwritten")); string(got) != "new contents" {
+		t.Errorf("overwritten = %q", got)
+	}
+	if got, _ := os.ReadFile(store.path(folder + "/log")); string(got) != "line 1\nline 2\n" {
+		t.Errorf("log = %q", got)
+	}
+	if _, err := os.Stat(store.path(folder + "/removed")); !os.IsNotExist(err) {
+		t.Errorf("removed should be removed, stat: %v", err)
+	}
+}
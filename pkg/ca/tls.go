@@ -0,0 +1,90 @@
+package ca
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+CA自己的server（gRPC和http）用的TLS配置
+每次握手都取当前的本地证书和trust bundle：根证书轮换或者其他副本复制过来新的根证书后不用重启
+给出的客户端证书一定会被验证，吊销了的证书会被拒绝；没有证书的客户端可以用bearer token或者join token
+
+NOTE: we use CA's root certificate as client and server's trust root certificate, there is a logic circle
+*/
+func (ca *CertificateAuthority) ServerTLSConfig() (*tls.Config, error) {
+	local := &localCertificate{certFile: ca.path(localCertLocation), keyFile: ca.path(localKeyLocation)}
+	if _, err := local.get(); err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return local.get()
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			localCert, err := local.get()
+			if err != nil {
+				return nil, err
+			}
+			//clients signed by old and new roots are both accepted during a rollover
+			//返回的配置替换掉整个server配置，要自己声明ALPN，否则gRPC客户端协商不到h2
+			return &tls.Config{
+				Certificates: []tls.Certificate{*localCert},
+				NextProtos:   []string{"h2", "http/1.1"},
+				ClientAuth:   tls.VerifyClientCertIfGiven,
+				ClientCAs:    ca.CurrentTrustBundle().CertPool(),
+				VerifyConnection: func(cs tls.ConnectionState) error {
+					if len(cs.VerifiedChains) == 0 {
+						return nil
+					}
+					leaf := cs.VerifiedChains[0][0]
+					revoked, err := ca.IsRevoked(leaf)
+					if err != nil {
+						return err
+					}
+					if revoked {
+						return fmt.Errorf("client certificate %v (serial %v) is revoked", IdentityOf(leaf), leaf.SerialNumber.Text(16))
+					}
+					return nil
+				},
+			}, nil
+		},
+	}, nil
+}
+
+/*
+本地server的证书，文件修改后重新加载
+*/
+type localCertificate struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func (l *localCertificate) get() (*tls.Certificate, error) {
+	info, err := os.Stat(l.certFile)
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.cert != nil && info.ModTime().Equal(l.modTime) {
+		return l.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		if l.cert != nil {
+			//证书和私钥可能正在被替换，先用原来的
+			return l.cert, nil
+		}
+		return nil, err
+	}
+	l.cert, l.modTime = &cert, info.ModTime()
+	return l.cert, nil
+}
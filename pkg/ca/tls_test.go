@@ -0,0 +1,120 @@
+package ca
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+)
+
+func TestServerTLSConfigALPN(t *testing.T) {
+	config, err := CA.ServerTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		offered []string
+		want    string
+	}{
+		{offered: []string{"h2"}, want: "h2"},
+		{offered: []string{"h2", "http/1.1"}, want: "h2"},
+		{offered: []string{"http/1.1"}, want: "http/1.1"},
+	}
+	for _, tt := range tests {
+		perClient, err := config.GetConfigForClient(&tls.ClientHelloInfo{SupportedProtos: tt.offered})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		for _, proto := range perClient.NextProtos {
+			if contains(tt.offered, proto) {
+				got = proto
+				break
+			}
+		}
+		if got != tt.want {
+			t.Errorf("offered %v, negotiated %q, want %q", tt.offered, got, tt.want)
+		}
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+吊销了的客户端证书在握手时就被拒绝
+*/
+func TestServerTLSConfigRevokedClient(t *testing.T) {
+	config, err := CA.ServerTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		revoke  bool
+		wantErr bool
+	}{
+		{name: "valid client certificate"},
+		{name: "revoked client certificate", revoke: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := WithCaller(context.Background(), LocalOperator)
+			signed, err := CA.SignX509(ctx, &CertificateSigningRequest{SubjectCommonName: "tls-client"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			cert, err := CA.LoadCertificate(signed.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			keyPEM, err := CA.FetchKey(ctx, signed.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			key, err := decryptKey(keyPEM, signed.KeySecret)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.revoke {
+				if _, err := CA.Revoke(ctx, signed.ID, "keyCompromise"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			//用TCP而不是net.Pipe，握手失败时服务端发alert不会因为没人读而卡住
+			lis, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer lis.Close()
+			serverErr := make(chan error, 1)
+			go func() {
+				conn, err := lis.Accept()
+				if err != nil {
+					serverErr <- err
+					return
+				}
+				defer conn.Close()
+				serverErr <- tls.Server(conn, config).Handshake()
+			}()
+			client, err := tls.Dial("tcp", lis.Addr().String(), &tls.Config{
+				RootCAs:      CA.CurrentTrustBundle().CertPool(),
+				ServerName:   "localhost",
+				Certificates: []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key, Leaf: cert}},
+			})
+			if err == nil {
+				defer client.Close()
+			}
+			if err := <-serverErr; (err != nil) != tt.wantErr {
+				t.Errorf("server handshake error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
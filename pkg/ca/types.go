@@ -1,10 +1,14 @@
 package ca
 
 import (
+	"crypto"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/asn1"
+	"fmt"
 	"net"
 	"net/url"
+	"strings"
 )
 
 /*
@@ -34,6 +38,8 @@ type CertificateSigningRequest struct {
 	URIs           []url.URL
 
 	Extensions []Extension
+
+	Profile string //签发用的profile，见Profiles，为空时是default
 }
 
 type DistinguishedName struct {
@@ -48,5 +54,94 @@ type Extension struct {
 }
 
 type Certificate struct {
-	ID string `json:"certificateId" `
+	ID        string `json:"certificateId" `
+	KeySecret string `json:"keySecret,omitempty"` //解密CA生成的私钥用，CA不保存它
+}
+
+/*
+签发的证书和CA为申请者生成的私钥
+*/
+type IssuedCertificate struct {
+	Certificate *x509.Certificate
+	PrivateKey  crypto.Signer
+}
+
+/*
+检查CSR中的字段，所有出错的字段都会作为 violation 放在返回的 *Error 中
+*/
+func (csr *CertificateSigningRequest) Validate() error {
+	var violations []FieldViolation
+	if csr.SubjectCommonName == "" && len(csr.DNSNames) == 0 && len(csr.EmailAddresses) == 0 &&
+		len(csr.IPAddresses) == 0 && len(csr.URIs) == 0 {
+		violations = append(violations, FieldViolation{Field: "SubjectCommonName", Description: "either a common name or a subject alternative name is required"})
+	}
+	for i, name := range csr.DNSNames {
+		if strings.TrimSpace(name) == "" || strings.ContainsAny(name, " /@") {
+			violations = append(violations, FieldViolation{Field: fmt.Sprintf("DNSNames[%d]", i), Description: fmt.Sprintf("%q is not a valid DNS name", name)})
+		}
+	}
+	for i, email := range csr.EmailAddresses {
+		if at := strings.LastIndex(email, "@"); at <= 0 || at == len(email)-1 {
+			violations = append(violations, FieldViolation{Field: fmt.Sprintf("EmailAddresses[%d]", i), Description: fmt.Sprintf("%q is not a valid email address", email)})
+		}
+	}
+	for i, ip := range csr.IPAddresses {
+		if len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+			violations = append(violations, FieldViolation{Field: fmt.Sprintf("IPAddresses[%d]", i), Description: "must be 4 or 16 bytes"})
+		}
+	}
+	for i, uri := range csr.URIs {
+		if uri.Scheme == "" {
+			violations = append(violations, FieldViolation{Field: fmt.Sprintf("URIs[%d]", i), Description: fmt.Sprintf("%q has no scheme", uri.String())})
+		}
+	}
+	for i, ex := range csr.Extensions {
+		if reservedExtension(ex.ID) {
+			violations = append(violations, FieldViolation{Field: fmt.Sprintf("Extensions[%d]", i), Description: fmt.Sprintf("%v is set by the CA and can't be requested", ex.ID)})
+		}
+	}
+	switch csr.PublicKeyAlg {
+	case x509.UnknownPublicKeyAlgorithm, x509.RSA, x509.ECDSA, x509.Ed25519:
+	default:
+		violations = append(violations, FieldViolation{Field: "PublicKeyAlg", Description: fmt.Sprintf("%v keys are not supported", csr.PublicKeyAlg)})
+	}
+	if len(violations) > 0 {
+		return InvalidArgument("INVALID_CSR", violations...)
+	}
+	return nil
+}
+
+/*
+由CA决定的扩展，申请者不能通过Extensions覆盖：subjectKeyId、keyUsage、SANs、basicConstraints、nameConstraints、authorityKeyId、extKeyUsage
+*/
+var reservedExtensions = []asn1.ObjectIdentifier{
+	{2, 5, 29, 14},
+	{2, 5, 29, 15},
+	{2, 5, 29, 17},
+	{2, 5, 29, 19},
+	{2, 5, 29, 30},
+	{2, 5, 29, 35},
+	{2, 5, 29, 37},
+}
+
+func reservedExtension(id asn1.ObjectIdentifier) bool {
+	for _, reserved := range reservedExtensions {
+		if id.Equal(reserved) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+CSR中要带到证书里的扩展，PKCS#10 CSR中由CA决定的扩展直接忽略
+*/
+func requestedExtensions(extensions []pkix.Extension) []pkix.Extension {
+	var result []pkix.Extension
+	for _, ex := range extensions {
+		if !reservedExtension(ex.Id) {
+			result = append(result, ex)
+		}
+	}
+	return result
 }
@@ -0,0 +1,119 @@
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+本地的服务注册表，代替Consul、etcd这类服务发现系统：
+每个服务是Dir下的一个目录，每个实例是其中的一个json文件，实例定期刷新文件，超过TTL没有刷新的实例被认为已经下线
+同一台机器上的多个进程，或者共享同一个目录（例如NFS）的机器可以通过它互相发现
+*/
+type Registry struct {
+	Dir string
+	TTL time.Duration
+}
+
+const DefaultTTL time.Duration = 15 * time.Second
+
+/*
+一个服务实例
+*/
+type Instance struct {
+	ID        string    `json:"id"`
+	Address   string    `json:"address"` //host:port
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+func (r Registry) ttl() time.Duration {
+	if r.TTL <= 0 {
+		return DefaultTTL
+	}
+	return r.TTL
+}
+
+func (r Registry) file(service string, id string) string {
+	return filepath.Join(r.Dir, service, id+".json")
+}
+
+/*
+注册实例并每隔TTL/3刷新一次，stopCh关闭时注销
+*/
+func (r Registry) Register(service string, instance Instance, stopCh <-chan struct{}) error {
+	if strings.ContainsAny(service, `/\`) || strings.ContainsAny(instance.ID, `/\`) {
+		return fmt.Errorf("service and instance id must not contain path separators")
+	}
+	if err := os.MkdirAll(filepath.Join(r.Dir, service), 0755); err != nil {
+		return err
+	}
+	if err := r.heartbeat(service, instance); err != nil {
+		return err
+	}
+	go func() {
+		ticker := time.NewTicker(r.ttl() / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopCh:
+				os.Remove(r.file(service, instance.ID))
+				return
+			case <-ticker.C:
+				if err := r.heartbeat(service, instance); err != nil {
+					log.Printf("refresh %v in the registry fail: %v", instance.ID, err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func (r Registry) heartbeat(service string, instance Instance) error {
+	instance.UpdatedAt = time.Now()
+	contents, err := json.Marshal(instance)
+	if err != nil {
+		return err
+	}
+	//先写临时文件再改名，查询的一方不会读到写了一半的文件
+	file := r.file(service, instance.ID)
+	if err := os.WriteFile(file+".tmp", contents, 0644); err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+/*
+服务当前在线的实例，按ID排序
+*/
+func (r Registry) Lookup(service string) ([]Instance, error) {
+	entries, err := os.ReadDir(filepath.Join(r.Dir, service))
+	if err != nil {
+		return nil, err
+	}
+	var instances []Instance
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		contents, err := os.ReadFile(filepath.Join(r.Dir, service, entry.Name()))
+		if err != nil {
+			continue
+		}
+		var instance Instance
+		if err := json.Unmarshal(contents, &instance); err != nil || instance.Address == "" {
+			continue
+		}
+		if time.Since(instance.UpdatedAt) > r.ttl() {
+			continue
+		}
+		instances = append(instances, instance)
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].ID < instances[j].ID })
+	return instances, nil
+}
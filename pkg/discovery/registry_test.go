@@ -0,0 +1,107 @@
+package discovery
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func addresses(instances []Instance) []string {
+	var result []string
+	for _, instance := range instances {
+		result = append(result, instance.Address)
+	}
+	return result
+}
+
+func TestRegistryLookup(t *testing.T) {
+	r := Registry{Dir: t.TempDir(), TTL: time.Minute}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	for _, instance := range []Instance{{ID: "b", Address: "10.0.0.2:8112"}, {ID: "a", Address: "10.0.0.1:8112"}} {
+		if err := r.Register("ca", instance, stopCh); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//超过TTL没有刷新的实例、写坏的文件、没有地址的实例和别的文件都不算
+	stale, _ := json.Marshal(Instance{ID: "c", Address: "10.0.0.3:8112", UpdatedAt: time.Now().Add(-2 * time.Minute)})
+	noAddress, _ := json.Marshal(Instance{ID: "d", UpdatedAt: time.Now()})
+	files := map[string][]byte{"c.json": stale, "d.json": noAddress, "e.json": []byte("{"), "f.json.tmp": []byte("{}")}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(r.Dir, "ca", name), contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		service string
+		want    []string
+		wantErr bool
+	}{
+		{service: "ca", want: []string{"10.0.0.1:8112", "10.0.0.2:8112"}},
+		{service: "unknown", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.service, func(t *testing.T) {
+			instances, err := r.Lookup(tt.service)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Lookup error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := addresses(instances); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Lookup = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegistryInvalidName(t *testing.T) {
+	r := Registry{Dir: t.TempDir()}
+	tests := []struct {
+		service string
+		id      string
+	}{
+		{service: "../ca", id: "a"},
+		{service: "ca", id: "../../a"},
+		{service: `ca\a`, id: "a"},
+	}
+	for _, tt := range tests {
+		if err := r.Register(tt.service, Instance{ID: tt.id, Address: "10.0.0.1:8112"}, nil); err == nil {
+			t.Errorf("Register(%q, %q) succeeded", tt.service, tt.id)
+		}
+	}
+}
+
+/*
+实例在TTL之内刷新，一直在线；stopCh关闭后删除注册的文件
+*/
+func TestRegistryHeartbeat(t *testing.T) {
+	r := Registry{Dir: t.TempDir(), TTL: 150 * time.Millisecond}
+	stopCh := make(chan struct{})
+	if err := r.Register("ca", Instance{ID: "a", Address: "10.0.0.1:8112"}, stopCh); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(3 * r.TTL)
+	instances, err := r.Lookup("ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 1 {
+		t.Fatalf("got %d instance(s) after %v, want the refreshed one", len(instances), 3*r.TTL)
+	}
+
+	close(stopCh)
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, err := os.Stat(r.file("ca", "a")); os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("instance is still registered after stopCh is closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
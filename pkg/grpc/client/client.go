@@ -0,0 +1,551 @@
+package client
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	cx509 "crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	mygrpc "github.com/jackyzhangfudan/sidecar/pkg/grpc"
+	"github.com/youmark/pkcs8"
+	googlegrpc "google.golang.org/grpc"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+const (
+	DefaultTarget     string        = "localhost:8112"
+	DefaultServerName string        = "localhost" //CA本地证书中的名字
+	DefaultRootCAFile string        = "cert/rootCA/root.crt"
+	DefaultTimeout    time.Duration = 10 * time.Second
+)
+
+/*
+CA客户端的选项
+客户端证书来自 CertFile/KeyFile（文件更新后新的连接使用新的证书），或者 JoinToken：
+没有证书时用它向CA申请第一张证书，之后由客户端在内存中自动续签；都没有时只能调用Enroll这类不需要证书的方法，或者用BearerToken认证
+*/
+type Options struct {
+	DialOptions
+
+	RootCAs     *cx509.CertPool //CA证书的信任根，为nil时从RootCAFile加载
+	RootCAFile  string
+	CertFile    string
+	KeyFile     string
+	BearerToken string                            //没有客户端证书时用于认证，见caserver的 --auth-config
+	JoinToken   string                            //CertFile不存在时用它申请客户端证书，申请到的证书会写到CertFile和KeyFile
+	Enrollment  *mygrpc.CertificateSigningRequest //用JoinToken申请证书时的CSR
+	Timeout     time.Duration                     //每次尝试的超时，默认10s
+	Retry       RetryPolicy
+}
+
+/*
+CA签发的一张证书，SignPKCS10和GetCertificate返回的证书没有私钥
+*/
+type Certificate struct {
+	ID             string
+	Certificate    *cx509.Certificate
+	CertificatePEM []byte
+	PrivateKey     crypto.Signer
+	PrivateKeyPEM  []byte //PKCS#8，没有加密
+}
+
+/*
+用于TLS的证书和私钥
+*/
+func (c *Certificate) TLSCertificate() (*tls.Certificate, error) {
+	if c.PrivateKey == nil {
+		return nil, fmt.Errorf("certificate %v has no private key", c.ID)
+	}
+	return &tls.Certificate{Certificate: [][]byte{c.Certificate.Raw}, PrivateKey: c.PrivateKey, Leaf: c.Certificate}, nil
+}
+
+/*
+CA的trust bundle
+*/
+type Bundle struct {
+	PEM          []byte
+	Certificates []*cx509.Certificate
+	Version      string
+}
+
+func (b *Bundle) CertPool() *cx509.CertPool {
+	pool := cx509.NewCertPool()
+	for _, cert := range b.Certificates {
+		pool.AddCert(cert)
+	}
+	return pool
+}
+
+/*
+CA的客户端，可以被多个goroutine同时使用
+所有方法都遵守ctx的取消和超时，Unavailable（例如副本不是leader）和带有重试时间的ResourceExhausted按Retry重试
+*/
+type Client struct {
+	opts  Options
+	roots *cx509.CertPool
+
+	mu       sync.RWMutex
+	conn     *googlegrpc.ClientConn
+	rpc      mygrpc.CertificateServiceClient
+	identity *Rotator //用join token申请的客户端证书
+	files    *keyPairFile
+}
+
+func New(opts Options) (*Client, error) {
+	if opts.Target == "" {
+		opts.Target = DefaultTarget
+	}
+	if opts.ServerName == "" {
+		opts.ServerName = DefaultServerName
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	opts.Retry = opts.Retry.withDefaults()
+
+	c := &Client{opts: opts, roots: opts.RootCAs}
+	if c.roots == nil {
+		file := opts.RootCAFile
+		if file == "" {
+			file = DefaultRootCAFile
+		}
+		contents, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("load root CA fail: %v", err)
+		}
+		c.roots = cx509.NewCertPool()
+		if !c.roots.AppendCertsFromPEM(contents) {
+			return nil, fmt.Errorf("no certificate in %v", file)
+		}
+	}
+	if opts.CertFile != "" && opts.KeyFile != "" {
+		c.files = &keyPairFile{certFile: opts.CertFile, keyFile: opts.KeyFile}
+		if !c.files.exists() && opts.JoinToken == "" {
+			return nil, fmt.Errorf("client certificate %v doesn't exist", opts.CertFile)
+		}
+	}
+
+	if err := c.dial(); err != nil {
+		return nil, err
+	}
+	if opts.JoinToken != "" && (c.files == nil || !c.files.exists()) {
+		if err := c.enrollSelf(); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *Client) dial() error {
+	tlsConfig := &tls.Config{
+		RootCAs:              c.roots,
+		GetClientCertificate: c.clientCertificate,
+	}
+	grpcOpts := []googlegrpc.DialOption{googlegrpc.WithChainUnaryInterceptor(retryInterceptor(c.opts.Retry, c.opts.Timeout))}
+	if c.opts.BearerToken != "" {
+		grpcOpts = append(grpcOpts, googlegrpc.WithPerRPCCredentials(bearerToken(c.opts.BearerToken)))
+	}
+	conn, err := Dial(c.opts.DialOptions, tlsConfig, grpcOpts...)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	old := c.conn
+	c.conn, c.rpc = conn, mygrpc.NewCertificateServiceClient(conn)
+	c.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+/*
+用join token申请客户端证书，然后重新连接，让新的连接带上证书
+*/
+func (c *Client) enrollSelf() error {
+	if c.opts.Enrollment == nil {
+		return fmt.Errorf("Enrollment is required to enroll with a join token")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.opts.Timeout*time.Duration(c.opts.Retry.MaxAttempts))
+	defer cancel()
+	cert, err := c.Enroll(ctx, c.opts.JoinToken, c.opts.Enrollment)
+	if err != nil {
+		return fmt.Errorf("enroll with the join token fail: %v", err)
+	}
+	identity, err := c.Rotate(cert, RotateOptions{OnRotate: c.saveIdentity})
+	if err != nil {
+		return err
+	}
+	c.saveIdentity(cert)
+	c.mu.Lock()
+	c.identity = identity
+	c.mu.Unlock()
+	return c.dial()
+}
+
+func (c *Client) saveIdentity(cert *Certificate) {
+	if c.files == nil {
+		return
+	}
+	if err := c.files.save(cert); err != nil {
+		fmt.Fprintf(os.Stderr, "save client certificate to %v fail: %v\n", c.opts.CertFile, err)
+	}
+}
+
+func (c *Client) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	identity := c.identity
+	c.mu.RUnlock()
+	if identity != nil {
+		return identity.tlsCertificate(), nil
+	}
+	if c.files != nil && c.files.exists() {
+		return c.files.get()
+	}
+	//没有证书，server按匿名调用者处理
+	return &tls.Certificate{}, nil
+}
+
+func (c *Client) client() mygrpc.CertificateServiceClient {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.rpc
+}
+
+func (c *Client) Close() error {
+	c.mu.Lock()
+	identity, conn := c.identity, c.conn
+	c.identity, c.conn = nil, nil
+	c.mu.Unlock()
+	if identity != nil {
+		identity.Stop()
+	}
+	if conn != nil {
+		return conn.Close()
+	}
+	return nil
+}
+
+/*
+CA提供的CSR模板
+*/
+func (c *Client) CsrTemplate(ctx context.Context) (*mygrpc.CertificateSigningRequest, error) {
+	return c.client().CsrTemplate(ctx, &emptypb.Empty{})
+}
+
+/*
+由CA生成私钥并签发证书，返回的证书带有解密后的私钥
+*/
+func (c *Client) Sign(ctx context.Context, csr *mygrpc.CertificateSigningRequest) (*Certificate, error) {
+	signed, err := c.client().SignCsr(ctx, csr)
+	if err != nil {
+		return nil, err
+	}
+	return c.fetch(ctx, signed)
+}
+
+/*
+签署自己生成私钥的PKCS#10 CSR（DER或PEM），私钥不离开调用者
+*/
+func (c *Client) SignPKCS10(ctx context.Context, csr []byte, profile string) (*Certificate, error) {
+	signed, err := c.client().SignPKCS10(ctx, &mygrpc.PKCS10Request{Csr: csr, Profile: profile})
+	if err != nil {
+		return nil, err
+	}
+	return c.GetCertificate(ctx, signed.CertificateId)
+}
+
+/*
+用新的私钥续签一张证书，subject和SANs不变
+*/
+func (c *Client) Renew(ctx context.Context, id string) (*Certificate, error) {
+	signed, err := c.client().RenewCert(ctx, &mygrpc.FileIdentifer{Id: id})
+	if err != nil {
+		return nil, err
+	}
+	return c.fetch(ctx, signed)
+}
+
+/*
+用join token申请证书，不需要客户端证书
+*/
+func (c *Client) Enroll(ctx context.Context, token string, csr *mygrpc.CertificateSigningRequest) (*Certificate, error) {
+	resp, err := c.client().Enroll(ctx, &mygrpc.EnrollRequest{Token: token, Csr: csr})
+	if err != nil {
+		return nil, err
+	}
+	cert, err := parseCertificate(resp.CertificateId, resp.Certificate)
+	if err != nil {
+		return nil, err
+	}
+	if err := cert.setKey(resp.PrivateKey, ""); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+/*
+取一张已经签发的证书，不包括私钥
+*/
+func (c *Client) GetCertificate(ctx context.Context, id string) (*Certificate, error) {
+	certPEM, err := c.client().GetCert(ctx, &mygrpc.FileIdentifer{Id: id})
+	if err != nil {
+		return nil, err
+	}
+	return parseCertificate(id, certPEM.Contents)
+}
+
+/*
+吊销一张证书，返回吊销的时间
+*/
+func (c *Client) Revoke(ctx context.Context, id string, reason string) (time.Time, error) {
+	resp, err := c.client().RevokeCert(ctx, &mygrpc.RevokeRequest{Id: id, Reason: reason})
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(resp.RevokedAt, 0), nil
+}
+
+/*
+一张证书的概要和吊销状态
+*/
+func (c *Client) DescribeCertificate(ctx context.Context, id string) (*mygrpc.CertificateInfo, error) {
+	return c.client().DescribeCertificate(ctx, &mygrpc.FileIdentifer{Id: id})
+}
+
+/*
+列出签发过的证书，status为valid、expired或revoked，identity为空时不按身份过滤
+*/
+func (c *Client) ListCertificates(ctx context.Context, status string, identity string) ([]*mygrpc.CertificateInfo, error) {
+	resp, err := c.client().ListCertificates(ctx, &mygrpc.ListCertificatesRequest{Status: status, Identity: identity})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Certificates, nil
+}
+
+/*
+within之内到期的证书，包括根证书、交叉签名的证书和CA server的证书，最早到期的在前
+*/
+func (c *Client) ListExpiring(ctx context.Context, within time.Duration) ([]*mygrpc.ExpiringCertificate, error) {
+	resp, err := c.client().ListExpiring(ctx, &mygrpc.ExpiringRequest{WithinSeconds: int64(within / time.Second)})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Certificates, nil
+}
+
+/*
+导出格式在命令行和HTTP接口中的名字，和 ca.ExportFormat 相同
+*/
+var ExportFormatNames = map[mygrpc.ExportFormat]string{
+	mygrpc.ExportFormat_ExportPEM:          "pem",
+	mygrpc.ExportFormat_ExportFullchain:    "fullchain",
+	mygrpc.ExportFormat_ExportDER:          "der",
+	mygrpc.ExportFormat_ExportPKCS12:       "pkcs12",
+	mygrpc.ExportFormat_ExportPKCS12Legacy: "pkcs12-legacy",
+	mygrpc.ExportFormat_ExportTruststore:   "truststore",
+	mygrpc.ExportFormat_ExportPKCS8:        "pkcs8",
+}
+
+/*
+以指定的格式导出证书，带私钥的格式需要签发时返回的key secret
+*/
+func (c *Client) Export(ctx context.Context, req *mygrpc.ExportRequest) (*mygrpc.ExportResponse, error) {
+	return c.client().ExportCertificate(ctx, req)
+}
+
+/*
+CA签发的CRL
+*/
+type CRL struct {
+	DER        []byte
+	Number     string
+	ThisUpdate time.Time
+	NextUpdate time.Time
+	Others     [][]byte //根证书轮换期间另一个根证书签发的CRL，DER
+}
+
+func (c *Client) CRL(ctx context.Context) (*CRL, error) {
+	resp, err := c.client().GetCRL(ctx, &emptypb.Empty{})
+	if err != nil {
+		return nil, err
+	}
+	return &CRL{DER: resp.Crl, Number: resp.Number, ThisUpdate: time.Unix(resp.ThisUpdate, 0), NextUpdate: time.Unix(resp.NextUpdate, 0), Others: resp.OtherCrls}, nil
+}
+
+/*
+CA当前的trust bundle，根证书轮换期间包括新旧两个根证书
+*/
+func (c *Client) TrustBundle(ctx context.Context) (*Bundle, error) {
+	resp, err := c.client().GetTrustBundle(ctx, &mygrpc.TrustBundleRequest{Format: mygrpc.BundleFormat_PEM})
+	if err != nil {
+		return nil, err
+	}
+	return parseBundle(resp)
+}
+
+func parseBundle(resp *mygrpc.TrustBundle) (*Bundle, error) {
+	return ParseBundle(resp.Contents, resp.Version)
+}
+
+/*
+解析PEM格式的trust bundle
+*/
+func ParseBundle(contents []byte, version string) (*Bundle, error) {
+	bundle := &Bundle{PEM: contents, Version: version}
+	rest := contents
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		cert, err := cx509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		bundle.Certificates = append(bundle.Certificates, cert)
+	}
+	if len(bundle.Certificates) == 0 {
+		return nil, fmt.Errorf("no certificate in the trust bundle")
+	}
+	return bundle, nil
+}
+
+/*
+取回签发的证书和加密的私钥，用key secret解密
+*/
+func (c *Client) fetch(ctx context.Context, signed *mygrpc.SignResponse) (*Certificate, error) {
+	cert, err := c.GetCertificate(ctx, signed.CertificateId)
+	if err != nil {
+		return nil, err
+	}
+	key, err := c.client().GetKey(ctx, &mygrpc.FileIdentifer{Id: signed.CertificateId})
+	if err != nil {
+		return nil, err
+	}
+	if err := cert.setKey(key.Contents, signed.KeySecret); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+/*
+由PEM格式的证书和私钥构造Certificate，keyPEM为空时没有私钥，secret是加密私钥的key secret
+*/
+func NewCertificate(id string, certPEM []byte, keyPEM []byte, secret string) (*Certificate, error) {
+	cert, err := parseCertificate(id, certPEM)
+	if err != nil {
+		return nil, err
+	}
+	if len(keyPEM) > 0 {
+		if err := cert.setKey(keyPEM, secret); err != nil {
+			return nil, err
+		}
+	}
+	return cert, nil
+}
+
+func parseCertificate(id string, certPEM []byte) (*Certificate, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, fmt.Errorf("certificate %v is not PEM encoded", id)
+	}
+	cert, err := cx509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return &Certificate{ID: id, Certificate: cert, CertificatePEM: certPEM}, nil
+}
+
+/*
+解析PKCS#8私钥，secret不为空时私钥是加密的
+*/
+func (c *Certificate) setKey(keyPEM []byte, secret string) error {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return fmt.Errorf("private key of %v is not PEM encoded", c.ID)
+	}
+	var password []byte
+	if block.Type == "ENCRYPTED PRIVATE KEY" {
+		password = []byte(secret)
+	}
+	key, err := pkcs8.ParsePKCS8PrivateKey(block.Bytes, password)
+	if err != nil {
+		return fmt.Errorf("decrypt private key of %v fail: %v", c.ID, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return fmt.Errorf("unsupported private key type %T", key)
+	}
+	keyDER, err := cx509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	c.PrivateKey = signer
+	c.PrivateKeyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return nil
+}
+
+/*
+文件中的客户端证书，文件修改后重新加载
+*/
+type keyPairFile struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func (f *keyPairFile) exists() bool {
+	_, err := os.Stat(f.certFile)
+	return err == nil
+}
+
+func (f *keyPairFile) get() (*tls.Certificate, error) {
+	info, err := os.Stat(f.certFile)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.cert != nil && info.ModTime().Equal(f.modTime) {
+		return f.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+	if err != nil {
+		if f.cert != nil {
+			//证书和私钥可能正在被替换，先用原来的
+			return f.cert, nil
+		}
+		return nil, err
+	}
+	f.cert, f.modTime = &cert, info.ModTime()
+	return f.cert, nil
+}
+
+/*
+先写私钥再写证书，读的一方看到新的证书时私钥已经是新的了
+*/
+func (f *keyPairFile) save(cert *Certificate) error {
+	if err := writeFile(f.keyFile, cert.PrivateKeyPEM, 0600); err != nil {
+		return err
+	}
+	return writeFile(f.certFile, cert.CertificatePEM, 0644)
+}
+
+func writeFile(path string, contents []byte, perm os.FileMode) error {
+	if err := os.WriteFile(path+".tmp", contents, perm); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
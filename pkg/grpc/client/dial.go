@@ -0,0 +1,81 @@
+package client
+
+import (
+	"crypto/tls"
+	"fmt"
+	"time"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/discovery"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	googlerpc "google.golang.org/grpc"
+	"google.golang.org/grpc/balancer/leastrequest"
+	"google.golang.org/grpc/balancer/roundrobin"
+	"google.golang.org/grpc/credentials"
+	_ "google.golang.org/grpc/health" //注册客户端的健康检查
+)
+
+const (
+	BalancerPickFirst    string = "pick_first"
+	BalancerRoundRobin   string = "round_robin"
+	BalancerLeastRequest string = "least_request"
+)
+
+/*
+连接CA的方式：target可以是 host:port、dns:///、static:///、file:/// 或 registry:///，
+有多个CA副本时按Balancer分摊请求，HealthCheck为true时不把请求发给不健康的副本
+*/
+type DialOptions struct {
+	Target          string
+	ServerName      string        //CA证书中的名字，所有副本都要有这个名字
+	Balancer        string        //pick_first, round_robin, least_request，默认round_robin
+	HealthCheck     bool          //用grpc.health.v1检查每个副本，只对round_robin和least_request有效
+	RegistryDir     string        //registry:/// 使用的本地服务注册表目录
+	RefreshInterval time.Duration //file:/// 和 registry:/// 多久重新查一次地址
+}
+
+func (opts DialOptions) serviceConfig() (string, error) {
+	var lb string
+	switch opts.Balancer {
+	case "", BalancerRoundRobin:
+		lb = fmt.Sprintf(`{"%v": {}}`, roundrobin.Name)
+	case BalancerLeastRequest:
+		lb = fmt.Sprintf(`{"%v": {"choiceCount": 2}}`, leastrequest.Name)
+	case BalancerPickFirst:
+		lb = `{"pick_first": {}}`
+	default:
+		return "", fmt.Errorf("unknown balancer %v, should be %v, %v or %v", opts.Balancer, BalancerPickFirst, BalancerRoundRobin, BalancerLeastRequest)
+	}
+	config := `{"loadBalancingConfig": [` + lb + `]`
+	if opts.HealthCheck {
+		//serviceName为空表示整个server的状态
+		config += `, "healthCheckConfig": {"serviceName": ""}`
+	}
+	return config + "}", nil
+}
+
+/*
+按DialOptions连接CA，tlsConfig是客户端的证书和信任的根证书，ServerName由opts决定，extra是附加的grpc选项
+*/
+func Dial(opts DialOptions, tlsConfig *tls.Config, extra ...googlerpc.DialOption) (*googlerpc.ClientConn, error) {
+	serviceConfig, err := opts.serviceConfig()
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig = tlsConfig.Clone()
+	if opts.ServerName != "" {
+		tlsConfig.ServerName = opts.ServerName
+	}
+
+	//stats handler 把当前span的trace context以W3C traceparent的形式注入到请求metadata中
+	dialOpts := []googlerpc.DialOption{
+		googlerpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
+		googlerpc.WithStatsHandler(otelgrpc.NewClientHandler()),
+		googlerpc.WithDefaultServiceConfig(serviceConfig),
+		googlerpc.WithResolvers(
+			staticBuilder{},
+			fileBuilder{interval: opts.RefreshInterval},
+			registryBuilder{registry: discovery.Registry{Dir: opts.RegistryDir}, interval: opts.RefreshInterval},
+		),
+	}
+	return googlerpc.Dial(opts.Target, append(dialOpts, extra...)...)
+}
@@ -0,0 +1,173 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/discovery"
+	"google.golang.org/grpc/resolver"
+)
+
+/*
+除了gRPC自带的dns:///，客户端还支持这几种target：
+static:///host1:8112,host2:8112  固定的地址列表
+file:///etc/sidecar/ca-endpoints  文件中每行一个地址，#开头的是注释，文件修改后自动生效
+registry:///ca                    本地服务注册表（discovery.Registry）中ca服务的实例
+*/
+const (
+	staticScheme   string = "static"
+	fileScheme     string = "file"
+	registryScheme string = "registry"
+)
+
+const DefaultRefreshInterval time.Duration = 5 * time.Second
+
+type staticBuilder struct{}
+
+func (staticBuilder) Scheme() string { return staticScheme }
+
+func (staticBuilder) Build(target resolver.Target, cc resolver.ClientConn, _ resolver.BuildOptions) (resolver.Resolver, error) {
+	addresses := splitAddresses(target.Endpoint())
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("no address in %v", target.URL.String())
+	}
+	if err := cc.UpdateState(resolver.State{Addresses: toAddresses(addresses)}); err != nil {
+		return nil, err
+	}
+	return nopResolver{}, nil
+}
+
+type nopResolver struct{}
+
+func (nopResolver) ResolveNow(resolver.ResolveNowOptions) {}
+func (nopResolver) Close()                                {}
+
+type fileBuilder struct {
+	interval time.Duration
+}
+
+func (fileBuilder) Scheme() string { return fileScheme }
+
+func (b fileBuilder) Build(target resolver.Target, cc resolver.ClientConn, _ resolver.BuildOptions) (resolver.Resolver, error) {
+	path := target.URL.Path
+	if path == "" {
+		path = target.URL.Opaque //file:endpoints.txt 这种相对路径
+	}
+	return startPolling(cc, b.interval, func() ([]string, error) {
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var addresses []string
+		scanner := bufio.NewScanner(bytes.NewReader(contents))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line != "" && !strings.HasPrefix(line, "#") {
+				addresses = append(addresses, line)
+			}
+		}
+		return addresses, nil
+	}), nil
+}
+
+type registryBuilder struct {
+	registry discovery.Registry
+	interval time.Duration
+}
+
+func (registryBuilder) Scheme() string { return registryScheme }
+
+func (b registryBuilder) Build(target resolver.Target, cc resolver.ClientConn, _ resolver.BuildOptions) (resolver.Resolver, error) {
+	service := target.Endpoint()
+	return startPolling(cc, b.interval, func() ([]string, error) {
+		instances, err := b.registry.Lookup(service)
+		if err != nil {
+			return nil, err
+		}
+		var addresses []string
+		for _, instance := range instances {
+			addresses = append(addresses, instance.Address)
+		}
+		return addresses, nil
+	}), nil
+}
+
+/*
+定期查询地址的resolver，地址变化时通知gRPC；gRPC发现连接失败时会调用ResolveNow马上再查一次
+*/
+type pollingResolver struct {
+	cc         resolver.ClientConn
+	lookup     func() ([]string, error)
+	resolveNow chan struct{}
+	done       chan struct{}
+}
+
+func startPolling(cc resolver.ClientConn, interval time.Duration, lookup func() ([]string, error)) *pollingResolver {
+	if interval <= 0 {
+		interval = DefaultRefreshInterval
+	}
+	r := &pollingResolver{cc: cc, lookup: lookup, resolveNow: make(chan struct{}, 1), done: make(chan struct{})}
+	go r.run(interval)
+	return r
+}
+
+func (r *pollingResolver) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var last string
+	for {
+		addresses, err := r.lookup()
+		switch {
+		case err != nil:
+			r.cc.ReportError(err)
+			last = ""
+		case len(addresses) == 0:
+			r.cc.ReportError(fmt.Errorf("no address found"))
+			last = ""
+		case strings.Join(addresses, ",") != last:
+			//地址没有变化时不打扰balancer
+			if err := r.cc.UpdateState(resolver.State{Addresses: toAddresses(addresses)}); err == nil {
+				last = strings.Join(addresses, ",")
+			}
+		}
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+		case <-r.resolveNow:
+		}
+	}
+}
+
+func (r *pollingResolver) ResolveNow(resolver.ResolveNowOptions) {
+	select {
+	case r.resolveNow <- struct{}{}:
+	default:
+	}
+}
+
+func (r *pollingResolver) Close() {
+	close(r.done)
+}
+
+func splitAddresses(s string) []string {
+	var addresses []string
+	for _, addr := range strings.Split(s, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addresses = append(addresses, addr)
+		}
+	}
+	return addresses
+}
+
+func toAddresses(addresses []string) []resolver.Address {
+	result := make([]resolver.Address, 0, len(addresses))
+	for _, addr := range addresses {
+		result = append(result, resolver.Address{Addr: addr})
+	}
+	return result
+}
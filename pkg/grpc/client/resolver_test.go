@@ -0,0 +1,183 @@
+package client
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/discovery"
+	"google.golang.org/grpc/resolver"
+)
+
+/*
+记录resolver通知给gRPC的地址和错误
+*/
+type fakeClientConn struct {
+	resolver.ClientConn
+	updates chan []string
+	errors  chan error
+}
+
+func newFakeClientConn() *fakeClientConn {
+	return &fakeClientConn{updates: make(chan []string, 16), errors: make(chan error, 16)}
+}
+
+func (cc *fakeClientConn) UpdateState(state resolver.State) error {
+	var addresses []string
+	for _, addr := range state.Addresses {
+		addresses = append(addresses, addr.Addr)
+	}
+	cc.updates <- addresses
+	return nil
+}
+
+func (cc *fakeClientConn) ReportError(err error) {
+	cc.errors <- err
+}
+
+/*
+等下一次通知的地址，want为nil时等一个错误；等地址时忽略中间报告的错误
+*/
+func (cc *fakeClientConn) expect(t *testing.T, want []string, wait time.Duration) {
+	t.Helper()
+	timeout := time.After(wait)
+	for {
+		select {
+		case got := <-cc.updates:
+			if want == nil || !reflect.DeepEqual(got, want) {
+				t.Fatalf("resolved %v, want %v", got, want)
+			}
+			return
+		case <-cc.errors:
+			if want == nil {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("no update in %v, want %v", wait, want)
+		}
+	}
+}
+
+/*
+wait内没有新的地址
+*/
+func (cc *fakeClientConn) expectNone(t *testing.T, wait time.Duration) {
+	t.Helper()
+	select {
+	case got := <-cc.updates:
+		t.Fatalf("unexpected update %v", got)
+	case <-time.After(wait):
+	}
+}
+
+func target(t *testing.T, s string) resolver.Target {
+	u, err := url.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resolver.Target{URL: *u}
+}
+
+func TestStaticResolver(t *testing.T) {
+	tests := []struct {
+		target  string
+		want    []string
+		wantErr bool
+	}{
+		{target: "static:///host1:8112,host2:8112", want: []string{"host1:8112", "host2:8112"}},
+		{target: "static:///host1:8112, ,host2:8112,", want: []string{"host1:8112", "host2:8112"}},
+		{target: "static:///", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			cc := newFakeClientConn()
+			r, err := staticBuilder{}.Build(target(t, tt.target), cc, resolver.BuildOptions{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Build error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer r.Close()
+			cc.expect(t, tt.want, time.Second)
+		})
+	}
+}
+
+/*
+先写临时文件再改名，resolver不会读到写了一半的文件
+*/
+func writeEndpoints(t *testing.T, file string, contents string) {
+	t.Helper()
+	if err := os.WriteFile(file+".tmp", []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(file+".tmp", file); err != nil {
+		t.Fatal(err)
+	}
+}
+
+/*
+文件修改后通知新的地址，地址没有变化时不通知，文件为空时报告错误
+*/
+func TestFileResolverUpdates(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "endpoints")
+	writeEndpoints(t, file, "host1:8112\n")
+	cc := newFakeClientConn()
+	r, err := fileBuilder{interval: 10 * time.Millisecond}.Build(target(t, "file://"+file), cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	cc.expect(t, []string{"host1:8112"}, time.Second)
+
+	tests := []struct {
+		name      string
+		contents  string
+		want      []string
+		unchanged bool
+	}{
+		{name: "address added", contents: "# CA replicas\nhost1:8112\n\n  host2:8112  \n", want: []string{"host1:8112", "host2:8112"}},
+		{name: "only comments changed", contents: "# all CA replicas\nhost1:8112\nhost2:8112\n", unchanged: true},
+		{name: "no address", contents: "# nothing\n"},
+		{name: "address back after an error", contents: "host1:8112\nhost2:8112\n", want: []string{"host1:8112", "host2:8112"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writeEndpoints(t, file, tt.contents)
+			if tt.unchanged {
+				cc.expectNone(t, 100*time.Millisecond)
+				return
+			}
+			cc.expect(t, tt.want, time.Second)
+		})
+	}
+}
+
+/*
+ResolveNow马上重新查询注册表，不用等下一个周期
+*/
+func TestRegistryResolverResolveNow(t *testing.T) {
+	registry := discovery.Registry{Dir: t.TempDir(), TTL: time.Minute}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	if err := registry.Register("ca", discovery.Instance{ID: "a", Address: "host1:8112"}, stopCh); err != nil {
+		t.Fatal(err)
+	}
+	cc := newFakeClientConn()
+	r, err := registryBuilder{registry: registry, interval: time.Hour}.Build(target(t, "registry:///ca"), cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	cc.expect(t, []string{"host1:8112"}, time.Second)
+
+	if err := registry.Register("ca", discovery.Instance{ID: "b", Address: "host2:8112"}, stopCh); err != nil {
+		t.Fatal(err)
+	}
+	r.ResolveNow(resolver.ResolveNowOptions{})
+	cc.expect(t, []string{"host1:8112", "host2:8112"}, time.Second)
+}
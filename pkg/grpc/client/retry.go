@@ -0,0 +1,110 @@
+package client
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	googlegrpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+失败时的重试策略，等待时间从InitialBackoff开始每次翻倍，不超过MaxBackoff，再加上最多一半的随机抖动
+server在RetryInfo中给出了等待时间时按server的来，超过MaxBackoff时不再重试（例如配额要到明天才恢复）
+*/
+type RetryPolicy struct {
+	MaxAttempts    int //包括第一次，默认4，为1时不重试
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = 4
+	}
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = 200 * time.Millisecond
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = 5 * time.Second
+	}
+	return p
+}
+
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	wait := p.InitialBackoff
+	for i := 1; i < attempt && wait < p.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > p.MaxBackoff {
+		wait = p.MaxBackoff
+	}
+	return wait + time.Duration(rand.Int63n(int64(wait)/2+1))
+}
+
+/*
+Unavailable表示请求没有被处理（连不上或者副本不是leader），ResourceExhausted只有server给出了等待时间才重试
+超时不重试，因为server可能已经签发了证书
+*/
+func retryDelay(err error) (time.Duration, bool) {
+	st := status.Convert(err)
+	var delay time.Duration
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok {
+			delay = info.RetryDelay.AsDuration()
+		}
+	}
+	switch st.Code() {
+	case codes.Unavailable:
+		return delay, true
+	case codes.ResourceExhausted:
+		return delay, delay > 0
+	default:
+		return 0, false
+	}
+}
+
+/*
+每次尝试单独使用timeout，按policy重试，ctx结束时返回最后一次的错误
+*/
+func retryInterceptor(policy RetryPolicy, timeout time.Duration) googlegrpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *googlegrpc.ClientConn, invoker googlegrpc.UnaryInvoker, opts ...googlegrpc.CallOption) error {
+		for attempt := 1; ; attempt++ {
+			attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+			err := invoker(attemptCtx, method, req, reply, cc, opts...)
+			cancel()
+			if err == nil || attempt >= policy.MaxAttempts || ctx.Err() != nil {
+				return err
+			}
+			delay, ok := retryDelay(err)
+			if !ok || delay > policy.MaxBackoff {
+				return err
+			}
+			wait := policy.backoff(attempt)
+			if delay > wait {
+				wait = delay
+			}
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(wait):
+			}
+		}
+	}
+}
+
+/*
+没有客户端证书时用bearer token认证
+*/
+type bearerToken string
+
+func (t bearerToken) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(t)}, nil
+}
+
+func (t bearerToken) RequireTransportSecurity() bool {
+	return true
+}
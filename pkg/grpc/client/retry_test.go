@@ -0,0 +1,112 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	googlegrpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+/*
+带有RetryInfo的错误，delay为0时不带
+*/
+func statusError(code codes.Code, delay time.Duration) error {
+	st := status.New(code, code.String())
+	if delay > 0 {
+		st, _ = st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(delay)})
+	}
+	return st.Err()
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		wantDelay time.Duration
+		wantRetry bool
+	}{
+		{name: "unavailable", err: statusError(codes.Unavailable, 0), wantRetry: true},
+		{name: "unavailable with retry info", err: statusError(codes.Unavailable, time.Second), wantDelay: time.Second, wantRetry: true},
+		{name: "resource exhausted without retry info", err: statusError(codes.ResourceExhausted, 0)},
+		{name: "resource exhausted with retry info", err: statusError(codes.ResourceExhausted, 2*time.Second), wantDelay: 2 * time.Second, wantRetry: true},
+		{name: "deadline exceeded", err: statusError(codes.DeadlineExceeded, 0)},
+		{name: "permission denied", err: statusError(codes.PermissionDenied, 0)},
+		{name: "not a status", err: context.Canceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delay, retry := retryDelay(tt.err)
+			if delay != tt.wantDelay || retry != tt.wantRetry {
+				t.Errorf("retryDelay = %v, %v, want %v, %v", delay, retry, tt.wantDelay, tt.wantRetry)
+			}
+		})
+	}
+}
+
+func TestRetryInterceptor(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 100 * time.Millisecond}
+	tests := []struct {
+		name         string
+		errs         []error //依次返回的错误，用完之后成功
+		wantAttempts int
+		wantCode     codes.Code
+	}{
+		{name: "success", wantAttempts: 1, wantCode: codes.OK},
+		{name: "unavailable then success", errs: []error{statusError(codes.Unavailable, 0), statusError(codes.Unavailable, 0)}, wantAttempts: 3, wantCode: codes.OK},
+		{name: "unavailable until MaxAttempts", errs: []error{statusError(codes.Unavailable, 0), statusError(codes.Unavailable, 0), statusError(codes.Unavailable, 0), statusError(codes.Unavailable, 0)}, wantAttempts: 3, wantCode: codes.Unavailable},
+		{name: "rate limited with a short delay", errs: []error{statusError(codes.ResourceExhausted, 10*time.Millisecond)}, wantAttempts: 2, wantCode: codes.OK},
+		{name: "rate limited longer than MaxBackoff", errs: []error{statusError(codes.ResourceExhausted, time.Hour)}, wantAttempts: 1, wantCode: codes.ResourceExhausted},
+		{name: "quota exhausted", errs: []error{statusError(codes.ResourceExhausted, 0)}, wantAttempts: 1, wantCode: codes.ResourceExhausted},
+		{name: "timeout", errs: []error{statusError(codes.DeadlineExceeded, 0)}, wantAttempts: 1, wantCode: codes.DeadlineExceeded},
+		{name: "invalid argument", errs: []error{statusError(codes.InvalidArgument, 0)}, wantAttempts: 1, wantCode: codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			invoker := func(ctx context.Context, method string, req, reply interface{}, cc *googlegrpc.ClientConn, opts ...googlegrpc.CallOption) error {
+				attempts++
+				if _, ok := ctx.Deadline(); !ok {
+					t.Error("attempt has no timeout")
+				}
+				if attempts <= len(tt.errs) {
+					return tt.errs[attempts-1]
+				}
+				return nil
+			}
+			err := retryInterceptor(policy, time.Second)(context.Background(), "/grpc.CertificateService/SignCert", nil, nil, nil, invoker)
+			if code := status.Code(err); code != tt.wantCode {
+				t.Errorf("code = %v, want %v", code, tt.wantCode)
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", attempts, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+/*
+ctx结束时不再等待重试
+*/
+func TestRetryInterceptorCancel(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 10, InitialBackoff: time.Hour, MaxBackoff: time.Hour}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	attempts := 0
+	invoker := func(context.Context, string, interface{}, interface{}, *googlegrpc.ClientConn, ...googlegrpc.CallOption) error {
+		attempts++
+		return statusError(codes.Unavailable, 0)
+	}
+	start := time.Now()
+	err := retryInterceptor(policy, time.Second)(ctx, "/grpc.CertificateService/SignCert", nil, nil, nil, invoker)
+	if status.Code(err) != codes.Unavailable || attempts != 1 {
+		t.Errorf("got %v after %d attempt(s), want Unavailable after 1", err, attempts)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("returned after %v, ctx ended after 50ms", elapsed)
+	}
+}
@@ -0,0 +1,227 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	cx509 "crypto/x509"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+type RotateOptions struct {
+	RenewAt       float64       //有效期过了多少比例后续签，默认2/3
+	RetryInterval time.Duration //续签失败后多久重试，默认30s
+	BundleRefresh time.Duration //多久检查一次trust bundle，默认5分钟
+	OnRotate      func(*Certificate)
+}
+
+/*
+自动续签的证书：到期之前用新的私钥续签，并定期刷新trust bundle
+它给出的tls.Config每次握手都使用当前的证书和信任的根证书，不需要重启连接的使用者
+*/
+type Rotator struct {
+	client *Client
+	opts   RotateOptions
+
+	mu     sync.RWMutex
+	cert   *Certificate
+	tls    *tls.Certificate
+	bundle *Bundle
+	roots  *cx509.CertPool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+/*
+开始自动续签cert，cert必须带有私钥（Sign、Renew或Enroll的结果）
+*/
+func (c *Client) Rotate(cert *Certificate, opts RotateOptions) (*Rotator, error) {
+	if opts.RenewAt <= 0 || opts.RenewAt >= 1 {
+		opts.RenewAt = 2.0 / 3
+	}
+	if opts.RetryInterval <= 0 {
+		opts.RetryInterval = 30 * time.Second
+	}
+	if opts.BundleRefresh <= 0 {
+		opts.BundleRefresh = 5 * time.Minute
+	}
+	r := &Rotator{client: c, opts: opts, stop: make(chan struct{}), done: make(chan struct{})}
+	if err := r.setCertificate(cert); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.opts.Timeout)
+	defer cancel()
+	if err := r.refreshBundle(ctx); err != nil {
+		return nil, err
+	}
+	go r.run()
+	return r, nil
+}
+
+func (r *Rotator) setCertificate(cert *Certificate) error {
+	tlsCert, err := cert.TLSCertificate()
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.cert, r.tls = cert, tlsCert
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *Rotator) refreshBundle(ctx context.Context) error {
+	bundle, err := r.client.TrustBundle(ctx)
+	if err != nil {
+		return fmt.Errorf("fetch the trust bundle fail: %v", err)
+	}
+	r.mu.Lock()
+	if r.bundle == nil || r.bundle.Version != bundle.Version {
+		r.bundle, r.roots = bundle, bundle.CertPool()
+	}
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *Rotator) renewTime() time.Time {
+	cert := r.Certificate().Certificate
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	return cert.NotBefore.Add(time.Duration(float64(lifetime) * r.opts.RenewAt))
+}
+
+func (r *Rotator) run() {
+	defer close(r.done)
+	bundleTicker := time.NewTicker(r.opts.BundleRefresh)
+	defer bundleTicker.Stop()
+	renewTimer := time.NewTimer(time.Until(r.renewTime()))
+	defer renewTimer.Stop()
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-bundleTicker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), r.client.opts.Timeout)
+			if err := r.refreshBundle(ctx); err != nil {
+				log.Print(err)
+			}
+			cancel()
+		case <-renewTimer.C:
+			next := r.opts.RetryInterval
+			if err := r.renew(); err != nil {
+				log.Printf("renew certificate %v fail, retry in %v: %v", r.Certificate().ID, next, err)
+			} else {
+				next = time.Until(r.renewTime())
+			}
+			renewTimer.Reset(next)
+		}
+	}
+}
+
+func (r *Rotator) renew() error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.client.opts.Timeout*time.Duration(r.client.opts.Retry.MaxAttempts))
+	defer cancel()
+	cert, err := r.client.Renew(ctx, r.Certificate().ID)
+	if err != nil {
+		return err
+	}
+	if err := r.setCertificate(cert); err != nil {
+		return err
+	}
+	log.Printf("certificate renewed as %v, valid until %v", cert.ID, cert.Certificate.NotAfter.Format(time.RFC3339))
+	if r.opts.OnRotate != nil {
+		r.opts.OnRotate(cert)
+	}
+	return nil
+}
+
+/*
+当前的证书
+*/
+func (r *Rotator) Certificate() *Certificate {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert
+}
+
+/*
+当前的trust bundle
+*/
+func (r *Rotator) Bundle() *Bundle {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.bundle
+}
+
+func (r *Rotator) tlsCertificate() *tls.Certificate {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.tls
+}
+
+func (r *Rotator) currentRoots() *cx509.CertPool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.roots
+}
+
+/*
+server一方的TLS配置：出示当前的证书，要求并用当前的trust bundle验证客户端证书
+*/
+func (r *Rotator) ServerTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*r.tlsCertificate()},
+				ClientAuth:   tls.RequireAndVerifyClientCert,
+				ClientCAs:    r.currentRoots(),
+			}, nil
+		},
+	}
+}
+
+/*
+客户端一方的TLS配置：出示当前的证书，用当前的trust bundle验证server证书中的serverName
+tls.Config的RootCAs不能在握手时更换，所以关闭默认的验证，在VerifyConnection中自己验证
+*/
+func (r *Rotator) ClientTLSConfig(serverName string) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return r.tlsCertificate(), nil
+		},
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return fmt.Errorf("server presented no certificate")
+			}
+			intermediates := cx509.NewCertPool()
+			for _, cert := range state.PeerCertificates[1:] {
+				intermediates.AddCert(cert)
+			}
+			_, err := state.PeerCertificates[0].Verify(cx509.VerifyOptions{
+				DNSName:       serverName,
+				Roots:         r.currentRoots(),
+				Intermediates: intermediates,
+			})
+			return err
+		},
+	}
+}
+
+/*
+停止续签，已经给出的tls.Config继续使用最后的证书
+*/
+func (r *Rotator) Stop() {
+	select {
+	case <-r.stop:
+	default:
+		close(r.stop)
+	}
+	<-r.done
+}
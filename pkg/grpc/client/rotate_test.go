@@ -0,0 +1,234 @@
+package client
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	cx509 "crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	mygrpc "github.com/jackyzhangfudan/sidecar/pkg/grpc"
+	googlegrpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+/*
+测试用的CA：自签名的根证书，签发的证书和私钥都是PEM
+*/
+type testCA struct {
+	cert *cx509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &cx509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              cx509.KeyUsageCertSign,
+	}
+	der, err := cx509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := cx509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) sign(cn string, notBefore time.Time, notAfter time.Time) (certPEM []byte, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &cx509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{cn},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []cx509.ExtKeyUsage{cx509.ExtKeyUsageServerAuth, cx509.ExtKeyUsageClientAuth},
+	}
+	der, err := cx509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := cx509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), nil
+}
+
+func (ca *testCA) issue(t *testing.T, cn string, notBefore time.Time, notAfter time.Time) (certPEM []byte, keyPEM []byte) {
+	t.Helper()
+	certPEM, keyPEM, err := ca.sign(cn, notBefore, notAfter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certPEM, keyPEM
+}
+
+func (ca *testCA) pool() *cx509.CertPool {
+	pool := cx509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+/*
+只实现续签需要的几个方法，前failures次RenewCert失败
+*/
+type renewServer struct {
+	mygrpc.UnimplementedCertificateServiceServer
+	ca *testCA
+
+	mu       sync.Mutex
+	failures int
+	renewals int
+	issued   map[string][2][]byte
+}
+
+func (s *renewServer) RenewCert(ctx context.Context, req *mygrpc.FileIdentifer) (*mygrpc.SignResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.renewals++
+	if s.renewals <= s.failures {
+		return nil, status.Error(codes.Internal, "storage failure")
+	}
+	id := fmt.Sprintf("renewed-%d", s.renewals)
+	certPEM, keyPEM, err := s.ca.sign("client", time.Now().Add(-time.Minute), time.Now().Add(time.Hour))
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	s.issued[id] = [2][]byte{certPEM, keyPEM}
+	return &mygrpc.SignResponse{CertificateId: id}, nil
+}
+
+func (s *renewServer) GetCert(ctx context.Context, req *mygrpc.FileIdentifer) (*mygrpc.FileStream, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &mygrpc.FileStream{Contents: s.issued[req.Id][0]}, nil
+}
+
+func (s *renewServer) GetKey(ctx context.Context, req *mygrpc.FileIdentifer) (*mygrpc.FileStream, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &mygrpc.FileStream{Contents: s.issued[req.Id][1]}, nil
+}
+
+func (s *renewServer) GetTrustBundle(ctx context.Context, req *mygrpc.TrustBundleRequest) (*mygrpc.TrustBundle, error) {
+	return &mygrpc.TrustBundle{Contents: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.ca.cert.Raw}), Version: "1"}, nil
+}
+
+func (s *renewServer) calls() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.renewals
+}
+
+/*
+到了RenewAt就续签，失败时每隔RetryInterval重试，成功后按新证书的有效期安排下一次续签
+*/
+func TestRotatorRenew(t *testing.T) {
+	ca := newTestCA(t)
+	tests := []struct {
+		name     string
+		failures int
+	}{
+		{name: "renew at RenewAt", failures: 0},
+		{name: "retry after failures", failures: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &renewServer{ca: ca, failures: tt.failures, issued: map[string][2][]byte{}}
+			serverCertPEM, serverKeyPEM := ca.issue(t, "localhost", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+			serverCert, err := tls.X509KeyPair(serverCertPEM, serverKeyPEM)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lis, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := googlegrpc.NewServer(googlegrpc.Creds(credentials.NewServerTLSFromCert(&serverCert)))
+			mygrpc.RegisterCertificateServiceServer(s, server)
+			go s.Serve(lis)
+			defer s.Stop()
+
+			client, err := New(Options{
+				DialOptions: DialOptions{Target: "static:///" + lis.Addr().String(), ServerName: "localhost"},
+				RootCAs:     ca.pool(),
+				Timeout:     time.Second,
+				Retry:       RetryPolicy{MaxAttempts: 1},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+
+			//有效期的一半已经过了，RenewAt为0.5时马上续签
+			certPEM, keyPEM := ca.issue(t, "client", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+			cert, err := NewCertificate("initial", certPEM, keyPEM, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			rotated := make(chan *Certificate, 1)
+			retryInterval := 50 * time.Millisecond
+			start := time.Now()
+			rotator, err := client.Rotate(cert, RotateOptions{RenewAt: 0.5, RetryInterval: retryInterval, OnRotate: func(c *Certificate) { rotated <- c }})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rotator.Stop()
+			if rotator.Bundle().Version != "1" {
+				t.Errorf("bundle version = %v, want 1", rotator.Bundle().Version)
+			}
+
+			select {
+			case c := <-rotated:
+				want := fmt.Sprintf("renewed-%d", tt.failures+1)
+				if c.ID != want || rotator.Certificate().ID != want {
+					t.Errorf("rotated to %v (current %v), want %v", c.ID, rotator.Certificate().ID, want)
+				}
+				if c.PrivateKey == nil || rotator.tlsCertificate().Leaf != c.Certificate {
+					t.Error("the rotator doesn't use the renewed certificate and key")
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("not renewed after %d call(s)", server.calls())
+			}
+			if elapsed := time.Since(start); elapsed < time.Duration(tt.failures)*retryInterval-10*time.Millisecond {
+				t.Errorf("renewed after %v, want %d retries %v apart", elapsed, tt.failures, retryInterval)
+			}
+
+			//新证书要过半小时才续签
+			time.Sleep(3 * retryInterval)
+			if calls := server.calls(); calls != tt.failures+1 {
+				t.Errorf("RenewCert called %d times, want %d", calls, tt.failures+1)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package client
+
+import (
+	"context"
+	"log"
+	"time"
+
+	mygrpc "github.com/jackyzhangfudan/sidecar/pkg/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	watchMinBackoff time.Duration = time.Second
+	watchMaxBackoff time.Duration = time.Minute
+)
+
+/*
+订阅某张证书所代表身份的变化，每个事件都会交给onEvent处理，onEvent返回错误时停止订阅
+连接断开时会以指数退避的方式重连，并从最新的证书继续订阅；ctx被取消或者证书被吊销时返回
+*/
+func WatchCertificate(ctx context.Context, rpcClient mygrpc.CertificateServiceClient, id string, onEvent func(*mygrpc.CertificateEvent) error) error {
+	backoff := watchMinBackoff
+	for {
+		stream, err := rpcClient.WatchCertificate(ctx, &mygrpc.WatchRequest{Id: id})
+		for err == nil {
+			var event *mygrpc.CertificateEvent
+			event, err = stream.Recv()
+			if err != nil {
+				break
+			}
+			backoff = watchMinBackoff
+			if event.Type == mygrpc.CertificateEvent_Issued {
+				id = event.CertificateId
+			}
+			if handleErr := onEvent(event); handleErr != nil {
+				return handleErr
+			}
+			if event.Type == mygrpc.CertificateEvent_Revoked {
+				return nil
+			}
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		switch status.Code(err) {
+		case codes.Unavailable, codes.Internal, codes.Unknown, codes.ResourceExhausted:
+		default:
+			return err
+		}
+		log.Printf("watch of certificate %v broken, retry in %v: %v", id, backoff, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > watchMaxBackoff {
+			backoff = watchMaxBackoff
+		}
+	}
+}
+
+/*
+见 WatchCertificate
+*/
+func (c *Client) Watch(ctx context.Context, id string, onEvent func(*mygrpc.CertificateEvent) error) error {
+	return WatchCertificate(ctx, c.client(), id, onEvent)
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"context"
+	cx509 "crypto/x509"
+	"net"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/auth"
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+	mygrpc "github.com/jackyzhangfudan/sidecar/pkg/grpc"
+	googlegrpc "google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+/*
+每个方法需要的权限，签发和续签的权限取决于证书的profile，见requiredPermission
+*/
+var methodPermissions = map[string]string{
+	"/grpc.CertificateService/CsrTemplate":         "",
+	"/grpc.CertificateService/GetTrustBundle":      "",
+	"/grpc.CertificateService/Enroll":              "", //由join token授权
+	"/grpc.CertificateService/SignCsrBatch":        "", //每个CSR的签发权限在handler中检查
+	"/grpc.CertificateService/SignCsrBatchStream":  "",
+	"/grpc.CertificateService/GetCert":             auth.PermissionRead,
+	"/grpc.CertificateService/GetKey":              auth.PermissionRead,
+	"/grpc.CertificateService/ExportCertificate":   auth.PermissionRead,
+	"/grpc.CertificateService/WatchCertificate":    auth.PermissionRead,
+	"/grpc.CertificateService/ListCertificates":    auth.PermissionRead,
+	"/grpc.CertificateService/DescribeCertificate": auth.PermissionRead,
+	"/grpc.CertificateService/ListExpiring":        auth.PermissionRead,
+	"/grpc.CertificateService/GetCRL":              "",
+	"/grpc.CertificateService/RevokeCert":          auth.PermissionRevoke,
+	"/grpc.health.v1.Health/Check":                 "",
+	"/grpc.health.v1.Health/Watch":                 "",
+}
+
+/*
+没有证书的新工作负载也能调用的方法
+*/
+var bootstrapMethods = map[string]bool{
+	"/grpc.CertificateService/CsrTemplate":    true,
+	"/grpc.CertificateService/GetTrustBundle": true,
+	"/grpc.CertificateService/Enroll":         true,
+	"/grpc.CertificateService/GetCRL":         true,
+	"/grpc.health.v1.Health/Check":            true,
+	"/grpc.health.v1.Health/Watch":            true,
+}
+
+func requiredPermission(method string, req interface{}) string {
+	switch in := req.(type) {
+	case *mygrpc.CertificateSigningRequest:
+		return auth.SignPermission(in.Profile)
+	case *mygrpc.PKCS10Request:
+		return auth.SignPermission(in.Profile)
+	case *mygrpc.FileIdentifer:
+		if method == "/grpc.CertificateService/RenewCert" {
+			//续签沿用原证书的profile，证书不存在时由RenewCert返回NotFound
+			if cert, err := ca.CA.LoadCertificate(in.Id); err == nil {
+				return auth.SignPermission(ca.ProfileOfCertificate(cert))
+			}
+			return auth.PermissionRead
+		}
+	}
+	if permission, ok := methodPermissions[method]; ok {
+		return permission
+	}
+	//新加的方法忘了配置权限时，只有admin可以调用
+	return auth.PermissionAdmin
+}
+
+/*
+认证调用者：mTLS客户端证书，或者metadata中的 authorization: Bearer <token>
+*/
+func authenticate(ctx context.Context, authorizer *auth.Authorizer) (*auth.Principal, error) {
+	var creds auth.Credentials
+	if p, ok := peer.FromContext(ctx); ok {
+		if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(tlsInfo.State.VerifiedChains) > 0 {
+			creds.PeerCertificates = []*cx509.Certificate{tlsInfo.State.VerifiedChains[0][0]}
+		}
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("authorization"); len(values) > 0 {
+			creds.BearerToken = auth.BearerToken(values[0])
+		}
+	}
+	return authorizer.Authenticate(creds)
+}
+
+/*
+没有启用认证但启用了mTLS时，和以前一样要求客户端证书
+*/
+func requireClientCert(authorizer *auth.Authorizer, mtls bool, method string, principal *auth.Principal) error {
+	if authorizer != nil || !mtls || bootstrapMethods[method] || principal.Method == auth.MethodMTLS {
+		return nil
+	}
+	return ca.NewError(ca.ErrUnauthenticated, "CLIENT_CERTIFICATE_REQUIRED", "%v requires a client certificate", method)
+}
+
+func authUnaryInterceptor(authorizer *auth.Authorizer, mtls bool) googlegrpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *googlegrpc.UnaryServerInfo, handler googlegrpc.UnaryHandler) (interface{}, error) {
+		principal, err := authenticate(ctx, authorizer)
+		if err == nil {
+			err = requireClientCert(authorizer, mtls, info.FullMethod, principal)
+		}
+		if err != nil {
+			return nil, toStatusError(err)
+		}
+		if err := authorizer.Authorize(principal, requiredPermission(info.FullMethod, req)); err != nil {
+			return nil, toStatusError(err)
+		}
+		return handler(withClientAddress(auth.WithPrincipal(ctx, principal)), req)
+	}
+}
+
+func authStreamInterceptor(authorizer *auth.Authorizer, mtls bool) googlegrpc.StreamServerInterceptor {
+	return func(srv interface{}, ss googlegrpc.ServerStream, info *googlegrpc.StreamServerInfo, handler googlegrpc.StreamHandler) error {
+		principal, err := authenticate(ss.Context(), authorizer)
+		if err == nil {
+			err = requireClientCert(authorizer, mtls, info.FullMethod, principal)
+		}
+		if err != nil {
+			return toStatusError(err)
+		}
+		if err := authorizer.Authorize(principal, requiredPermission(info.FullMethod, nil)); err != nil {
+			return toStatusError(err)
+		}
+		return handler(srv, &principalStream{ServerStream: ss, ctx: withClientAddress(auth.WithPrincipal(ss.Context(), principal))})
+	}
+}
+
+/*
+匿名调用者按网络地址限流
+*/
+func withClientAddress(ctx context.Context) context.Context {
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+			return ca.WithClientAddress(ctx, host)
+		}
+	}
+	return ctx
+}
+
+type principalStream struct {
+	googlegrpc.ServerStream
+	ctx context.Context
+}
+
+func (s *principalStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/auth"
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+	mygrpc "github.com/jackyzhangfudan/sidecar/pkg/grpc"
+)
+
+/*
+sign a batch of certificate signing requests, every request gets its own result
+*/
+func (s *certificateServiceServer) SignCsrBatch(ctx context.Context, in *mygrpc.SignBatchRequest) (*mygrpc.SignBatchResponse, error) {
+	return s.signBatch(ctx, in.Requests, in)
+}
+
+/*
+the same as SignCsrBatch, for batches too large for one message
+*/
+func (s *certificateServiceServer) SignCsrBatchStream(stream mygrpc.CertificateService_SignCsrBatchStreamServer) error {
+	var first *mygrpc.SignBatchRequest
+	var requests []*mygrpc.CertificateSigningRequest
+	for {
+		in, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if first == nil {
+			first = in
+		}
+		requests = append(requests, in.Requests...)
+		if len(requests) > ca.MaxBatchSize {
+			return toStatusError(ca.InvalidArgument("BATCH_TOO_LARGE", ca.FieldViolation{Field: "Requests", Description: fmt.Sprintf("at most %v requests in a batch", ca.MaxBatchSize)}))
+		}
+	}
+	if first == nil {
+		first = &mygrpc.SignBatchRequest{}
+	}
+
+	resp, err := s.signBatch(stream.Context(), requests, first)
+	if err != nil {
+		return err
+	}
+	return stream.SendAndClose(resp)
+}
+
+func (s *certificateServiceServer) signBatch(ctx context.Context, requests []*mygrpc.CertificateSigningRequest, opts *mygrpc.SignBatchRequest) (*mygrpc.SignBatchResponse, error) {
+	csrs := make([]*ca.CertificateSigningRequest, len(requests))
+	var violations []ca.FieldViolation
+	for i, request := range requests {
+		csr, csrViolations := FromProtoCSR(request)
+		for _, v := range csrViolations {
+			violations = append(violations, ca.FieldViolation{Field: fmt.Sprintf("Requests[%v].%v", i, v.Field), Description: v.Description})
+		}
+		csrs[i] = csr
+	}
+	if len(violations) > 0 {
+		return nil, toStatusError(ca.InvalidArgument("INVALID_CSR", violations...))
+	}
+	//批中每个CSR的profile都要有签发权限，拦截器只能看到整个请求
+	for _, csr := range csrs {
+		if err := s.authorizer.Authorize(auth.PrincipalFrom(ctx), auth.SignPermission(csr.Profile)); err != nil {
+			return nil, toStatusError(err)
+		}
+	}
+
+	results, err := ca.CA.SignX509Batch(ctx, csrs, ca.BatchOptions{AllOrNothing: opts.AllOrNothing, Parallelism: int(opts.Parallelism)})
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+	resp := &mygrpc.SignBatchResponse{}
+	for i, result := range results {
+		item := &mygrpc.SignBatchResult{Index: int32(i)}
+		if result.Err != nil {
+			item.Error = toBatchItemError(result.Err)
+			resp.Failed++
+		} else {
+			item.CertificateId = result.Certificate.ID
+			item.KeySecret = result.Certificate.KeySecret
+			resp.Succeeded++
+		}
+		resp.Results = append(resp.Results, item)
+	}
+	return resp, nil
+}
+
+/*
+批中一个请求的错误，和toStatusError一样不暴露内部错误的内容
+*/
+func toBatchItemError(err error) *mygrpc.BatchItemError {
+	var caErr *ca.Error
+	if !errors.As(err, &caErr) {
+		return &mygrpc.BatchItemError{Code: ca.ErrInternal.String(), Reason: "INTERNAL", Message: "internal error"}
+	}
+	if caErr.Err != nil {
+		log.Printf("%v: %v", caErr.Reason, caErr.Err)
+	}
+	message := (&ca.Error{Message: caErr.Message, Violations: caErr.Violations}).Error()
+	return &mygrpc.BatchItemError{Code: caErr.Code.String(), Reason: caErr.Reason, Message: message}
+}
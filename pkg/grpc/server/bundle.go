@@ -0,0 +1,41 @@
+package server
+
+import (
+	"context"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+	mygrpc "github.com/jackyzhangfudan/sidecar/pkg/grpc"
+)
+
+/*
+return the roots and intermediates clients should trust
+*/
+func (s *certificateServiceServer) GetTrustBundle(ctx context.Context, in *mygrpc.TrustBundleRequest) (*mygrpc.TrustBundle, error) {
+	bundle := ca.CA.CurrentTrustBundle()
+	result := &mygrpc.TrustBundle{
+		Format:            in.Format,
+		Version:           bundle.Version,
+		RootCount:         int32(len(bundle.Roots)),
+		IntermediateCount: int32(len(bundle.Intermediates)),
+	}
+	if in.IfNoneMatch == bundle.Version {
+		result.NotModified = true
+		return result, nil
+	}
+
+	switch in.Format {
+	case mygrpc.BundleFormat_DER:
+		result.Contents = bundle.DER()
+	case mygrpc.BundleFormat_JWKS:
+		contents, err := bundle.JWKS()
+		if err != nil {
+			return nil, toStatusError(ca.WrapError(ca.ErrInternal, "BUNDLE_ENCODING_FAILED", err, "encode trust bundle fail"))
+		}
+		result.Contents = contents
+	case mygrpc.BundleFormat_PEM:
+		result.Contents = bundle.PEM()
+	default:
+		return nil, toStatusError(ca.InvalidArgument("UNKNOWN_BUNDLE_FORMAT", ca.FieldViolation{Field: "Format", Description: "must be PEM, DER or JWKS"}))
+	}
+	return result, nil
+}
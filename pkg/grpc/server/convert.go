@@ -0,0 +1,104 @@
+package server
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+	mygrpc "github.com/jackyzhangfudan/sidecar/pkg/grpc"
+)
+
+/*
+把gRPC的CSR消息转化为 ca.CertificateSigningRequest，无法解析的字段作为 violation 返回
+*/
+func FromProtoCSR(csrReq *mygrpc.CertificateSigningRequest) (*ca.CertificateSigningRequest, []ca.FieldViolation) {
+	csr := &ca.CertificateSigningRequest{}
+	var violations []ca.FieldViolation
+
+	csr.Version = int(csrReq.Version)
+	csr.PublicKeyAlg = x509.PublicKeyAlgorithm(csrReq.PublicKeyAlg)
+	csr.SignatureAlgorithm = x509.SignatureAlgorithm(csrReq.SignatureAlgorithm)
+	csr.Profile = csrReq.Profile
+
+	csr.DNSNames = csrReq.DNSNames
+	csr.EmailAddresses = csrReq.EmailAddresses
+	csr.SubjectCommonName = csrReq.SubjectCommonName
+
+	csr.SubjectCountry = csrReq.SubjectCountry
+	csr.SubjectLocality = csrReq.SubjectLocality
+	csr.SubjectOrganization = csrReq.SubjectOrganization
+	csr.SubjectOrganizationalUnit = csrReq.SubjectOrganizationalUnit
+	csr.SubjectPostalCode = csrReq.SubjectPostalCode
+	csr.SubjectProvince = csrReq.SubjectProvince
+	csr.SubjectSerialNumber = csrReq.SubjectSerialNumber
+	csr.SubjectStreetAddress = csrReq.SubjectStreetAddress
+
+	for i, ipStr := range csrReq.IPAddresses {
+		ip := net.ParseIP(ipStr)
+		if ip == nil {
+			violations = append(violations, violation("IPAddresses", i, "%q is not a valid IP address", ipStr))
+			continue
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		csr.IPAddresses = append(csr.IPAddresses, ip)
+	}
+
+	for i, uriStr := range csrReq.URIs {
+		uri, err := url.Parse(uriStr)
+		if err != nil || uri.Scheme == "" {
+			violations = append(violations, violation("URIs", i, "%q is not an absolute URI", uriStr))
+			continue
+		}
+		csr.URIs = append(csr.URIs, *uri)
+	}
+
+	for i, name := range csrReq.SubjectExtraNames {
+		oid, err := parseOID(name.Type)
+		if err != nil {
+			violations = append(violations, violation("SubjectExtraNames", i, "%q is not a valid OID", name.Type))
+			continue
+		}
+		csr.SubjectExtraNames = append(csr.SubjectExtraNames, ca.DistinguishedName{Type: oid, Value: name.Value})
+	}
+
+	for i, ex := range csrReq.Extensions {
+		oid, err := parseOID(ex.ID)
+		if err != nil {
+			violations = append(violations, violation("Extensions", i, "%q is not a valid OID", ex.ID))
+			continue
+		}
+		csr.Extensions = append(csr.Extensions, ca.Extension{ID: oid, Critical: ex.Critical, Value: ex.Value})
+	}
+
+	return csr, violations
+}
+
+func violation(field string, index int, format string, args ...interface{}) ca.FieldViolation {
+	return ca.FieldViolation{Field: fmt.Sprintf("%v[%d]", field, index), Description: fmt.Sprintf(format, args...)}
+}
+
+/*
+解析点分形式的OID，例如 "2.5.4.12"，每一段只能是十进制数字，不接受 +1、-1 这样带符号的写法
+*/
+func parseOID(s string) (asn1.ObjectIdentifier, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("oid %q needs at least two arcs", s)
+	}
+	oid := make(asn1.ObjectIdentifier, 0, len(parts))
+	for _, part := range parts {
+		v, err := strconv.ParseUint(part, 10, 31)
+		if err != nil {
+			return nil, fmt.Errorf("invalid arc %q in oid %q", part, s)
+		}
+		oid = append(oid, int(v))
+	}
+	return oid, nil
+}
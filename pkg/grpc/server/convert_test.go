@@ -0,0 +1,128 @@
+package server
+
+import (
+	"encoding/asn1"
+	"net"
+	"reflect"
+	"testing"
+
+	mygrpc "github.com/jackyzhangfudan/sidecar/pkg/grpc"
+)
+
+func TestFromProtoCSR(t *testing.T) {
+	tests := []struct {
+		name           string
+		in             *mygrpc.CertificateSigningRequest
+		wantIPs        []net.IP
+		wantURIs       []string
+		wantExtraNames []asn1.ObjectIdentifier
+		wantExtensions []asn1.ObjectIdentifier
+		wantFields     []string
+	}{
+		{
+			name: "all fields",
+			in: &mygrpc.CertificateSigningRequest{
+				SubjectCommonName: "api",
+				DNSNames:          []string{"api.local"},
+				IPAddresses:       []string{"10.0.0.1", "::1"},
+				URIs:              []string{"spiffe://example.org/api"},
+				SubjectExtraNames: []*mygrpc.DistinguishedName{{Type: "2.5.4.12", Value: "engineer"}},
+				Extensions:        []*mygrpc.Extension{{ID: "1.2.3.4", Critical: true, Value: []byte{0x05, 0x00}}},
+			},
+			wantIPs:        []net.IP{net.IPv4(10, 0, 0, 1).To4(), net.ParseIP("::1")},
+			wantURIs:       []string{"spiffe://example.org/api"},
+			wantExtraNames: []asn1.ObjectIdentifier{{2, 5, 4, 12}},
+			wantExtensions: []asn1.ObjectIdentifier{{1, 2, 3, 4}},
+		},
+		{
+			name:       "invalid IP",
+			in:         &mygrpc.CertificateSigningRequest{IPAddresses: []string{"10.0.0.1", "10.0.0.256"}},
+			wantIPs:    []net.IP{net.IPv4(10, 0, 0, 1).To4()},
+			wantFields: []string{"IPAddresses[1]"},
+		},
+		{
+			name:       "relative URI",
+			in:         &mygrpc.CertificateSigningRequest{URIs: []string{"/api", "spiffe://example.org/api"}},
+			wantURIs:   []string{"spiffe://example.org/api"},
+			wantFields: []string{"URIs[0]"},
+		},
+		{
+			name: "invalid OIDs",
+			in: &mygrpc.CertificateSigningRequest{
+				SubjectExtraNames: []*mygrpc.DistinguishedName{{Type: "2", Value: "x"}, {Type: "2.5.4.x", Value: "y"}},
+				Extensions:        []*mygrpc.Extension{{ID: "1.-2.3"}, {ID: "1.+2.3"}},
+			},
+			wantFields: []string{"SubjectExtraNames[0]", "SubjectExtraNames[1]", "Extensions[0]", "Extensions[1]"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			csr, violations := FromProtoCSR(tt.in)
+			var fields []string
+			for _, v := range violations {
+				fields = append(fields, v.Field)
+			}
+			if !reflect.DeepEqual(fields, tt.wantFields) {
+				t.Errorf("violations on %v, want %v", fields, tt.wantFields)
+			}
+			if csr.SubjectCommonName != tt.in.SubjectCommonName || !reflect.DeepEqual(csr.DNSNames, tt.in.DNSNames) {
+				t.Errorf("subject %q %v, want %q %v", csr.SubjectCommonName, csr.DNSNames, tt.in.SubjectCommonName, tt.in.DNSNames)
+			}
+			if !reflect.DeepEqual(csr.IPAddresses, tt.wantIPs) {
+				t.Errorf("IPAddresses = %v, want %v", csr.IPAddresses, tt.wantIPs)
+			}
+			var uris []string
+			for _, uri := range csr.URIs {
+				uris = append(uris, uri.String())
+			}
+			if !reflect.DeepEqual(uris, tt.wantURIs) {
+				t.Errorf("URIs = %v, want %v", uris, tt.wantURIs)
+			}
+			var extraNames, extensions []asn1.ObjectIdentifier
+			for _, name := range csr.SubjectExtraNames {
+				extraNames = append(extraNames, name.Type)
+			}
+			for _, ex := range csr.Extensions {
+				extensions = append(extensions, ex.ID)
+			}
+			if !reflect.DeepEqual(extraNames, tt.wantExtraNames) || !reflect.DeepEqual(extensions, tt.wantExtensions) {
+				t.Errorf("extra names %v and extensions %v, want %v and %v", extraNames, extensions, tt.wantExtraNames, tt.wantExtensions)
+			}
+			if len(tt.in.Extensions) > 0 && len(csr.Extensions) > 0 && csr.Extensions[0].Critical != tt.in.Extensions[0].Critical {
+				t.Error("critical flag of the extension is lost")
+			}
+		})
+	}
+}
+
+func TestParseOID(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    asn1.ObjectIdentifier
+		wantErr bool
+	}{
+		{in: "2.5.4.12", want: asn1.ObjectIdentifier{2, 5, 4, 12}},
+		{in: "1.3.6.1.4.1.311.60.2.1.3", want: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 60, 2, 1, 3}},
+		{in: "2", wantErr: true},
+		{in: "", wantErr: true},
+		{in: "2.5.", wantErr: true},
+		{in: "2..5", wantErr: true},
+		{in: "2.+5.4", wantErr: true},
+		{in: "2.-5.4", wantErr: true},
+		{in: "+2.5.4", wantErr: true},
+		{in: "2. 5.4", wantErr: true},
+		{in: "2.0x5.4", wantErr: true},
+		{in: "2.5.99999999999", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseOID(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !got.Equal(tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
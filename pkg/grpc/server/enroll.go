@@ -0,0 +1,38 @@
+package server
+
+import (
+	"context"
+	cx509 "crypto/x509"
+	"encoding/pem"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+	mygrpc "github.com/jackyzhangfudan/sidecar/pkg/grpc"
+)
+
+/*
+request the first certificate with a join token, the caller doesn't need a certificate or other credentials
+*/
+func (s *certificateServiceServer) Enroll(ctx context.Context, in *mygrpc.EnrollRequest) (*mygrpc.EnrollResponse, error) {
+	if in.Csr == nil {
+		return nil, toStatusError(ca.InvalidArgument("INVALID_CSR", ca.FieldViolation{Field: "Csr", Description: "is required"}))
+	}
+	csr, violations := FromProtoCSR(in.Csr)
+	if len(violations) > 0 {
+		return nil, toStatusError(ca.InvalidArgument("INVALID_CSR", violations...))
+	}
+
+	enrolled, err := ca.CA.Enroll(ctx, in.Token, csr)
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+	keyDER, err := cx509.MarshalPKCS8PrivateKey(enrolled.Issued.PrivateKey)
+	if err != nil {
+		return nil, toStatusError(ca.WrapError(ca.ErrInternal, "KEY_ENCODING_FAILED", err, "encode private key fail"))
+	}
+	return &mygrpc.EnrollResponse{
+		CertificateId: enrolled.ID,
+		Certificate:   pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: enrolled.Issued.Certificate.Raw}),
+		PrivateKey:    pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+		Chain:         trustBundlePEM(),
+	}, nil
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"errors"
+	"log"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	"google.golang.org/protobuf/protoadapt"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+var grpcCodes = map[ca.ErrorCode]codes.Code{
+	ca.ErrInternal:           codes.Internal,
+	ca.ErrInvalidArgument:    codes.InvalidArgument,
+	ca.ErrNotFound:           codes.NotFound,
+	ca.ErrAlreadyExists:      codes.AlreadyExists,
+	ca.ErrPermissionDenied:   codes.PermissionDenied,
+	ca.ErrUnauthenticated:    codes.Unauthenticated,
+	ca.ErrFailedPrecondition: codes.FailedPrecondition,
+	ca.ErrResourceExhausted:  codes.ResourceExhausted,
+	ca.ErrUnavailable:        codes.Unavailable,
+}
+
+/*
+把CA返回的错误转换为gRPC status，并附带 google.rpc.ErrorInfo 和 google.rpc.BadRequest
+不认识的错误一律当作Internal，且不暴露错误内容
+*/
+func toStatusError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	var caErr *ca.Error
+	if !errors.As(err, &caErr) {
+		log.Printf("unexpected error: %v", err)
+		return status.Error(codes.Internal, "internal error")
+	}
+	if caErr.Err != nil {
+		log.Printf("%v: %v", caErr.Reason, caErr.Err)
+	}
+
+	st := status.New(grpcCodes[caErr.Code], caErr.Message)
+	details := []protoadapt.MessageV1{&errdetails.ErrorInfo{Reason: caErr.Reason, Domain: ca.ErrorDomain, Metadata: caErr.Metadata}}
+	if len(caErr.Violations) > 0 {
+		badRequest := &errdetails.BadRequest{}
+		for _, v := range caErr.Violations {
+			badRequest.FieldViolations = append(badRequest.FieldViolations, &errdetails.BadRequest_FieldViolation{Field: v.Field, Description: v.Description})
+		}
+		details = append(details, badRequest)
+	}
+	if caErr.RetryAfter > 0 {
+		details = append(details, &errdetails.RetryInfo{RetryDelay: durationpb.New(caErr.RetryAfter)})
+	}
+	withDetails, detailErr := st.WithDetails(details...)
+	if detailErr != nil {
+		return st.Err()
+	}
+	return withDetails.Err()
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+func TestToStatusError(t *testing.T) {
+	limited := ca.NewError(ca.ErrResourceExhausted, "RATE_LIMITED", "too many requests")
+	limited.RetryAfter = 1500 * time.Millisecond
+	tests := []struct {
+		name           string
+		err            error
+		wantCode       codes.Code
+		wantMessage    string
+		wantReason     string
+		wantViolations []string
+		wantRetry      time.Duration
+	}{
+		{name: "not found", err: ca.NewError(ca.ErrNotFound, "CERT_NOT_FOUND", "certificate x not found"), wantCode: codes.NotFound, wantMessage: "certificate x not found", wantReason: "CERT_NOT_FOUND"},
+		{name: "wrapped", err: fmt.Errorf("sign: %w", ca.NewError(ca.ErrPermissionDenied, "NOT_OWNER", "not yours")), wantCode: codes.PermissionDenied, wantMessage: "not yours", wantReason: "NOT_OWNER"},
+		{
+			name:           "field violations",
+			err:            ca.InvalidArgument("INVALID_CSR", ca.FieldViolation{Field: "DNSNames[0]", Description: "empty"}, ca.FieldViolation{Field: "URIs[1]", Description: "relative"}),
+			wantCode:       codes.InvalidArgument,
+			wantMessage:    "invalid request",
+			wantReason:     "INVALID_CSR",
+			wantViolations: []string{"DNSNames[0]", "URIs[1]"},
+		},
+		{name: "retry after", err: limited, wantCode: codes.ResourceExhausted, wantMessage: "too many requests", wantReason: "RATE_LIMITED", wantRetry: 1500 * time.Millisecond},
+		{name: "unavailable", err: ca.NewError(ca.ErrUnavailable, "NOT_LEADER", "retry with the leader"), wantCode: codes.Unavailable, wantMessage: "retry with the leader", wantReason: "NOT_LEADER"},
+		{name: "internal cause hidden", err: ca.WrapError(ca.ErrInternal, "STORAGE_FAILED", errors.New("disk /dev/sda1 full"), "persist fail"), wantCode: codes.Internal, wantMessage: "persist fail", wantReason: "STORAGE_FAILED"},
+		{name: "unknown error", err: errors.New("secret detail"), wantCode: codes.Internal, wantMessage: "internal error"},
+		{name: "already a status", err: status.Error(codes.Aborted, "aborted"), wantCode: codes.Aborted, wantMessage: "aborted"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st, ok := status.FromError(toStatusError(tt.err))
+			if !ok {
+				t.Fatal("not a gRPC status")
+			}
+			if st.Code() != tt.wantCode || st.Message() != tt.wantMessage {
+				t.Errorf("status %v %q, want %v %q", st.Code(), st.Message(), tt.wantCode, tt.wantMessage)
+			}
+			var reason string
+			var violations []string
+			var retry time.Duration
+			for _, detail := range st.Details() {
+				switch detail := detail.(type) {
+				case *errdetails.ErrorInfo:
+					reason = detail.Reason
+					if detail.Domain != ca.ErrorDomain {
+						t.Errorf("domain = %v", detail.Domain)
+					}
+				case *errdetails.BadRequest:
+					for _, v := range detail.FieldViolations {
+						violations = append(violations, v.Field)
+					}
+				case *errdetails.RetryInfo:
+					retry = detail.RetryDelay.AsDuration()
+				}
+			}
+			if reason != tt.wantReason {
+				t.Errorf("reason = %q, want %q", reason, tt.wantReason)
+			}
+			if fmt.Sprint(violations) != fmt.Sprint(tt.wantViolations) {
+				t.Errorf("violations on %v, want %v", violations, tt.wantViolations)
+			}
+			if retry != tt.wantRetry {
+				t.Errorf("retry delay = %v, want %v", retry, tt.wantRetry)
+			}
+		})
+	}
+	if toStatusError(nil) != nil {
+		t.Error("nil error becomes a status")
+	}
+}
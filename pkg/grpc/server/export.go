@@ -0,0 +1,38 @@
+package server
+
+import (
+	"context"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+	mygrpc "github.com/jackyzhangfudan/sidecar/pkg/grpc"
+)
+
+var exportFormats = map[mygrpc.ExportFormat]ca.ExportFormat{
+	mygrpc.ExportFormat_ExportPEM:          ca.ExportPEM,
+	mygrpc.ExportFormat_ExportFullchain:    ca.ExportFullchain,
+	mygrpc.ExportFormat_ExportDER:          ca.ExportDER,
+	mygrpc.ExportFormat_ExportPKCS12:       ca.ExportPKCS12,
+	mygrpc.ExportFormat_ExportPKCS12Legacy: ca.ExportPKCS12Legacy,
+	mygrpc.ExportFormat_ExportTruststore:   ca.ExportTruststore,
+	mygrpc.ExportFormat_ExportPKCS8:        ca.ExportPKCS8,
+}
+
+/*
+export an issued certificate as PEM, fullchain, DER, PKCS#12 or its key as PKCS#8
+*/
+func (s *certificateServiceServer) ExportCertificate(ctx context.Context, in *mygrpc.ExportRequest) (*mygrpc.ExportResponse, error) {
+	format, ok := exportFormats[in.Format]
+	if !ok {
+		return nil, toStatusError(ca.InvalidArgument("UNKNOWN_EXPORT_FORMAT", ca.FieldViolation{Field: "Format", Description: "unknown export format"}))
+	}
+	export, err := ca.CA.ExportCertificate(ctx, in.Id, ca.ExportOptions{Format: format, Password: in.Password, KeySecret: in.KeySecret})
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+	return &mygrpc.ExportResponse{
+		Format:      in.Format,
+		Contents:    export.Contents,
+		ContentType: export.ContentType,
+		FileName:    export.FileName,
+	}, nil
+}
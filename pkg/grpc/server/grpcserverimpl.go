@@ -3,27 +3,16 @@ package server
 import (
 	"context"
 	"log"
-	"net"
-	"strconv"
-	"strings"
 
+	"github.com/jackyzhangfudan/sidecar/pkg/auth"
 	"github.com/jackyzhangfudan/sidecar/pkg/ca"
 	mygrpc "github.com/jackyzhangfudan/sidecar/pkg/grpc"
-	codes "google.golang.org/grpc/codes"
-	status "google.golang.org/grpc/status"
 	emptypb "google.golang.org/protobuf/types/known/emptypb"
 )
 
-type ServerError struct {
-	msg string
-}
-
-func (e *ServerError) Error() string {
-	return e.msg
-}
-
 type certificateServiceServer struct {
 	mygrpc.UnimplementedCertificateServiceServer
+	authorizer *auth.Authorizer //为nil时不做授权
 }
 
 /*
@@ -40,7 +29,7 @@ func (s *certificateServiceServer) CsrTemplate(context.Context, *emptypb.Empty)
 		SubjectCommonName: "tsinghua.edu.cn",
 		EmailAddresses:    []string{"ex@example.com"},
 		DNSNames:          []string{"localhost"},
-		IPAddresses:       []string{"0.0.0.0", "127.0.0.1"},
+		IPAddresses:       []string{"0.0.0.0", "127.0.0.1", "::1"},
 	}
 
 	return csr, nil
@@ -50,50 +39,32 @@ func (s *certificateServiceServer) CsrTemplate(context.Context, *emptypb.Empty)
 Sing a certificate signing request
 */
 func (s *certificateServiceServer) SignCsr(ctx context.Context, csrReq *mygrpc.CertificateSigningRequest) (*mygrpc.SignResponse, error) {
-	csr := &ca.CertificateSigningRequest{}
-
-	csr.DNSNames = csrReq.DNSNames
-	csr.EmailAddresses = csrReq.EmailAddresses
-	csr.SubjectCommonName = csrReq.SubjectCommonName
-
-	csr.SubjectCountry = csrReq.SubjectCountry
-	csr.SubjectLocality = csrReq.SubjectLocality
-	csr.SubjectOrganization = csrReq.SubjectOrganization
-	csr.SubjectOrganizationalUnit = csrReq.SubjectOrganizationalUnit
-	csr.SubjectPostalCode = csrReq.SubjectPostalCode
-	csr.SubjectProvince = csrReq.SubjectProvince
-	csr.SubjectSerialNumber = csrReq.SubjectSerialNumber
-	csr.SubjectStreetAddress = csrReq.SubjectStreetAddress
-
-	for _, ipStr := range csrReq.IPAddresses {
-		ips := strings.Split(ipStr, ".")
-		if len(ips) != 4 {
-			continue
-		}
-		var ip net.IP
-		for _, ele := range ips {
-			v, err := strconv.ParseUint(ele, 10, 8)
-			if err != nil {
-				continue
-			}
-			ip = append(ip, byte(v))
-		}
-		if len(ip) != 4 {
-			continue
-		}
-		csr.IPAddresses = append(csr.IPAddresses, ip)
+	csr, violations := FromProtoCSR(csrReq)
+	if len(violations) > 0 {
+		return nil, toStatusError(ca.InvalidArgument("INVALID_CSR", violations...))
 	}
 
-	theCert, err := ca.CA.SignX509(csr)
+	theCert, err := ca.CA.SignX509(ctx, csr)
 
 	if err != nil {
-		return nil, status.Error(codes.Internal, "singing csr fail")
+		return nil, toStatusError(err)
 	}
 
-	result := &mygrpc.SignResponse{CertificateId: theCert.ID}
+	result := &mygrpc.SignResponse{CertificateId: theCert.ID, KeySecret: theCert.KeySecret}
 	return result, nil
 }
 
+/*
+sign a PKCS#10 CSR, the requester keeps the private key so there is nothing to fetch with GetKey
+*/
+func (s *certificateServiceServer) SignPKCS10(ctx context.Context, in *mygrpc.PKCS10Request) (*mygrpc.SignResponse, error) {
+	theCert, err := ca.CA.SignPKCS10(ctx, in.Csr, in.Profile)
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+	return &mygrpc.SignResponse{CertificateId: theCert.ID}, nil
+}
+
 /*
 return the generated certificate
 */
@@ -101,19 +72,20 @@ func (s *certificateServiceServer) GetCert(ctx context.Context, in *mygrpc.FileI
 	contents, err := ca.CA.GetCertFile(in.Id)
 	if err != nil {
 		log.Printf("can't find the expected client certificate file %v", err)
-		return nil, &ServerError{msg: "can't get the expected file"}
+		return nil, toStatusError(err)
 	}
 	return &mygrpc.FileStream{Contents: contents}, nil
 }
 
 /*
-return the generated private key
+return the generated private key, it is encrypted with the KeySecret of SignResponse,
+only the requester can fetch it and only once
 */
 func (s *certificateServiceServer) GetKey(ctx context.Context, in *mygrpc.FileIdentifer) (*mygrpc.FileStream, error) {
-	contents, err := ca.CA.GetKeyFile(in.Id)
+	contents, err := ca.CA.FetchKey(ctx, in.Id)
 	if err != nil {
 		log.Printf("can't find the expected client private key file %v", err)
-		return nil, &ServerError{msg: "can't get the expected file"}
+		return nil, toStatusError(err)
 	}
 	return &mygrpc.FileStream{Contents: contents}, nil
 }
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+	mygrpc "github.com/jackyzhangfudan/sidecar/pkg/grpc"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+/*
+list the issued certificates, optionally filtered by status and identity
+*/
+func (s *certificateServiceServer) ListCertificates(ctx context.Context, in *mygrpc.ListCertificatesRequest) (*mygrpc.ListCertificatesResponse, error) {
+	infos, err := ca.CA.ListCertificates(ca.ListOptions{Status: in.Status, Identity: in.Identity})
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+	result := &mygrpc.ListCertificatesResponse{}
+	for _, info := range infos {
+		result.Certificates = append(result.Certificates, ToProtoInfo(info))
+	}
+	return result, nil
+}
+
+/*
+summary and revocation status of a certificate
+*/
+func (s *certificateServiceServer) DescribeCertificate(ctx context.Context, in *mygrpc.FileIdentifer) (*mygrpc.CertificateInfo, error) {
+	info, err := ca.CA.DescribeCertificate(in.Id)
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+	return ToProtoInfo(info), nil
+}
+
+/*
+CRL signed by the current issuer, regenerated by the leader when a certificate is revoked or half of its validity has passed;
+during a root rollover the CRL of the other root, listing the certificates it issued, is in OtherCrls
+*/
+func (s *certificateServiceServer) GetCRL(ctx context.Context, in *emptypb.Empty) (*mygrpc.CRLResponse, error) {
+	crls, err := ca.CA.CRLs(ca.DefaultCRLValidity)
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+	crl := crls[0]
+	resp := &mygrpc.CRLResponse{
+		Crl:        crl.DER,
+		Number:     crl.Number.String(),
+		ThisUpdate: crl.ThisUpdate.Unix(),
+		NextUpdate: crl.NextUpdate.Unix(),
+		Entries:    int32(crl.Entries),
+	}
+	for _, other := range crls[1:] {
+		resp.OtherCrls = append(resp.OtherCrls, other.DER)
+	}
+	return resp, nil
+}
+
+/*
+certificates of the CA, including the roots and the local server certificate, expiring within the given seconds
+*/
+func (s *certificateServiceServer) ListExpiring(ctx context.Context, in *mygrpc.ExpiringRequest) (*mygrpc.ExpiringResponse, error) {
+	expiring, err := ca.CA.ExpiringCertificates(time.Duration(in.WithinSeconds) * time.Second)
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+	result := &mygrpc.ExpiringResponse{}
+	for _, cert := range expiring {
+		result.Certificates = append(result.Certificates, ToProtoExpiring(cert))
+	}
+	return result, nil
+}
+
+/*
+把 ca.CertificateInfo 转化为gRPC消息，命令行的 --local 模式也用它
+*/
+func ToProtoInfo(info *ca.CertificateInfo) *mygrpc.CertificateInfo {
+	result := &mygrpc.CertificateInfo{
+		Id:           info.ID,
+		CommonName:   info.CommonName,
+		Identity:     info.Identity,
+		Profile:      info.Profile,
+		SerialNumber: info.SerialNumber,
+		Issuer:       info.Issuer,
+		SANs:         info.SANs,
+		NotBefore:    info.NotBefore.Unix(),
+		NotAfter:     info.NotAfter.Unix(),
+		Status:       info.Status,
+	}
+	if info.Revocation != nil {
+		result.RevocationReason = info.Revocation.Reason
+		result.RevokedAt = info.Revocation.RevokedAt.Unix()
+	}
+	return result
+}
+
+/*
+把 ca.ExpiringCertificate 转化为gRPC消息
+*/
+func ToProtoExpiring(cert *ca.ExpiringCertificate) *mygrpc.ExpiringCertificate {
+	return &mygrpc.ExpiringCertificate{
+		Kind:         cert.Kind,
+		Id:           cert.ID,
+		Subject:      cert.Subject,
+		Identity:     cert.Identity,
+		SerialNumber: cert.SerialNumber,
+		NotBefore:    cert.NotBefore.Unix(),
+		NotAfter:     cert.NotAfter.Unix(),
+	}
+}
@@ -0,0 +1,11 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/jackyzhangfudan/sidecar/internal/catest"
+)
+
+func TestMain(m *testing.M) {
+	catest.Main(m)
+}
@@ -1,16 +1,18 @@
 package server
 
 import (
-	"crypto/tls"
-	cx509 "crypto/x509"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net"
 
+	"github.com/jackyzhangfudan/sidecar/pkg/auth"
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
 	mygrpc "github.com/jackyzhangfudan/sidecar/pkg/grpc"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	googlegrpc "google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
 const (
@@ -19,26 +21,50 @@ const (
 
 var server *certificateServiceServer = &certificateServiceServer{}
 
+// 客户端的负载均衡用它跳过不健康的副本，多副本时只有leader是SERVING
+var healthServer = health.NewServer()
+
+/*
+设置整个server的健康状态，可以在Run之前调用
+*/
+func SetServing(serving bool) {
+	if serving {
+		healthServer.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	} else {
+		healthServer.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	}
+}
+
 /*
 Start gRPC server to accept certificate related request
+authorizer 为nil时不做授权，和以前一样所有持有CA签发证书的客户端都可以调用；address 为空时监听默认端口
 */
-func Run(enableMTls bool, stopCh <-chan struct{}) {
-	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+func Run(address string, enableMTls bool, authorizer *auth.Authorizer, stopCh <-chan struct{}) {
+	server.authorizer = authorizer
+	if address == "" {
+		address = fmt.Sprintf(":%d", port)
+	}
+	lis, err := net.Listen("tcp", address)
 	if err != nil {
 		log.Fatalf("failed to listen: %v", err)
 	}
 
-	var s *googlegrpc.Server
+	//stats handler 为每个rpc生成server span，并从metadata中提取W3C trace context
+	opts := []googlegrpc.ServerOption{
+		googlegrpc.StatsHandler(otelgrpc.NewServerHandler()),
+		googlegrpc.ChainUnaryInterceptor(authUnaryInterceptor(authorizer, enableMTls)),
+		googlegrpc.ChainStreamInterceptor(authStreamInterceptor(authorizer, enableMTls)),
+	}
 	if enableMTls {
 		tlsCre, err := createTLSCredentials()
 		if err != nil {
 			return
 		}
-		s = googlegrpc.NewServer(googlegrpc.Creds(tlsCre))
-	} else {
-		s = googlegrpc.NewServer()
+		opts = append(opts, googlegrpc.Creds(tlsCre))
 	}
+	s := googlegrpc.NewServer(opts...)
 	mygrpc.RegisterCertificateServiceServer(s, server)
+	healthpb.RegisterHealthServer(s, healthServer)
 
 	go func() {
 		log.Printf("server listening at %v, gRpc", lis.Addr())
@@ -48,6 +74,8 @@ func Run(enableMTls bool, stopCh <-chan struct{}) {
 	}()
 
 	<-stopCh
+	//先告诉客户端不要再发新的请求过来
+	healthServer.Shutdown()
 	s.Stop()
 }
 
@@ -59,27 +87,11 @@ NOTE: following implementation is just for technical verification, isn't suitabl
 because we use CA's root certificate as gRPC client and server's trust root certificate, there is a logic circle
 */
 func createTLSCredentials() (credentials.TransportCredentials, error) {
-	caPEMFile, err := ioutil.ReadFile("cert/rootCA/root.crt") //assume both grpc server and client's certificate are signed by same CA
-	if err != nil {
-		return nil, err
-	}
-
-	caPool := cx509.NewCertPool()
-	if !caPool.AppendCertsFromPEM(caPEMFile) {
-		return nil, &ServerError{msg: "load local cert fail"}
-	}
-
-	localCert, err := tls.LoadX509KeyPair("cert/localCert/local.crt", "cert/localCert/local.private.key")
+	//没有启用认证时，除了Enroll这类引导用的方法，都由拦截器要求客户端证书
+	config, err := ca.CA.ServerTLSConfig()
 	if err != nil {
 		log.Print("load local certificate and key file fail")
 		return nil, err
 	}
-
-	config := &tls.Config{
-		Certificates: []tls.Certificate{localCert},
-		ClientAuth:   tls.RequireAndVerifyClientCert, //means mTLS, will check client's certificate
-		ClientCAs:    caPool,
-	}
-
 	return credentials.NewTLS(config), nil
 }
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"log"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+	mygrpc "github.com/jackyzhangfudan/sidecar/pkg/grpc"
+)
+
+/*
+renew a certificate, the new one has the same subject and SANs but a new key
+*/
+func (s *certificateServiceServer) RenewCert(ctx context.Context, in *mygrpc.FileIdentifer) (*mygrpc.SignResponse, error) {
+	theCert, err := ca.CA.RenewX509(ctx, in.Id)
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+	return &mygrpc.SignResponse{CertificateId: theCert.ID, KeySecret: theCert.KeySecret}, nil
+}
+
+/*
+revoke a certificate
+*/
+func (s *certificateServiceServer) RevokeCert(ctx context.Context, in *mygrpc.RevokeRequest) (*mygrpc.RevokeResponse, error) {
+	revocation, err := ca.CA.Revoke(ctx, in.Id, in.Reason)
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+	return &mygrpc.RevokeResponse{CertificateId: revocation.CertificateID, RevokedAt: revocation.RevokedAt.Unix()}, nil
+}
+
+/*
+推送某张证书的变化：先推送当前的证书，之后每次续签、吊销和trust bundle变化都会推送
+续签只认通过RenewX509从当前证书续签、并且申请者相同的证书，同一个CN的其他证书不算
+推送的续签证书不带私钥：私钥只有调用RenewCert的人能通过KeySecret取到，只负责观察的调用者拿不到
+*/
+func (s *certificateServiceServer) WatchCertificate(in *mygrpc.WatchRequest, stream mygrpc.CertificateService_WatchCertificateServer) error {
+	//先订阅再读当前状态，避免漏掉中间发生的事件
+	events, cancel := ca.CA.Subscribe()
+	defer cancel()
+
+	cert, err := ca.CA.LoadCertificate(in.Id)
+	if err != nil {
+		return toStatusError(err)
+	}
+	identity := ca.IdentityOf(cert)
+	owner := ca.CA.OwnerOf(in.Id)
+	currentId := in.Id
+
+	if revocation, _ := ca.CA.GetRevocation(currentId); revocation != nil {
+		return stream.Send(&mygrpc.CertificateEvent{
+			Type:          mygrpc.CertificateEvent_Revoked,
+			CertificateId: currentId,
+			Identity:      identity,
+			Reason:        revocation.Reason,
+			Timestamp:     revocation.RevokedAt.Unix(),
+		})
+	}
+	initial, err := issuedEvent(ca.Event{Type: ca.EventIssued, CertificateID: currentId, Identity: identity, Time: cert.NotBefore})
+	if err != nil {
+		return toStatusError(err)
+	}
+	if err := stream.Send(initial); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case e, ok := <-events:
+			if !ok {
+				return nil
+			}
+			var out *mygrpc.CertificateEvent
+			switch {
+			case e.Type == ca.EventIssued && e.RenewalOf == currentId && e.Owner == owner:
+				out, err = issuedEvent(e)
+				if err != nil {
+					log.Printf("load renewed certificate %v fail: %v", e.CertificateID, err)
+					continue
+				}
+				currentId = e.CertificateID
+			case e.Type == ca.EventRevoked && e.CertificateID == currentId:
+				out = &mygrpc.CertificateEvent{Type: mygrpc.CertificateEvent_Revoked, CertificateId: e.CertificateID,
+					Identity: e.Identity, Reason: e.Reason, Timestamp: e.Time.Unix()}
+			case e.Type == ca.EventTrustBundleChanged:
+				out = &mygrpc.CertificateEvent{Type: mygrpc.CertificateEvent_TrustBundleChanged, Identity: identity,
+					TrustBundle: trustBundlePEM(), Timestamp: e.Time.Unix()}
+			default:
+				continue
+			}
+			if err := stream.Send(out); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+/*
+只推送证书，私钥由发起续签的调用者用GetKey取，只能取一次
+*/
+func issuedEvent(e ca.Event) (*mygrpc.CertificateEvent, error) {
+	certPEM, err := ca.CA.GetCertFile(e.CertificateID)
+	if err != nil {
+		return nil, err
+	}
+	return &mygrpc.CertificateEvent{
+		Type:          mygrpc.CertificateEvent_Issued,
+		CertificateId: e.CertificateID,
+		Identity:      e.Identity,
+		Certificate:   certPEM,
+		Chain:         trustBundlePEM(),
+		Timestamp:     e.Time.Unix(),
+	}, nil
+}
+
+func trustBundlePEM() []byte {
+	return ca.CA.CurrentTrustBundle().PEM()
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+	mygrpc "github.com/jackyzhangfudan/sidecar/pkg/grpc"
+)
+
+type watchStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	events chan *mygrpc.CertificateEvent
+}
+
+func (s *watchStream) Context() context.Context { return s.ctx }
+
+func (s *watchStream) Send(e *mygrpc.CertificateEvent) error {
+	s.events <- e
+	return nil
+}
+
+func TestWatchCertificateRenewal(t *testing.T) {
+	sign := func(caller string, id string) string {
+		ctx := ca.WithCaller(context.Background(), caller)
+		var cert *ca.Certificate
+		var err error
+		if id == "" {
+			cert, err = ca.CA.SignX509(ctx, &ca.CertificateSigningRequest{SubjectCommonName: "watched", DNSNames: []string{"watched.local"}})
+		} else {
+			cert, err = ca.CA.RenewX509(ctx, id)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert.ID
+	}
+
+	watched := sign("alice", "")
+	other := sign("bob", "")
+	tests := []struct {
+		name string
+		do   func() string
+		want bool
+	}{
+		{name: "another certificate with the same CN", do: func() string { return sign("bob", "") }},
+		{name: "renewal of another certificate", do: func() string { return sign("bob", other) }},
+		{name: "renewal by the local operator", do: func() string { return sign(ca.LocalOperator, watched) }},
+		{name: "renewal by the owner", do: func() string { return sign("alice", watched) }, want: true},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := &watchStream{ctx: ctx, events: make(chan *mygrpc.CertificateEvent, 8)}
+	s := &certificateServiceServer{}
+	go s.WatchCertificate(&mygrpc.WatchRequest{Id: watched}, stream)
+	if initial := <-stream.events; initial.CertificateId != watched {
+		t.Fatalf("initial event is for %v, want %v", initial.CertificateId, watched)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := tt.do()
+			select {
+			case e := <-stream.events:
+				if !tt.want {
+					t.Fatalf("unexpected event for %v", e.CertificateId)
+				}
+				if e.Type != mygrpc.CertificateEvent_Issued || e.CertificateId != id {
+					t.Fatalf("got %v event for %v, want Issued for %v", e.Type, e.CertificateId, id)
+				}
+				if len(e.Certificate) == 0 || len(e.PrivateKey) != 0 {
+					t.Error("the event must carry the certificate and no private key")
+				}
+			case <-time.After(200 * time.Millisecond):
+				if tt.want {
+					t.Fatal("no event for the renewal")
+				}
+			}
+		})
+	}
+}
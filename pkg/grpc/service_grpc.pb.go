@@ -27,6 +27,24 @@ type CertificateServiceClient interface {
 	SignCsr(ctx context.Context, in *CertificateSigningRequest, opts ...grpc.CallOption) (*SignResponse, error)
 	GetCert(ctx context.Context, in *FileIdentifer, opts ...grpc.CallOption) (*FileStream, error)
 	GetKey(ctx context.Context, in *FileIdentifer, opts ...grpc.CallOption) (*FileStream, error)
+	RenewCert(ctx context.Context, in *FileIdentifer, opts ...grpc.CallOption) (*SignResponse, error)
+	RevokeCert(ctx context.Context, in *RevokeRequest, opts ...grpc.CallOption) (*RevokeResponse, error)
+	// follows a certificate across renewals made by RenewCert from its requester; certificates issued for the
+	// same identity in other ways are not reported. Issued events carry no key, a watcher that wants the new key
+	// has to renew the certificate itself
+	WatchCertificate(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (CertificateService_WatchCertificateClient, error)
+	GetTrustBundle(ctx context.Context, in *TrustBundleRequest, opts ...grpc.CallOption) (*TrustBundle, error)
+	ExportCertificate(ctx context.Context, in *ExportRequest, opts ...grpc.CallOption) (*ExportResponse, error)
+	Enroll(ctx context.Context, in *EnrollRequest, opts ...grpc.CallOption) (*EnrollResponse, error)
+	SignCsrBatch(ctx context.Context, in *SignBatchRequest, opts ...grpc.CallOption) (*SignBatchResponse, error)
+	// the requests of all messages make up one batch, the options are taken from the first message
+	SignCsrBatchStream(ctx context.Context, opts ...grpc.CallOption) (CertificateService_SignCsrBatchStreamClient, error)
+	// sign a CSR whose private key is kept by the requester, KeySecret of the response is empty
+	SignPKCS10(ctx context.Context, in *PKCS10Request, opts ...grpc.CallOption) (*SignResponse, error)
+	ListCertificates(ctx context.Context, in *ListCertificatesRequest, opts ...grpc.CallOption) (*ListCertificatesResponse, error)
+	DescribeCertificate(ctx context.Context, in *FileIdentifer, opts ...grpc.CallOption) (*CertificateInfo, error)
+	GetCRL(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*CRLResponse, error)
+	ListExpiring(ctx context.Context, in *ExpiringRequest, opts ...grpc.CallOption) (*ExpiringResponse, error)
 }
 
 type certificateServiceClient struct {
@@ -73,6 +91,171 @@ func (c *certificateServiceClient) GetKey(ctx context.Context, in *FileIdentifer
 	return out, nil
 }
 
+func (c *certificateServiceClient) RenewCert(ctx context.Context, in *FileIdentifer, opts ...grpc.CallOption) (*SignResponse, error) {
+	out := new(SignResponse)
+	err := c.cc.Invoke(ctx, "/grpc.CertificateService/RenewCert", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *certificateServiceClient) RevokeCert(ctx context.Context, in *RevokeRequest, opts ...grpc.CallOption) (*RevokeResponse, error) {
+	out := new(RevokeResponse)
+	err := c.cc.Invoke(ctx, "/grpc.CertificateService/RevokeCert", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *certificateServiceClient) WatchCertificate(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (CertificateService_WatchCertificateClient, error) {
+	stream, err := c.cc.NewStream(ctx, &CertificateService_ServiceDesc.Streams[0], "/grpc.CertificateService/WatchCertificate", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &certificateServiceWatchCertificateClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type CertificateService_WatchCertificateClient interface {
+	Recv() (*CertificateEvent, error)
+	grpc.ClientStream
+}
+
+type certificateServiceWatchCertificateClient struct {
+	grpc.ClientStream
+}
+
+func (x *certificateServiceWatchCertificateClient) Recv() (*CertificateEvent, error) {
+	m := new(CertificateEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *certificateServiceClient) GetTrustBundle(ctx context.Context, in *TrustBundleRequest, opts ...grpc.CallOption) (*TrustBundle, error) {
+	out := new(TrustBundle)
+	err := c.cc.Invoke(ctx, "/grpc.CertificateService/GetTrustBundle", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *certificateServiceClient) ExportCertificate(ctx context.Context, in *ExportRequest, opts ...grpc.CallOption) (*ExportResponse, error) {
+	out := new(ExportResponse)
+	err := c.cc.Invoke(ctx, "/grpc.CertificateService/ExportCertificate", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *certificateServiceClient) Enroll(ctx context.Context, in *EnrollRequest, opts ...grpc.CallOption) (*EnrollResponse, error) {
+	out := new(EnrollResponse)
+	err := c.cc.Invoke(ctx, "/grpc.CertificateService/Enroll", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *certificateServiceClient) SignCsrBatch(ctx context.Context, in *SignBatchRequest, opts ...grpc.CallOption) (*SignBatchResponse, error) {
+	out := new(SignBatchResponse)
+	err := c.cc.Invoke(ctx, "/grpc.CertificateService/SignCsrBatch", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *certificateServiceClient) SignCsrBatchStream(ctx context.Context, opts ...grpc.CallOption) (CertificateService_SignCsrBatchStreamClient, error) {
+	stream, err := c.cc.NewStream(ctx, &CertificateService_ServiceDesc.Streams[1], "/grpc.CertificateService/SignCsrBatchStream", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &certificateServiceSignCsrBatchStreamClient{stream}
+	return x, nil
+}
+
+type CertificateService_SignCsrBatchStreamClient interface {
+	Send(*SignBatchRequest) error
+	CloseAndRecv() (*SignBatchResponse, error)
+	grpc.ClientStream
+}
+
+type certificateServiceSignCsrBatchStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *certificateServiceSignCsrBatchStreamClient) Send(m *SignBatchRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *certificateServiceSignCsrBatchStreamClient) CloseAndRecv() (*SignBatchResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(SignBatchResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *certificateServiceClient) SignPKCS10(ctx context.Context, in *PKCS10Request, opts ...grpc.CallOption) (*SignResponse, error) {
+	out := new(SignResponse)
+	err := c.cc.Invoke(ctx, "/grpc.CertificateService/SignPKCS10", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *certificateServiceClient) ListCertificates(ctx context.Context, in *ListCertificatesRequest, opts ...grpc.CallOption) (*ListCertificatesResponse, error) {
+	out := new(ListCertificatesResponse)
+	err := c.cc.Invoke(ctx, "/grpc.CertificateService/ListCertificates", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *certificateServiceClient) DescribeCertificate(ctx context.Context, in *FileIdentifer, opts ...grpc.CallOption) (*CertificateInfo, error) {
+	out := new(CertificateInfo)
+	err := c.cc.Invoke(ctx, "/grpc.CertificateService/DescribeCertificate", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *certificateServiceClient) GetCRL(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*CRLResponse, error) {
+	out := new(CRLResponse)
+	err := c.cc.Invoke(ctx, "/grpc.CertificateService/GetCRL", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *certificateServiceClient) ListExpiring(ctx context.Context, in *ExpiringRequest, opts ...grpc.CallOption) (*ExpiringResponse, error) {
+	out := new(ExpiringResponse)
+	err := c.cc.Invoke(ctx, "/grpc.CertificateService/ListExpiring", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // CertificateServiceServer is the server API for CertificateService service.
 // All implementations must embed UnimplementedCertificateServiceServer
 // for forward compatibility
@@ -81,6 +264,24 @@ type CertificateServiceServer interface {
 	SignCsr(context.Context, *CertificateSigningRequest) (*SignResponse, error)
 	GetCert(context.Context, *FileIdentifer) (*FileStream, error)
 	GetKey(context.Context, *FileIdentifer) (*FileStream, error)
+	RenewCert(context.Context, *FileIdentifer) (*SignResponse, error)
+	RevokeCert(context.Context, *RevokeRequest) (*RevokeResponse, error)
+	// follows a certificate across renewals made by RenewCert from its requester; certificates issued for the
+	// same identity in other ways are not reported. Issued events carry no key, a watcher that wants the new key
+	// has to renew the certificate itself
+	WatchCertificate(*WatchRequest, CertificateService_WatchCertificateServer) error
+	GetTrustBundle(context.Context, *TrustBundleRequest) (*TrustBundle, error)
+	ExportCertificate(context.Context, *ExportRequest) (*ExportResponse, error)
+	Enroll(context.Context, *EnrollRequest) (*EnrollResponse, error)
+	SignCsrBatch(context.Context, *SignBatchRequest) (*SignBatchResponse, error)
+	// the requests of all messages make up one batch, the options are taken from the first message
+	SignCsrBatchStream(CertificateService_SignCsrBatchStreamServer) error
+	// sign a CSR whose private key is kept by the requester, KeySecret of the response is empty
+	SignPKCS10(context.Context, *PKCS10Request) (*SignResponse, error)
+	ListCertificates(context.Context, *ListCertificatesRequest) (*ListCertificatesResponse, error)
+	DescribeCertificate(context.Context, *FileIdentifer) (*CertificateInfo, error)
+	GetCRL(context.Context, *emptypb.Empty) (*CRLResponse, error)
+	ListExpiring(context.Context, *ExpiringRequest) (*ExpiringResponse, error)
 	mustEmbedUnimplementedCertificateServiceServer()
 }
 
@@ -100,6 +301,45 @@ func (UnimplementedCertificateServiceServer) GetCert(context.Context, *FileIdent
 func (UnimplementedCertificateServiceServer) GetKey(context.Context, *FileIdentifer) (*FileStream, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetKey not implemented")
 }
+func (UnimplementedCertificateServiceServer) RenewCert(context.Context, *FileIdentifer) (*SignResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RenewCert not implemented")
+}
+func (UnimplementedCertificateServiceServer) RevokeCert(context.Context, *RevokeRequest) (*RevokeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RevokeCert not implemented")
+}
+func (UnimplementedCertificateServiceServer) WatchCertificate(*WatchRequest, CertificateService_WatchCertificateServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchCertificate not implemented")
+}
+func (UnimplementedCertificateServiceServer) GetTrustBundle(context.Context, *TrustBundleRequest) (*TrustBundle, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetTrustBundle not implemented")
+}
+func (UnimplementedCertificateServiceServer) ExportCertificate(context.Context, *ExportRequest) (*ExportResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ExportCertificate not implemented")
+}
+func (UnimplementedCertificateServiceServer) Enroll(context.Context, *EnrollRequest) (*EnrollResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Enroll not implemented")
+}
+func (UnimplementedCertificateServiceServer) SignCsrBatch(context.Context, *SignBatchRequest) (*SignBatchResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SignCsrBatch not implemented")
+}
+func (UnimplementedCertificateServiceServer) SignCsrBatchStream(CertificateService_SignCsrBatchStreamServer) error {
+	return status.Errorf(codes.Unimplemented, "method SignCsrBatchStream not implemented")
+}
+func (UnimplementedCertificateServiceServer) SignPKCS10(context.Context, *PKCS10Request) (*SignResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SignPKCS10 not implemented")
+}
+func (UnimplementedCertificateServiceServer) ListCertificates(context.Context, *ListCertificatesRequest) (*ListCertificatesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListCertificates not implemented")
+}
+func (UnimplementedCertificateServiceServer) DescribeCertificate(context.Context, *FileIdentifer) (*CertificateInfo, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DescribeCertificate not implemented")
+}
+func (UnimplementedCertificateServiceServer) GetCRL(context.Context, *emptypb.Empty) (*CRLResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetCRL not implemented")
+}
+func (UnimplementedCertificateServiceServer) ListExpiring(context.Context, *ExpiringRequest) (*ExpiringResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListExpiring not implemented")
+}
 func (UnimplementedCertificateServiceServer) mustEmbedUnimplementedCertificateServiceServer() {}
 
 // UnsafeCertificateServiceServer may be embedded to opt out of forward compatibility for this service.
@@ -185,6 +425,251 @@ func _CertificateService_GetKey_Handler(srv interface{}, ctx context.Context, de
 	return interceptor(ctx, in, info, handler)
 }
 
+func _CertificateService_RenewCert_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FileIdentifer)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CertificateServiceServer).RenewCert(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/grpc.CertificateService/RenewCert",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CertificateServiceServer).RenewCert(ctx, req.(*FileIdentifer))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CertificateService_RevokeCert_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RevokeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CertificateServiceServer).RevokeCert(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/grpc.CertificateService/RevokeCert",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CertificateServiceServer).RevokeCert(ctx, req.(*RevokeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CertificateService_WatchCertificate_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(CertificateServiceServer).WatchCertificate(m, &certificateServiceWatchCertificateServer{stream})
+}
+
+type CertificateService_WatchCertificateServer interface {
+	Send(*CertificateEvent) error
+	grpc.ServerStream
+}
+
+type certificateServiceWatchCertificateServer struct {
+	grpc.ServerStream
+}
+
+func (x *certificateServiceWatchCertificateServer) Send(m *CertificateEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _CertificateService_GetTrustBundle_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TrustBundleRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CertificateServiceServer).GetTrustBundle(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/grpc.CertificateService/GetTrustBundle",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CertificateServiceServer).GetTrustBundle(ctx, req.(*TrustBundleRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CertificateService_ExportCertificate_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ExportRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CertificateServiceServer).ExportCertificate(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/grpc.CertificateService/ExportCertificate",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CertificateServiceServer).ExportCertificate(ctx, req.(*ExportRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CertificateService_Enroll_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(EnrollRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CertificateServiceServer).Enroll(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/grpc.CertificateService/Enroll",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CertificateServiceServer).Enroll(ctx, req.(*EnrollRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CertificateService_SignCsrBatch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SignBatchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CertificateServiceServer).SignCsrBatch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/grpc.CertificateService/SignCsrBatch",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CertificateServiceServer).SignCsrBatch(ctx, req.(*SignBatchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CertificateService_SignCsrBatchStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(CertificateServiceServer).SignCsrBatchStream(&certificateServiceSignCsrBatchStreamServer{stream})
+}
+
+type CertificateService_SignCsrBatchStreamServer interface {
+	SendAndClose(*SignBatchResponse) error
+	Recv() (*SignBatchRequest, error)
+	grpc.ServerStream
+}
+
+type certificateServiceSignCsrBatchStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *certificateServiceSignCsrBatchStreamServer) SendAndClose(m *SignBatchResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *certificateServiceSignCsrBatchStreamServer) Recv() (*SignBatchRequest, error) {
+	m := new(SignBatchRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _CertificateService_SignPKCS10_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PKCS10Request)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CertificateServiceServer).SignPKCS10(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/grpc.CertificateService/SignPKCS10",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CertificateServiceServer).SignPKCS10(ctx, req.(*PKCS10Request))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CertificateService_ListCertificates_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListCertificatesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CertificateServiceServer).ListCertificates(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/grpc.CertificateService/ListCertificates",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CertificateServiceServer).ListCertificates(ctx, req.(*ListCertificatesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CertificateService_DescribeCertificate_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FileIdentifer)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CertificateServiceServer).DescribeCertificate(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/grpc.CertificateService/DescribeCertificate",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CertificateServiceServer).DescribeCertificate(ctx, req.(*FileIdentifer))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CertificateService_GetCRL_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CertificateServiceServer).GetCRL(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/grpc.CertificateService/GetCRL",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CertificateServiceServer).GetCRL(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CertificateService_ListExpiring_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ExpiringRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CertificateServiceServer).ListExpiring(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/grpc.CertificateService/ListExpiring",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CertificateServiceServer).ListExpiring(ctx, req.(*ExpiringRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // CertificateService_ServiceDesc is the grpc.ServiceDesc for CertificateService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -208,7 +693,62 @@ var CertificateService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "GetKey",
 			Handler:    _CertificateService_GetKey_Handler,
 		},
+		{
+			MethodName: "RenewCert",
+			Handler:    _CertificateService_RenewCert_Handler,
+		},
+		{
+			MethodName: "RevokeCert",
+			Handler:    _CertificateService_RevokeCert_Handler,
+		},
+		{
+			MethodName: "GetTrustBundle",
+			Handler:    _CertificateService_GetTrustBundle_Handler,
+		},
+		{
+			MethodName: "ExportCertificate",
+			Handler:    _CertificateService_ExportCertificate_Handler,
+		},
+		{
+			MethodName: "Enroll",
+			Handler:    _CertificateService_Enroll_Handler,
+		},
+		{
+			MethodName: "SignCsrBatch",
+			Handler:    _CertificateService_SignCsrBatch_Handler,
+		},
+		{
+			MethodName: "SignPKCS10",
+			Handler:    _CertificateService_SignPKCS10_Handler,
+		},
+		{
+			MethodName: "ListCertificates",
+			Handler:    _CertificateService_ListCertificates_Handler,
+		},
+		{
+			MethodName: "DescribeCertificate",
+			Handler:    _CertificateService_DescribeCertificate_Handler,
+		},
+		{
+			MethodName: "GetCRL",
+			Handler:    _CertificateService_GetCRL_Handler,
+		},
+		{
+			MethodName: "ListExpiring",
+			Handler:    _CertificateService_ListExpiring_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchCertificate",
+			Handler:       _CertificateService_WatchCertificate_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "SignCsrBatchStream",
+			Handler:       _CertificateService_SignCsrBatchStream_Handler,
+			ClientStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "service.proto",
 }
@@ -0,0 +1,164 @@
+package ha
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/raft"
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+)
+
+const (
+	commandFiles string = "files" //一批文件修改
+	commandSync  string = "sync"  //整个替换几个目录，根证书轮换之后使用
+	commandSeed  string = "seed"  //集群第一次选出leader时，用leader的整个 cert/ 作为初始状态
+)
+
+const storeFolder string = "cert"
+
+const rootCAFolder string = storeFolder + "/rootCA"
+
+/*
+raft日志中的一条命令
+*/
+type command struct {
+	Type    string          `json:"type"`
+	Changes []ca.FileChange `json:"changes,omitempty"`
+	Folders []string        `json:"folders,omitempty"` //sync和seed替换的目录
+	Files   []ca.FileChange `json:"files,omitempty"`   //这些目录下的全部文件
+	Purge   bool            `json:"purge,omitempty"`   //执行之后做快照并截掉日志，见 Node.ApplyAndPurge
+}
+
+/*
+复制的状态机：状态就是每个副本本地的 cert/ 目录，所有副本按日志的顺序执行同样的修改
+*/
+type fsm struct {
+	authority *ca.CertificateAuthority //状态所在的CA
+	purge     chan struct{}            //执行了要purge的命令，由 Node.purgeLoop 做快照
+	mu        sync.Mutex
+	seeded    bool
+}
+
+func (f *fsm) Apply(entry *raft.Log) interface{} {
+	var cmd command
+	if err := json.Unmarshal(entry.Data, &cmd); err != nil {
+		log.Printf("ha: can't parse log %d: %v", entry.Index, err)
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch cmd.Type {
+	case commandFiles:
+		if err := f.authority.ApplyLocal(cmd.Changes); err != nil {
+			log.Printf("ha: apply log %d fail: %v", entry.Index, err)
+			return err
+		}
+		//根证书轮换的激活会换掉根证书
+		if touchesFolder(cmd.Changes, rootCAFolder) {
+			if err := f.authority.Reload(); err != nil {
+				log.Printf("ha: reload CA fail: %v", err)
+			}
+		}
+		//Apply中不能调用raft的Snapshot
+		if cmd.Purge {
+			select {
+			case f.purge <- struct{}{}:
+			default:
+			}
+		}
+		return nil
+	case commandSync, commandSeed:
+		if err := f.replaceFolders(cmd.Folders, cmd.Files); err != nil {
+			log.Printf("ha: apply log %d fail: %v", entry.Index, err)
+			return err
+		}
+		if cmd.Type == commandSeed {
+			f.seeded = true
+		}
+		if err := f.authority.Reload(); err != nil {
+			log.Printf("ha: reload CA fail: %v", err)
+		}
+		return nil
+	default:
+		log.Printf("ha: unknown command %v in log %d", cmd.Type, entry.Index)
+		return nil
+	}
+}
+
+func touchesFolder(changes []ca.FileChange, folder string) bool {
+	for _, change := range changes {
+		if strings.HasPrefix(change.Path, folder+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fsm) replaceFolders(folders []string, files []ca.FileChange) error {
+	for _, folder := range folders {
+		var inFolder []ca.FileChange
+		for _, file := range files {
+			if strings.HasPrefix(file.Path, folder+"/") {
+				inFolder = append(inFolder, file)
+			}
+		}
+		if err := f.authority.ReplaceFolder(folder, inFolder); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fsm) isSeeded() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.seeded
+}
+
+/*
+快照是整个 cert/ 目录的内容
+*/
+type snapshot struct {
+	Seeded bool            `json:"seeded"`
+	Files  []ca.FileChange `json:"files"`
+}
+
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	files, err := f.authority.ReadFolder(storeFolder)
+	if err != nil {
+		return nil, err
+	}
+	return &snapshot{Seeded: f.seeded, Files: files}, nil
+}
+
+func (f *fsm) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	var snap snapshot
+	if err := json.NewDecoder(rc).Decode(&snap); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.authority.ReplaceFolder(storeFolder, snap.Files); err != nil {
+		return err
+	}
+	f.seeded = snap.Seeded
+	log.Printf("ha: restored %d files from the snapshot", len(snap.Files))
+	return f.authority.Reload()
+}
+
+func (s *snapshot) Persist(sink raft.SnapshotSink) error {
+	if err := json.NewEncoder(sink).Encode(s); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *snapshot) Release() {}
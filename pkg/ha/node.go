@@ -0,0 +1,367 @@
+package ha
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+)
+
+const applyTimeout time.Duration = 10 * time.Second
+
+/*
+一个CA副本
+*/
+type Peer struct {
+	ID      string
+	Address string //raft的地址，host:port
+}
+
+/*
+解析 id1=host1:7000,id2=host2:7000 格式的副本列表
+*/
+func ParsePeers(s string) ([]Peer, error) {
+	var peers []Peer
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		id, address, ok := strings.Cut(item, "=")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("peer %v should be <id>=<host:port>", item)
+		}
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return nil, fmt.Errorf("address of peer %v should be host:port: %v", id, err)
+		}
+		peers = append(peers, Peer{ID: id, Address: address})
+	}
+	return peers, nil
+}
+
+type Options struct {
+	NodeID  string
+	Address string //raft监听的地址，其他副本用它连接这个副本
+	Dir     string //raft日志和快照的目录
+	//集群的全部副本（包括自己），第一次启动时用它初始化集群，所有副本要给出相同的列表
+	Peers []Peer
+	//当前副本成为leader或者不再是leader时调用，也会在启动时以false调用一次
+	OnLeaderChange func(isLeader bool)
+	//副本之间用双向TLS通信：这个副本的证书和私钥，以及验证其他副本证书的CA
+	//证书的身份（SPIFFE ID或CN）要是副本的id，只有Peers和集群配置中的副本可以连接
+	CertFile string
+	KeyFile  string
+	CAFile   string
+	//状态复制到这个CA的目录，为nil时是 ca.CA
+	CA *ca.CertificateAuthority
+}
+
+/*
+用raft复制CA状态的存储，实现 ca.Store
+只有leader接受修改，follower返回 ErrUnavailable，客户端应该重试或者改连leader
+*/
+type Node struct {
+	opts   Options
+	mu     sync.Mutex //保护raft的赋值，transport在raft创建之前就可能收到连接
+	raft   *raft.Raft
+	fsm    *fsm
+	bolt   *raftboltdb.BoltStore
+	leader int32 //为1时leader已经追上日志并且完成了初始化，可以接受修改
+	stop   chan struct{}
+}
+
+func Start(opts Options) (*Node, error) {
+	if opts.NodeID == "" {
+		opts.NodeID = opts.Address
+	}
+	if opts.CA == nil {
+		opts.CA = &ca.CA
+	}
+	if err := os.MkdirAll(opts.Dir, 0700); err != nil {
+		return nil, err
+	}
+
+	config := raft.DefaultConfig()
+	config.LocalID = raft.ServerID(opts.NodeID)
+	config.Logger = hclog.New(&hclog.LoggerOptions{Name: "raft", Level: hclog.Warn, Output: os.Stderr})
+	notifyCh := make(chan bool, 8)
+	config.NotifyCh = notifyCh
+
+	bolt, err := raftboltdb.NewBoltStore(filepath.Join(opts.Dir, "raft.db"))
+	if err != nil {
+		return nil, fmt.Errorf("open raft log fail: %v", err)
+	}
+	//只保留最新的快照，删除的私钥不会留在旧的快照中
+	snapshots, err := raft.NewFileSnapshotStore(opts.Dir, 1, os.Stderr)
+	if err != nil {
+		bolt.Close()
+		return nil, fmt.Errorf("open raft snapshots fail: %v", err)
+	}
+	n := &Node{opts: opts, fsm: &fsm{authority: opts.CA, purge: make(chan struct{}, 1)}, bolt: bolt, stop: make(chan struct{})}
+	stream, err := newTLSStreamLayer(opts, n)
+	if err != nil {
+		bolt.Close()
+		return nil, fmt.Errorf("listen on %v fail: %v", opts.Address, err)
+	}
+	transport := raft.NewNetworkTransport(stream, 3, applyTimeout, os.Stderr)
+
+	hasState, err := raft.HasExistingState(bolt, bolt, snapshots)
+	if err != nil {
+		transport.Close()
+		bolt.Close()
+		return nil, err
+	}
+	raftNode, err := raft.NewRaft(config, n.fsm, bolt, bolt, snapshots, transport)
+	if err != nil {
+		transport.Close()
+		bolt.Close()
+		return nil, err
+	}
+	n.mu.Lock()
+	n.raft = raftNode
+	n.mu.Unlock()
+	if !hasState && len(opts.Peers) > 0 {
+		configuration := raft.Configuration{}
+		for _, peer := range opts.Peers {
+			configuration.Servers = append(configuration.Servers, raft.Server{ID: raft.ServerID(peer.ID), Address: raft.ServerAddress(peer.Address)})
+		}
+		log.Printf("ha: bootstrap the cluster with %d replicas", len(opts.Peers))
+		if err := n.raft.BootstrapCluster(configuration).Error(); err != nil && err != raft.ErrCantBootstrap {
+			n.Shutdown()
+			return nil, err
+		}
+	}
+
+	n.notify(false)
+	go n.watchLeadership(notifyCh)
+	go n.purgeLoop()
+	return n, nil
+}
+
+/*
+id是否是集群的副本：启动时给出的Peers，或者raft配置中的副本
+*/
+func (n *Node) isMember(id string) bool {
+	if id == n.opts.NodeID {
+		return true
+	}
+	for _, peer := range n.opts.Peers {
+		if peer.ID == id {
+			return true
+		}
+	}
+	servers, ok := n.servers()
+	if !ok {
+		return false
+	}
+	for _, server := range servers {
+		if string(server.ID) == id {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+在address上的副本：启动时给出的Peers，或者raft配置中的副本
+*/
+func (n *Node) idAt(address string) (string, bool) {
+	for _, peer := range n.opts.Peers {
+		if peer.Address == address {
+			return peer.ID, true
+		}
+	}
+	servers, ok := n.servers()
+	if !ok {
+		return "", false
+	}
+	for _, server := range servers {
+		if string(server.Address) == address {
+			return string(server.ID), true
+		}
+	}
+	return "", false
+}
+
+/*
+raft配置中的副本，raft还没有创建时返回false
+*/
+func (n *Node) servers() ([]raft.Server, bool) {
+	n.mu.Lock()
+	r := n.raft
+	n.mu.Unlock()
+	if r == nil {
+		return nil, false
+	}
+	future := r.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, false
+	}
+	return future.Configuration().Servers, true
+}
+
+func (n *Node) notify(isLeader bool) {
+	if n.opts.OnLeaderChange != nil {
+		n.opts.OnLeaderChange(isLeader)
+	}
+}
+
+func (n *Node) watchLeadership(notifyCh <-chan bool) {
+	for isLeader := range notifyCh {
+		if !isLeader {
+			if atomic.SwapInt32(&n.leader, 0) == 1 {
+				log.Printf("ha: %v is no longer the leader", n.opts.NodeID)
+				n.notify(false)
+			}
+			continue
+		}
+		if err := n.becomeLeader(); err != nil {
+			log.Printf("ha: %v can't take over as the leader: %v", n.opts.NodeID, err)
+			continue
+		}
+		log.Printf("ha: %v is the leader", n.opts.NodeID)
+		n.notify(true)
+	}
+}
+
+/*
+成为leader之后先执行完以前的日志；集群还没有初始状态时，用自己的 cert/ 作为初始状态
+*/
+func (n *Node) becomeLeader() error {
+	if err := n.raft.Barrier(applyTimeout).Error(); err != nil {
+		return err
+	}
+	if !n.fsm.isSeeded() {
+		files, err := n.opts.CA.ReadFolder(storeFolder)
+		if err != nil {
+			return err
+		}
+		log.Printf("ha: seed the cluster with %d files from %v", len(files), n.opts.NodeID)
+		if err := n.apply(command{Type: commandSeed, Folders: []string{storeFolder}, Files: files}); err != nil {
+			return err
+		}
+	}
+	//follower期间的配额统计可能已经过时
+	if err := n.opts.CA.Reload(); err != nil {
+		return err
+	}
+	if n.raft.State() != raft.Leader {
+		return raft.ErrLeadershipLost
+	}
+	atomic.StoreInt32(&n.leader, 1)
+	return nil
+}
+
+func (n *Node) IsLeader() bool {
+	return atomic.LoadInt32(&n.leader) == 1 && n.raft.State() == raft.Leader
+}
+
+func (n *Node) notLeader() error {
+	_, leaderID := n.raft.LeaderWithID()
+	caErr := ca.NewError(ca.ErrUnavailable, "NOT_LEADER", "this CA replica is not the leader, retry with the leader")
+	caErr.Metadata = map[string]string{"leaderId": string(leaderID)}
+	caErr.RetryAfter = time.Second
+	return caErr
+}
+
+func (n *Node) Apply(changes []ca.FileChange) error {
+	if !n.IsLeader() {
+		return n.notLeader()
+	}
+	return n.apply(command{Type: commandFiles, Changes: changes})
+}
+
+/*
+执行修改，之后每个副本各自做一次快照并截掉快照之前的全部日志，被删除的文件以前的内容不再留在日志和快照中
+*/
+func (n *Node) ApplyAndPurge(changes []ca.FileChange) error {
+	if !n.IsLeader() {
+		return n.notLeader()
+	}
+	return n.apply(command{Type: commandFiles, Changes: changes, Purge: true})
+}
+
+func (n *Node) purgeLoop() {
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-n.fsm.purge:
+		}
+		if err := n.purge(); err != nil {
+			log.Printf("ha: purge the raft log of %v fail: %v", n.opts.NodeID, err)
+		}
+	}
+}
+
+/*
+快照之后raft默认还保留TrailingLogs条日志，这一次临时改成0
+*/
+func (n *Node) purge() error {
+	config := n.raft.ReloadableConfig()
+	purging := config
+	purging.TrailingLogs = 0
+	if err := n.raft.ReloadConfig(purging); err != nil {
+		return err
+	}
+	defer n.raft.ReloadConfig(config)
+	if err := n.raft.Snapshot().Error(); err != nil && !errors.Is(err, raft.ErrNothingNewToSnapshot) {
+		return err
+	}
+	return nil
+}
+
+func (n *Node) Sync(folders ...string) error {
+	if !n.IsLeader() {
+		return n.notLeader()
+	}
+	cmd := command{Type: commandSync, Folders: folders}
+	for _, folder := range folders {
+		files, err := n.opts.CA.ReadFolder(folder)
+		if err != nil {
+			return err
+		}
+		cmd.Files = append(cmd.Files, files...)
+	}
+	return n.apply(cmd)
+}
+
+func (n *Node) apply(cmd command) error {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	future := n.raft.Apply(data, applyTimeout)
+	if err := future.Error(); err != nil {
+		if errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrLeadershipLost) || errors.Is(err, raft.ErrEnqueueTimeout) {
+			return n.notLeader()
+		}
+		return err
+	}
+	if err, ok := future.Response().(error); ok {
+		return err
+	}
+	return nil
+}
+
+func (n *Node) Shutdown() error {
+	select {
+	case <-n.stop:
+	default:
+		close(n.stop)
+	}
+	err := n.raft.Shutdown().Error()
+	n.bolt.Close()
+	return err
+}
@@ -0,0 +1,307 @@
+package ha
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	cx509 "crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+)
+
+/*
+测试用的CA，给每个副本签发CN是副本id的证书
+*/
+type testCA struct {
+	cert *cx509.Certificate
+	key  *ecdsa.PrivateKey
+	file string
+}
+
+func newTestCA(t *testing.T, dir string, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &cx509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              cx509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := cx509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := cx509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, name+".crt")
+	writePEM(t, file, "CERTIFICATE", der)
+	return &testCA{cert: cert, key: key, file: file}
+}
+
+/*
+签发id的证书，返回证书和私钥文件
+*/
+func (c *testCA) issue(t *testing.T, dir string, id string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &cx509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: id},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     cx509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []cx509.ExtKeyUsage{cx509.ExtKeyUsageServerAuth, cx509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := cx509.CreateCertificate(rand.Reader, template, c.cert, &key.PublicKey, c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := cx509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, id+".crt"), filepath.Join(dir, id+".key")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "PRIVATE KEY", keyDER)
+	return certFile, keyFile
+}
+
+func writePEM(t *testing.T, file string, blockType string, der []byte) {
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func freeAddress(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	deadline := time.Now().Add(20 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %v", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+/*
+在本机启动三个副本：选出leader，leader的修改复制到每个副本；
+别的CA签发的证书和不在集群中的id都连不上
+*/
+func TestThreeReplicas(t *testing.T) {
+	dir := t.TempDir()
+	authority := newTestCA(t, dir, "raft-ca")
+	ids := []string{"ca1", "ca2", "ca3"}
+	var peers []Peer
+	for _, id := range ids {
+		peers = append(peers, Peer{ID: id, Address: freeAddress(t)})
+	}
+
+	var nodes []*Node
+	for i, id := range ids {
+		certFile, keyFile := authority.issue(t, dir, id)
+		//每个副本有自己的CA目录，集群选出leader后用leader的 cert/ 替换
+		replica := ca.New(filepath.Join(dir, id, "ca"))
+		if err := replica.Init(); err != nil {
+			t.Fatal(err)
+		}
+		node, err := Start(Options{
+			NodeID:   id,
+			Address:  peers[i].Address,
+			Dir:      filepath.Join(dir, id),
+			Peers:    peers,
+			CertFile: certFile,
+			KeyFile:  keyFile,
+			CAFile:   authority.file,
+			CA:       replica,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer node.Shutdown()
+		nodes = append(nodes, node)
+	}
+
+	var leader *Node
+	waitFor(t, "a leader", func() bool {
+		for _, node := range nodes {
+			if node.IsLeader() {
+				leader = node
+				return true
+			}
+		}
+		return false
+	})
+	for _, node := range nodes {
+		if node != leader {
+			if err := node.Apply([]ca.FileChange{{Op: ca.OpWrite, Path: "cert/ha-test", Contents: []byte("x"), Perm: 0600}}); ca.CodeOf(err) != ca.ErrUnavailable {
+				t.Errorf("apply on follower %v: %v, want NOT_LEADER", node.opts.NodeID, err)
+			}
+		}
+	}
+	if err := leader.Apply([]ca.FileChange{{Op: ca.OpWrite, Path: "cert/ha-test", Contents: []byte("replicated"), Perm: 0600}}); err != nil {
+		t.Fatal(err)
+	}
+	last := leader.raft.LastIndex()
+	waitFor(t, "the replication", func() bool {
+		for _, node := range nodes {
+			if node.raft.AppliedIndex() < last {
+				return false
+			}
+		}
+		return true
+	})
+	for _, node := range nodes {
+		if contents, err := os.ReadFile(filepath.Join(node.opts.CA.Dir(), "cert/ha-test")); err != nil || string(contents) != "replicated" {
+			t.Errorf("cert/ha-test of %v = %q, %v", node.opts.NodeID, contents, err)
+		}
+		if !node.opts.CA.RootCA.Equal(&leader.opts.CA.RootCA) {
+			t.Errorf("%v doesn't use the root CA seeded by the leader", node.opts.NodeID)
+		}
+	}
+
+	//取走的私钥被删除之后，每个副本的日志和快照中都不再有它
+	sealed := []byte("sealed private key")
+	if err := leader.Apply([]ca.FileChange{{Op: ca.OpWrite, Path: "cert/clientCert/ha-test.key", Contents: sealed, Perm: 0600}}); err != nil {
+		t.Fatal(err)
+	}
+	written := leader.raft.LastIndex()
+	if err := leader.ApplyAndPurge([]ca.FileChange{{Op: ca.OpRemove, Path: "cert/clientCert/ha-test.key"}}); err != nil {
+		t.Fatal(err)
+	}
+	encoded := []byte(base64.StdEncoding.EncodeToString(sealed))
+	for i, node := range nodes {
+		waitFor(t, "the purge on "+ids[i], func() bool {
+			first, err := node.bolt.FirstIndex()
+			//日志全部截掉时FirstIndex为0
+			return err == nil && (first == 0 || first > written)
+		})
+		snapshots, err := raft.NewFileSnapshotStore(filepath.Join(dir, ids[i]), 1, io.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		metas, err := snapshots.List()
+		if err != nil || len(metas) != 1 {
+			t.Fatalf("%v has snapshots %v, %v, want exactly one", ids[i], metas, err)
+		}
+		_, rc, err := snapshots.Open(metas[0].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(contents, encoded) {
+			t.Errorf("the snapshot of %v still has the removed key", ids[i])
+		}
+	}
+
+	other := newTestCA(t, dir, "other-ca")
+	var follower string
+	for _, node := range nodes {
+		if node != leader {
+			follower = node.opts.NodeID
+		}
+	}
+	tests := []struct {
+		name        string
+		ca          *testCA
+		id          string
+		at          string //连接的一方认为leader的地址上是哪个副本，为空时是leader
+		wantDialErr bool   //连接的一方自己发现对方不是要连的副本
+	}{
+		{name: "untrusted CA", ca: other, id: "ca2"},
+		{name: "unknown replica", ca: authority, id: "intruder"},
+		{name: "another replica answers at the address", ca: authority, id: follower, at: follower, wantDialErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			at := tt.at
+			if at == "" {
+				at = leader.opts.NodeID
+			}
+			certFile, keyFile := tt.ca.issue(t, t.TempDir(), tt.id)
+			stream, err := newTLSStreamLayer(Options{Address: freeAddress(t), CertFile: certFile, KeyFile: keyFile, CAFile: authority.file}, staticMembership{leader.opts.Address: at})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer stream.Close()
+			conn, err := stream.Dial(raftAddress(leader), time.Second)
+			if tt.wantDialErr {
+				if err == nil {
+					conn.Close()
+					t.Fatalf("dialed %v at the address of %v", at, leader.opts.NodeID)
+				}
+				return
+			}
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			//TLS 1.3中服务端在握手之后才验证客户端证书，拒绝时读到错误
+			conn.SetDeadline(time.Now().Add(2 * time.Second))
+			conn.Write([]byte{0})
+			if _, err := io.ReadFull(conn, make([]byte, 1)); err == nil {
+				t.Errorf("%v connected to the leader", tt.name)
+			}
+		})
+	}
+
+	//不在集群中的地址不会去连
+	stream, err := newTLSStreamLayer(Options{Address: freeAddress(t), CertFile: filepath.Join(dir, "ca1.crt"), KeyFile: filepath.Join(dir, "ca1.key"), CAFile: authority.file}, staticMembership{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	if conn, err := stream.Dial(raftAddress(leader), time.Second); err == nil {
+		conn.Close()
+		t.Error("dialed an address that isn't a replica of the cluster")
+	}
+}
+
+/*
+连接的一方认为各个地址上是哪个副本，address → id
+*/
+type staticMembership map[string]string
+
+func (m staticMembership) isMember(string) bool { return true }
+
+func (m staticMembership) idAt(address string) (string, bool) {
+	id, ok := m[address]
+	return id, ok
+}
+
+func raftAddress(n *Node) raft.ServerAddress {
+	return raft.ServerAddress(n.opts.Address)
+}
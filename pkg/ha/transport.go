@@ -0,0 +1,146 @@
+package ha
+
+import (
+	"crypto/tls"
+	cx509 "crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+)
+
+/*
+副本之间的raft连接：双向TLS，对方的证书要由 --raft-ca 签发，身份（SPIFFE ID或CN）要是集群中某个副本的id；
+连接别的副本时，对方的身份还要是这个地址上的副本的id，拿到了某个副本证书的机器不能冒充其他副本
+raft日志中有证书、吊销记录和加密的根证书私钥，不能让别的机器加入或者偷听
+*/
+type tlsStreamLayer struct {
+	net.Listener
+	advertise net.Addr
+	client    *tls.Config
+	roots     *cx509.CertPool
+	members   membership
+}
+
+/*
+集群中有哪些副本
+*/
+type membership interface {
+	isMember(id string) bool
+	//在address上的副本的id
+	idAt(address string) (string, bool)
+}
+
+func newTLSStreamLayer(opts Options, members membership) (*tlsStreamLayer, error) {
+	if opts.CertFile == "" || opts.KeyFile == "" || opts.CAFile == "" {
+		return nil, fmt.Errorf("the replicas talk over mutual TLS, a certificate, its key and the CA bundle are needed")
+	}
+	cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load the replica certificate fail: %v", err)
+	}
+	bundle, err := os.ReadFile(opts.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	roots := cx509.NewCertPool()
+	if !roots.AppendCertsFromPEM(bundle) {
+		return nil, fmt.Errorf("no certificate in %v", opts.CAFile)
+	}
+
+	advertise, err := net.ResolveTCPAddr("tcp", opts.Address)
+	if err != nil {
+		return nil, err
+	}
+	if advertise.IP == nil || advertise.IP.IsUnspecified() {
+		return nil, fmt.Errorf("%v is not an address the other replicas can reach", opts.Address)
+	}
+
+	l := &tlsStreamLayer{advertise: advertise, roots: roots, members: members}
+	//证书链和身份都自己检查，副本的地址常常是IP，不按主机名验证；VerifyConnection在Dial中按地址设置
+	l.client = &tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS12,
+	}
+	server := &tls.Config{
+		Certificates:     []tls.Certificate{cert},
+		ClientAuth:       tls.RequireAnyClientCert,
+		VerifyConnection: l.verifyClient,
+		MinVersion:       tls.VersionTLS12,
+	}
+	listener, err := net.Listen("tcp", opts.Address)
+	if err != nil {
+		return nil, err
+	}
+	l.Listener = tls.NewListener(listener, server)
+	return l, nil
+}
+
+/*
+验证对方的证书链，返回对方的副本id
+*/
+func (l *tlsStreamLayer) verifyPeer(state tls.ConnectionState) (string, error) {
+	if len(state.PeerCertificates) == 0 {
+		return "", errors.New("the peer presented no certificate")
+	}
+	leaf := state.PeerCertificates[0]
+	intermediates := cx509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := leaf.Verify(cx509.VerifyOptions{
+		Roots:         l.roots,
+		Intermediates: intermediates,
+		KeyUsages:     []cx509.ExtKeyUsage{cx509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return "", fmt.Errorf("certificate of the peer is not trusted: %v", err)
+	}
+	//副本id直接写在CN中，没有前缀
+	return strings.TrimPrefix(ca.IdentityOf(leaf), "cn:"), nil
+}
+
+func (l *tlsStreamLayer) verifyClient(state tls.ConnectionState) error {
+	id, err := l.verifyPeer(state)
+	if err != nil {
+		return err
+	}
+	if !l.members.isMember(id) {
+		return fmt.Errorf("%v is not a replica of this cluster", id)
+	}
+	return nil
+}
+
+func (l *tlsStreamLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	expected, ok := l.members.idAt(string(address))
+	if !ok {
+		return nil, fmt.Errorf("%v is not the address of a replica of this cluster", address)
+	}
+	config := l.client.Clone()
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		id, err := l.verifyPeer(state)
+		if err != nil {
+			return err
+		}
+		if id != expected {
+			return fmt.Errorf("%v answered at %v, the replica there is %v", id, address, expected)
+		}
+		return nil
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", string(address), config)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (l *tlsStreamLayer) Addr() net.Addr {
+	return l.advertise
+}
@@ -0,0 +1,486 @@
+package httpclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	cx509 "crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	mygrpc "github.com/jackyzhangfudan/sidecar/pkg/grpc"
+	myclient "github.com/jackyzhangfudan/sidecar/pkg/grpc/client"
+)
+
+const DefaultURL string = "http://localhost:8111"
+
+/*
+caserver --grpc=false 的客户端，方法和 pkg/grpc/client 的Client相同，用于命令行等需要同时支持两种协议的地方
+https时用RootCAs（或RootCAFile）验证server，CertFile/KeyFile是mTLS的客户端证书
+*/
+type Options struct {
+	URL         string
+	RootCAs     *cx509.CertPool
+	RootCAFile  string
+	CertFile    string
+	KeyFile     string
+	BearerToken string
+	Timeout     time.Duration //每个请求的超时，默认10s
+}
+
+type Client struct {
+	base  string
+	http  *http.Client
+	token string
+}
+
+/*
+server返回的 application/problem+json
+*/
+type Error struct {
+	Status     int    `json:"status"`
+	Title      string `json:"title"`
+	Detail     string `json:"detail"`
+	Reason     string `json:"reason"`
+	RetryAfter string `json:"-"`
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("%d %v", e.Status, e.Title)
+	if e.Reason != "" {
+		msg += ": " + e.Reason
+	}
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	if e.RetryAfter != "" {
+		msg += ", retry after " + e.RetryAfter + "s"
+	}
+	return msg
+}
+
+func New(opts Options) (*Client, error) {
+	if opts.URL == "" {
+		opts.URL = DefaultURL
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = myclient.DefaultTimeout
+	}
+	tlsConfig := &tls.Config{RootCAs: opts.RootCAs}
+	if tlsConfig.RootCAs == nil && opts.RootCAFile != "" {
+		contents, err := os.ReadFile(opts.RootCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("load root CA fail: %v", err)
+		}
+		tlsConfig.RootCAs = cx509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(contents) {
+			return nil, fmt.Errorf("no certificate in %v", opts.RootCAFile)
+		}
+	}
+	if opts.CertFile != "" && opts.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate fail: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return &Client{
+		base:  strings.TrimRight(opts.URL, "/"),
+		http:  &http.Client{Timeout: opts.Timeout, Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment}},
+		token: opts.BearerToken,
+	}, nil
+}
+
+func (c *Client) Close() error {
+	c.http.CloseIdleConnections()
+	return nil
+}
+
+/*
+发送请求，2xx以外的响应转化为 *Error
+*/
+func (c *Client) do(ctx context.Context, method string, path string, header http.Header, body []byte) ([]byte, http.Header, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	contents, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		problem := &Error{Status: resp.StatusCode, Title: http.StatusText(resp.StatusCode), RetryAfter: resp.Header.Get("Retry-After")}
+		if json.Unmarshal(contents, problem) != nil {
+			problem.Detail = strings.TrimSpace(string(contents))
+		}
+		return nil, nil, problem
+	}
+	return contents, resp.Header, nil
+}
+
+func (c *Client) getJSON(ctx context.Context, path string, v interface{}) error {
+	contents, _, err := c.do(ctx, "GET", path, nil, nil)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(contents, v)
+}
+
+/*
+/csr 的JSON格式，见 ca.CertificateSigningRequest
+*/
+type csrJSON struct {
+	Version                   int
+	SubjectCountry            []string
+	SubjectOrganization       []string
+	SubjectOrganizationalUnit []string
+	SubjectLocality           []string
+	SubjectProvince           []string
+	SubjectStreetAddress      []string
+	SubjectPostalCode         []string
+	SubjectSerialNumber       string
+	SubjectCommonName         string
+	SubjectExtraNames         []nameJSON
+	PublicKeyAlg              int
+	SignatureAlgorithm        int
+	DNSNames                  []string
+	EmailAddresses            []string
+	IPAddresses               []string
+	URIs                      []url.URL
+	Extensions                []extensionJSON
+	Profile                   string
+}
+
+type nameJSON struct {
+	Type  asn1.ObjectIdentifier
+	Value interface{}
+}
+
+type extensionJSON struct {
+	ID       asn1.ObjectIdentifier
+	Critical bool
+	Value    []byte
+}
+
+func toCSRJSON(csr *mygrpc.CertificateSigningRequest) (*csrJSON, error) {
+	result := &csrJSON{
+		Version:                   int(csr.Version),
+		SubjectCountry:            csr.SubjectCountry,
+		SubjectOrganization:       csr.SubjectOrganization,
+		SubjectOrganizationalUnit: csr.SubjectOrganizationalUnit,
+		SubjectLocality:           csr.SubjectLocality,
+		SubjectProvince:           csr.SubjectProvince,
+		SubjectStreetAddress:      csr.SubjectStreetAddress,
+		SubjectPostalCode:         csr.SubjectPostalCode,
+		SubjectSerialNumber:       csr.SubjectSerialNumber,
+		SubjectCommonName:         csr.SubjectCommonName,
+		PublicKeyAlg:              int(csr.PublicKeyAlg),
+		SignatureAlgorithm:        int(csr.SignatureAlgorithm),
+		DNSNames:                  csr.DNSNames,
+		EmailAddresses:            csr.EmailAddresses,
+		IPAddresses:               csr.IPAddresses,
+		Profile:                   csr.Profile,
+	}
+	for _, s := range csr.URIs {
+		uri, err := url.Parse(s)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a valid URI: %v", s, err)
+		}
+		result.URIs = append(result.URIs, *uri)
+	}
+	for _, name := range csr.SubjectExtraNames {
+		oid, err := parseOID(name.Type)
+		if err != nil {
+			return nil, err
+		}
+		result.SubjectExtraNames = append(result.SubjectExtraNames, nameJSON{Type: oid, Value: name.Value})
+	}
+	for _, ex := range csr.Extensions {
+		oid, err := parseOID(ex.ID)
+		if err != nil {
+			return nil, err
+		}
+		result.Extensions = append(result.Extensions, extensionJSON{ID: oid, Critical: ex.Critical, Value: ex.Value})
+	}
+	return result, nil
+}
+
+/*
+解析点分形式的OID，每一段只能是十进制数字
+*/
+func parseOID(s string) (asn1.ObjectIdentifier, error) {
+	var oid asn1.ObjectIdentifier
+	for _, part := range strings.Split(s, ".") {
+		v, err := strconv.ParseUint(part, 10, 31)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a valid OID", s)
+		}
+		oid = append(oid, int(v))
+	}
+	if len(oid) < 2 {
+		return nil, fmt.Errorf("%q is not a valid OID", s)
+	}
+	return oid, nil
+}
+
+type signResponse struct {
+	ID        string `json:"certificateId"`
+	KeySecret string `json:"keySecret"`
+}
+
+/*
+由CA生成私钥并签发证书，返回的证书带有解密后的私钥
+*/
+func (c *Client) Sign(ctx context.Context, csr *mygrpc.CertificateSigningRequest) (*myclient.Certificate, error) {
+	body, err := toCSRJSON(csr)
+	if err != nil {
+		return nil, err
+	}
+	contents, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	contents, _, err = c.do(ctx, "POST", "/csr", http.Header{"Content-Type": {"application/json"}}, contents)
+	if err != nil {
+		return nil, err
+	}
+	var signed signResponse
+	if err := json.Unmarshal(contents, &signed); err != nil {
+		return nil, err
+	}
+	certPEM, err := c.export(ctx, signed.ID, "pem", nil)
+	if err != nil {
+		return nil, err
+	}
+	//不给密码时导出的是没有加密的PKCS#8
+	keyPEM, err := c.export(ctx, signed.ID, "pkcs8", http.Header{"X-Key-Secret": {signed.KeySecret}})
+	if err != nil {
+		return nil, err
+	}
+	return myclient.NewCertificate(signed.ID, certPEM, keyPEM, "")
+}
+
+/*
+签署自己生成私钥的PKCS#10 CSR（DER或PEM）
+*/
+func (c *Client) SignPKCS10(ctx context.Context, csr []byte, profile string) (*myclient.Certificate, error) {
+	contents, _, err := c.do(ctx, "POST", "/csr?profile="+url.QueryEscape(profile), http.Header{"Content-Type": {"application/pkcs10"}}, csr)
+	if err != nil {
+		return nil, err
+	}
+	var signed signResponse
+	if err := json.Unmarshal(contents, &signed); err != nil {
+		return nil, err
+	}
+	return c.GetCertificate(ctx, signed.ID)
+}
+
+func (c *Client) GetCertificate(ctx context.Context, id string) (*myclient.Certificate, error) {
+	certPEM, err := c.export(ctx, id, "pem", nil)
+	if err != nil {
+		return nil, err
+	}
+	return myclient.NewCertificate(id, certPEM, nil, "")
+}
+
+func (c *Client) export(ctx context.Context, id string, format string, header http.Header) ([]byte, error) {
+	contents, _, err := c.do(ctx, "GET", "/certs/"+url.PathEscape(id)+"/export?format="+format, header, nil)
+	return contents, err
+}
+
+/*
+以指定的格式导出证书，密码和key secret放在请求头中
+*/
+func (c *Client) Export(ctx context.Context, req *mygrpc.ExportRequest) (*mygrpc.ExportResponse, error) {
+	format, ok := myclient.ExportFormatNames[req.Format]
+	if !ok {
+		return nil, fmt.Errorf("unknown export format %v", req.Format)
+	}
+	header := http.Header{}
+	if req.Password != "" {
+		header.Set("X-Export-Password", req.Password)
+	}
+	if req.KeySecret != "" {
+		header.Set("X-Key-Secret", req.KeySecret)
+	}
+	contents, respHeader, err := c.do(ctx, "GET", "/certs/"+url.PathEscape(req.Id)+"/export?format="+format, header, nil)
+	if err != nil {
+		return nil, err
+	}
+	result := &mygrpc.ExportResponse{Format: req.Format, Contents: contents, ContentType: respHeader.Get("Content-Type")}
+	if _, params, err := mime.ParseMediaType(respHeader.Get("Content-Disposition")); err == nil {
+		result.FileName = params["filename"]
+	}
+	return result, nil
+}
+
+/*
+/certs 返回的JSON，见 ca.CertificateInfo
+*/
+type infoJSON struct {
+	ID           string    `json:"id"`
+	CommonName   string    `json:"commonName"`
+	Identity     string    `json:"identity"`
+	Profile      string    `json:"profile"`
+	SerialNumber string    `json:"serialNumber"`
+	Issuer       string    `json:"issuer"`
+	SANs         []string  `json:"sans"`
+	NotBefore    time.Time `json:"notBefore"`
+	NotAfter     time.Time `json:"notAfter"`
+	Status       string    `json:"status"`
+	Revocation   *struct {
+		Reason    string    `json:"reason"`
+		RevokedAt time.Time `json:"revokedAt"`
+	} `json:"revocation"`
+}
+
+func (info *infoJSON) toProto() *mygrpc.CertificateInfo {
+	result := &mygrpc.CertificateInfo{
+		Id:           info.ID,
+		CommonName:   info.CommonName,
+		Identity:     info.Identity,
+		Profile:      info.Profile,
+		SerialNumber: info.SerialNumber,
+		Issuer:       info.Issuer,
+		SANs:         info.SANs,
+		NotBefore:    info.NotBefore.Unix(),
+		NotAfter:     info.NotAfter.Unix(),
+		Status:       info.Status,
+	}
+	if info.Revocation != nil {
+		result.RevocationReason = info.Revocation.Reason
+		result.RevokedAt = info.Revocation.RevokedAt.Unix()
+	}
+	return result
+}
+
+func (c *Client) DescribeCertificate(ctx context.Context, id string) (*mygrpc.CertificateInfo, error) {
+	var info infoJSON
+	if err := c.getJSON(ctx, "/certs/"+url.PathEscape(id), &info); err != nil {
+		return nil, err
+	}
+	return info.toProto(), nil
+}
+
+func (c *Client) ListCertificates(ctx context.Context, status string, identity string) ([]*mygrpc.CertificateInfo, error) {
+	query := url.Values{}
+	if status != "" {
+		query.Set("status", status)
+	}
+	if identity != "" {
+		query.Set("identity", identity)
+	}
+	var infos []infoJSON
+	if err := c.getJSON(ctx, "/certs?"+query.Encode(), &infos); err != nil {
+		return nil, err
+	}
+	result := make([]*mygrpc.CertificateInfo, 0, len(infos))
+	for i := range infos {
+		result = append(result, infos[i].toProto())
+	}
+	return result, nil
+}
+
+func (c *Client) ListExpiring(ctx context.Context, within time.Duration) ([]*mygrpc.ExpiringCertificate, error) {
+	var expiring []struct {
+		Kind         string    `json:"kind"`
+		ID           string    `json:"id"`
+		Subject      string    `json:"subject"`
+		Identity     string    `json:"identity"`
+		SerialNumber string    `json:"serialNumber"`
+		NotBefore    time.Time `json:"notBefore"`
+		NotAfter     time.Time `json:"notAfter"`
+	}
+	if err := c.getJSON(ctx, "/certs/expiring?within="+url.QueryEscape(within.String()), &expiring); err != nil {
+		return nil, err
+	}
+	result := make([]*mygrpc.ExpiringCertificate, 0, len(expiring))
+	for _, cert := range expiring {
+		result = append(result, &mygrpc.ExpiringCertificate{
+			Kind:         cert.Kind,
+			Id:           cert.ID,
+			Subject:      cert.Subject,
+			Identity:     cert.Identity,
+			SerialNumber: cert.SerialNumber,
+			NotBefore:    cert.NotBefore.Unix(),
+			NotAfter:     cert.NotAfter.Unix(),
+		})
+	}
+	return result, nil
+}
+
+func (c *Client) Revoke(ctx context.Context, id string, reason string) (time.Time, error) {
+	body, _ := json.Marshal(map[string]string{"reason": reason})
+	contents, _, err := c.do(ctx, "POST", "/certs/"+url.PathEscape(id)+"/revoke", http.Header{"Content-Type": {"application/json"}}, body)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var revocation struct {
+		RevokedAt time.Time `json:"revokedAt"`
+	}
+	if err := json.Unmarshal(contents, &revocation); err != nil {
+		return time.Time{}, err
+	}
+	return revocation.RevokedAt, nil
+}
+
+func (c *Client) TrustBundle(ctx context.Context) (*myclient.Bundle, error) {
+	contents, header, err := c.do(ctx, "GET", "/ca/bundle?format=pem", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return myclient.ParseBundle(contents, strings.Trim(header.Get("ETag"), `"`))
+}
+
+/*
+PEM中第一个是当前签发证书的根证书的CRL，根证书轮换期间后面还有另一个根证书的CRL
+*/
+func (c *Client) CRL(ctx context.Context) (*myclient.CRL, error) {
+	contents, _, err := c.do(ctx, "GET", "/ca/crl?format=pem", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	crl := &myclient.CRL{}
+	for block, rest := pem.Decode(contents); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "X509 CRL" {
+			continue
+		}
+		if crl.DER != nil {
+			crl.Others = append(crl.Others, block.Bytes)
+			continue
+		}
+		list, err := cx509.ParseRevocationList(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse the CRL fail: %v", err)
+		}
+		crl.DER, crl.ThisUpdate, crl.NextUpdate = block.Bytes, list.ThisUpdate, list.NextUpdate
+		if list.Number != nil {
+			crl.Number = list.Number.String()
+		}
+	}
+	if crl.DER == nil {
+		return nil, fmt.Errorf("no CRL in the response")
+	}
+	return crl, nil
+}
@@ -0,0 +1,57 @@
+package httpserver
+
+import (
+	cx509 "crypto/x509"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/auth"
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+)
+
+//为nil时不做授权
+var authorizer *auth.Authorizer
+
+/*
+路径需要的权限；/csr 的签发权限取决于CSR的profile，在signCsrHandler中检查
+trust bundle和CRL是公开的，客户端第一次连接CA之前就需要它
+*/
+func pathPermission(path string) string {
+	if strings.HasPrefix(path, "/certs/") && strings.HasSuffix(path, "/revoke") {
+		return auth.PermissionRevoke
+	}
+	if path == "/certs" || strings.HasPrefix(path, "/certs/") {
+		return auth.PermissionRead
+	}
+	return ""
+}
+
+/*
+认证调用者（Authorization: Bearer <token>，或者TLS客户端证书），并检查路径需要的权限
+*/
+func authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		creds := auth.Credentials{BearerToken: auth.BearerToken(r.Header.Get("Authorization"))}
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			creds.PeerCertificates = []*cx509.Certificate{r.TLS.VerifiedChains[0][0]}
+		}
+		principal, err := authorizer.Authenticate(creds)
+		if err == nil {
+			err = authorizer.Authorize(principal, pathPermission(r.URL.Path))
+		}
+		if err != nil {
+			writeProblem(w, r, err)
+			return
+		}
+		ctx := auth.WithPrincipal(r.Context(), principal)
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			ctx = ca.WithClientAddress(ctx, host)
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func authorize(r *http.Request, permission string) error {
+	return authorizer.Authorize(auth.PrincipalFrom(r.Context()), permission)
+}
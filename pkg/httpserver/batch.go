@@ -0,0 +1,86 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/auth"
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+)
+
+type batchRequest struct {
+	Requests     []*ca.CertificateSigningRequest `json:"requests"`
+	AllOrNothing bool                            `json:"allOrNothing"`
+	Parallelism  int                             `json:"parallelism"`
+}
+
+type batchResult struct {
+	Index         int      `json:"index"`
+	CertificateID string   `json:"certificateId,omitempty"`
+	KeySecret     string   `json:"keySecret,omitempty"`
+	Error         *problem `json:"error,omitempty"`
+}
+
+type batchResponse struct {
+	Results   []batchResult `json:"results"`
+	Succeeded int           `json:"succeeded"`
+	Failed    int           `json:"failed"`
+}
+
+/*
+批量签发：POST /csr/batch {"requests": [...], "allOrNothing": false, "parallelism": 4}
+每个CSR都有自己的结果，整批都没有处理时才返回错误
+*/
+func signCsrBatchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		methodNotAllowed(w, r, "POST")
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeProblem(w, r, ca.WrapError(ca.ErrInvalidArgument, "UNREADABLE_BODY", err, "can't read request body"))
+		return
+	}
+	req := batchRequest{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeProblem(w, r, ca.InvalidArgument("MALFORMED_JSON", ca.FieldViolation{Field: "body", Description: err.Error()}))
+		return
+	}
+	for i, csr := range req.Requests {
+		if csr == nil {
+			writeProblem(w, r, ca.InvalidArgument("INVALID_CSR", ca.FieldViolation{Field: fmt.Sprintf("requests[%v]", i), Description: "must not be null"}))
+			return
+		}
+		if err := authorize(r, auth.SignPermission(csr.Profile)); err != nil {
+			writeProblem(w, r, err)
+			return
+		}
+	}
+
+	results, err := ca.CA.SignX509Batch(r.Context(), req.Requests, ca.BatchOptions{AllOrNothing: req.AllOrNothing, Parallelism: req.Parallelism})
+	if err != nil {
+		writeProblem(w, r, err)
+		return
+	}
+	resp := batchResponse{Results: make([]batchResult, 0, len(results))}
+	for i, result := range results {
+		item := batchResult{Index: i}
+		if result.Err != nil {
+			item.Error = itemProblem(r, result.Err)
+			resp.Failed++
+		} else {
+			item.CertificateID = result.Certificate.ID
+			item.KeySecret = result.Certificate.KeySecret
+			resp.Succeeded++
+		}
+		resp.Results = append(resp.Results, item)
+	}
+	jsonBytes, _ := json.Marshal(resp)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
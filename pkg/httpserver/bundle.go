@@ -0,0 +1,54 @@
+package httpserver
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+)
+
+/*
+返回客户端需要信任的根证书和中间证书，?format=pem|der|jwks，默认pem
+支持ETag和If-None-Match，bundle没有变化时返回304
+*/
+func trustBundleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		methodNotAllowed(w, r, "GET, HEAD")
+		return
+	}
+
+	bundle := ca.CA.CurrentTrustBundle()
+	etag := `"` + bundle.Version + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if match := r.Header.Get("If-None-Match"); match != "" && (match == etag || match == "*") {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	var contents []byte
+	var contentType string
+	switch strings.ToLower(r.URL.Query().Get("format")) {
+	case "", "pem":
+		contents, contentType = bundle.PEM(), "application/x-pem-file"
+	case "der":
+		contents, contentType = bundle.DER(), "application/pkix-cert"
+	case "jwks":
+		var err error
+		contents, err = bundle.JWKS()
+		if err != nil {
+			writeProblem(w, r, ca.WrapError(ca.ErrInternal, "BUNDLE_ENCODING_FAILED", err, "encode trust bundle fail"))
+			return
+		}
+		contentType = "application/jwk-set+json"
+	default:
+		writeProblem(w, r, ca.InvalidArgument("UNKNOWN_BUNDLE_FORMAT", ca.FieldViolation{Field: "format", Description: "must be pem, der or jwks"}))
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	if r.Method == "GET" {
+		w.Write(contents)
+	}
+}
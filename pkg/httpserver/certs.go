@@ -0,0 +1,152 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+	"github.com/jackyzhangfudan/sidecar/pkg/util"
+)
+
+/*
+/certs?status=valid|expired|revoked&identity=<身份>，列出签发过的证书
+*/
+func listCertsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, r, "GET")
+		return
+	}
+	infos, err := ca.CA.ListCertificates(ca.ListOptions{Status: r.URL.Query().Get("status"), Identity: r.URL.Query().Get("identity")})
+	if err != nil {
+		writeProblem(w, r, err)
+		return
+	}
+	if infos == nil {
+		infos = []*ca.CertificateInfo{}
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+/*
+/certs/expiring?within=30d，列出within之内到期的证书，包括根证书和本地server的证书
+*/
+func expiringHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, r, "GET")
+		return
+	}
+	within := 30 * 24 * time.Hour
+	if value := r.URL.Query().Get("within"); value != "" {
+		var err error
+		if within, err = util.ParseDuration(value); err != nil {
+			writeProblem(w, r, ca.InvalidArgument("INVALID_WITHIN", ca.FieldViolation{Field: "within", Description: err.Error()}))
+			return
+		}
+	}
+	expiring, err := ca.CA.ExpiringCertificates(within)
+	if err != nil {
+		writeProblem(w, r, err)
+		return
+	}
+	if expiring == nil {
+		expiring = []*ca.ExpiringCertificate{}
+	}
+	writeJSON(w, http.StatusOK, expiring)
+}
+
+/*
+/certs/{id}：证书的概要和吊销状态
+/certs/{id}/export：见exportHandler
+/certs/{id}/revoke：POST，body可以是 {"reason": "keyCompromise"}
+*/
+func certsHandler(w http.ResponseWriter, r *http.Request) {
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/certs/"), "/")
+	switch action {
+	case "":
+		if r.Method != "GET" {
+			methodNotAllowed(w, r, "GET")
+			return
+		}
+		info, err := ca.CA.DescribeCertificate(id)
+		if err != nil {
+			writeProblem(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, info)
+	case "export":
+		exportHandler(w, r, id)
+	case "revoke":
+		revokeHandler(w, r, id)
+	default:
+		writeProblem(w, r, ca.NewError(ca.ErrNotFound, "UNKNOWN_PATH", "no resource at %v", r.URL.Path))
+	}
+}
+
+func revokeHandler(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != "POST" {
+		methodNotAllowed(w, r, "POST")
+		return
+	}
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	contents, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeProblem(w, r, ca.WrapError(ca.ErrInvalidArgument, "UNREADABLE_BODY", err, "can't read request body"))
+		return
+	}
+	if len(contents) > 0 {
+		if err := json.Unmarshal(contents, &body); err != nil {
+			writeProblem(w, r, ca.InvalidArgument("MALFORMED_JSON", ca.FieldViolation{Field: "body", Description: err.Error()}))
+			return
+		}
+	}
+	revocation, err := ca.CA.Revoke(r.Context(), id, body.Reason)
+	if err != nil {
+		writeProblem(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, revocation)
+}
+
+/*
+/ca/crl?format=der|pem，默认DER，是当前签发证书的根证书的CRL
+根证书轮换期间PEM中还有另一个根证书的CRL，列出它签发的证书
+*/
+func crlHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, r, "GET")
+		return
+	}
+	crls, err := ca.CA.CRLs(ca.DefaultCRLValidity)
+	if err != nil {
+		writeProblem(w, r, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(ca.DefaultCRLValidity.Seconds()/24)))
+	switch strings.ToLower(r.URL.Query().Get("format")) {
+	case "", "der":
+		w.Header().Set("Content-Type", "application/pkix-crl")
+		w.WriteHeader(http.StatusOK)
+		w.Write(crls[0].DER)
+	case "pem":
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		w.WriteHeader(http.StatusOK)
+		for _, crl := range crls {
+			w.Write(crl.PEM())
+		}
+	default:
+		writeProblem(w, r, ca.InvalidArgument("UNKNOWN_CRL_FORMAT", ca.FieldViolation{Field: "format", Description: "must be der or pem"}))
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	body, _ := json.Marshal(v)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
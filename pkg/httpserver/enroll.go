@@ -0,0 +1,69 @@
+package httpserver
+
+import (
+	cx509 "crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+)
+
+type enrollRequest struct {
+	Token string                        `json:"token"`
+	CSR   *ca.CertificateSigningRequest `json:"csr"`
+}
+
+type enrollResponse struct {
+	CertificateID string `json:"certificateId"`
+	Certificate   string `json:"certificate"`
+	PrivateKey    string `json:"privateKey"` //CA上不保存
+	Chain         string `json:"chain"`
+}
+
+/*
+用join token申请第一张证书，不需要其他凭证：POST /enroll {"token": "...", "csr": {...}}
+*/
+func enrollHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		methodNotAllowed(w, r, "POST")
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeProblem(w, r, ca.WrapError(ca.ErrInvalidArgument, "UNREADABLE_BODY", err, "can't read request body"))
+		return
+	}
+	req := enrollRequest{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeProblem(w, r, ca.InvalidArgument("MALFORMED_JSON", ca.FieldViolation{Field: "body", Description: err.Error()}))
+		return
+	}
+	if req.CSR == nil {
+		writeProblem(w, r, ca.InvalidArgument("INVALID_CSR", ca.FieldViolation{Field: "csr", Description: "is required"}))
+		return
+	}
+
+	enrolled, err := ca.CA.Enroll(r.Context(), req.Token, req.CSR)
+	if err != nil {
+		writeProblem(w, r, err)
+		return
+	}
+	keyDER, err := cx509.MarshalPKCS8PrivateKey(enrolled.Issued.PrivateKey)
+	if err != nil {
+		writeProblem(w, r, ca.WrapError(ca.ErrInternal, "KEY_ENCODING_FAILED", err, "encode private key fail"))
+		return
+	}
+	resp, _ := json.Marshal(enrollResponse{
+		CertificateID: enrolled.ID,
+		Certificate:   string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: enrolled.Issued.Certificate.Raw})),
+		PrivateKey:    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})),
+		Chain:         string(ca.CA.CurrentTrustBundle().PEM()),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(resp)
+}
@@ -0,0 +1,49 @@
+package httpserver
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+)
+
+const (
+	exportPasswordHeader = "X-Export-Password"
+	keySecretHeader      = "X-Key-Secret"
+)
+
+/*
+/certs/{id}/export?format=pem|fullchain|der|pkcs12|pkcs12-legacy|truststore|pkcs8，默认pem
+密码不放在URL里，以免出现在日志中：GET用X-Export-Password头，POST也可以用表单字段password
+带私钥的格式还需要签发时返回的keySecret，放在X-Key-Secret头或表单字段keySecret中
+*/
+func exportHandler(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != "GET" && r.Method != "POST" {
+		methodNotAllowed(w, r, "GET, POST")
+		return
+	}
+
+	password := r.Header.Get(exportPasswordHeader)
+	if password == "" && r.Method == "POST" {
+		password = r.PostFormValue("password")
+	}
+	keySecret := r.Header.Get(keySecretHeader)
+	if keySecret == "" && r.Method == "POST" {
+		keySecret = r.PostFormValue("keySecret")
+	}
+	export, err := ca.CA.ExportCertificate(r.Context(), id, ca.ExportOptions{
+		Format:    ca.ExportFormat(strings.ToLower(r.URL.Query().Get("format"))),
+		Password:  password,
+		KeySecret: keySecret,
+	})
+	if err != nil {
+		writeProblem(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", export.ContentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+export.FileName+`"`)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(export.Contents)
+}
@@ -0,0 +1,108 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+)
+
+const problemContentType string = "application/problem+json"
+
+var httpStatus = map[ca.ErrorCode]int{
+	ca.ErrInternal:           http.StatusInternalServerError,
+	ca.ErrInvalidArgument:    http.StatusBadRequest,
+	ca.ErrNotFound:           http.StatusNotFound,
+	ca.ErrAlreadyExists:      http.StatusConflict,
+	ca.ErrPermissionDenied:   http.StatusForbidden,
+	ca.ErrUnauthenticated:    http.StatusUnauthorized,
+	ca.ErrFailedPrecondition: http.StatusConflict,
+	ca.ErrResourceExhausted:  http.StatusTooManyRequests,
+	ca.ErrUnavailable:        http.StatusServiceUnavailable,
+}
+
+/*
+RFC 7807 problem details，reason 和 invalid-params 是扩展成员，与gRPC的 ErrorInfo、BadRequest 对应
+*/
+type problem struct {
+	Type          string              `json:"type"`
+	Title         string              `json:"title"`
+	Status        int                 `json:"status"`
+	Detail        string              `json:"detail,omitempty"`
+	Instance      string              `json:"instance,omitempty"`
+	Reason        string              `json:"reason,omitempty"`
+	Domain        string              `json:"domain,omitempty"`
+	Metadata      map[string]string   `json:"metadata,omitempty"`
+	InvalidParams []ca.FieldViolation `json:"invalid-params,omitempty"`
+}
+
+/*
+以 application/problem+json 返回错误，不认识的错误当作500，且不暴露错误内容
+*/
+func writeProblem(w http.ResponseWriter, r *http.Request, err error) {
+	var caErr *ca.Error
+	if !errors.As(err, &caErr) {
+		log.Printf("unexpected error: %v", err)
+		caErr = ca.NewError(ca.ErrInternal, "INTERNAL", "internal error")
+	}
+	if caErr.Err != nil {
+		log.Printf("%v: %v", caErr.Reason, caErr.Err)
+	}
+
+	if caErr.Code == ca.ErrUnauthenticated {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="sidecar"`)
+	}
+	if caErr.RetryAfter > 0 {
+		//Retry-After 只能是整数秒，向上取整
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(caErr.RetryAfter.Seconds()))))
+	}
+	writeProblemStatus(w, r, httpStatus[caErr.Code], caErr)
+}
+
+func writeProblemStatus(w http.ResponseWriter, r *http.Request, status int, caErr *ca.Error) {
+	body, _ := json.Marshal(newProblem(r, status, caErr))
+
+	w.Header().Set("Content-Type", problemContentType)
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func newProblem(r *http.Request, status int, caErr *ca.Error) problem {
+	return problem{
+		Type:          "urn:problem-type:sidecar:" + strings.ToLower(strings.ReplaceAll(caErr.Reason, "_", "-")),
+		Title:         http.StatusText(status),
+		Status:        status,
+		Detail:        caErr.Message,
+		Instance:      r.URL.Path,
+		Reason:        caErr.Reason,
+		Domain:        ca.ErrorDomain,
+		Metadata:      caErr.Metadata,
+		InvalidParams: caErr.Violations,
+	}
+}
+
+/*
+批量请求中一个请求的错误，和writeProblem一样不认识的错误当作500
+*/
+func itemProblem(r *http.Request, err error) *problem {
+	var caErr *ca.Error
+	if !errors.As(err, &caErr) {
+		log.Printf("unexpected error: %v", err)
+		caErr = ca.NewError(ca.ErrInternal, "INTERNAL", "internal error")
+	}
+	if caErr.Err != nil {
+		log.Printf("%v: %v", caErr.Reason, caErr.Err)
+	}
+	p := newProblem(r, httpStatus[caErr.Code], caErr)
+	return &p
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request, allowed string) {
+	w.Header().Set("Allow", allowed)
+	writeProblemStatus(w, r, http.StatusMethodNotAllowed, ca.NewError(ca.ErrInvalidArgument, "METHOD_NOT_ALLOWED", "method %v is not allowed", r.Method))
+}
@@ -0,0 +1,77 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+)
+
+func TestWriteProblem(t *testing.T) {
+	limited := ca.NewError(ca.ErrResourceExhausted, "RATE_LIMITED", "too many requests")
+	limited.RetryAfter = 1500 * time.Millisecond
+	tests := []struct {
+		name           string
+		err            error
+		wantStatus     int
+		wantType       string
+		wantDetail     string
+		wantParams     []string
+		wantRetryAfter string
+		wantChallenge  bool
+	}{
+		{name: "not found", err: ca.NewError(ca.ErrNotFound, "CERT_NOT_FOUND", "certificate x not found"), wantStatus: http.StatusNotFound, wantType: "urn:problem-type:sidecar:cert-not-found", wantDetail: "certificate x not found"},
+		{name: "already exists", err: ca.NewError(ca.ErrAlreadyExists, "DUPLICATE", "exists"), wantStatus: http.StatusConflict, wantType: "urn:problem-type:sidecar:duplicate", wantDetail: "exists"},
+		{name: "failed precondition", err: ca.NewError(ca.ErrFailedPrecondition, "ALREADY_REVOKED", "revoked"), wantStatus: http.StatusConflict, wantType: "urn:problem-type:sidecar:already-revoked", wantDetail: "revoked"},
+		{
+			name:       "field violations",
+			err:        fmt.Errorf("sign: %w", ca.InvalidArgument("INVALID_CSR", ca.FieldViolation{Field: "DNSNames[0]", Description: "empty"})),
+			wantStatus: http.StatusBadRequest,
+			wantType:   "urn:problem-type:sidecar:invalid-csr",
+			wantDetail: "invalid request",
+			wantParams: []string{"DNSNames[0]"},
+		},
+		{name: "rate limited", err: limited, wantStatus: http.StatusTooManyRequests, wantType: "urn:problem-type:sidecar:rate-limited", wantDetail: "too many requests", wantRetryAfter: "2"},
+		{name: "unauthenticated", err: ca.NewError(ca.ErrUnauthenticated, "NO_CREDENTIALS", "who are you"), wantStatus: http.StatusUnauthorized, wantType: "urn:problem-type:sidecar:no-credentials", wantDetail: "who are you", wantChallenge: true},
+		{name: "permission denied", err: ca.NewError(ca.ErrPermissionDenied, "NOT_OWNER", "not yours"), wantStatus: http.StatusForbidden, wantType: "urn:problem-type:sidecar:not-owner", wantDetail: "not yours"},
+		{name: "not leader", err: ca.NewError(ca.ErrUnavailable, "NOT_LEADER", "retry with the leader"), wantStatus: http.StatusServiceUnavailable, wantType: "urn:problem-type:sidecar:not-leader", wantDetail: "retry with the leader"},
+		{name: "unknown error", err: errors.New("secret detail"), wantStatus: http.StatusInternalServerError, wantType: "urn:problem-type:sidecar:internal", wantDetail: "internal error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			writeProblem(w, httptest.NewRequest("GET", "/certs/x", nil), tt.err)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %v, want %v", w.Code, tt.wantStatus)
+			}
+			if got := w.Header().Get("Content-Type"); got != problemContentType {
+				t.Errorf("Content-Type = %v", got)
+			}
+			if got := w.Header().Get("Retry-After"); got != tt.wantRetryAfter {
+				t.Errorf("Retry-After = %q, want %q", got, tt.wantRetryAfter)
+			}
+			if got := w.Header().Get("WWW-Authenticate") != ""; got != tt.wantChallenge {
+				t.Errorf("WWW-Authenticate sent: %v, want %v", got, tt.wantChallenge)
+			}
+			var p problem
+			if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+				t.Fatal(err)
+			}
+			if p.Status != tt.wantStatus || p.Type != tt.wantType || p.Detail != tt.wantDetail || p.Instance != "/certs/x" {
+				t.Errorf("problem %+v", p)
+			}
+			var params []string
+			for _, v := range p.InvalidParams {
+				params = append(params, v.Field)
+			}
+			if fmt.Sprint(params) != fmt.Sprint(tt.wantParams) {
+				t.Errorf("invalid-params %v, want %v", params, tt.wantParams)
+			}
+		})
+	}
+}
@@ -1,13 +1,19 @@
 package httpserver
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"strings"
 
+	"github.com/jackyzhangfudan/sidecar/pkg/auth"
 	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
 const (
@@ -20,23 +26,50 @@ var running bool
 func init() {
 }
 
-func Run() {
+/*
+authz 为nil时不做授权，address 为空时监听默认端口，tlsConfig 不为nil时用https
+*/
+func Run(address string, tlsConfig *tls.Config, authz *auth.Authorizer, stopCh <-chan struct{}) {
 	if running {
 		return
 	}
+	authorizer = authz
+	if address == "" {
+		address = fmt.Sprintf(":%v", port)
+	}
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", rootHandler)
 	mux.HandleFunc("/csr-template", getCsrTemplateHandler)
 	mux.HandleFunc("/csr", signCsrHandler)
+	mux.HandleFunc("/csr/batch", signCsrBatchHandler)
+	mux.HandleFunc("/spiffe/bundle", spiffeBundleHandler)
+	mux.HandleFunc("/ca/bundle", trustBundleHandler)
+	mux.HandleFunc("/ca/crl", crlHandler)
+	mux.HandleFunc("/certs", listCertsHandler)
+	mux.HandleFunc("/certs/", certsHandler)
+	mux.HandleFunc("/certs/expiring", expiringHandler)
+	mux.HandleFunc("/enroll", enrollHandler)
 	server = &http.Server{
-		Addr:    fmt.Sprintf(":%v", port),
-		Handler: mux,
+		Addr:      address,
+		Handler:   otelhttp.NewHandler(authMiddleware(mux), "ca-http"), //每个请求都会生成一个server span
+		TLSConfig: tlsConfig,
 	}
 
 	running = true
-	fmt.Printf("server listening at %v, http", server.Addr)
-	if server.ListenAndServe() != nil {
+	go func() {
+		<-stopCh
+		server.Shutdown(context.Background())
+	}()
+	var err error
+	if tlsConfig != nil {
+		fmt.Printf("server listening at %v, https", server.Addr)
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		fmt.Printf("server listening at %v, http", server.Addr)
+		err = server.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
 		running = false
 		log.Printf("can't start http server at %v", server.Addr)
 	}
@@ -54,7 +87,7 @@ func rootHandler(w http.ResponseWriter, r *http.Request) {
 
 func getCsrTemplateHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		methodNotAllowed(w, r, "GET")
 		return
 	}
 
@@ -72,53 +105,97 @@ func getCsrTemplateHandler(w http.ResponseWriter, r *http.Request) {
 
 	csrBytes, err := json.Marshal(csr)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		writeProblem(w, r, err)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
 	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
 	w.Write(csrBytes)
 }
 
 func signCsrHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		methodNotAllowed(w, r, "POST")
 		return
 	}
 
 	reqBody, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		writeProblem(w, r, ca.WrapError(ca.ErrInvalidArgument, "UNREADABLE_BODY", err, "can't read request body"))
+		return
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/pkcs10") {
+		signPKCS10(w, r, reqBody)
 		return
 	}
 
 	csr := &ca.CertificateSigningRequest{}
 	err = json.Unmarshal(reqBody, csr)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		writeProblem(w, r, ca.InvalidArgument("MALFORMED_JSON", ca.FieldViolation{Field: "body", Description: err.Error()}))
+		return
+	}
+	if err := authorize(r, auth.SignPermission(csr.Profile)); err != nil {
+		writeProblem(w, r, err)
 		return
 	}
 
-	var sync chan int = make(chan int, 1)
-	go signCsrRoutine(w, csr, sync)
+	//net/http已经为每个请求起了一个goroutine，同时生成私钥的个数由CA的限流控制
+	theCert, err := ca.CA.SignX509(r.Context(), csr)
+	if err != nil {
+		writeProblem(w, r, err)
+		return
+	}
 
-	<-sync
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	jsonByte, _ := json.Marshal(theCert)
+	w.Write(jsonByte)
 }
 
-func signCsrRoutine(w http.ResponseWriter, csr *ca.CertificateSigningRequest, sync chan<- int) {
-	defer close(sync)
-	theCert, err := ca.CA.SignX509(csr)
-
+/*
+签署申请者自己生成私钥的PKCS#10 CSR（DER或PEM），profile由 ?profile= 指定
+*/
+func signPKCS10(w http.ResponseWriter, r *http.Request, body []byte) {
+	profile := r.URL.Query().Get("profile")
+	if err := authorize(r, auth.SignPermission(profile)); err != nil {
+		writeProblem(w, r, err)
+		return
+	}
+	theCert, err := ca.CA.SignPKCS10(r.Context(), body, profile)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "error happen: %v", err)
+		writeProblem(w, r, err)
 		return
 	}
-
-	w.WriteHeader(http.StatusAccepted)
 	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
 	jsonByte, _ := json.Marshal(theCert)
 	w.Write(jsonByte)
+}
+
+/*
+返回某个trust domain的trust bundle，PEM格式，例如 /spiffe/bundle?trustDomain=example.org
+*/
+func spiffeBundleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, r, "GET")
+		return
+	}
+
+	td := r.URL.Query().Get("trustDomain")
+	if td == "" {
+		td = ca.CA.TrustDomain
+	}
+	certs, err := ca.CA.TrustBundle(td)
+	if err != nil {
+		writeProblem(w, r, err)
+		return
+	}
 
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.WriteHeader(http.StatusOK)
+	for _, cert := range certs {
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
 }
@@ -0,0 +1,229 @@
+package inspect
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	cx509 "crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	KindCertificate string = "certificate"
+	KindCSR         string = "csr"
+	KindCRL         string = "crl"
+)
+
+/*
+PEM或DER文件中的一个证书、CSR或CRL
+*/
+type Object struct {
+	Kind        string
+	DER         []byte
+	Certificate *cx509.Certificate
+	CSR         *cx509.CertificateRequest
+	CRL         *cx509.RevocationList
+}
+
+func (o *Object) PEM() []byte {
+	blockType := map[string]string{KindCertificate: "CERTIFICATE", KindCSR: "CERTIFICATE REQUEST", KindCRL: "X509 CRL"}[o.Kind]
+	return pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: o.DER})
+}
+
+/*
+解析文件中的全部对象：PEM时按块的类型，DER时依次尝试证书、CSR和CRL
+*/
+func Parse(contents []byte) ([]*Object, error) {
+	var objects []*Object
+	rest := contents
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		object, err := parseBlock(block.Type, block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if object != nil {
+			objects = append(objects, object)
+		}
+	}
+	if len(objects) > 0 {
+		return objects, nil
+	}
+
+	for _, kind := range []string{"CERTIFICATE", "CERTIFICATE REQUEST", "X509 CRL"} {
+		if object, err := parseBlock(kind, contents); err == nil {
+			return []*Object{object}, nil
+		}
+	}
+	return nil, fmt.Errorf("no certificate, CSR or CRL found")
+}
+
+func parseBlock(blockType string, der []byte) (*Object, error) {
+	object := &Object{DER: der}
+	var err error
+	switch blockType {
+	case "CERTIFICATE":
+		object.Kind = KindCertificate
+		object.Certificate, err = cx509.ParseCertificate(der)
+	case "CERTIFICATE REQUEST", "NEW CERTIFICATE REQUEST":
+		object.Kind = KindCSR
+		object.CSR, err = cx509.ParseCertificateRequest(der)
+	case "X509 CRL":
+		object.Kind = KindCRL
+		object.CRL, err = cx509.ParseRevocationList(der)
+	default:
+		//私钥等其他块不解析
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse %v fail: %v", object.Kind, err)
+	}
+	return object, nil
+}
+
+/*
+对象的可读描述，用于表格和JSON输出
+*/
+type Description struct {
+	Kind               string     `json:"kind"`
+	Subject            string     `json:"subject,omitempty"`
+	Issuer             string     `json:"issuer,omitempty"`
+	SerialNumber       string     `json:"serialNumber,omitempty"`
+	NotBefore          *time.Time `json:"notBefore,omitempty"`
+	NotAfter           *time.Time `json:"notAfter,omitempty"`
+	ThisUpdate         *time.Time `json:"thisUpdate,omitempty"`
+	NextUpdate         *time.Time `json:"nextUpdate,omitempty"`
+	IsCA               bool       `json:"isCA,omitempty"`
+	PublicKey          string     `json:"publicKey,omitempty"`
+	SignatureAlgorithm string     `json:"signatureAlgorithm,omitempty"`
+	SANs               []string   `json:"sans,omitempty"`
+	KeyUsage           []string   `json:"keyUsage,omitempty"`
+	ExtKeyUsage        []string   `json:"extKeyUsage,omitempty"`
+	SubjectKeyID       string     `json:"subjectKeyId,omitempty"`
+	AuthorityKeyID     string     `json:"authorityKeyId,omitempty"`
+	Revoked            []Revoked  `json:"revoked,omitempty"`
+	SHA256Fingerprint  string     `json:"sha256Fingerprint"`
+}
+
+type Revoked struct {
+	SerialNumber string    `json:"serialNumber"`
+	RevokedAt    time.Time `json:"revokedAt"`
+	Reason       string    `json:"reason,omitempty"`
+}
+
+func Describe(o *Object) *Description {
+	sum := sha256.Sum256(o.DER)
+	d := &Description{Kind: o.Kind, SHA256Fingerprint: strings.ToUpper(hex.EncodeToString(sum[:]))}
+	switch o.Kind {
+	case KindCertificate:
+		cert := o.Certificate
+		d.Subject, d.Issuer = cert.Subject.String(), cert.Issuer.String()
+		d.SerialNumber = cert.SerialNumber.Text(16)
+		d.NotBefore, d.NotAfter = &cert.NotBefore, &cert.NotAfter
+		d.IsCA = cert.IsCA
+		d.PublicKey = publicKeyName(cert.PublicKey)
+		d.SignatureAlgorithm = cert.SignatureAlgorithm.String()
+		d.SANs = sans(cert.DNSNames, cert.IPAddresses, cert.EmailAddresses, cert.URIs)
+		d.KeyUsage = keyUsages(cert.KeyUsage)
+		for _, usage := range cert.ExtKeyUsage {
+			d.ExtKeyUsage = append(d.ExtKeyUsage, extKeyUsageNames[usage])
+		}
+		d.SubjectKeyID, d.AuthorityKeyID = hex.EncodeToString(cert.SubjectKeyId), hex.EncodeToString(cert.AuthorityKeyId)
+	case KindCSR:
+		csr := o.CSR
+		d.Subject = csr.Subject.String()
+		d.PublicKey = publicKeyName(csr.PublicKey)
+		d.SignatureAlgorithm = csr.SignatureAlgorithm.String()
+		d.SANs = sans(csr.DNSNames, csr.IPAddresses, csr.EmailAddresses, csr.URIs)
+	case KindCRL:
+		crl := o.CRL
+		d.Issuer = crl.Issuer.String()
+		d.ThisUpdate, d.NextUpdate = &crl.ThisUpdate, &crl.NextUpdate
+		for _, entry := range crl.RevokedCertificates {
+			d.Revoked = append(d.Revoked, Revoked{SerialNumber: entry.SerialNumber.Text(16), RevokedAt: entry.RevocationTime, Reason: ReasonOf(entry)})
+		}
+	}
+	return d
+}
+
+func publicKeyName(key interface{}) string {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %d", key.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "ECDSA " + key.Curve.Params().Name
+	case ed25519.PublicKey:
+		return "Ed25519"
+	}
+	return fmt.Sprintf("%T", key)
+}
+
+func sans(dnsNames []string, ips []net.IP, emails []string, uris []*url.URL) []string {
+	result := append([]string{}, dnsNames...)
+	for _, ip := range ips {
+		result = append(result, ip.String())
+	}
+	result = append(result, emails...)
+	for _, uri := range uris {
+		result = append(result, uri.String())
+	}
+	return result
+}
+
+var keyUsageNames = []string{"digitalSignature", "contentCommitment", "keyEncipherment", "dataEncipherment", "keyAgreement", "keyCertSign", "cRLSign", "encipherOnly", "decipherOnly"}
+
+func keyUsages(usage cx509.KeyUsage) []string {
+	var result []string
+	for i, name := range keyUsageNames {
+		if usage&(1<<i) != 0 {
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+var extKeyUsageNames = map[cx509.ExtKeyUsage]string{
+	cx509.ExtKeyUsageAny:             "any",
+	cx509.ExtKeyUsageServerAuth:      "serverAuth",
+	cx509.ExtKeyUsageClientAuth:      "clientAuth",
+	cx509.ExtKeyUsageCodeSigning:     "codeSigning",
+	cx509.ExtKeyUsageEmailProtection: "emailProtection",
+	cx509.ExtKeyUsageTimeStamping:    "timeStamping",
+	cx509.ExtKeyUsageOCSPSigning:     "OCSPSigning",
+}
+
+var oidCRLReason = asn1.ObjectIdentifier{2, 5, 29, 21}
+
+var reasonNames = map[int]string{
+	0: "unspecified", 1: "keyCompromise", 2: "cACompromise", 3: "affiliationChanged", 4: "superseded",
+	5: "cessationOfOperation", 6: "certificateHold", 8: "removeFromCRL", 9: "privilegeWithdrawn", 10: "aACompromise",
+}
+
+/*
+CRL条目中的吊销原因，没有给出时为空
+*/
+func ReasonOf(entry pkix.RevokedCertificate) string {
+	for _, ext := range entry.Extensions {
+		if !ext.Id.Equal(oidCRLReason) {
+			continue
+		}
+		var code asn1.Enumerated
+		if _, err := asn1.Unmarshal(ext.Value, &code); err == nil {
+			return reasonNames[int(code)]
+		}
+	}
+	return ""
+}
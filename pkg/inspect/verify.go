@@ -0,0 +1,116 @@
+package inspect
+
+import (
+	cx509 "crypto/x509"
+	"fmt"
+	"time"
+)
+
+const (
+	VerifyValid   string = "valid"
+	VerifyRevoked string = "revoked"
+	VerifyInvalid string = "invalid"
+	VerifyUnknown string = "unknown" //证书链有效，但是没有可用的CRL，吊销状态未知
+)
+
+type VerifyOptions struct {
+	Roots         *cx509.CertPool
+	Intermediates []*cx509.Certificate
+	CRLs          [][]byte //DER，为空时不检查吊销状态；根证书轮换期间新旧根证书各有一份，用证书的签发者签的那份
+	DNSName       string   //不为空时检查证书是否包含这个名字
+	Now           time.Time
+}
+
+/*
+证书的验证结果，Chain从证书本身到根证书
+*/
+type VerifyResult struct {
+	Status            string    `json:"status"`
+	Chain             []string  `json:"chain,omitempty"`
+	RevocationChecked bool      `json:"revocationChecked"`
+	RevokedAt         time.Time `json:"revokedAt,omitempty"`
+	Reason            string    `json:"reason,omitempty"`
+	Error             string    `json:"error,omitempty"`
+}
+
+/*
+验证证书链，再用签发者签名的CRL检查吊销状态
+没有签发者签的CRL或者CRL已经过期时，吊销状态是未知的，结果是unknown
+*/
+func Verify(cert *cx509.Certificate, opts VerifyOptions) *VerifyResult {
+	if opts.Now.IsZero() {
+		opts.Now = time.Now()
+	}
+	result := &VerifyResult{Status: VerifyInvalid}
+	intermediates := cx509.NewCertPool()
+	for _, intermediate := range opts.Intermediates {
+		intermediates.AddCert(intermediate)
+	}
+	chains, err := cert.Verify(cx509.VerifyOptions{
+		Roots:         opts.Roots,
+		Intermediates: intermediates,
+		DNSName:       opts.DNSName,
+		CurrentTime:   opts.Now,
+		KeyUsages:     []cx509.ExtKeyUsage{cx509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	for _, chainCert := range chains[0] {
+		result.Chain = append(result.Chain, chainCert.Subject.String())
+	}
+	result.Status = VerifyValid
+	if len(opts.CRLs) == 0 {
+		return result
+	}
+
+	issuer := chains[0][0]
+	if len(chains[0]) > 1 {
+		issuer = chains[0][1]
+	}
+	result.Status = VerifyUnknown
+	crl, err := issuerCRL(issuer, opts.CRLs)
+	if err != nil {
+		result.Error = "revocation status unknown, " + err.Error()
+		return result
+	}
+	if !opts.Now.Before(crl.NextUpdate) {
+		result.Error = "revocation status unknown, the CRL expired at " + crl.NextUpdate.Format(time.RFC3339)
+		return result
+	}
+	result.Status = VerifyValid
+	result.RevocationChecked = true
+	for _, entry := range crl.RevokedCertificates {
+		if entry.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+			result.Status = VerifyRevoked
+			result.RevokedAt = entry.RevocationTime
+			result.Reason = ReasonOf(entry)
+			break
+		}
+	}
+	return result
+}
+
+/*
+crls中issuer签的那份，有多份时用最新的
+*/
+func issuerCRL(issuer *cx509.Certificate, crls [][]byte) (*cx509.RevocationList, error) {
+	var found *cx509.RevocationList
+	for _, der := range crls {
+		crl, err := cx509.ParseRevocationList(der)
+		if err != nil {
+			return nil, fmt.Errorf("can't parse the CRL: %v", err)
+		}
+		if crl.CheckSignatureFrom(issuer) != nil {
+			continue
+		}
+		if found == nil || crl.ThisUpdate.After(found.ThisUpdate) {
+			found = crl
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no CRL is signed by the issuer %v", issuer.Subject)
+	}
+	return found, nil
+}
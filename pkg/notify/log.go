@@ -0,0 +1,22 @@
+package notify
+
+import (
+	"context"
+	"log"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+)
+
+/*
+把到期通知写到server的日志
+*/
+type Log struct{}
+
+func (Log) Name() string { return "log" }
+
+func (Log) Notify(ctx context.Context, report *ca.ExpiryReport) error {
+	for _, notice := range report.Notices {
+		log.Printf("certificate expiring: %v", describe(notice))
+	}
+	return nil
+}
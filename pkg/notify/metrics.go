@@ -0,0 +1,78 @@
+package notify
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+	"github.com/jackyzhangfudan/sidecar/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+/*
+把每次扫描的结果记到metrics，由监控系统按自己的规则告警
+*/
+type Metrics struct {
+	mu       sync.Mutex
+	expiring map[string]int64     //kind -> 最大阈值之内到期的证书数
+	soonest  map[string]time.Time //kind -> 最早的到期时间
+	notices  metric.Int64Counter
+}
+
+func NewMetrics() (*Metrics, error) {
+	meter := tracing.Meter()
+	m := &Metrics{}
+	var err error
+	if m.notices, err = meter.Int64Counter("sidecar.ca.expiry.notices",
+		metric.WithDescription("certificates crossing an expiry threshold, by kind")); err != nil {
+		return nil, err
+	}
+	if _, err = meter.Int64ObservableGauge("sidecar.ca.expiring.certificates",
+		metric.WithDescription("certificates expiring within the largest threshold, by kind"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			for kind, count := range m.expiring {
+				o.Observe(count, metric.WithAttributes(attribute.String("kind", kind)))
+			}
+			return nil
+		})); err != nil {
+		return nil, err
+	}
+	if _, err = meter.Int64ObservableGauge("sidecar.ca.expiring.soonest", metric.WithUnit("s"),
+		metric.WithDescription("seconds until the first of the expiring certificates expires, by kind, negative when already expired"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			for kind, notAfter := range m.soonest {
+				o.Observe(int64(time.Until(notAfter)/time.Second), metric.WithAttributes(attribute.String("kind", kind)))
+			}
+			return nil
+		})); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *Metrics) Name() string { return "metrics" }
+
+func (m *Metrics) Notify(ctx context.Context, report *ca.ExpiryReport) error {
+	for _, notice := range report.Notices {
+		m.notices.Add(ctx, 1, metric.WithAttributes(attribute.String("kind", notice.Certificate.Kind)))
+	}
+	//没有快要到期的证书时也要报0
+	expiring := map[string]int64{ca.KindRoot: 0, ca.KindIntermediate: 0, ca.KindLocal: 0, ca.KindLeaf: 0}
+	soonest := map[string]time.Time{}
+	for _, cert := range report.Expiring {
+		expiring[cert.Kind]++
+		if first, ok := soonest[cert.Kind]; !ok || cert.NotAfter.Before(first) {
+			soonest[cert.Kind] = cert.NotAfter
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expiring, m.soonest = expiring, soonest
+	return nil
+}
@@ -0,0 +1,29 @@
+/*
+证书到期通知的渠道：日志、webhook、邮件和metrics，都实现了 ca.ExpiryNotifier
+*/
+package notify
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+	"github.com/jackyzhangfudan/sidecar/pkg/util"
+)
+
+/*
+一条通知的文字描述，日志和邮件使用
+*/
+func describe(notice *ca.ExpiryNotice) string {
+	cert := notice.Certificate
+	name := cert.Kind + " certificate"
+	if cert.ID != "" {
+		name += " " + cert.ID
+	}
+	when := "expires in " + util.FormatDuration(notice.Remaining)
+	if notice.Remaining <= 0 {
+		when = "expired " + util.FormatDuration(-notice.Remaining) + " ago"
+	}
+	return fmt.Sprintf("%v (%v, serial %v) %v at %v, threshold %v",
+		name, cert.Subject, cert.SerialNumber, when, cert.NotAfter.UTC().Format(time.RFC3339), util.FormatDuration(notice.Threshold))
+}
@@ -0,0 +1,142 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+)
+
+const DefaultSMTPTimeout time.Duration = 30 * time.Second
+
+type SMTPOptions struct {
+	Address  string //host:port
+	From     string
+	To       []string
+	Username string //为空时不认证
+	Password string
+	Timeout  time.Duration //连接和发送一封邮件的超时，默认 DefaultSMTPTimeout；ctx更早到期时以ctx为准
+}
+
+/*
+把到期通知汇总成一封邮件发出去，服务器支持时使用STARTTLS
+*/
+type SMTP struct {
+	opts SMTPOptions
+}
+
+func NewSMTP(opts SMTPOptions) (*SMTP, error) {
+	if _, _, err := net.SplitHostPort(opts.Address); err != nil {
+		return nil, fmt.Errorf("invalid SMTP address %v: %v", opts.Address, err)
+	}
+	if opts.From == "" || len(opts.To) == 0 {
+		return nil, fmt.Errorf("SMTP needs a sender and at least one recipient")
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultSMTPTimeout
+	}
+	return &SMTP{opts: opts}, nil
+}
+
+func (s *SMTP) Name() string { return "smtp:" + s.opts.Address }
+
+func (s *SMTP) Notify(ctx context.Context, report *ca.ExpiryReport) error {
+	if len(report.Notices) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.opts.Timeout)
+	defer cancel()
+	return s.send(ctx, s.message(report))
+}
+
+/*
+和 smtp.SendMail 一样，但是连接和之后的每一步都受ctx控制，服务器不响应时不会一直等下去
+*/
+func (s *SMTP) send(ctx context.Context, msg []byte) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", s.opts.Address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	//ctx被取消时关闭连接，正在进行的读写马上返回
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	host, _, _ := net.SplitHostPort(s.opts.Address)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return contextError(ctx, err)
+		}
+	}
+	if s.opts.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.opts.Username, s.opts.Password, host)); err != nil {
+			return contextError(ctx, err)
+		}
+	}
+	if err := c.Mail(s.opts.From); err != nil {
+		return contextError(ctx, err)
+	}
+	for _, to := range s.opts.To {
+		if err := c.Rcpt(to); err != nil {
+			return contextError(ctx, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	if _, err := w.Write(msg); err != nil {
+		return contextError(ctx, err)
+	}
+	if err := w.Close(); err != nil {
+		return contextError(ctx, err)
+	}
+	return contextError(ctx, c.Quit())
+}
+
+/*
+超时或者取消时返回ctx的错误，比关闭连接造成的读写错误更容易看懂
+*/
+func contextError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return fmt.Errorf("%w: %v", ctx.Err(), err)
+	}
+	return err
+}
+
+func (s *SMTP) message(report *ca.ExpiryReport) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %v\r\n", s.opts.From)
+	fmt.Fprintf(&b, "To: %v\r\n", strings.Join(s.opts.To, ", "))
+	fmt.Fprintf(&b, "Subject: [sidecar] %v certificate(s) expiring\r\n", len(report.Notices))
+	fmt.Fprintf(&b, "Date: %v\r\n", report.Time.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	for _, notice := range report.Notices {
+		fmt.Fprintf(&b, "%v\r\n", describe(notice))
+	}
+	fmt.Fprintf(&b, "\r\n%v certificate(s) of the CA expire within the largest threshold, see `sidecar ca expiring`.\r\n", len(report.Expiring))
+	return b.Bytes()
+}
@@ -0,0 +1,177 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+)
+
+/*
+只实现SendMail用到的命令的SMTP服务器，hang为true时接受连接之后什么也不说
+*/
+type fakeSMTP struct {
+	listener net.Listener
+	hang     bool
+	mu       sync.Mutex
+	from     string
+	to       []string
+	data     string
+}
+
+func newFakeSMTP(t *testing.T, hang bool) *fakeSMTP {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fakeSMTP{listener: listener, hang: hang}
+	go server.serve()
+	t.Cleanup(func() { listener.Close() })
+	return server
+}
+
+func (s *fakeSMTP) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeSMTP) handle(conn net.Conn) {
+	defer conn.Close()
+	if s.hang {
+		conn.Read(make([]byte, 1))
+		return
+	}
+	r := bufio.NewReader(conn)
+	reply := func(lines string) { conn.Write([]byte(lines)) }
+	reply("220 fake ESMTP\r\n")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		command := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			reply("250-fake\r\n250 8BITMIME\r\n")
+		case strings.HasPrefix(command, "MAIL FROM:"):
+			s.mu.Lock()
+			s.from = pathOf(line)
+			s.mu.Unlock()
+			reply("250 ok\r\n")
+		case strings.HasPrefix(command, "RCPT TO:"):
+			s.mu.Lock()
+			s.to = append(s.to, pathOf(line))
+			s.mu.Unlock()
+			reply("250 ok\r\n")
+		case command == "DATA":
+			reply("354 go ahead\r\n")
+			var data strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			s.mu.Lock()
+			s.data = data.String()
+			s.mu.Unlock()
+			reply("250 queued\r\n")
+		case command == "QUIT":
+			reply("221 bye\r\n")
+			return
+		default:
+			reply("502 not implemented\r\n")
+		}
+	}
+}
+
+/*
+MAIL FROM:<a@b> BODY=8BITMIME 中尖括号里的地址
+*/
+func pathOf(line string) string {
+	_, rest, _ := strings.Cut(line, "<")
+	path, _, _ := strings.Cut(rest, ">")
+	return path
+}
+
+func testReport() *ca.ExpiryReport {
+	now := time.Now()
+	cert := &ca.ExpiringCertificate{Kind: ca.KindLeaf, ID: "2006-01-02_15-04-05-api", Subject: "CN=api", SerialNumber: "0a", NotBefore: now.Add(-24 * time.Hour), NotAfter: now.Add(time.Hour)}
+	return &ca.ExpiryReport{
+		Time:     now,
+		Notices:  []*ca.ExpiryNotice{{Certificate: cert, Threshold: 24 * time.Hour, Remaining: time.Hour}},
+		Expiring: []*ca.ExpiringCertificate{cert},
+	}
+}
+
+func TestSMTPNotify(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name    string
+		hang    bool
+		ctx     context.Context
+		report  *ca.ExpiryReport
+		wantErr error
+	}{
+		{name: "delivered", ctx: context.Background(), report: testReport()},
+		{name: "no notices", hang: true, ctx: context.Background(), report: &ca.ExpiryReport{Time: time.Now()}},
+		{name: "server never answers", hang: true, ctx: context.Background(), report: testReport(), wantErr: context.DeadlineExceeded},
+		{name: "canceled", ctx: canceled, report: testReport(), wantErr: context.Canceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeSMTP(t, tt.hang)
+			mail, err := NewSMTP(SMTPOptions{
+				Address: server.listener.Addr().String(),
+				From:    "ca@example.com",
+				To:      []string{"ops@example.com", "sec@example.com"},
+				Timeout: 500 * time.Millisecond,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			start := time.Now()
+			err = mail.Notify(tt.ctx, tt.report)
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("Notify took %v", elapsed)
+			}
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tt.report.Notices) == 0 {
+				return
+			}
+			server.mu.Lock()
+			defer server.mu.Unlock()
+			if server.from != "ca@example.com" || strings.Join(server.to, ",") != "ops@example.com,sec@example.com" {
+				t.Errorf("envelope from %v to %v", server.from, server.to)
+			}
+			if !strings.Contains(server.data, "Subject: [sidecar] 1 certificate(s) expiring") || !strings.Contains(server.data, "2006-01-02_15-04-05-api") {
+				t.Errorf("unexpected message:\n%v", server.data)
+			}
+		})
+	}
+}
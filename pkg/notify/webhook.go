@@ -0,0 +1,75 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+	"github.com/jackyzhangfudan/sidecar/pkg/webhook"
+)
+
+/*
+把到期通知以json POST到一个URL，返回2xx才算送达
+不签名、不排队，需要签名和重试的用 --webhook-config（见 pkg/webhook）
+*/
+type Webhook struct {
+	URL    string
+	Client *http.Client
+}
+
+func NewWebhook(url string, timeout time.Duration) *Webhook {
+	return &Webhook{URL: url, Client: &http.Client{Timeout: timeout}}
+}
+
+/*
+webhook收到的json
+*/
+type WebhookPayload struct {
+	Type    string          `json:"type"`
+	Time    time.Time       `json:"time"`
+	Notices []WebhookNotice `json:"notices"`
+}
+
+type WebhookNotice struct {
+	*ca.ExpiringCertificate
+	ThresholdSeconds int64 `json:"thresholdSeconds"`
+	RemainingSeconds int64 `json:"remainingSeconds"` //小于等于0表示已经过期
+}
+
+func (w *Webhook) Name() string { return "webhook:" + w.URL }
+
+func (w *Webhook) Notify(ctx context.Context, report *ca.ExpiryReport) error {
+	if len(report.Notices) == 0 {
+		return nil
+	}
+	payload := WebhookPayload{Type: webhook.EventExpiring, Time: report.Time}
+	for _, notice := range report.Notices {
+		payload.Notices = append(payload.Notices, WebhookNotice{
+			ExpiringCertificate: notice.Certificate,
+			ThresholdSeconds:    int64(notice.Threshold / time.Second),
+			RemainingSeconds:    int64(notice.Remaining / time.Second),
+		})
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%v returned %v", w.URL, resp.Status)
+	}
+	return nil
+}
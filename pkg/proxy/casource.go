@@ -0,0 +1,257 @@
+package proxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	cx509 "crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	mygrpc "github.com/jackyzhangfudan/sidecar/pkg/grpc"
+	"github.com/youmark/pkcs8"
+	googlegrpc "google.golang.org/grpc"
+	grpccredentials "google.golang.org/grpc/credentials"
+)
+
+const (
+	retryInterval time.Duration = 5 * time.Second
+
+	stateCertFile   string = "cert.pem"
+	stateKeyFile    string = "key.pem"
+	stateBundleFile string = "bundle.pem"
+	stateIDFile     string = "id"
+)
+
+/*
+通过CA的gRPC API拿证书：第一次用join token申请，之后用当前的证书做mTLS续签
+*/
+type CAOptions struct {
+	Address    string   //CA的gRPC地址
+	ServerName string   //CA证书中的名字
+	BundleFile string   //还没有证书时，用来验证CA的根证书（PEM）
+	JoinToken  string   //申请第一张证书用的join token
+	CommonName string   //申请的证书的CN
+	DNSNames   []string //申请的证书的DNS名
+	StateDir   string   //保存证书和私钥，重启之后不用再申请
+}
+
+type caSource struct {
+	credentials
+	opts CAOptions
+	id   string //当前证书的id，续签时用
+}
+
+func NewCASource(opts CAOptions) Source {
+	return &caSource{credentials: newCredentials(), opts: opts}
+}
+
+func (s *caSource) Run(stopCh <-chan struct{}) {
+	ctx, cancel := contextOf(stopCh)
+	defer cancel()
+
+	if err := s.loadState(); err != nil {
+		log.Printf("no usable certificate in %v: %v", s.opts.StateDir, err)
+	}
+	for {
+		var wait time.Duration
+		cert := s.Certificate()
+		switch {
+		case cert == nil || time.Now().After(cert.Leaf.NotAfter):
+			if err := s.enroll(ctx); err != nil {
+				log.Printf("enroll with the join token fail, retry in %v: %v", retryInterval, err)
+				wait = retryInterval
+			}
+		case time.Now().After(renewTime(cert.Leaf)):
+			if err := s.renew(ctx); err != nil {
+				log.Printf("renew certificate %v fail, retry in %v: %v", s.id, retryInterval, err)
+				wait = retryInterval
+			}
+		default:
+			wait = time.Until(renewTime(cert.Leaf))
+		}
+		if wait <= 0 {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+/*
+证书过了2/3的有效期就续签
+*/
+func renewTime(cert *cx509.Certificate) time.Time {
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	return cert.NotBefore.Add(lifetime * 2 / 3)
+}
+
+func (s *caSource) enroll(ctx context.Context) error {
+	if s.opts.JoinToken == "" {
+		return fmt.Errorf("no join token to request the first certificate")
+	}
+	bundle, err := os.ReadFile(s.opts.BundleFile)
+	if err != nil {
+		return err
+	}
+	roots := cx509.NewCertPool()
+	if !roots.AppendCertsFromPEM(bundle) {
+		return fmt.Errorf("no certificate in %v", s.opts.BundleFile)
+	}
+
+	conn, err := s.dial(ctx, &tls.Config{ServerName: s.opts.ServerName, RootCAs: roots})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	resp, err := mygrpc.NewCertificateServiceClient(conn).Enroll(ctx, &mygrpc.EnrollRequest{
+		Token: s.opts.JoinToken,
+		Csr:   &mygrpc.CertificateSigningRequest{SubjectCommonName: s.opts.CommonName, DNSNames: s.opts.DNSNames},
+	})
+	if err != nil {
+		return err
+	}
+	cert, err := tls.X509KeyPair(resp.Certificate, resp.PrivateKey)
+	if err != nil {
+		return err
+	}
+	return s.update(resp.CertificateId, &cert, resp.PrivateKey, resp.Chain)
+}
+
+/*
+用当前的证书做mTLS，续签后取回新的证书和私钥，以及最新的trust bundle
+*/
+func (s *caSource) renew(ctx context.Context) error {
+	conn, err := s.dial(ctx, &tls.Config{
+		ServerName:   s.opts.ServerName,
+		RootCAs:      s.Roots(),
+		Certificates: []tls.Certificate{*s.Certificate()},
+	})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	client := mygrpc.NewCertificateServiceClient(conn)
+
+	signed, err := client.RenewCert(ctx, &mygrpc.FileIdentifer{Id: s.id})
+	if err != nil {
+		return err
+	}
+	certPEM, err := client.GetCert(ctx, &mygrpc.FileIdentifer{Id: signed.CertificateId})
+	if err != nil {
+		return err
+	}
+	encryptedKey, err := client.GetKey(ctx, &mygrpc.FileIdentifer{Id: signed.CertificateId})
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(encryptedKey.Contents)
+	if block == nil {
+		return fmt.Errorf("private key of %v is not PEM encoded", signed.CertificateId)
+	}
+	key, err := pkcs8.ParsePKCS8PrivateKey(block.Bytes, []byte(signed.KeySecret))
+	if err != nil {
+		return err
+	}
+	keyDER, err := cx509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	cert, err := tls.X509KeyPair(certPEM.Contents, keyPEM)
+	if err != nil {
+		return err
+	}
+	bundle, err := client.GetTrustBundle(ctx, &mygrpc.TrustBundleRequest{Format: mygrpc.BundleFormat_PEM})
+	if err != nil {
+		return err
+	}
+	return s.update(signed.CertificateId, &cert, keyPEM, bundle.Contents)
+}
+
+func (s *caSource) dial(ctx context.Context, config *tls.Config) (*googlegrpc.ClientConn, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	return googlegrpc.DialContext(ctx, s.opts.Address, googlegrpc.WithTransportCredentials(grpccredentials.NewTLS(config)), googlegrpc.WithBlock())
+}
+
+func (s *caSource) update(id string, cert *tls.Certificate, keyPEM []byte, bundlePEM []byte) error {
+	leaf, err := cx509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	cert.Leaf = leaf
+	roots := cx509.NewCertPool()
+	if !roots.AppendCertsFromPEM(bundlePEM) {
+		return fmt.Errorf("no certificate in the trust bundle")
+	}
+
+	s.id = id
+	s.set(cert, roots)
+	log.Printf("got certificate %v for %v, expires at %v", id, leaf.Subject.CommonName, leaf.NotAfter)
+	if err := s.saveState(cert, keyPEM, bundlePEM); err != nil {
+		log.Printf("save certificate to %v fail: %v", s.opts.StateDir, err)
+	}
+	return nil
+}
+
+func (s *caSource) saveState(cert *tls.Certificate, keyPEM []byte, bundlePEM []byte) error {
+	if s.opts.StateDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(s.opts.StateDir, 0700); err != nil {
+		return err
+	}
+	var certPEM []byte
+	for _, der := range cert.Certificate {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	files := map[string][]byte{stateCertFile: certPEM, stateKeyFile: keyPEM, stateBundleFile: bundlePEM, stateIDFile: []byte(s.id)}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(s.opts.StateDir, name), contents, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *caSource) loadState() error {
+	if s.opts.StateDir == "" {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(filepath.Join(s.opts.StateDir, stateCertFile), filepath.Join(s.opts.StateDir, stateKeyFile))
+	if err != nil {
+		return err
+	}
+	if cert.Leaf, err = cx509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return err
+	}
+	if _, ok := cert.PrivateKey.(crypto.Signer); !ok {
+		return fmt.Errorf("private key can't sign")
+	}
+	bundle, err := os.ReadFile(filepath.Join(s.opts.StateDir, stateBundleFile))
+	if err != nil {
+		return err
+	}
+	id, err := os.ReadFile(filepath.Join(s.opts.StateDir, stateIDFile))
+	if err != nil {
+		return err
+	}
+	roots := cx509.NewCertPool()
+	if !roots.AppendCertsFromPEM(bundle) {
+		return fmt.Errorf("no certificate in the saved trust bundle")
+	}
+	if time.Now().After(cert.Leaf.NotAfter) {
+		return fmt.Errorf("the saved certificate expired at %v", cert.Leaf.NotAfter)
+	}
+	s.id = string(id)
+	s.set(&cert, roots)
+	return nil
+}
@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+)
+
+/*
+续签拿到新证书之后，入站代理的新连接马上用上新证书，不用重启；新证书也保存到StateDir中
+*/
+func TestCASourceRotation(t *testing.T) {
+	client := issue(t, "", "client")
+	stateDir := t.TempDir()
+	source := NewCASource(CAOptions{StateDir: stateDir}).(*caSource)
+	addr := startInbound(t, InboundOptions{Upstream: echoUpstream(t), Mode: ModeHTTP}, source)
+	bundle := ca.CA.CurrentTrustBundle().PEM()
+
+	tests := []struct {
+		name string
+		cert *issued
+	}{
+		{name: "enrolled certificate", cert: issue(t, "", "proxy", "localhost")},
+		{name: "renewed certificate", cert: issue(t, "", "proxy", "localhost")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := source.update(tt.cert.id, tt.cert.cert, tt.cert.keyPEM, bundle); err != nil {
+				t.Fatal(err)
+			}
+			resp, err := mtlsClient(client.cert, false).Get("https://" + addr + "/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %v", resp.StatusCode)
+			}
+			if got, want := resp.TLS.PeerCertificates[0].SerialNumber, tt.cert.cert.Leaf.SerialNumber; got.Cmp(want) != 0 {
+				t.Errorf("proxy served serial %x, want %x", got, want)
+			}
+
+			restarted := NewCASource(CAOptions{StateDir: stateDir}).(*caSource)
+			if err := restarted.loadState(); err != nil {
+				t.Fatal(err)
+			}
+			if restarted.id != tt.cert.id || !restarted.Certificate().Leaf.Equal(tt.cert.cert.Leaf) {
+				t.Errorf("saved state has %v, want %v", restarted.id, tt.cert.id)
+			}
+		})
+	}
+}
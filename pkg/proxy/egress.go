@@ -0,0 +1,284 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+/*
+出站代理的配置：应用用明文访问本地的端口或者主机名，代理用workload的证书向上游发起mTLS
+*/
+type EgressConfig struct {
+	//按主机名转发的HTTP监听地址，应用把它设为HTTP_PROXY，或者直接请求它并带上Host头
+	Listen string        `json:"listen,omitempty"`
+	Routes []EgressRoute `json:"routes"`
+}
+
+/*
+一个上游服务。Listen和Host至少设置一个：
+Listen 是专用的本地端口，字节流原样通过mTLS转发，任何基于TCP的协议都可以用；
+Host 是主机名，发到EgressConfig.Listen的HTTP请求按Host头选择route
+*/
+type EgressRoute struct {
+	Name       string           `json:"name"`
+	Listen     string           `json:"listen,omitempty"`
+	Host       string           `json:"host,omitempty"`
+	Upstream   string           `json:"upstream"`             //上游sidecar的mTLS地址，host:port
+	ServerName string           `json:"serverName,omitempty"` //SNI，默认是Upstream中的host
+	Expect     ExpectedIdentity `json:"expect,omitempty"`     //上游证书应该具有的身份
+	ALPN       []string         `json:"alpn,omitempty"`       //只用于Listen，例如应用说h2c时设为["h2"]
+}
+
+func LoadEgressConfig(file string) (*EgressConfig, error) {
+	contents, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var config EgressConfig
+	if err := json.Unmarshal(contents, &config); err != nil {
+		return nil, fmt.Errorf("can't parse %v: %v", file, err)
+	}
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid egress config %v: %v", file, err)
+	}
+	return &config, nil
+}
+
+func (c *EgressConfig) validate() error {
+	names := map[string]bool{}
+	hosts := map[string]bool{}
+	for i := range c.Routes {
+		route := &c.Routes[i]
+		if route.Name == "" {
+			route.Name = fmt.Sprintf("route-%d", i)
+		}
+		if names[route.Name] {
+			return fmt.Errorf("duplicated route name %v", route.Name)
+		}
+		names[route.Name] = true
+		host, _, err := net.SplitHostPort(route.Upstream)
+		if err != nil {
+			return fmt.Errorf("upstream of route %v should be host:port: %v", route.Name, err)
+		}
+		if route.ServerName == "" {
+			route.ServerName = host
+		}
+		if route.Listen == "" && route.Host == "" {
+			return fmt.Errorf("route %v needs listen or host", route.Name)
+		}
+		if route.Host != "" {
+			if c.Listen == "" {
+				return fmt.Errorf("route %v routes by host, but the egress listen address is not set", route.Name)
+			}
+			route.Host = strings.ToLower(route.Host)
+			if hosts[route.Host] {
+				return fmt.Errorf("host %v is used by more than one route", route.Host)
+			}
+			hosts[route.Host] = true
+		}
+	}
+	return nil
+}
+
+/*
+一个route的上游连接，所有连接都计入metrics
+*/
+type egressUpstream struct {
+	route   EgressRoute
+	tls     *tls.Config
+	metrics *egressMetrics
+}
+
+func newEgressUpstream(route EgressRoute, alpn []string, source Source, metrics *egressMetrics) *egressUpstream {
+	u := &egressUpstream{route: route, metrics: metrics}
+	u.tls = clientTLSConfig(source, route.ServerName, route.Expect, alpn, func(err error) {
+		if err != nil {
+			log.Printf("egress route %v: reject upstream %v: %v", route.Name, route.Upstream, err)
+			metrics.connection(route.Name, "rejected")
+			return
+		}
+		metrics.connection(route.Name, "ok")
+	})
+	return u
+}
+
+func (u *egressUpstream) dial(ctx context.Context) (net.Conn, error) {
+	d := net.Dialer{Timeout: 10 * time.Second}
+	conn, err := d.DialContext(ctx, "tcp", u.route.Upstream)
+	if err != nil {
+		u.metrics.connection(u.route.Name, "dial_failed")
+		return nil, err
+	}
+	return u.metrics.count(conn, u.route.Name), nil
+}
+
+/*
+启动出站代理直到stopCh关闭，要在source拿到证书之后调用
+*/
+func RunEgress(config *EgressConfig, source Source, stopCh <-chan struct{}) error {
+	metrics, err := newEgressMetrics()
+	if err != nil {
+		return err
+	}
+
+	errCh := make(chan error, len(config.Routes)+1)
+	hostRoutes := map[string]*egressUpstream{}
+	for _, route := range config.Routes {
+		if route.Host != "" {
+			hostRoutes[route.Host] = newEgressUpstream(route, []string{"h2", "http/1.1"}, source, metrics)
+		}
+		if route.Listen != "" {
+			lis, err := net.Listen("tcp", route.Listen)
+			if err != nil {
+				return err
+			}
+			log.Printf("egress route %v listening at %v, forward to %v", route.Name, lis.Addr(), route.Upstream)
+			upstream := newEgressUpstream(route, route.ALPN, source, metrics)
+			go func() { errCh <- serveEgressTCP(lis, upstream, stopCh) }()
+		}
+	}
+	if len(hostRoutes) > 0 {
+		lis, err := net.Listen("tcp", config.Listen)
+		if err != nil {
+			return err
+		}
+		log.Printf("egress proxy listening at %v for %d host(s)", lis.Addr(), len(hostRoutes))
+		go func() { errCh <- serveEgressHTTP(lis, hostRoutes, stopCh) }()
+	}
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-stopCh:
+		return nil
+	}
+}
+
+func serveEgressTCP(lis net.Listener, upstream *egressUpstream, stopCh <-chan struct{}) error {
+	go func() {
+		<-stopCh
+		lis.Close()
+	}()
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			select {
+			case <-stopCh:
+				return nil
+			default:
+			}
+			return err
+		}
+		go upstream.forward(conn.(*net.TCPConn))
+	}
+}
+
+func (u *egressUpstream) forward(conn *net.TCPConn) {
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	raw, err := u.dial(ctx)
+	if err != nil {
+		log.Printf("egress route %v: connect to %v fail: %v", u.route.Name, u.route.Upstream, err)
+		return
+	}
+	upstream := tls.Client(raw, u.tls)
+	defer upstream.Close()
+	if err := upstream.HandshakeContext(ctx); err != nil {
+		//证书没有通过验证的已经在VerifyConnection中记录过了
+		var verr *verifyError
+		if !errors.As(err, &verr) {
+			u.metrics.connection(u.route.Name, "tls_failed")
+		}
+		log.Printf("egress route %v: tls handshake with %v fail: %v", u.route.Name, u.route.Upstream, err)
+		return
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, conn)
+		upstream.CloseWrite()
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, upstream)
+		conn.CloseWrite()
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+}
+
+func serveEgressHTTP(lis net.Listener, routes map[string]*egressUpstream, stopCh <-chan struct{}) error {
+	proxies := map[string]http.Handler{}
+	for host, upstream := range routes {
+		proxies[host] = upstream.reverseProxy()
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect {
+			//应用自己做TLS时代理就没法换成mTLS了
+			http.Error(w, "CONNECT is not supported, send plaintext requests to the egress proxy", http.StatusMethodNotAllowed)
+			return
+		}
+		host := strings.ToLower(r.Host)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		proxy, ok := proxies[host]
+		if !ok {
+			http.Error(w, "no egress route for host "+host, http.StatusNotFound)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	})
+
+	server := &http.Server{Handler: otelhttp.NewHandler(handler, "sidecar-egress"), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-stopCh
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+	if err := server.Serve(lis); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+/*
+转发到一个上游的反向代理，和上游之间按ALPN协商使用HTTP/2或HTTP/1.1
+*/
+func (u *egressUpstream) reverseProxy() http.Handler {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return u.dial(ctx)
+		},
+		TLSClientConfig:     u.tls,
+		ForceAttemptHTTP2:   true,
+		TLSHandshakeTimeout: 10 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	return &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.URL.Scheme = "https"
+			r.URL.Host = u.route.Upstream
+			r.Host = ""
+		},
+		Transport:     otelhttp.NewTransport(transport),
+		FlushInterval: -1,
+		ErrorLog:      log.Default(),
+	}
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+/*
+出站代理 → 入站代理 → 应用，上游的身份不符合Expect时不转发
+*/
+func TestEgressIdentity(t *testing.T) {
+	backend := issue(t, "spiffe://example.org/backend", "backend", "localhost")
+	upstream := startInbound(t, InboundOptions{Upstream: echoUpstream(t), Mode: ModeHTTP}, newStaticSource(backend.cert))
+	source := newStaticSource(issue(t, "spiffe://example.org/frontend", "frontend").cert)
+	metrics, err := newEgressMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		serverName string
+		expect     ExpectedIdentity
+		tcp        bool
+		wantOK     bool
+	}{
+		{name: "expected SPIFFE ID", expect: ExpectedIdentity{SPIFFEIDs: []string{"spiffe://example.org/backend"}}, wantOK: true},
+		{name: "unexpected SPIFFE ID", expect: ExpectedIdentity{SPIFFEIDs: []string{"spiffe://example.org/payments"}}},
+		{name: "expected DNS name", expect: ExpectedIdentity{DNSNames: []string{"localhost"}}, wantOK: true},
+		{name: "unexpected DNS name", expect: ExpectedIdentity{DNSNames: []string{"payments.local"}}},
+		{name: "server name", serverName: "localhost", wantOK: true},
+		{name: "wrong server name", serverName: "payments.local"},
+		{name: "tcp route with expected SPIFFE ID", expect: ExpectedIdentity{SPIFFEIDs: []string{"spiffe://example.org/backend"}}, tcp: true, wantOK: true},
+		{name: "tcp route with unexpected SPIFFE ID", expect: ExpectedIdentity{SPIFFEIDs: []string{"spiffe://example.org/payments"}}, tcp: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverName := tt.serverName
+			if serverName == "" {
+				serverName = "127.0.0.1"
+			}
+			route := EgressRoute{Name: "backend", Host: "backend.local", Upstream: upstream, ServerName: serverName, Expect: tt.expect}
+			lis, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			stopCh := make(chan struct{})
+			defer close(stopCh)
+			if tt.tcp {
+				go serveEgressTCP(lis, newEgressUpstream(route, nil, source, metrics), stopCh)
+			} else {
+				routes := map[string]*egressUpstream{route.Host: newEgressUpstream(route, []string{"h2", "http/1.1"}, source, metrics)}
+				go serveEgressHTTP(lis, routes, stopCh)
+			}
+
+			req, _ := http.NewRequest(http.MethodGet, "http://"+lis.Addr().String()+"/", nil)
+			req.Host = "backend.local"
+			resp, err := (&http.Client{Transport: &http.Transport{DisableKeepAlives: true}}).Do(req)
+			if err != nil {
+				if tt.wantOK || !tt.tcp {
+					t.Fatal(err)
+				}
+				return
+			}
+			resp.Body.Close()
+			if ok := resp.StatusCode == http.StatusOK; ok != tt.wantOK {
+				t.Fatalf("status = %v, wantOK %v", resp.StatusCode, tt.wantOK)
+			}
+			if tt.wantOK {
+				if got := resp.Header.Get("X-Seen-Spiffe-Id"); got != "spiffe://example.org/frontend" {
+					t.Errorf("upstream saw SPIFFE ID %q", got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	cx509 "crypto/x509"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+/*
+代理转发给本地应用的header，描述mTLS对端的身份
+应用只能从代理收到请求，客户端自己带来的同名header会先被删掉
+*/
+const (
+	//Envoy的格式：Hash=<sha256>;Subject="<DN>";URI=<SAN URI>;DNS=<SAN DNS>
+	HeaderForwardedClientCert string = "X-Forwarded-Client-Cert"
+	HeaderPeerSubject         string = "X-Peer-Subject"
+	HeaderPeerSANs            string = "X-Peer-Sans"
+	HeaderPeerSPIFFEID        string = "X-Peer-Spiffe-Id"
+)
+
+/*
+对端证书表示的身份
+*/
+type PeerIdentity struct {
+	Subject  string
+	SANs     []string //DNS:<name>, IP:<ip>, URI:<uri>, email:<address>
+	SPIFFEID string   //证书中的spiffe:// URI，没有时为空
+	Serial   string   //证书序列号，十六进制
+	Hash     string   //证书DER的sha256，十六进制
+}
+
+func identityOf(cert *cx509.Certificate) PeerIdentity {
+	sum := sha256.Sum256(cert.Raw)
+	id := PeerIdentity{Subject: cert.Subject.String(), Serial: cert.SerialNumber.Text(16), Hash: hex.EncodeToString(sum[:])}
+	for _, uri := range cert.URIs {
+		id.SANs = append(id.SANs, "URI:"+uri.String())
+		if uri.Scheme == "spiffe" && id.SPIFFEID == "" {
+			id.SPIFFEID = uri.String()
+		}
+	}
+	for _, dns := range cert.DNSNames {
+		id.SANs = append(id.SANs, "DNS:"+dns)
+	}
+	for _, ip := range cert.IPAddresses {
+		id.SANs = append(id.SANs, "IP:"+ip.String())
+	}
+	for _, email := range cert.EmailAddresses {
+		id.SANs = append(id.SANs, "email:"+email)
+	}
+	return id
+}
+
+func (id PeerIdentity) String() string {
+	if id.SPIFFEID != "" {
+		return id.SPIFFEID
+	}
+	return id.Subject
+}
+
+/*
+去掉客户端伪造的身份header，换成mTLS握手得到的身份
+*/
+func setIdentityHeaders(header http.Header, cert *cx509.Certificate) {
+	for _, name := range []string{HeaderForwardedClientCert, HeaderPeerSubject, HeaderPeerSANs, HeaderPeerSPIFFEID} {
+		header.Del(name)
+	}
+	if cert == nil {
+		return
+	}
+	id := identityOf(cert)
+	id.Subject = headerValue(id.Subject)
+	for i := range id.SANs {
+		id.SANs[i] = headerValue(id.SANs[i])
+	}
+
+	xfcc := []string{"Hash=" + id.Hash, "Subject=" + quote(id.Subject)}
+	for _, uri := range cert.URIs {
+		xfcc = append(xfcc, "URI="+headerValue(uri.String()))
+	}
+	for _, dns := range cert.DNSNames {
+		xfcc = append(xfcc, "DNS="+headerValue(dns))
+	}
+	header.Set(HeaderForwardedClientCert, strings.Join(xfcc, ";"))
+	header.Set(HeaderPeerSubject, id.Subject)
+	if len(id.SANs) > 0 {
+		header.Set(HeaderPeerSANs, strings.Join(id.SANs, ", "))
+	}
+	if id.SPIFFEID != "" {
+		header.Set(HeaderPeerSPIFFEID, id.SPIFFEID)
+	}
+}
+
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+/*
+证书中的字符串可以包含任意字符，header中不能有控制字符
+*/
+func headerValue(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return '?'
+		}
+		return r
+	}, s)
+}
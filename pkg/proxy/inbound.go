@@ -0,0 +1,246 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"golang.org/x/net/http2"
+)
+
+const (
+	ModeHTTP string = "http" //按HTTP/1.1或HTTP/2转发，注入对端身份的header
+	ModeTCP  string = "tcp"  //原样转发TCP字节流
+)
+
+/*
+入站代理：在Listen上终止mTLS，把明文转发给本地应用
+*/
+type InboundOptions struct {
+	Listen      string  //对外的mTLS地址
+	Upstream    string  //本地应用的地址，例如127.0.0.1:8080
+	Mode        string  //ModeHTTP或ModeTCP
+	UpstreamH2C bool    //本地应用使用明文HTTP/2（h2c），例如gRPC服务
+	Policy      *Policy //为nil时不做授权
+}
+
+/*
+启动入站代理直到stopCh关闭，要在source拿到证书之后调用
+*/
+func RunInbound(opts InboundOptions, source Source, stopCh <-chan struct{}) error {
+	if opts.Mode != ModeHTTP && opts.Mode != ModeTCP {
+		return fmt.Errorf("unknown proxy mode %v, should be %v or %v", opts.Mode, ModeHTTP, ModeTCP)
+	}
+	lis, err := net.Listen("tcp", opts.Listen)
+	if err != nil {
+		return err
+	}
+	lis = tls.NewListener(lis, serverTLSConfig(source, opts.Mode))
+	log.Printf("proxy listening at %v, mode %v, forward to %v", lis.Addr(), opts.Mode, opts.Upstream)
+
+	if opts.Mode == ModeTCP {
+		return serveTCP(lis, opts, stopCh)
+	}
+	return serveHTTP(lis, opts, stopCh)
+}
+
+/*
+每次握手都取source当前的证书和根证书，证书轮换之后新的连接马上用上新证书
+*/
+func serverTLSConfig(source Source, mode string) *tls.Config {
+	protos := []string{"h2", "http/1.1"}
+	if mode == ModeTCP {
+		protos = nil
+	}
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert := source.Certificate()
+			if cert == nil {
+				return nil, fmt.Errorf("no certificate yet")
+			}
+			return &tls.Config{
+				Certificates: []tls.Certificate{*cert},
+				ClientAuth:   tls.RequireAndVerifyClientCert,
+				ClientCAs:    source.Roots(),
+				NextProtos:   protos,
+				MinVersion:   tls.VersionTLS12,
+			}, nil
+		},
+	}
+}
+
+func serveHTTP(lis net.Listener, opts InboundOptions, stopCh <-chan struct{}) error {
+	target := &url.URL{Scheme: "http", Host: opts.Upstream}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.FlushInterval = -1 //流式的响应（SSE、gRPC stream）马上转发
+	var transport http.RoundTripper = http.DefaultTransport
+	if opts.UpstreamH2C {
+		transport = &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			},
+		}
+	}
+	proxy.Transport = otelhttp.NewTransport(transport)
+
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		//到这里的请求一定完成了mTLS握手
+		setIdentityHeaders(r.Header, r.TLS.PeerCertificates[0])
+	}
+
+	server := &http.Server{
+		Handler:           otelhttp.NewHandler(authorizeHandler(opts.Policy, proxy), "sidecar-proxy"), //客户端用ALPN协商h2时按HTTP/2服务
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-stopCh
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+	if err := server.Serve(lis); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+/*
+按策略授权每个请求，gRPC请求被拒绝时返回PermissionDenied，其它请求返回403
+*/
+func authorizeHandler(policy *Policy, next http.Handler) http.Handler {
+	if policy == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := cleanPath(r.URL); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cert := r.TLS.PeerCertificates[0]
+		req := &policyRequest{cert: cert, id: identityOf(cert), http: true, method: r.Method, path: r.URL.Path}
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			req.grpc = strings.TrimPrefix(r.URL.Path, "/")
+		}
+		if policy.authorize(req) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if req.grpc != "" {
+			//只有header的gRPC响应，grpc-status 7 是 PermissionDenied
+			w.Header().Set("Content-Type", "application/grpc")
+			w.Header().Set("Grpc-Status", "7")
+			w.Header().Set("Grpc-Message", "denied by the proxy policy")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		http.Error(w, "denied by the proxy policy", http.StatusForbidden)
+	})
+}
+
+/*
+策略检查的路径就是转发给本地应用的路径：先清理掉 //、/./，转发时也用清理后的路径；
+含有..或编码的斜杠（%2F、%5C）的路径直接拒绝，否则 /public/../admin 按 /public/* 放行后，应用会把它当成 /admin
+*/
+func cleanPath(u *url.URL) error {
+	escaped := strings.ToLower(u.EscapedPath())
+	if strings.Contains(escaped, "%2f") || strings.Contains(escaped, "%5c") || strings.Contains(u.Path, `\`) {
+		return fmt.Errorf("encoded slash in path %v", u.EscapedPath())
+	}
+	for _, segment := range strings.Split(u.Path, "/") {
+		if segment == ".." {
+			return fmt.Errorf("'..' in path %v", u.EscapedPath())
+		}
+	}
+	if !strings.HasPrefix(u.Path, "/") {
+		return nil //OPTIONS *
+	}
+	cleaned := path.Clean(u.Path)
+	if strings.HasSuffix(u.Path, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	if cleaned != u.Path {
+		u.Path, u.RawPath = cleaned, ""
+	}
+	return nil
+}
+
+func serveTCP(lis net.Listener, opts InboundOptions, stopCh <-chan struct{}) error {
+	var conns sync.Map
+	go func() {
+		<-stopCh
+		lis.Close()
+		conns.Range(func(conn, _ interface{}) bool {
+			conn.(net.Conn).Close()
+			return true
+		})
+	}()
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			select {
+			case <-stopCh:
+				return nil
+			default:
+			}
+			return err
+		}
+		conns.Store(conn, nil)
+		go func() {
+			defer conns.Delete(conn)
+			forwardTCP(conn.(*tls.Conn), opts.Upstream, opts.Policy)
+		}()
+	}
+}
+
+func forwardTCP(conn *tls.Conn, upstream string, policy *Policy) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := conn.Handshake(); err != nil {
+		log.Printf("tls handshake with %v fail: %v", conn.RemoteAddr(), err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	cert := conn.ConnectionState().PeerCertificates[0]
+	peer := identityOf(cert)
+	if !policy.authorize(&policyRequest{cert: cert, id: peer}) {
+		return
+	}
+
+	backend, err := net.DialTimeout("tcp", upstream, 10*time.Second)
+	if err != nil {
+		log.Printf("connect to %v for %v fail: %v", upstream, peer, err)
+		return
+	}
+	defer backend.Close()
+	log.Printf("tcp connection from %v (%v, serial %v)", conn.RemoteAddr(), peer, peer.Serial)
+
+	//一个方向结束时半关闭另一边，让对方读到EOF
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(backend, conn)
+		backend.(*net.TCPConn).CloseWrite()
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, backend)
+		conn.CloseWrite()
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+}
@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+回显代理转发过来的身份header和协议
+*/
+func echoUpstream(t *testing.T) string {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Seen-Spiffe-Id", r.Header.Get(HeaderPeerSPIFFEID))
+		w.Header().Set("X-Seen-Subject", r.Header.Get(HeaderPeerSubject))
+		w.Header().Set("X-Seen-Path", r.URL.EscapedPath())
+	}))
+	t.Cleanup(upstream.Close)
+	return strings.TrimPrefix(upstream.URL, "http://")
+}
+
+func TestInboundRoundTrip(t *testing.T) {
+	server := issue(t, "spiffe://example.org/server", "server", "localhost")
+	client := issue(t, "spiffe://example.org/client", "client")
+	addr := startInbound(t, InboundOptions{Upstream: echoUpstream(t), Mode: ModeHTTP}, newStaticSource(server.cert))
+
+	tests := []struct {
+		name      string
+		client    *tls.Certificate
+		h2        bool
+		wantProto string
+		wantErr   bool
+	}{
+		{name: "HTTP/1.1", client: client.cert, wantProto: "HTTP/1.1"},
+		{name: "HTTP/2", client: client.cert, h2: true, wantProto: "HTTP/2.0"},
+		{name: "no client certificate", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, "https://"+addr+"/hello", nil)
+			//客户端伪造的身份header要被换掉
+			req.Header.Set(HeaderPeerSPIFFEID, "spiffe://example.org/admin")
+			resp, err := mtlsClient(tt.client, tt.h2).Do(req)
+			if tt.wantErr {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatal("request without a client certificate succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.Proto != tt.wantProto {
+				t.Errorf("proto = %v, want %v", resp.Proto, tt.wantProto)
+			}
+			if got := resp.Header.Get("X-Seen-Spiffe-Id"); got != "spiffe://example.org/client" {
+				t.Errorf("upstream saw SPIFFE ID %q", got)
+			}
+			if got := resp.Header.Get("X-Seen-Subject"); got != "CN=client" {
+				t.Errorf("upstream saw subject %q", got)
+			}
+		})
+	}
+}
+
+/*
+策略检查的路径和转发给应用的路径一致，..和编码的斜杠不能绕过策略
+*/
+func TestInboundPathPolicy(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "policy.json")
+	writePolicy(t, file, `{"rules": [{"name": "public", "action": "allow", "paths": ["/public/*"]}]}`, time.Now())
+	policy, err := LoadPolicy(file, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := issue(t, "", "server", "localhost")
+	client := issue(t, "", "client")
+	addr := startInbound(t, InboundOptions{Upstream: echoUpstream(t), Mode: ModeHTTP, Policy: policy}, newStaticSource(server.cert))
+
+	tests := []struct {
+		path       string
+		wantStatus int
+		wantPath   string //应用收到的路径
+	}{
+		{path: "/public/a", wantStatus: http.StatusOK, wantPath: "/public/a"},
+		{path: "/public//a/./b/", wantStatus: http.StatusOK, wantPath: "/public/a/b/"},
+		{path: "/admin", wantStatus: http.StatusForbidden},
+		{path: "/public/../admin", wantStatus: http.StatusBadRequest},
+		{path: "/public/%2e%2e/admin", wantStatus: http.StatusBadRequest},
+		{path: "/public/..%2Fadmin", wantStatus: http.StatusBadRequest},
+		{path: "/public%2F..%2Fadmin", wantStatus: http.StatusBadRequest},
+		{path: "/public/a%5C..%5Cadmin", wantStatus: http.StatusBadRequest},
+		{path: "/public/a%20b", wantStatus: http.StatusOK, wantPath: "/public/a%20b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			resp, err := mtlsClient(client.cert, false).Get("https://" + addr + tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %v, want %v", resp.StatusCode, tt.wantStatus)
+			}
+			if got := resp.Header.Get("X-Seen-Path"); got != tt.wantPath {
+				t.Errorf("upstream saw path %q, want %q", got, tt.wantPath)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	cx509 "crypto/x509"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/jackyzhangfudan/sidecar/internal/catest"
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+	"github.com/youmark/pkcs8"
+)
+
+func TestMain(m *testing.M) {
+	catest.Main(m, func() error { return ca.CA.SetTrustDomain("example.org") })
+}
+
+/*
+测试CA签发的证书，spiffeID为空时签普通证书
+*/
+type issued struct {
+	id     string
+	cert   *tls.Certificate
+	keyPEM []byte
+}
+
+func issue(t *testing.T, spiffeID string, cn string, dnsNames ...string) *issued {
+	t.Helper()
+	ctx := ca.WithCaller(context.Background(), ca.LocalOperator)
+	csr := &ca.CertificateSigningRequest{SubjectCommonName: cn, DNSNames: dnsNames}
+	var signed *ca.Certificate
+	var err error
+	if spiffeID == "" {
+		signed, err = ca.CA.SignX509(ctx, csr)
+	} else {
+		signed, err = ca.CA.SignX509SVID(ctx, spiffeID, csr)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := ca.CA.LoadCertificate(signed.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := ca.CA.FetchKey(ctx, signed.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(encrypted)
+	key, err := pkcs8.ParsePKCS8PrivateKey(block.Bytes, []byte(signed.KeySecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := cx509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &issued{
+		id:     signed.ID,
+		cert:   &tls.Certificate{Certificate: [][]byte{leaf.Raw}, PrivateKey: key, Leaf: leaf},
+		keyPEM: pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}),
+	}
+}
+
+/*
+证书固定的Source
+*/
+type staticSource struct {
+	credentials
+}
+
+func newStaticSource(cert *tls.Certificate) *staticSource {
+	s := &staticSource{credentials: newCredentials()}
+	s.set(cert, ca.CA.CurrentTrustBundle().CertPool())
+	return s
+}
+
+func (s *staticSource) Run(<-chan struct{}) {}
+
+/*
+在随机端口上启动入站代理，返回它的地址
+*/
+func startInbound(t *testing.T, opts InboundOptions, source Source) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopCh := make(chan struct{})
+	t.Cleanup(func() { close(stopCh) })
+	lis = tls.NewListener(lis, serverTLSConfig(source, opts.Mode))
+	if opts.Mode == ModeTCP {
+		go serveTCP(lis, opts, stopCh)
+	} else {
+		go serveHTTP(lis, opts, stopCh)
+	}
+	return lis.Addr().String()
+}
+
+/*
+用client的证书访问入站代理的客户端，client为nil时不出示证书，h2为false时只用HTTP/1.1
+*/
+func mtlsClient(client *tls.Certificate, h2 bool) *http.Client {
+	config := &tls.Config{RootCAs: ca.CA.CurrentTrustBundle().CertPool(), ServerName: "localhost"}
+	if client != nil {
+		config.Certificates = []tls.Certificate{*client}
+	}
+	if !h2 {
+		config.NextProtos = []string{"http/1.1"}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: config, ForceAttemptHTTP2: h2}}
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+/*
+出站连接的metrics，按route区分
+*/
+type egressMetrics struct {
+	connections metric.Int64Counter       //result: ok, dial_failed, rejected, tls_failed
+	active      metric.Int64UpDownCounter //已经建立、还没有关闭的连接
+	bytes       metric.Int64Counter       //direction: sent, received，TLS加密之后的字节数
+}
+
+func newEgressMetrics() (*egressMetrics, error) {
+	meter := tracing.Meter()
+	m := &egressMetrics{}
+	var err error
+	if m.connections, err = meter.Int64Counter("sidecar.proxy.egress.connections",
+		metric.WithDescription("upstream connections opened by the egress proxy, result is ok, dial_failed, rejected or tls_failed")); err != nil {
+		return nil, err
+	}
+	if m.active, err = meter.Int64UpDownCounter("sidecar.proxy.egress.active",
+		metric.WithDescription("open upstream connections of the egress proxy")); err != nil {
+		return nil, err
+	}
+	if m.bytes, err = meter.Int64Counter("sidecar.proxy.egress.bytes", metric.WithUnit("By"),
+		metric.WithDescription("bytes sent to and received from upstreams, after TLS encryption")); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *egressMetrics) connection(route string, result string) {
+	m.connections.Add(context.Background(), 1, metric.WithAttributes(attribute.String("route", route), attribute.String("result", result)))
+}
+
+/*
+统计收发字节数的连接，关闭时减少active
+*/
+type countedConn struct {
+	net.Conn
+	route    attribute.KeyValue
+	metrics  *egressMetrics
+	closeOne sync.Once
+}
+
+func (m *egressMetrics) count(conn net.Conn, route string) net.Conn {
+	c := &countedConn{Conn: conn, route: attribute.String("route", route), metrics: m}
+	m.active.Add(context.Background(), 1, metric.WithAttributes(c.route))
+	return c
+}
+
+func (c *countedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.metrics.bytes.Add(context.Background(), int64(n), metric.WithAttributes(c.route, attribute.String("direction", "received")))
+	}
+	return n, err
+}
+
+func (c *countedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.metrics.bytes.Add(context.Background(), int64(n), metric.WithAttributes(c.route, attribute.String("direction", "sent")))
+	}
+	return n, err
+}
+
+func (c *countedConn) Close() error {
+	c.closeOne.Do(func() {
+		c.metrics.active.Add(context.Background(), -1, metric.WithAttributes(c.route))
+	})
+	return c.Conn.Close()
+}
@@ -0,0 +1,305 @@
+package proxy
+
+import (
+	"context"
+	cx509 "crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const (
+	ActionAllow string = "allow"
+	ActionDeny  string = "deny"
+)
+
+/*
+入站流量的授权策略：先看deny规则，匹配任何一条就拒绝；再看allow规则，匹配任何一条就放行；
+都不匹配时按DefaultAction（默认deny）。DryRun时只记录会被拒绝的请求，不真正拒绝
+*/
+type PolicyConfig struct {
+	DefaultAction string       `json:"defaultAction,omitempty"`
+	DryRun        bool         `json:"dryRun,omitempty"`
+	Rules         []PolicyRule `json:"rules"`
+}
+
+/*
+一条规则，各个条件之间是“且”，一个条件中的多个值之间是“或”，没有设置的条件匹配任何请求
+值以*结尾时按前缀匹配，例如 spiffe://example.org/ns/prod/*、/api/*、grpc.CertificateService/*
+*/
+type PolicyRule struct {
+	Name    string    `json:"name"`
+	Action  string    `json:"action"`
+	Peer    PeerMatch `json:"peer,omitempty"`
+	Methods []string  `json:"methods,omitempty"` //HTTP方法
+	Paths   []string  `json:"paths,omitempty"`   //HTTP路径
+	GRPC    []string  `json:"grpc,omitempty"`    //gRPC的 <service>/<method>，只匹配gRPC请求
+}
+
+/*
+对端证书的身份
+*/
+type PeerMatch struct {
+	CommonNames         []string `json:"commonNames,omitempty"`
+	SANs                []string `json:"sans,omitempty"` //DNS:<name>, IP:<ip>, URI:<uri>, email:<address>
+	SPIFFEIDs           []string `json:"spiffeIds,omitempty"`
+	OrganizationalUnits []string `json:"organizationalUnits,omitempty"`
+}
+
+/*
+要授权的请求；tcp模式下只有对端证书，带有HTTP或gRPC条件的规则不会匹配
+*/
+type policyRequest struct {
+	cert   *cx509.Certificate
+	id     PeerIdentity
+	http   bool
+	method string
+	path   string
+	grpc   string //gRPC请求的 <service>/<method>，不是gRPC请求时为空
+}
+
+/*
+授权的结果
+*/
+type decision struct {
+	allowed bool
+	dryRun  bool   //本来要拒绝，DryRun放行了
+	rule    string //匹配的规则，按DefaultAction决定时为空
+}
+
+func (c *PolicyConfig) validate() error {
+	switch c.DefaultAction {
+	case "":
+		c.DefaultAction = ActionDeny
+	case ActionAllow, ActionDeny:
+	default:
+		return fmt.Errorf("defaultAction should be %v or %v", ActionAllow, ActionDeny)
+	}
+	for i := range c.Rules {
+		rule := &c.Rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i)
+		}
+		if rule.Action != ActionAllow && rule.Action != ActionDeny {
+			return fmt.Errorf("action of rule %v should be %v or %v", rule.Name, ActionAllow, ActionDeny)
+		}
+		for j, method := range rule.Methods {
+			rule.Methods[j] = strings.ToUpper(method)
+		}
+		for _, name := range rule.GRPC {
+			if !strings.Contains(name, "/") {
+				return fmt.Errorf("grpc of rule %v should be <service>/<method>, got %v", rule.Name, name)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *PolicyConfig) evaluate(req *policyRequest) decision {
+	for _, action := range []string{ActionDeny, ActionAllow} {
+		for _, rule := range c.Rules {
+			if rule.Action == action && rule.matches(req) {
+				return c.decide(action, rule.Name)
+			}
+		}
+	}
+	return c.decide(c.DefaultAction, "")
+}
+
+func (c *PolicyConfig) decide(action string, rule string) decision {
+	if action == ActionAllow {
+		return decision{allowed: true, rule: rule}
+	}
+	return decision{allowed: c.DryRun, dryRun: c.DryRun, rule: rule}
+}
+
+func (r *PolicyRule) matches(req *policyRequest) bool {
+	if !r.Peer.matches(req.cert, req.id) {
+		return false
+	}
+	if len(r.Methods) > 0 || len(r.Paths) > 0 || len(r.GRPC) > 0 {
+		if !req.http {
+			return false
+		}
+	}
+	if len(r.Methods) > 0 && !matchAny(r.Methods, req.method) {
+		return false
+	}
+	if len(r.Paths) > 0 && !matchAny(r.Paths, req.path) {
+		return false
+	}
+	if len(r.GRPC) > 0 && (req.grpc == "" || !matchAny(r.GRPC, req.grpc)) {
+		return false
+	}
+	return true
+}
+
+func (m *PeerMatch) matches(cert *cx509.Certificate, id PeerIdentity) bool {
+	if len(m.CommonNames) > 0 && !matchAny(m.CommonNames, cert.Subject.CommonName) {
+		return false
+	}
+	if len(m.SPIFFEIDs) > 0 && (id.SPIFFEID == "" || !matchAny(m.SPIFFEIDs, id.SPIFFEID)) {
+		return false
+	}
+	if len(m.SANs) > 0 && !matchSome(m.SANs, id.SANs) {
+		return false
+	}
+	if len(m.OrganizationalUnits) > 0 && !matchSome(m.OrganizationalUnits, cert.Subject.OrganizationalUnit) {
+		return false
+	}
+	return true
+}
+
+func matchPattern(pattern string, value string) bool {
+	if prefix := strings.TrimSuffix(pattern, "*"); prefix != pattern {
+		return strings.HasPrefix(value, prefix)
+	}
+	return pattern == value
+}
+
+func matchAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if matchPattern(pattern, value) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+values中有任何一个匹配patterns
+*/
+func matchSome(patterns []string, values []string) bool {
+	for _, value := range values {
+		if matchAny(patterns, value) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+从文件加载的策略，文件修改后自动重新加载；新的文件有错误时继续使用原来的策略
+*/
+type Policy struct {
+	file    string
+	dryRun  bool //命令行要求的DryRun，覆盖文件中的设置
+	mu      sync.RWMutex
+	config  *PolicyConfig
+	modTime time.Time
+
+	decisions metric.Int64Counter
+}
+
+func LoadPolicy(file string, dryRun bool) (*Policy, error) {
+	p := &Policy{file: file, dryRun: dryRun}
+	if err := p.reload(); err != nil {
+		return nil, err
+	}
+	var err error
+	p.decisions, err = tracing.Meter().Int64Counter("sidecar.proxy.policy.decisions",
+		metric.WithDescription("authorization decisions of the proxy, decision is allow, deny or dry_run_deny"))
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *Policy) reload() error {
+	info, err := os.Stat(p.file)
+	if err != nil {
+		return err
+	}
+	contents, err := os.ReadFile(p.file)
+	if err != nil {
+		return err
+	}
+	var config PolicyConfig
+	if err := json.Unmarshal(contents, &config); err != nil {
+		return fmt.Errorf("can't parse %v: %v", p.file, err)
+	}
+	if err := config.validate(); err != nil {
+		return fmt.Errorf("invalid policy %v: %v", p.file, err)
+	}
+	config.DryRun = config.DryRun || p.dryRun
+
+	p.mu.Lock()
+	p.config, p.modTime = &config, info.ModTime()
+	p.mu.Unlock()
+	return nil
+}
+
+/*
+每隔interval检查一次文件，直到stopCh关闭
+*/
+func (p *Policy) Run(interval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+		info, err := os.Stat(p.file)
+		if err != nil {
+			log.Printf("check policy %v fail: %v", p.file, err)
+			continue
+		}
+		p.mu.RLock()
+		changed := !info.ModTime().Equal(p.modTime)
+		p.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := p.reload(); err != nil {
+			log.Printf("reload policy fail, keep the old one: %v", err)
+			//同一个错误的文件只报一次
+			p.mu.Lock()
+			p.modTime = info.ModTime()
+			p.mu.Unlock()
+			continue
+		}
+		log.Printf("policy %v reloaded", p.file)
+	}
+}
+
+/*
+授权一个请求并记录结果，被拒绝的请求（包括DryRun放行的）都写日志，带上对端证书的序列号
+*/
+func (p *Policy) authorize(req *policyRequest) bool {
+	if p == nil {
+		return true
+	}
+	p.mu.RLock()
+	config := p.config
+	p.mu.RUnlock()
+
+	d := config.evaluate(req)
+	result := ActionAllow
+	if !d.allowed || d.dryRun {
+		result = ActionDeny
+		if d.dryRun {
+			result = "dry_run_deny"
+		}
+		rule := d.rule
+		if rule == "" {
+			rule = "defaultAction"
+		}
+		target := "connection"
+		if req.http {
+			target = req.method + " " + req.path
+		}
+		log.Printf("policy %v: %v (serial %v) %v, rule %v", result, req.id, req.id.Serial, target, rule)
+	}
+	p.decisions.Add(context.Background(), 1, metric.WithAttributes(attribute.String("decision", result)))
+	return d.allowed
+}
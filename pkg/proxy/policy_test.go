@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		value   string
+		want    bool
+	}{
+		{pattern: "/api/v1", value: "/api/v1", want: true},
+		{pattern: "/api/v1", value: "/api/v1/users"},
+		{pattern: "/api/*", value: "/api/v1/users", want: true},
+		{pattern: "/api/*", value: "/api/", want: true},
+		{pattern: "/api/*", value: "/api"},
+		{pattern: "*", value: "anything", want: true},
+		{pattern: "spiffe://example.org/ns/prod/*", value: "spiffe://example.org/ns/prod/sa/web", want: true},
+		{pattern: "spiffe://example.org/ns/prod/*", value: "spiffe://example.org/ns/production/sa/web"},
+		{pattern: "grpc.CertificateService/*", value: "grpc.CertificateService/GetCert", want: true},
+	}
+	for _, tt := range tests {
+		if got := matchPattern(tt.pattern, tt.value); got != tt.want {
+			t.Errorf("matchPattern(%q, %q) = %v, want %v", tt.pattern, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestPolicyRuleMatches(t *testing.T) {
+	web := issue(t, "spiffe://example.org/ns/prod/web", "web", "web.local")
+	cert := web.cert.Leaf
+	id := identityOf(cert)
+	httpReq := func(method string, path string) *policyRequest {
+		return &policyRequest{cert: cert, id: id, http: true, method: method, path: path}
+	}
+
+	tests := []struct {
+		name string
+		rule PolicyRule
+		req  *policyRequest
+		want bool
+	}{
+		{name: "empty rule", req: &policyRequest{cert: cert, id: id}, want: true},
+		{name: "SPIFFE ID prefix", rule: PolicyRule{Peer: PeerMatch{SPIFFEIDs: []string{"spiffe://example.org/ns/prod/*"}}}, req: httpReq("GET", "/"), want: true},
+		{name: "other SPIFFE ID", rule: PolicyRule{Peer: PeerMatch{SPIFFEIDs: []string{"spiffe://example.org/ns/dev/*"}}}, req: httpReq("GET", "/")},
+		{name: "common name", rule: PolicyRule{Peer: PeerMatch{CommonNames: []string{"web"}}}, req: httpReq("GET", "/"), want: true},
+		{name: "DNS SAN", rule: PolicyRule{Peer: PeerMatch{SANs: []string{"DNS:web.local"}}}, req: httpReq("GET", "/"), want: true},
+		{name: "other SAN", rule: PolicyRule{Peer: PeerMatch{SANs: []string{"DNS:db.local"}}}, req: httpReq("GET", "/")},
+		{name: "method and path", rule: PolicyRule{Methods: []string{"GET"}, Paths: []string{"/api/*"}}, req: httpReq("GET", "/api/users"), want: true},
+		{name: "other method", rule: PolicyRule{Methods: []string{"GET"}, Paths: []string{"/api/*"}}, req: httpReq("POST", "/api/users")},
+		{name: "other path", rule: PolicyRule{Methods: []string{"GET"}, Paths: []string{"/api/*"}}, req: httpReq("GET", "/admin")},
+		{name: "http condition on a tcp connection", rule: PolicyRule{Paths: []string{"/*"}}, req: &policyRequest{cert: cert, id: id}},
+		{name: "grpc method", rule: PolicyRule{GRPC: []string{"grpc.CertificateService/*"}}, req: &policyRequest{cert: cert, id: id, http: true, method: "POST", path: "/grpc.CertificateService/GetCert", grpc: "grpc.CertificateService/GetCert"}, want: true},
+		{name: "grpc condition on a plain http request", rule: PolicyRule{GRPC: []string{"grpc.CertificateService/*"}}, req: httpReq("POST", "/grpc.CertificateService/GetCert")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rule.matches(tt.req); got != tt.want {
+				t.Errorf("matches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func writePolicy(t *testing.T, file string, contents string, modTime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(file, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(file, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+const denyAdminPolicy = `{"defaultAction": "allow", "rules": [{"name": "no-admin", "action": "deny", "paths": ["/admin/*"]}]}`
+
+func TestPolicyDryRun(t *testing.T) {
+	cert := issue(t, "", "client").cert.Leaf
+	tests := []struct {
+		name   string
+		config string
+		dryRun bool
+		path   string
+		want   bool
+	}{
+		{name: "allowed", config: denyAdminPolicy, path: "/public/a", want: true},
+		{name: "denied", config: denyAdminPolicy, path: "/admin/users"},
+		{name: "dry run in the file", config: `{"dryRun": true, "rules": []}`, path: "/admin/users", want: true},
+		{name: "dry run on the command line", config: denyAdminPolicy, dryRun: true, path: "/admin/users", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "policy.json")
+			writePolicy(t, file, tt.config, time.Now())
+			policy, err := LoadPolicy(file, tt.dryRun)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := &policyRequest{cert: cert, id: identityOf(cert), http: true, method: "GET", path: tt.path}
+			if got := policy.authorize(req); got != tt.want {
+				t.Errorf("authorize = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+/*
+文件修改后自动重新加载，修改成错误的文件时继续用原来的策略
+*/
+func TestPolicyReload(t *testing.T) {
+	cert := issue(t, "", "client").cert.Leaf
+	file := filepath.Join(t.TempDir(), "policy.json")
+	start := time.Now().Add(-time.Hour)
+	writePolicy(t, file, denyAdminPolicy, start)
+	policy, err := LoadPolicy(file, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go policy.Run(10*time.Millisecond, stopCh)
+
+	admin := &policyRequest{cert: cert, id: identityOf(cert), http: true, method: "GET", path: "/admin/users"}
+	tests := []struct {
+		name   string
+		config string
+		want   bool
+	}{
+		{name: "allow everything", config: `{"defaultAction": "allow", "rules": []}`, want: true},
+		{name: "invalid file keeps the old policy", config: `{"defaultAction": "maybe"}`, want: true},
+		{name: "deny admin again", config: denyAdminPolicy},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writePolicy(t, file, tt.config, start.Add(time.Duration(i+1)*time.Minute))
+			//等Run看到新的修改时间
+			deadline := time.Now().Add(2 * time.Second)
+			for {
+				policy.mu.RLock()
+				seen := policy.modTime.Equal(start.Add(time.Duration(i+1) * time.Minute))
+				policy.mu.RUnlock()
+				if seen || time.Now().After(deadline) {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if got := policy.authorize(admin); got != tt.want {
+				t.Errorf("authorize = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
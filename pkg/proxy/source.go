@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	cx509 "crypto/x509"
+	"sync"
+)
+
+/*
+代理使用的证书和信任的根证书，Source从CA拿到它们并在过期之前自动轮换
+*/
+type Source interface {
+	//当前的证书，还没有拿到时返回nil
+	Certificate() *tls.Certificate
+	//当前信任的根证书，根证书轮换时会同时包含新旧根证书
+	Roots() *cx509.CertPool
+	//拿到证书之后关闭
+	Ready() <-chan struct{}
+	//在后台获取并轮换证书，直到stopCh关闭
+	Run(stopCh <-chan struct{})
+}
+
+/*
+各种Source共用的状态，证书随时可能被替换，每次使用时都要重新取
+*/
+type credentials struct {
+	mu    sync.RWMutex
+	cert  *tls.Certificate
+	roots *cx509.CertPool
+	ready chan struct{}
+	once  sync.Once
+}
+
+func newCredentials() credentials {
+	return credentials{ready: make(chan struct{})}
+}
+
+func (c *credentials) Certificate() *tls.Certificate {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert
+}
+
+func (c *credentials) Roots() *cx509.CertPool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.roots
+}
+
+func (c *credentials) Ready() <-chan struct{} {
+	return c.ready
+}
+
+func (c *credentials) set(cert *tls.Certificate, roots *cx509.CertPool) {
+	c.mu.Lock()
+	c.cert = cert
+	c.roots = roots
+	c.mu.Unlock()
+	c.once.Do(func() { close(c.ready) })
+}
+
+/*
+等到source拿到证书，ctx结束时返回错误
+*/
+func WaitReady(ctx context.Context, source Source) error {
+	select {
+	case <-source.Ready():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+/*
+stopCh关闭时取消的context
+*/
+func contextOf(stopCh <-chan struct{}) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
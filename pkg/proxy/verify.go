@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"crypto/tls"
+	cx509 "crypto/x509"
+	"fmt"
+)
+
+/*
+上游服务应该具有的身份，都为空时按ServerName验证证书中的DNS名
+*/
+type ExpectedIdentity struct {
+	DNSNames  []string `json:"dnsNames,omitempty"`  //证书中有其中一个DNS名即可
+	SPIFFEIDs []string `json:"spiffeIds,omitempty"` //证书中的SPIFFE ID是其中一个即可
+}
+
+func (e ExpectedIdentity) empty() bool {
+	return len(e.DNSNames) == 0 && len(e.SPIFFEIDs) == 0
+}
+
+/*
+发起mTLS的客户端配置：用source当前的证书，按source当前的根证书验证证书链，再验证上游的身份
+上游的证书不一定包含我们连接用的名字（例如只有SPIFFE ID），所以关掉默认的验证，在VerifyConnection中自己做
+*/
+func clientTLSConfig(source Source, serverName string, expected ExpectedIdentity, alpn []string, onVerify func(error)) *tls.Config {
+	return &tls.Config{
+		ServerName:         serverName,
+		NextProtos:         alpn,
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: true,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert := source.Certificate()
+			if cert == nil {
+				return nil, fmt.Errorf("no certificate yet")
+			}
+			return cert, nil
+		},
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			err := verifyPeer(cs.PeerCertificates, source.Roots(), serverName, expected)
+			if onVerify != nil {
+				onVerify(err)
+			}
+			if err != nil {
+				return &verifyError{err}
+			}
+			return nil
+		},
+	}
+}
+
+/*
+上游的证书没有通过验证，和网络等其它握手错误区分开
+*/
+type verifyError struct {
+	err error
+}
+
+func (e *verifyError) Error() string {
+	return e.err.Error()
+}
+
+func (e *verifyError) Unwrap() error {
+	return e.err
+}
+
+func verifyPeer(certs []*cx509.Certificate, roots *cx509.CertPool, serverName string, expected ExpectedIdentity) error {
+	if len(certs) == 0 {
+		return fmt.Errorf("upstream didn't provide a certificate")
+	}
+	intermediates := cx509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	leaf := certs[0]
+	if _, err := leaf.Verify(cx509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []cx509.ExtKeyUsage{cx509.ExtKeyUsageServerAuth},
+	}); err != nil {
+		return err
+	}
+
+	if expected.empty() {
+		return leaf.VerifyHostname(serverName)
+	}
+	id := identityOf(leaf)
+	for _, spiffeID := range expected.SPIFFEIDs {
+		if id.SPIFFEID == spiffeID {
+			return nil
+		}
+	}
+	for _, name := range expected.DNSNames {
+		if leaf.VerifyHostname(name) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("upstream %v (serial %v) is not one of the expected identities", id, id.Serial)
+}
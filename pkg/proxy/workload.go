@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	cx509 "crypto/x509"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/workloadapi"
+	googlegrpc "google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+/*
+从SPIFFE Workload API拿X.509-SVID，SVID轮换时Workload API会推送新的
+*/
+type workloadSource struct {
+	credentials
+	socketPath string
+}
+
+func NewWorkloadSource(socketPath string) Source {
+	return &workloadSource{credentials: newCredentials(), socketPath: socketPath}
+}
+
+func (s *workloadSource) Run(stopCh <-chan struct{}) {
+	ctx, cancel := contextOf(stopCh)
+	defer cancel()
+	for {
+		err := s.watch(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("workload api stream broken, retry in %v: %v", retryInterval, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+func (s *workloadSource) watch(ctx context.Context) error {
+	conn, err := googlegrpc.DialContext(ctx, "unix:"+s.socketPath, googlegrpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	//SPIFFE规范要求的header
+	ctx = metadata.AppendToOutgoingContext(ctx, "workload.spiffe.io", "true")
+	stream, err := workloadapi.NewSpiffeWorkloadAPIClient(conn).FetchX509SVID(ctx, &workloadapi.X509SVIDRequest{})
+	if err != nil {
+		return err
+	}
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		cert, roots, err := parseSVIDResponse(resp)
+		if err != nil {
+			log.Printf("invalid X.509-SVID from workload api: %v", err)
+			continue
+		}
+		log.Printf("got X.509-SVID %v, expires at %v", resp.Svids[0].SpiffeId, cert.Leaf.NotAfter)
+		s.set(cert, roots)
+	}
+}
+
+/*
+用第一个SVID作为代理的证书，信任本trust domain和联邦trust domain的根证书
+*/
+func parseSVIDResponse(resp *workloadapi.X509SVIDResponse) (*tls.Certificate, *cx509.CertPool, error) {
+	if len(resp.Svids) == 0 {
+		return nil, nil, fmt.Errorf("no SVID for this workload")
+	}
+	svid := resp.Svids[0]
+	chain, err := cx509.ParseCertificates(svid.X509Svid)
+	if err != nil || len(chain) == 0 {
+		return nil, nil, fmt.Errorf("parse SVID certificates fail: %v", err)
+	}
+	key, err := cx509.ParsePKCS8PrivateKey(svid.X509SvidKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parse SVID key fail: %v", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("SVID key can't sign")
+	}
+
+	roots := cx509.NewCertPool()
+	bundles := [][]byte{svid.Bundle}
+	for _, bundle := range resp.FederatedBundles {
+		bundles = append(bundles, bundle)
+	}
+	for _, bundle := range bundles {
+		certs, err := cx509.ParseCertificates(bundle)
+		if err != nil {
+			return nil, nil, fmt.Errorf("parse trust bundle fail: %v", err)
+		}
+		for _, cert := range certs {
+			roots.AddCert(cert)
+		}
+	}
+
+	cert := &tls.Certificate{PrivateKey: signer, Leaf: chain[0]}
+	for _, c := range chain {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+	return cert, roots, nil
+}
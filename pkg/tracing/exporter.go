@@ -0,0 +1,60 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+/*
+tracing和metrics共用的exporter选择，what是写在错误信息中的名字（trace、metrics）
+otlp创建OTLP gRPC exporter；writer创建写到w的exporter，w为nil时以易读的格式写到标准输出
+exporter为none时enabled为false；file时打开文件，closer要在exporter关闭之后关闭
+*/
+func newExporter[E any](what string, kind string, file string, otlp func() (E, error), writer func(w io.Writer) (E, error)) (exporter E, closer io.Closer, enabled bool, err error) {
+	switch kind {
+	case "", ExporterNone:
+		return exporter, nil, false, nil
+	case ExporterOTLP:
+		exporter, err = otlp()
+	case ExporterStdout:
+		exporter, err = writer(nil)
+	case ExporterFile:
+		if file == "" {
+			return exporter, nil, false, fmt.Errorf("%v file must be given when exporter is %v", what, ExporterFile)
+		}
+		var f *os.File
+		if f, err = os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+			return exporter, nil, false, err
+		}
+		if exporter, err = writer(f); err != nil {
+			f.Close()
+		} else {
+			closer = f
+		}
+	default:
+		return exporter, nil, false, fmt.Errorf("unknown %v exporter %v", what, kind)
+	}
+	if err != nil {
+		log.Printf("create %v %v exporter fail", kind, what)
+		return exporter, nil, false, err
+	}
+	return exporter, closer, true, nil
+}
+
+/*
+先关闭provider（flush剩下的数据），再关闭exporter写入的文件
+*/
+func shutdownFunc(shutdown func(context.Context) error, closer io.Closer) func(context.Context) error {
+	return func(ctx context.Context) error {
+		err := shutdown(ctx)
+		if closer != nil {
+			closer.Close()
+		}
+		return err
+	}
+}
+
+func noShutdown(context.Context) error { return nil }
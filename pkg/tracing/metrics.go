@@ -0,0 +1,73 @@
+package tracing
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdoutmetric"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+)
+
+/*
+metrics 的配置，exporter 的取值和 tracing 相同
+*/
+type MetricsOptions struct {
+	ServiceName string
+	Exporter    string        //none, otlp, stdout, file
+	Endpoint    string        //OTLP gRPC collector 地址
+	Insecure    bool          //OTLP 连接不使用TLS
+	File        string        //exporter为file时，metrics写入的文件
+	Interval    time.Duration //多久导出一次
+}
+
+/*
+安装全局的 MeterProvider，返回的函数用于在退出前flush并关闭exporter
+*/
+func SetupMetrics(ctx context.Context, opts MetricsOptions) (func(context.Context) error, error) {
+	exporter, closer, enabled, err := newExporter("metrics", opts.Exporter, opts.File,
+		func() (sdkmetric.Exporter, error) {
+			clientOpts := []otlpmetricgrpc.Option{}
+			if opts.Endpoint != "" {
+				clientOpts = append(clientOpts, otlpmetricgrpc.WithEndpoint(opts.Endpoint))
+			}
+			if opts.Insecure {
+				clientOpts = append(clientOpts, otlpmetricgrpc.WithInsecure())
+			}
+			return otlpmetricgrpc.New(ctx, clientOpts...)
+		},
+		func(w io.Writer) (sdkmetric.Exporter, error) {
+			if w == nil {
+				return stdoutmetric.New(stdoutmetric.WithPrettyPrint())
+			}
+			return stdoutmetric.New(stdoutmetric.WithWriter(w))
+		})
+	if err != nil {
+		return nil, err
+	}
+	if !enabled {
+		return noShutdown, nil
+	}
+
+	res, err := newResource(opts.ServiceName)
+	if err != nil {
+		return nil, err
+	}
+	readerOpts := []sdkmetric.PeriodicReaderOption{}
+	if opts.Interval > 0 {
+		readerOpts = append(readerOpts, sdkmetric.WithInterval(opts.Interval))
+	}
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter, readerOpts...)), sdkmetric.WithResource(res))
+	otel.SetMeterProvider(provider)
+	return shutdownFunc(provider.Shutdown, closer), nil
+}
+
+/*
+项目内部统一使用的 meter，没有安装MeterProvider时什么也不记录
+*/
+func Meter() metric.Meter {
+	return otel.Meter(instrumentationName)
+}
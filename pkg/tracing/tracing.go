@@ -0,0 +1,86 @@
+package tracing
+
+import (
+	"context"
+	"io"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	ExporterNone   string = "none"
+	ExporterOTLP   string = "otlp"
+	ExporterStdout string = "stdout"
+	ExporterFile   string = "file"
+
+	instrumentationName string = "github.com/jackyzhangfudan/sidecar"
+)
+
+/*
+tracing 的配置，通常来自命令行参数
+*/
+type Options struct {
+	ServiceName string
+	Exporter    string //none, otlp, stdout, file
+	Endpoint    string //OTLP gRPC collector 地址，例如 localhost:4317
+	Insecure    bool   //OTLP 连接不使用TLS
+	File        string //exporter为file时，span写入的文件
+}
+
+/*
+安装全局的 TracerProvider 和 W3C trace-context propagator，返回的函数用于在退出前flush并关闭exporter
+*/
+func Setup(ctx context.Context, opts Options) (func(context.Context) error, error) {
+	//无论是否导出span，都要传播上游的trace context
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	exporter, closer, enabled, err := newExporter("trace", opts.Exporter, opts.File,
+		func() (sdktrace.SpanExporter, error) {
+			clientOpts := []otlptracegrpc.Option{}
+			if opts.Endpoint != "" {
+				clientOpts = append(clientOpts, otlptracegrpc.WithEndpoint(opts.Endpoint))
+			}
+			if opts.Insecure {
+				clientOpts = append(clientOpts, otlptracegrpc.WithInsecure())
+			}
+			return otlptracegrpc.New(ctx, clientOpts...)
+		},
+		func(w io.Writer) (sdktrace.SpanExporter, error) {
+			if w == nil {
+				return stdouttrace.New(stdouttrace.WithPrettyPrint())
+			}
+			return stdouttrace.New(stdouttrace.WithWriter(w))
+		})
+	if err != nil {
+		return nil, err
+	}
+	if !enabled {
+		return noShutdown, nil
+	}
+
+	res, err := newResource(opts.ServiceName)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	return shutdownFunc(provider.Shutdown, closer), nil
+}
+
+func newResource(serviceName string) (*resource.Resource, error) {
+	return resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName)))
+}
+
+/*
+项目内部统一使用的 tracer
+*/
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
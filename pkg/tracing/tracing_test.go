@@ -0,0 +1,101 @@
+package tracing
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSetup(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		opts    Options
+		wantErr string
+		wantLog string
+	}{
+		{name: "none", opts: Options{Exporter: ExporterNone}},
+		{name: "default", opts: Options{}},
+		{name: "file", opts: Options{ServiceName: "test", Exporter: ExporterFile, File: filepath.Join(dir, "spans.json")}, wantLog: "test.span"},
+		{name: "file without a path", opts: Options{Exporter: ExporterFile}, wantErr: "trace file must be given"},
+		{name: "unknown exporter", opts: Options{Exporter: "jaeger"}, wantErr: "unknown trace exporter jaeger"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shutdown, err := Setup(context.Background(), tt.opts)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, span := Tracer().Start(context.Background(), "test.span")
+			span.End()
+			if err := shutdown(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantLog == "" {
+				return
+			}
+			contents, err := os.ReadFile(tt.opts.File)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(contents), tt.wantLog) {
+				t.Errorf("%v not exported: %s", tt.wantLog, contents)
+			}
+		})
+	}
+}
+
+func TestSetupMetrics(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		opts    MetricsOptions
+		wantErr string
+		wantLog string
+	}{
+		{name: "none", opts: MetricsOptions{Exporter: ExporterNone}},
+		{name: "file", opts: MetricsOptions{ServiceName: "test", Exporter: ExporterFile, File: filepath.Join(dir, "metrics.json")}, wantLog: "test.counter"},
+		{name: "file without a path", opts: MetricsOptions{Exporter: ExporterFile}, wantErr: "metrics file must be given"},
+		{name: "unknown exporter", opts: MetricsOptions{Exporter: "prometheus"}, wantErr: "unknown metrics exporter prometheus"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shutdown, err := SetupMetrics(context.Background(), tt.opts)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			counter, err := Meter().Int64Counter("test.counter")
+			if err != nil {
+				t.Fatal(err)
+			}
+			counter.Add(context.Background(), 1)
+			if err := shutdown(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantLog == "" {
+				return
+			}
+			contents, err := os.ReadFile(tt.opts.File)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(contents), tt.wantLog) {
+				t.Errorf("%v not exported: %s", tt.wantLog, contents)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package util
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+和 time.ParseDuration 一样，另外支持以天为单位，例如 30d、1d12h
+*/
+func ParseDuration(s string) (time.Duration, error) {
+	days, rest, ok := strings.Cut(s, "d")
+	if !ok {
+		return time.ParseDuration(s)
+	}
+	n, err := strconv.ParseFloat(days, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	d := time.Duration(n * float64(24*time.Hour))
+	if rest != "" {
+		more, err := time.ParseDuration(rest)
+		if err != nil || more < 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		d += more
+	}
+	return d, nil
+}
+
+/*
+以天、小时、分钟显示一段时间，例如 29d23h、5h30m，负数表示已经过去
+*/
+func FormatDuration(d time.Duration) string {
+	sign := ""
+	if d < 0 {
+		sign, d = "-", -d
+	}
+	d = d.Truncate(time.Minute)
+	days := d / (24 * time.Hour)
+	d -= days * 24 * time.Hour
+	var b strings.Builder
+	b.WriteString(sign)
+	if days > 0 {
+		fmt.Fprintf(&b, "%dd", days)
+	}
+	if hours := d / time.Hour; hours > 0 {
+		fmt.Fprintf(&b, "%dh", hours)
+		d -= hours * time.Hour
+	}
+	if minutes := d / time.Minute; minutes > 0 || b.Len() == len(sign) {
+		fmt.Fprintf(&b, "%dm", minutes)
+	}
+	return b.String()
+}
@@ -0,0 +1,155 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+	"github.com/jackyzhangfudan/sidecar/pkg/util"
+)
+
+const (
+	DefaultMaxAttempts    int           = 12
+	DefaultInitialBackoff time.Duration = time.Second
+	DefaultMaxBackoff     time.Duration = time.Hour
+	DefaultTimeout        time.Duration = 10 * time.Second
+)
+
+/*
+webhook的配置文件，例如
+{"endpoints": [{"name": "deploy", "url": "https://deploy.example.com/hooks/ca", "secretFile": "deploy.secret", "events": ["certificate.issued", "certificate.renewed"]}]}
+时间可以写成 30s、10m、1d 这样
+*/
+type Config struct {
+	Endpoints      []Endpoint `json:"endpoints"`
+	MaxAttempts    int        `json:"maxAttempts"`    //最多发送多少次，之后放到队列的 failed/ 中，默认12
+	InitialBackoff string     `json:"initialBackoff"` //第一次重试前等多久，之后每次加倍，默认1s
+	MaxBackoff     string     `json:"maxBackoff"`     //两次重试之间最多等多久，默认1h
+	Timeout        string     `json:"timeout"`        //每次发送的超时，默认10s
+
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	timeout        time.Duration
+}
+
+type Endpoint struct {
+	Name       string   `json:"name"` //队列中用来区分endpoint，只能有字母、数字、- 和 _
+	URL        string   `json:"url"`
+	Secret     string   `json:"secret"`     //HMAC-SHA256的密钥
+	SecretFile string   `json:"secretFile"` //从文件中读密钥，不把密钥写在配置里
+	Events     []string `json:"events"`     //接收哪些事件，为空时接收全部
+}
+
+var endpointName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+/*
+读取并检查配置文件，secretFile中的密钥读到Secret
+*/
+func Load(file string) (*Config, error) {
+	contents, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var config Config
+	if err := json.Unmarshal(contents, &config); err != nil {
+		return nil, ca.WrapError(ca.ErrInvalidArgument, "INVALID_WEBHOOK_CONFIG", err, "can't parse %v", file)
+	}
+	for i := range config.Endpoints {
+		endpoint := &config.Endpoints[i]
+		if endpoint.Secret == "" && endpoint.SecretFile != "" {
+			secret, err := os.ReadFile(endpoint.SecretFile)
+			if err != nil {
+				return nil, err
+			}
+			endpoint.Secret = strings.TrimRight(string(secret), "\r\n")
+		}
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+func (c *Config) validate() error {
+	var violations []ca.FieldViolation
+	names := map[string]bool{}
+	for i, endpoint := range c.Endpoints {
+		field := fmt.Sprintf("endpoints[%v]", i)
+		if !endpointName.MatchString(endpoint.Name) {
+			violations = append(violations, ca.FieldViolation{Field: field + ".name", Description: "must be letters, digits, - or _"})
+		} else if names[endpoint.Name] {
+			violations = append(violations, ca.FieldViolation{Field: field + ".name", Description: "duplicate endpoint " + endpoint.Name})
+		}
+		names[endpoint.Name] = true
+		if u, err := url.Parse(endpoint.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			violations = append(violations, ca.FieldViolation{Field: field + ".url", Description: "must be an http or https URL"})
+		}
+		if endpoint.Secret == "" {
+			violations = append(violations, ca.FieldViolation{Field: field + ".secret", Description: "secret or secretFile is required, payloads are signed with it"})
+		}
+		for _, event := range endpoint.Events {
+			if !knownEvent(event) {
+				violations = append(violations, ca.FieldViolation{Field: field + ".events", Description: "unknown event " + event})
+			}
+		}
+	}
+	if c.MaxAttempts < 0 {
+		violations = append(violations, ca.FieldViolation{Field: "maxAttempts", Description: "must not be negative"})
+	}
+	if c.MaxAttempts == 0 {
+		c.MaxAttempts = DefaultMaxAttempts
+	}
+	durations := []struct {
+		field  string
+		value  string
+		target *time.Duration
+		def    time.Duration
+	}{
+		{"initialBackoff", c.InitialBackoff, &c.initialBackoff, DefaultInitialBackoff},
+		{"maxBackoff", c.MaxBackoff, &c.maxBackoff, DefaultMaxBackoff},
+		{"timeout", c.Timeout, &c.timeout, DefaultTimeout},
+	}
+	for _, d := range durations {
+		*d.target = d.def
+		if d.value == "" {
+			continue
+		}
+		value, err := util.ParseDuration(d.value)
+		if err != nil || value <= 0 {
+			violations = append(violations, ca.FieldViolation{Field: d.field, Description: "must be a positive duration"})
+			continue
+		}
+		*d.target = value
+	}
+	if len(violations) > 0 {
+		return ca.InvalidArgument("INVALID_WEBHOOK_CONFIG", violations...)
+	}
+	return nil
+}
+
+/*
+发送超时，用于 webhook test 这类不经过队列的发送
+*/
+func (c *Config) SendTimeout() time.Duration {
+	return c.timeout
+}
+
+/*
+这个endpoint是否接收这类事件
+*/
+func (e *Endpoint) Accepts(eventType string) bool {
+	if len(e.Events) == 0 {
+		return true
+	}
+	for _, event := range e.Events {
+		if event == eventType {
+			return true
+		}
+	}
+	return false
+}
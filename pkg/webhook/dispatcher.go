@@ -0,0 +1,335 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+	"github.com/jackyzhangfudan/sidecar/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+/*
+把CA的事件（签发、续签、吊销）和到期通知发给配置的endpoint
+CA把事件和证书一起写进发件箱（见 ca.EnableOutbox），dispatcher从发件箱取出事件写进持久的队列再发送，
+失败时按指数退避重试，server重启后接着发
+多副本时发件箱随存储复制，由leader取出，队列在这个副本本地
+*/
+type Dispatcher struct {
+	config *Config
+	queue  *queue
+	client *http.Client
+
+	mu      sync.Mutex
+	pending map[string][]*delivery   //endpoint -> 还没有发出去的delivery
+	wake    map[string]chan struct{} //有新的delivery时通知endpoint的goroutine
+
+	deliveries metric.Int64Counter
+}
+
+func NewDispatcher(config *Config, queueDir string) (*Dispatcher, error) {
+	q, err := openQueue(queueDir)
+	if err != nil {
+		return nil, fmt.Errorf("open webhook queue %v fail: %v", queueDir, err)
+	}
+	d := &Dispatcher{
+		config:  config,
+		queue:   q,
+		client:  &http.Client{Timeout: config.timeout},
+		pending: map[string][]*delivery{},
+		wake:    map[string]chan struct{}{},
+	}
+	for _, endpoint := range config.Endpoints {
+		d.wake[endpoint.Name] = make(chan struct{}, 1)
+	}
+	queued, err := q.load()
+	if err != nil {
+		return nil, fmt.Errorf("load webhook queue %v fail: %v", queueDir, err)
+	}
+	for _, item := range queued {
+		if _, ok := d.wake[item.Endpoint]; !ok {
+			//配置中已经删掉的endpoint
+			log.Printf("webhook endpoint %v is not configured, move %v to %v", item.Endpoint, item.file, failedFolder)
+			item.LastError = "endpoint is not configured"
+			if err := q.fail(item); err != nil {
+				log.Printf("move webhook delivery %v fail: %v", item.file, err)
+			}
+			continue
+		}
+		d.pending[item.Endpoint] = append(d.pending[item.Endpoint], item)
+	}
+
+	meter := tracing.Meter()
+	if d.deliveries, err = meter.Int64Counter("sidecar.webhook.deliveries",
+		metric.WithDescription("webhook delivery attempts by endpoint, result is delivered, retry or failed")); err != nil {
+		return nil, err
+	}
+	if _, err = meter.Int64ObservableGauge("sidecar.webhook.pending",
+		metric.WithDescription("webhook deliveries waiting in the queue by endpoint"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			for _, endpoint := range d.config.Endpoints {
+				o.Observe(int64(len(d.pending[endpoint.Name])), metric.WithAttributes(attribute.String("endpoint", endpoint.Name)))
+			}
+			return nil
+		})); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// 没有收到CA的事件时也隔这么久检查一次发件箱，例如刚成为leader时
+const outboxPollInterval time.Duration = 5 * time.Second
+
+/*
+把发件箱中的事件放进队列并发送队列中的delivery，直到stopCh关闭
+CA的事件订阅只用来及时醒来，订阅丢掉的事件还在发件箱中，下一次检查时取出
+*/
+func (d *Dispatcher) Run(stopCh <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for i := range d.config.Endpoints {
+		go d.deliverLoop(ctx, &d.config.Endpoints[i])
+	}
+
+	events, unsubscribe := ca.CA.Subscribe()
+	defer unsubscribe()
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+	for {
+		d.drainOutbox()
+		select {
+		case <-stopCh:
+			return
+		case <-events:
+		case <-ticker.C:
+		}
+	}
+}
+
+/*
+把发件箱中的事件按顺序放进队列，入队之后才从发件箱删除
+两步之间崩溃时同一个事件会再入队一次，事件的ID由发件箱中的ID决定，接收方可以用它去重
+*/
+func (d *Dispatcher) drainOutbox() {
+	if !ca.CA.IsLeader() {
+		return
+	}
+	entries, err := ca.CA.Outbox()
+	if err != nil {
+		log.Printf("read the CA outbox fail: %v", err)
+		return
+	}
+	for _, entry := range entries {
+		event, err := fromOutboxEntry(entry)
+		if err != nil {
+			log.Printf("create webhook event for %v fail: %v", entry.ID, err)
+			return
+		}
+		if event != nil {
+			if err := d.Enqueue(event); err != nil {
+				log.Printf("queue webhook event %v fail: %v", event.Type, err)
+				return
+			}
+		}
+		if err := ca.CA.AckOutbox(entry.ID); err != nil {
+			log.Printf("remove %v from the CA outbox fail: %v", entry.ID, err)
+			return
+		}
+	}
+}
+
+/*
+把事件放进每个接收它的endpoint的队列，队列中已经有同一个事件时不再放
+*/
+func (d *Dispatcher) Enqueue(event *Event) error {
+	for _, endpoint := range d.config.Endpoints {
+		if !endpoint.Accepts(event.Type) || d.queued(endpoint.Name, event.ID) {
+			continue
+		}
+		item := &delivery{Endpoint: endpoint.Name, Event: event, NextAttempt: time.Now()}
+		if err := d.queue.add(item); err != nil {
+			return err
+		}
+		d.mu.Lock()
+		d.pending[endpoint.Name] = append(d.pending[endpoint.Name], item)
+		d.mu.Unlock()
+		select {
+		case d.wake[endpoint.Name] <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (d *Dispatcher) queued(endpoint string, eventID string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, item := range d.pending[endpoint] {
+		if item.Event.ID == eventID {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+实现 ca.ExpiryNotifier：每个到期通知是一个 certificate.expiring 事件，入队成功就算通知过
+*/
+func (d *Dispatcher) Name() string { return "webhooks" }
+
+func (d *Dispatcher) Notify(ctx context.Context, report *ca.ExpiryReport) error {
+	for _, notice := range report.Notices {
+		event, err := fromExpiryNotice(notice)
+		if err != nil {
+			return err
+		}
+		if err := d.Enqueue(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+一个endpoint的delivery按顺序逐个发送，没有到重试时间的先等着
+*/
+func (d *Dispatcher) deliverLoop(ctx context.Context, endpoint *Endpoint) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		item, wait := d.next(endpoint.Name)
+		if item == nil {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(wait)
+			select {
+			case <-ctx.Done():
+				return
+			case <-d.wake[endpoint.Name]:
+			case <-timer.C:
+			}
+			continue
+		}
+		d.attempt(ctx, endpoint, item)
+	}
+}
+
+/*
+到了发送时间、最早入队的delivery；没有时返回要等多久
+*/
+func (d *Dispatcher) next(endpoint string) (*delivery, time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	wait := time.Hour
+	for _, item := range d.pending[endpoint] {
+		if !item.NextAttempt.After(now) {
+			return item, 0
+		}
+		if until := item.NextAttempt.Sub(now); until < wait {
+			wait = until
+		}
+	}
+	return nil, wait
+}
+
+func (d *Dispatcher) attempt(ctx context.Context, endpoint *Endpoint, item *delivery) {
+	err := Deliver(ctx, d.client, endpoint, item.Event)
+	item.Attempts++
+	result := "delivered"
+	switch {
+	case err == nil:
+		if err := d.queue.remove(item); err != nil {
+			log.Printf("remove webhook delivery %v fail: %v", item.file, err)
+		}
+		d.done(item)
+	case item.Attempts >= d.config.MaxAttempts:
+		result = "failed"
+		item.LastError = err.Error()
+		log.Printf("give up webhook %v event %v to %v after %v attempts: %v", item.Event.Type, item.Event.ID, endpoint.Name, item.Attempts, err)
+		if err := d.queue.fail(item); err != nil {
+			log.Printf("move webhook delivery %v fail: %v", item.file, err)
+		}
+		d.done(item)
+	default:
+		result = "retry"
+		item.LastError = err.Error()
+		item.NextAttempt = time.Now().Add(d.backoff(item.Attempts))
+		if err := d.queue.save(item); err != nil {
+			log.Printf("save webhook delivery %v fail: %v", item.file, err)
+		}
+	}
+	d.deliveries.Add(ctx, 1, metric.WithAttributes(attribute.String("endpoint", endpoint.Name), attribute.String("result", result)))
+}
+
+func (d *Dispatcher) done(item *delivery) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	pending := d.pending[item.Endpoint]
+	for i := range pending {
+		if pending[i] == item {
+			d.pending[item.Endpoint] = append(pending[:i:i], pending[i+1:]...)
+			return
+		}
+	}
+}
+
+/*
+第n次失败之后等 initialBackoff * 2^(n-1)，最多maxBackoff，再在后一半中随机取值，避免大量重试同时发出
+*/
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	backoff := d.config.maxBackoff
+	if attempts < 32 {
+		if b := d.config.initialBackoff << (attempts - 1); b > 0 && b < backoff {
+			backoff = b
+		}
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+/*
+把事件签名后POST给endpoint一次，返回2xx才算成功
+*/
+func Deliver(ctx context.Context, client *http.Client, endpoint *Endpoint, event *Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "sidecar-webhook")
+	req.Header.Set(HeaderEvent, event.Type)
+	req.Header.Set(HeaderDelivery, event.ID)
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderSignature, Sign(endpoint.Secret, timestamp, body))
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%v returned %v", endpoint.URL, resp.Status)
+	}
+	return nil
+}
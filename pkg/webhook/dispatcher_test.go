@@ -0,0 +1,199 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+)
+
+/*
+记录收到的请求，前failures次返回500
+*/
+type receiver struct {
+	mu       sync.Mutex
+	failures int
+	requests []*http.Request
+	bodies   [][]byte
+	ok       chan struct{}
+}
+
+func newReceiver(t *testing.T, failures int) (*receiver, *httptest.Server) {
+	r := &receiver{failures: failures, ok: make(chan struct{}, 16)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.mu.Lock()
+		r.requests = append(r.requests, req)
+		r.bodies = append(r.bodies, body)
+		fail := len(r.requests) <= r.failures
+		r.mu.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		r.ok <- struct{}{}
+	}))
+	t.Cleanup(server.Close)
+	return r, server
+}
+
+func (r *receiver) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.requests)
+}
+
+func startDispatcher(t *testing.T, url string, maxAttempts int) (*Dispatcher, string) {
+	config := &Config{
+		Endpoints:      []Endpoint{{Name: "test", URL: url, Secret: "s3cret"}},
+		MaxAttempts:    maxAttempts,
+		InitialBackoff: "10ms",
+		MaxBackoff:     "20ms",
+	}
+	if err := config.validate(); err != nil {
+		t.Fatal(err)
+	}
+	queueDir := t.TempDir()
+	d, err := NewDispatcher(config, queueDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopCh := make(chan struct{})
+	go d.Run(stopCh)
+	t.Cleanup(func() { close(stopCh) })
+	return d, queueDir
+}
+
+func waitUntil(t *testing.T, what string, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %v", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDispatcherRetry(t *testing.T) {
+	tests := []struct {
+		name         string
+		failures     int
+		maxAttempts  int
+		wantRequests int
+		wantFailed   bool
+	}{
+		{name: "first attempt", failures: 0, maxAttempts: 3, wantRequests: 1},
+		{name: "after two failures", failures: 2, maxAttempts: 3, wantRequests: 3},
+		{name: "attempts used up", failures: 10, maxAttempts: 3, wantRequests: 3, wantFailed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, server := newReceiver(t, tt.failures)
+			d, queueDir := startDispatcher(t, server.URL, tt.maxAttempts)
+			event, err := SampleEvent(EventRevoked)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := d.Enqueue(event); err != nil {
+				t.Fatal(err)
+			}
+			//已经在队列中的事件不会再入队
+			if err := d.Enqueue(event); err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.wantFailed {
+				waitUntil(t, "the delivery to fail", func() bool {
+					failed, _ := filepath.Glob(filepath.Join(queueDir, failedFolder, "*.json"))
+					return len(failed) == 1
+				})
+			} else {
+				select {
+				case <-r.ok:
+				case <-time.After(5 * time.Second):
+					t.Fatal("the event is not delivered")
+				}
+				waitUntil(t, "the queue to be empty", func() bool {
+					queued, _ := filepath.Glob(filepath.Join(queueDir, "*.json"))
+					return len(queued) == 0
+				})
+			}
+			if got := r.count(); got != tt.wantRequests {
+				t.Errorf("%d requests, want %d", got, tt.wantRequests)
+			}
+
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			for i, req := range r.requests {
+				if req.Header.Get(HeaderDelivery) != event.ID || req.Header.Get(HeaderEvent) != EventRevoked {
+					t.Errorf("request %d: delivery %v, event %v", i, req.Header.Get(HeaderDelivery), req.Header.Get(HeaderEvent))
+				}
+				if err := Verify("s3cret", req.Header.Get(HeaderTimestamp), req.Header.Get(HeaderSignature), r.bodies[i], time.Minute); err != nil {
+					t.Errorf("request %d: %v", i, err)
+				}
+			}
+		})
+	}
+}
+
+/*
+签发和吊销的事件从发件箱送到endpoint，送进队列之后发件箱就清空了
+*/
+func TestOutboxDelivery(t *testing.T) {
+	ca.CA.EnableOutbox()
+	cert, err := ca.CA.SignX509(context.Background(), &ca.CertificateSigningRequest{SubjectCommonName: "outbox", DNSNames: []string{"outbox.local"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ca.CA.Revoke(context.Background(), cert.ID, "superseded"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ca.CA.Outbox()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("%d events in the outbox, want 2", len(entries))
+	}
+	first, _ := fromOutboxEntry(entries[0])
+	again, _ := fromOutboxEntry(entries[0])
+	if first.ID != again.ID {
+		t.Errorf("event ID changes between %v and %v", first.ID, again.ID)
+	}
+
+	r, server := newReceiver(t, 0)
+	startDispatcher(t, server.URL, 3)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-r.ok:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the events are not delivered")
+		}
+	}
+	r.mu.Lock()
+	var types []string
+	for _, body := range r.bodies {
+		var event Event
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Data.CertificateID != cert.ID {
+			t.Errorf("event for %v, want %v", event.Data.CertificateID, cert.ID)
+		}
+		types = append(types, event.Type)
+	}
+	r.mu.Unlock()
+	if len(types) != 2 || types[0] != EventIssued || types[1] != EventRevoked {
+		t.Errorf("events %v, want issued then revoked", types)
+	}
+	if entries, _ := ca.CA.Outbox(); len(entries) != 0 {
+		t.Errorf("%d events left in the outbox", len(entries))
+	}
+}
@@ -0,0 +1,147 @@
+package webhook
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+)
+
+const (
+	EventIssued   string = "certificate.issued"
+	EventRenewed  string = "certificate.renewed"
+	EventRevoked  string = "certificate.revoked"
+	EventExpiring string = "certificate.expiring"
+)
+
+var Events = []string{EventIssued, EventRenewed, EventRevoked, EventExpiring}
+
+func knownEvent(eventType string) bool {
+	for _, event := range Events {
+		if event == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+POST给endpoint的json，ID在重试时不变，接收方可以用来去重
+*/
+type Event struct {
+	ID   string    `json:"id"`
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	Data EventData `json:"data"`
+}
+
+type EventData struct {
+	CertificateID    string     `json:"certificateId,omitempty"`
+	Kind             string     `json:"kind,omitempty"` //certificate.expiring：root、intermediate、local或leaf
+	Subject          string     `json:"subject,omitempty"`
+	Identity         string     `json:"identity,omitempty"`
+	SerialNumber     string     `json:"serialNumber,omitempty"` //十六进制
+	NotAfter         *time.Time `json:"notAfter,omitempty"`
+	RenewalOf        string     `json:"renewalOf,omitempty"`        //certificate.renewed：旧证书的ID
+	Reason           string     `json:"reason,omitempty"`           //certificate.revoked：吊销原因
+	ThresholdSeconds int64      `json:"thresholdSeconds,omitempty"` //certificate.expiring：越过的通知阈值
+	RemainingSeconds int64      `json:"remainingSeconds,omitempty"` //certificate.expiring：还剩多久，负数表示已经过期
+}
+
+func NewEvent(eventType string, data EventData) (*Event, error) {
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	return &Event{ID: "evt_" + hex.EncodeToString(id), Type: eventType, Time: time.Now().UTC(), Data: data}, nil
+}
+
+/*
+发件箱中的事件，ID由发件箱中的ID决定，重复入队时不变
+*/
+func fromOutboxEntry(entry *ca.OutboxEntry) (*Event, error) {
+	event, err := fromCAEvent(entry.Event)
+	if event == nil || err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(entry.ID))
+	event.ID = "evt_" + hex.EncodeToString(sum[:12])
+	return event, nil
+}
+
+/*
+把CA的事件转化为webhook的事件，不需要通知的事件（例如trust bundle的变化）返回nil
+*/
+func fromCAEvent(e ca.Event) (*Event, error) {
+	data := EventData{CertificateID: e.CertificateID, Identity: e.Identity}
+	var eventType string
+	switch {
+	case e.Type == ca.EventIssued && e.RenewalOf != "":
+		eventType, data.RenewalOf = EventRenewed, e.RenewalOf
+	case e.Type == ca.EventIssued:
+		eventType = EventIssued
+	case e.Type == ca.EventRevoked:
+		eventType, data.Reason = EventRevoked, e.Reason
+	default:
+		return nil, nil
+	}
+	if info, err := ca.CA.DescribeCertificate(e.CertificateID); err == nil {
+		data.Subject = "CN=" + info.CommonName
+		data.SerialNumber = info.SerialNumber
+		data.NotAfter = &info.NotAfter
+	}
+	event, err := NewEvent(eventType, data)
+	if err != nil {
+		return nil, err
+	}
+	if !e.Time.IsZero() {
+		event.Time = e.Time.UTC()
+	}
+	return event, nil
+}
+
+func fromExpiryNotice(notice *ca.ExpiryNotice) (*Event, error) {
+	cert := notice.Certificate
+	notAfter := cert.NotAfter
+	return NewEvent(EventExpiring, EventData{
+		CertificateID:    cert.ID,
+		Kind:             cert.Kind,
+		Subject:          cert.Subject,
+		Identity:         cert.Identity,
+		SerialNumber:     cert.SerialNumber,
+		NotAfter:         &notAfter,
+		ThresholdSeconds: int64(notice.Threshold / time.Second),
+		RemainingSeconds: int64(notice.Remaining / time.Second),
+	})
+}
+
+/*
+webhook test 发送的示例事件，数据是编出来的
+*/
+func SampleEvent(eventType string) (*Event, error) {
+	notAfter := time.Now().UTC().Add(90 * 24 * time.Hour).Truncate(time.Second)
+	data := EventData{
+		CertificateID: "2006-01-02_15-04-05-sample",
+		Subject:       "CN=sample",
+		Identity:      "spiffe://example.org/sample",
+		SerialNumber:  "0123456789abcdef",
+		NotAfter:      &notAfter,
+	}
+	switch eventType {
+	case EventRenewed:
+		data.RenewalOf = "2006-01-01_15-04-05-sample"
+	case EventRevoked:
+		data.Reason = "superseded"
+	case EventExpiring:
+		expiresAt := time.Now().UTC().Add(7*24*time.Hour - time.Minute).Truncate(time.Second)
+		data.Kind, data.NotAfter = ca.KindLeaf, &expiresAt
+		data.ThresholdSeconds = int64(7 * 24 * time.Hour / time.Second)
+		data.RemainingSeconds = data.ThresholdSeconds - 60
+	case EventIssued:
+	default:
+		return nil, ca.InvalidArgument("UNKNOWN_EVENT", ca.FieldViolation{Field: "event", Description: "unknown event " + eventType})
+	}
+	return NewEvent(eventType, data)
+}
@@ -0,0 +1,97 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const failedFolder string = "failed"
+
+/*
+一个事件发给一个endpoint，每个delivery是队列目录下的一个json文件，重启后接着发
+文件名以入队的时间开头，同一个endpoint按入队的顺序发送
+*/
+type delivery struct {
+	Endpoint    string    `json:"endpoint"`
+	Event       *Event    `json:"event"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"nextAttempt"`
+	LastError   string    `json:"lastError,omitempty"`
+
+	file string
+}
+
+/*
+发送失败的次数用完之后移到 failed/ 中，留给人工处理
+*/
+type queue struct {
+	dir string
+}
+
+func openQueue(dir string) (*queue, error) {
+	if err := os.MkdirAll(filepath.Join(dir, failedFolder), 0700); err != nil {
+		return nil, err
+	}
+	return &queue{dir: dir}, nil
+}
+
+/*
+队列中还没有发出去的delivery，按入队顺序
+*/
+func (q *queue) load() ([]*delivery, error) {
+	files, err := filepath.Glob(filepath.Join(q.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	var result []*delivery
+	for _, file := range files {
+		contents, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		d := &delivery{file: file}
+		if err := json.Unmarshal(contents, d); err != nil || d.Event == nil {
+			log.Printf("skip corrupted webhook delivery %v: %v", file, err)
+			continue
+		}
+		result = append(result, d)
+	}
+	return result, nil
+}
+
+func (q *queue) add(d *delivery) error {
+	d.file = filepath.Join(q.dir, fmt.Sprintf("%020d-%v-%v.json", time.Now().UnixNano(), d.Event.ID, d.Endpoint))
+	return q.save(d)
+}
+
+/*
+先写临时文件再改名，重启时不会读到写了一半的文件
+*/
+func (q *queue) save(d *delivery) error {
+	contents, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	tmp := d.file + ".tmp"
+	if err := os.WriteFile(tmp, contents, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.file)
+}
+
+func (q *queue) remove(d *delivery) error {
+	return os.Remove(d.file)
+}
+
+func (q *queue) fail(d *delivery) error {
+	if err := q.save(d); err != nil {
+		return err
+	}
+	return os.Rename(d.file, filepath.Join(q.dir, failedFolder, filepath.Base(d.file)))
+}
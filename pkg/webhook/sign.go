@@ -0,0 +1,46 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	HeaderEvent     string = "X-Sidecar-Event"
+	HeaderDelivery  string = "X-Sidecar-Delivery" //事件的ID
+	HeaderTimestamp string = "X-Sidecar-Timestamp"
+	HeaderSignature string = "X-Sidecar-Signature" //sha256=<hex>
+)
+
+/*
+签名的是 "<timestamp>.<body>"，带上时间戳防止旧的请求被重放
+*/
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+/*
+接收方检查签名：时间戳和现在相差不能超过tolerance，签名要和 Sign 的结果一致
+*/
+func Verify(secret string, timestamp string, signature string, body []byte, tolerance time.Duration) error {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid %v header", HeaderTimestamp)
+	}
+	if age := time.Since(time.Unix(ts, 0)); age > tolerance || age < -tolerance {
+		return fmt.Errorf("timestamp is %v away from now", age.Truncate(time.Second))
+	}
+	if !strings.HasPrefix(signature, "sha256=") || !hmac.Equal([]byte(signature), []byte(Sign(secret, ts, body))) {
+		return fmt.Errorf("signature mismatch")
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package webhook
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	body := []byte(`{"id":"evt_1","type":"certificate.issued"}`)
+	now := time.Now().Unix()
+	tests := []struct {
+		name      string
+		secret    string
+		timestamp string
+		signature string
+		body      []byte
+		wantErr   bool
+	}{
+		{name: "valid", secret: "s3cret", timestamp: strconv.FormatInt(now, 10), signature: Sign("s3cret", now, body), body: body},
+		{name: "wrong secret", secret: "other", timestamp: strconv.FormatInt(now, 10), signature: Sign("s3cret", now, body), body: body, wantErr: true},
+		{name: "changed body", secret: "s3cret", timestamp: strconv.FormatInt(now, 10), signature: Sign("s3cret", now, body), body: []byte(`{}`), wantErr: true},
+		{name: "timestamp not signed", secret: "s3cret", timestamp: strconv.FormatInt(now+1, 10), signature: Sign("s3cret", now, body), body: body, wantErr: true},
+		{name: "replayed", secret: "s3cret", timestamp: strconv.FormatInt(now-600, 10), signature: Sign("s3cret", now-600, body), body: body, wantErr: true},
+		{name: "invalid timestamp", secret: "s3cret", timestamp: "yesterday", signature: Sign("s3cret", now, body), body: body, wantErr: true},
+		{name: "no scheme", secret: "s3cret", timestamp: strconv.FormatInt(now, 10), signature: Sign("s3cret", now, body)[len("sha256="):], body: body, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Verify(tt.secret, tt.timestamp, tt.signature, tt.body, 5*time.Minute)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Verify: %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
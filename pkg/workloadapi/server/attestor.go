@@ -0,0 +1,80 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+)
+
+/*
+一条attestation规则：对端进程满足所有给出的条件时，可以拿到SpiffeID对应的X.509-SVID
+UID、GID为空表示不限制；Path是可执行文件的绝对路径，和接受连接时 /proc/<pid>/exe 指向的文件比较
+*/
+type Rule struct {
+	SpiffeID string   `json:"spiffeId"`
+	UID      *uint32  `json:"uid,omitempty"`
+	GID      *uint32  `json:"gid,omitempty"`
+	Path     string   `json:"path,omitempty"`
+	DNSNames []string `json:"dnsNames,omitempty"`
+	Hint     string   `json:"hint,omitempty"`
+}
+
+type rulesFile struct {
+	Rules []Rule `json:"rules"`
+}
+
+/*
+从JSON文件加载attestation规则，例如
+{"rules": [{"spiffeId": "spiffe://example.org/web", "uid": 1000}]}
+*/
+func LoadRules(file string, trustDomain string) ([]Rule, error) {
+	contents, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	rf := &rulesFile{}
+	if err := json.Unmarshal(contents, rf); err != nil {
+		return nil, err
+	}
+	for i, rule := range rf.Rules {
+		id, err := ca.ParseSPIFFEID(rule.SpiffeID)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i, err)
+		}
+		if id.TrustDomain != trustDomain {
+			return nil, fmt.Errorf("rule %d: %v isn't in trust domain %v", i, rule.SpiffeID, trustDomain)
+		}
+		if rule.UID == nil && rule.GID == nil && rule.Path == "" {
+			return nil, fmt.Errorf("rule %d: at least one of uid, gid and path is required", i)
+		}
+	}
+	return rf.Rules, nil
+}
+
+func (r *Rule) matches(creds *PeerCredentials) bool {
+	if r.UID != nil && *r.UID != creds.UID {
+		return false
+	}
+	if r.GID != nil && *r.GID != creds.GID {
+		return false
+	}
+	if r.Path != "" && creds.Exe != r.Path {
+		return false
+	}
+	return true
+}
+
+/*
+返回对端进程可以拿到的所有身份
+*/
+func attest(rules []Rule, creds *PeerCredentials) []*Rule {
+	var matched []*Rule
+	for i := range rules {
+		if rules[i].matches(creds) {
+			matched = append(matched, &rules[i])
+		}
+	}
+	return matched
+}
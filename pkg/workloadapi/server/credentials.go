@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"google.golang.org/grpc/credentials"
+)
+
+const peerCredAuthType string = "peercred"
+
+/*
+Unix domain socket 对端进程的身份，由内核给出（SO_PEERCRED），调用者无法伪造
+*/
+type PeerCredentials struct {
+	credentials.CommonAuthInfo
+	UID       uint32
+	GID       uint32
+	PID       int32
+	Exe       string //接受连接时 /proc/<pid>/exe 指向的文件
+	StartTime uint64 //接受连接时进程的启动时间，用来发现pid被复用
+}
+
+func (c PeerCredentials) AuthType() string {
+	return peerCredAuthType
+}
+
+func (c PeerCredentials) String() string {
+	return fmt.Sprintf("uid=%d gid=%d pid=%d", c.UID, c.GID, c.PID)
+}
+
+/*
+签发前确认对端还是接受连接时的那个进程：pid没有被复用，也没有exec成别的程序
+*/
+func (c PeerCredentials) verify() error {
+	exe, startTime, err := readProcess(c.PID)
+	if err != nil {
+		return err
+	}
+	if startTime != c.StartTime || exe != c.Exe {
+		return errors.New("peer process changed since the connection was accepted")
+	}
+	return nil
+}
+
+/*
+gRPC TransportCredentials：不做加密，只在连接建立时读取对端进程的peer credentials，
+之后在handler里可以通过 peer.FromContext 拿到
+*/
+type peerCredTransport struct{}
+
+func (t peerCredTransport) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		conn.Close()
+		return nil, nil, errors.New("workload api only accepts unix domain socket connections")
+	}
+	creds, err := readPeerCredentials(unixConn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	creds.SecurityLevel = credentials.NoSecurity
+	return conn, *creds, nil
+}
+
+func (t peerCredTransport) ClientHandshake(ctx context.Context, authority string, conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return nil, nil, errors.New("peer credentials are only used by the server")
+}
+
+func (t peerCredTransport) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{SecurityProtocol: peerCredAuthType}
+}
+
+func (t peerCredTransport) Clone() credentials.TransportCredentials {
+	return peerCredTransport{}
+}
+
+func (t peerCredTransport) OverrideServerName(string) error {
+	return nil
+}
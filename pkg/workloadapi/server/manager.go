@@ -0,0 +1,198 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+)
+
+/*
+缓存已经签发的X.509-SVID，并在过期前轮换
+证书过了一半有效期就重新签发，所有正在stream的调用者会被通知
+生成私钥和签发都在锁外进行，不会让其他stream等着
+没有stream在用的SVID到了轮换时间就从缓存里删掉，下次get时再签
+*/
+type svidManager struct {
+	ca  *ca.CertificateAuthority
+	ttl time.Duration
+
+	mu      sync.Mutex
+	svids   map[string]*cachedSVID //key 是整条规则，SPIFFE ID相同、DNSNames不同的规则各有各的SVID
+	refs    map[string]int         //每条规则正在stream的调用者数量
+	updated chan struct{}          //每次有SVID轮换时close，然后换一个新的
+}
+
+type cachedSVID struct {
+	rule *Rule
+	svid *ca.IssuedCertificate
+}
+
+func newSVIDManager(authority *ca.CertificateAuthority, ttl time.Duration) *svidManager {
+	return &svidManager{
+		ca:      authority,
+		ttl:     ttl,
+		svids:   map[string]*cachedSVID{},
+		refs:    map[string]int{},
+		updated: make(chan struct{}),
+	}
+}
+
+func ruleKey(rule *Rule) string {
+	key, _ := json.Marshal(rule)
+	return string(key)
+}
+
+/*
+返回规则对应的SVID，还没有签发过或者已经过期时现签
+快到期的SVID由rotate轮换并通知所有stream，这里不通知，调用者本来就会发送拿到的SVID
+*/
+func (m *svidManager) get(ctx context.Context, rule *Rule) (*ca.IssuedCertificate, error) {
+	key := ruleKey(rule)
+	m.mu.Lock()
+	cached, ok := m.svids[key]
+	m.mu.Unlock()
+	if ok && time.Now().Before(cached.svid.Certificate.NotAfter) {
+		return cached.svid, nil
+	}
+
+	svid, err := m.issue(ctx, rule)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	//其他stream同时签发了一张，用先放进去的那张
+	if other, ok := m.svids[key]; ok && other != cached && time.Now().Before(other.svid.Certificate.NotAfter) {
+		return other.svid, nil
+	}
+	m.svids[key] = &cachedSVID{rule: rule, svid: svid}
+	return svid, nil
+}
+
+/*
+stream开始时登记它要的规则，返回的函数在stream结束时调用
+*/
+func (m *svidManager) acquire(rules []*Rule) func() {
+	keys := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		keys = append(keys, ruleKey(rule))
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, key := range keys {
+		m.refs[key]++
+	}
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		for _, key := range keys {
+			if m.refs[key]--; m.refs[key] <= 0 {
+				delete(m.refs, key)
+			}
+		}
+	}
+}
+
+func (m *svidManager) issue(ctx context.Context, rule *Rule) (*ca.IssuedCertificate, error) {
+	id, err := url.Parse(rule.SpiffeID)
+	if err != nil {
+		return nil, err
+	}
+	csr := &ca.CertificateSigningRequest{
+		URIs:     []url.URL{*id},
+		DNSNames: rule.DNSNames,
+	}
+	return m.ca.IssueX509(ctx, csr, m.ttl)
+}
+
+func (m *svidManager) needRotate(svid *ca.IssuedCertificate) bool {
+	lifetime := svid.Certificate.NotAfter.Sub(svid.Certificate.NotBefore)
+	return time.Now().After(svid.Certificate.NotBefore.Add(lifetime / 2))
+}
+
+/*
+有变化时会被close的channel，调用者收到通知后应重新调用changes拿新的channel
+*/
+func (m *svidManager) changes() <-chan struct{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.updated
+}
+
+/*
+通知所有stream：SVID或trust bundle有变化
+*/
+func (m *svidManager) notify() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	close(m.updated)
+	m.updated = make(chan struct{})
+}
+
+/*
+定期检查并轮换快到期的SVID
+*/
+func (m *svidManager) run(stopCh <-chan struct{}) {
+	interval := m.ttl / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	events, cancel := m.ca.Subscribe()
+	defer cancel()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			m.rotate()
+		case e := <-events:
+			if e.Type == ca.EventTrustBundleChanged {
+				m.notify()
+			}
+		}
+	}
+}
+
+func (m *svidManager) rotate() {
+	m.mu.Lock()
+	var due []*cachedSVID
+	for key, cached := range m.svids {
+		if !m.needRotate(cached.svid) {
+			continue
+		}
+		if m.refs[key] == 0 {
+			delete(m.svids, key)
+			continue
+		}
+		due = append(due, cached)
+	}
+	m.mu.Unlock()
+
+	rotated := false
+	for _, old := range due {
+		svid, err := m.issue(context.Background(), old.rule)
+		if err != nil {
+			log.Printf("rotate X.509-SVID of %v fail: %v", old.rule.SpiffeID, err)
+			continue
+		}
+		key := ruleKey(old.rule)
+		m.mu.Lock()
+		//签发期间get已经换上了新的，就不用这张了
+		if m.svids[key] == old {
+			m.svids[key] = &cachedSVID{rule: old.rule, svid: svid}
+			rotated = true
+			log.Printf("X.509-SVID of %v rotated, expires at %v", old.rule.SpiffeID, svid.Certificate.NotAfter)
+		}
+		m.mu.Unlock()
+	}
+	if rotated {
+		m.notify()
+	}
+}
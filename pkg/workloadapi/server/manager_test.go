@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	cx509 "crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/jackyzhangfudan/sidecar/internal/catest"
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+)
+
+func TestMain(m *testing.M) {
+	catest.Main(m, func() error { return ca.CA.SetTrustDomain("example.org") })
+}
+
+func TestSVIDCache(t *testing.T) {
+	base := Rule{SpiffeID: "spiffe://example.org/web", DNSNames: []string{"web.local"}}
+	tests := []struct {
+		name  string
+		other Rule
+		same  bool
+	}{
+		{name: "same rule", other: base, same: true},
+		{name: "different DNS names", other: Rule{SpiffeID: base.SpiffeID, DNSNames: []string{"api.local"}}},
+		{name: "no DNS names", other: Rule{SpiffeID: base.SpiffeID}},
+		{name: "different SPIFFE ID", other: Rule{SpiffeID: "spiffe://example.org/api", DNSNames: base.DNSNames}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newSVIDManager(&ca.CA, time.Hour)
+			first, err := m.get(context.Background(), &base)
+			if err != nil {
+				t.Fatal(err)
+			}
+			changes := m.changes()
+			other := tt.other
+			second, err := m.get(context.Background(), &other)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (first == second) != tt.same {
+				t.Errorf("same SVID = %v, want %v", first == second, tt.same)
+			}
+			if got := second.Certificate.DNSNames; len(got) != len(other.DNSNames) || (len(got) > 0 && got[0] != other.DNSNames[0]) {
+				t.Errorf("DNSNames = %v, want %v", got, other.DNSNames)
+			}
+			select {
+			case <-changes:
+				t.Error("get must not notify the streams")
+			default:
+			}
+		})
+	}
+}
+
+func TestSVIDEviction(t *testing.T) {
+	expired := &ca.IssuedCertificate{Certificate: &cx509.Certificate{
+		NotBefore: time.Now().Add(-2 * time.Hour),
+		NotAfter:  time.Now().Add(-time.Hour),
+	}}
+	tests := []struct {
+		name      string
+		streaming bool
+		cached    bool
+	}{
+		{name: "streamed SVID is rotated", streaming: true, cached: true},
+		{name: "unused SVID is evicted", streaming: false, cached: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newSVIDManager(&ca.CA, time.Hour)
+			rule := &Rule{SpiffeID: "spiffe://example.org/web"}
+			key := ruleKey(rule)
+			m.svids[key] = &cachedSVID{rule: rule, svid: expired}
+			if tt.streaming {
+				release := m.acquire([]*Rule{rule})
+				defer release()
+			}
+			m.rotate()
+			cached, ok := m.svids[key]
+			if ok != tt.cached {
+				t.Fatalf("cached = %v, want %v", ok, tt.cached)
+			}
+			if ok && cached.svid == expired {
+				t.Error("streamed SVID wasn't rotated")
+			}
+		})
+	}
+}
+
+func TestSVIDRelease(t *testing.T) {
+	m := newSVIDManager(&ca.CA, time.Hour)
+	rule := &Rule{SpiffeID: "spiffe://example.org/web"}
+	first := m.acquire([]*Rule{rule})
+	second := m.acquire([]*Rule{rule})
+	first()
+	if got := m.refs[ruleKey(rule)]; got != 1 {
+		t.Errorf("refs after one release = %d, want 1", got)
+	}
+	second()
+	if _, ok := m.refs[ruleKey(rule)]; ok {
+		t.Error("refs not cleaned up after the last release")
+	}
+}
@@ -0,0 +1,80 @@
+//go:build linux
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+/*
+通过 SO_PEERCRED 读取对端进程的 uid/gid/pid，并在接受连接时记下它的可执行文件和启动时间
+之后的attestation都用这里记下的信息，不在RPC时重新读 /proc，避免pid被复用或者连接后再exec
+*/
+func readPeerCredentials(conn *net.UnixConn) (*PeerCredentials, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var ucred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if credErr != nil {
+		return nil, credErr
+	}
+	exe, startTime, err := readProcess(ucred.Pid)
+	if err != nil {
+		return nil, err
+	}
+	return &PeerCredentials{UID: ucred.Uid, GID: ucred.Gid, PID: ucred.Pid, Exe: exe, StartTime: startTime}, nil
+}
+
+/*
+读取进程的可执行文件和启动时间，读exe前后的启动时间不一致说明中间pid被复用了
+没有权限读 /proc/<pid>/exe 时exe为空，带path的规则不会匹配
+*/
+func readProcess(pid int32) (string, uint64, error) {
+	before, err := processStartTime(pid)
+	if err != nil {
+		return "", 0, err
+	}
+	exe, _ := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	after, err := processStartTime(pid)
+	if err != nil {
+		return "", 0, err
+	}
+	if before != after {
+		return "", 0, errors.New("peer process exited while being attested")
+	}
+	return exe, after, nil
+}
+
+/*
+/proc/<pid>/stat 的第22个字段，进程启动时间（开机后的clock ticks）
+comm字段里可能有空格和括号，所以从最后一个 ')' 之后开始数，那里是第3个字段
+*/
+func processStartTime(pid int32) (uint64, error) {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	end := strings.LastIndexByte(string(stat), ')')
+	if end < 0 {
+		return 0, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	fields := strings.Fields(string(stat[end+1:]))
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	return strconv.ParseUint(fields[19], 10, 64)
+}
@@ -0,0 +1,54 @@
+//go:build linux
+
+package server
+
+import (
+	"os"
+	"testing"
+)
+
+func TestPeerCredentialsVerify(t *testing.T) {
+	exe, startTime, err := readProcess(int32(os.Getpid()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, _ := os.Readlink("/proc/self/exe"); exe != want {
+		t.Fatalf("exe = %v, want %v", exe, want)
+	}
+	tests := []struct {
+		name    string
+		creds   PeerCredentials
+		wantErr bool
+	}{
+		{name: "same process", creds: PeerCredentials{PID: int32(os.Getpid()), Exe: exe, StartTime: startTime}},
+		{name: "pid reused", creds: PeerCredentials{PID: int32(os.Getpid()), Exe: exe, StartTime: startTime + 1}, wantErr: true},
+		{name: "exec after connect", creds: PeerCredentials{PID: int32(os.Getpid()), Exe: "/usr/bin/other", StartTime: startTime}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.creds.verify(); (err != nil) != tt.wantErr {
+				t.Errorf("verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRuleMatchesAcceptedExe(t *testing.T) {
+	tests := []struct {
+		name string
+		rule Rule
+		want bool
+	}{
+		{name: "same exe", rule: Rule{Path: "/usr/bin/web"}, want: true},
+		{name: "other exe", rule: Rule{Path: "/usr/bin/api"}},
+	}
+	//pid指向当前进程，规则只能看接受连接时记下的exe
+	creds := &PeerCredentials{PID: int32(os.Getpid()), Exe: "/usr/bin/web"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rule.matches(creds); got != tt.want {
+				t.Errorf("matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package server
+
+import (
+	"errors"
+	"net"
+)
+
+func readPeerCredentials(conn *net.UnixConn) (*PeerCredentials, error) {
+	return nil, errors.New("peer credentials are only supported on linux")
+}
+
+func readProcess(pid int32) (string, uint64, error) {
+	return "", 0, errors.New("peer credentials are only supported on linux")
+}
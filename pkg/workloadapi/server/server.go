@@ -0,0 +1,205 @@
+package server
+
+import (
+	"context"
+	cx509 "crypto/x509"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/jackyzhangfudan/sidecar/pkg/ca"
+	"github.com/jackyzhangfudan/sidecar/pkg/workloadapi"
+	googlegrpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	//SPIFFE规范要求客户端在每个请求中带上这个header，用来防止SSRF
+	securityHeader string = "workload.spiffe.io"
+)
+
+type Options struct {
+	SocketPath string
+	RulesFile  string
+	SVIDTTL    time.Duration
+}
+
+type workloadServer struct {
+	workloadapi.UnimplementedSpiffeWorkloadAPIServer
+	rules   []Rule
+	manager *svidManager
+}
+
+/*
+在Unix domain socket上启动SPIFFE Workload API
+调用者通过内核给出的peer credentials识别，按attestation规则拿到X.509-SVID
+*/
+func Run(opts Options, stopCh <-chan struct{}) {
+	if ca.CA.TrustDomain == "" {
+		log.Print("workload api needs a trust domain")
+		return
+	}
+	rules, err := LoadRules(opts.RulesFile, ca.CA.TrustDomain)
+	if err != nil {
+		log.Printf("load attestation rules fail: %v", err)
+		return
+	}
+
+	os.Remove(opts.SocketPath)
+	lis, err := net.Listen("unix", opts.SocketPath)
+	if err != nil {
+		log.Printf("failed to listen: %v", err)
+		return
+	}
+	//任何用户的进程都可以连接，身份由peer credentials决定
+	if err := os.Chmod(opts.SocketPath, 0777); err != nil {
+		log.Printf("chmod workload api socket fail: %v", err)
+	}
+
+	server := &workloadServer{rules: rules, manager: newSVIDManager(&ca.CA, opts.SVIDTTL)}
+	s := googlegrpc.NewServer(googlegrpc.Creds(peerCredTransport{}))
+	workloadapi.RegisterSpiffeWorkloadAPIServer(s, server)
+
+	go server.manager.run(stopCh)
+	go func() {
+		log.Printf("workload api listening at %v", lis.Addr())
+		if err := s.Serve(lis); err != nil {
+			log.Printf("workload api stopped: %v", err)
+		}
+	}()
+
+	<-stopCh
+	s.Stop()
+	os.Remove(opts.SocketPath)
+}
+
+/*
+返回调用者有权拿到的所有X.509-SVID，之后每次轮换都会推送新的
+*/
+func (s *workloadServer) FetchX509SVID(req *workloadapi.X509SVIDRequest, stream workloadapi.SpiffeWorkloadAPI_FetchX509SVIDServer) error {
+	ctx := stream.Context()
+	creds, rules, err := s.attestCaller(ctx)
+	if err != nil {
+		return err
+	}
+	release := s.manager.acquire(rules)
+	defer release()
+
+	for {
+		changes := s.manager.changes()
+		resp, err := s.x509SVIDResponse(ctx, creds, rules)
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-changes:
+		}
+	}
+}
+
+/*
+返回所有trust domain的trust bundle，有变化时推送
+*/
+func (s *workloadServer) FetchX509Bundles(req *workloadapi.X509BundlesRequest, stream workloadapi.SpiffeWorkloadAPI_FetchX509BundlesServer) error {
+	ctx := stream.Context()
+	if _, _, err := s.attestCaller(ctx); err != nil {
+		return err
+	}
+
+	for {
+		changes := s.manager.changes()
+		resp := &workloadapi.X509BundlesResponse{Bundles: map[string][]byte{}}
+		for td, certs := range ca.CA.TrustBundles() {
+			resp.Bundles[trustDomainID(td)] = concatDER(certs)
+		}
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-changes:
+		}
+	}
+}
+
+/*
+检查security header，并根据peer credentials找到调用者匹配的规则
+*/
+func (s *workloadServer) attestCaller(ctx context.Context) (*PeerCredentials, []*Rule, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok || len(md.Get(securityHeader)) != 1 || md.Get(securityHeader)[0] != "true" {
+		return nil, nil, status.Error(codes.InvalidArgument, "security header missing from request")
+	}
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil, nil, status.Error(codes.Internal, "no peer information")
+	}
+	creds, ok := p.AuthInfo.(PeerCredentials)
+	if !ok {
+		return nil, nil, status.Error(codes.Internal, "no peer credentials")
+	}
+	rules := attest(s.rules, &creds)
+	if len(rules) == 0 {
+		log.Printf("no identity for workload %v", creds)
+		return nil, nil, status.Error(codes.PermissionDenied, "no identity issued")
+	}
+	return &creds, rules, nil
+}
+
+/*
+每次下发SVID前都确认对端还是接受连接时attest过的那个进程
+*/
+func (s *workloadServer) x509SVIDResponse(ctx context.Context, creds *PeerCredentials, rules []*Rule) (*workloadapi.X509SVIDResponse, error) {
+	if err := creds.verify(); err != nil {
+		log.Printf("workload %v no longer attested: %v", creds, err)
+		return nil, status.Error(codes.PermissionDenied, "peer process changed")
+	}
+	bundles := ca.CA.TrustBundles()
+	resp := &workloadapi.X509SVIDResponse{FederatedBundles: map[string][]byte{}}
+	for _, rule := range rules {
+		svid, err := s.manager.get(ctx, rule)
+		if err != nil {
+			log.Printf("issue X.509-SVID for %v fail: %v", rule.SpiffeID, err)
+			return nil, status.Error(codes.Unavailable, "can't issue X.509-SVID")
+		}
+		key, err := cx509.MarshalPKCS8PrivateKey(svid.PrivateKey)
+		if err != nil {
+			return nil, status.Error(codes.Internal, "can't marshal private key")
+		}
+		resp.Svids = append(resp.Svids, &workloadapi.X509SVID{
+			SpiffeId:    rule.SpiffeID,
+			X509Svid:    svid.Certificate.Raw,
+			X509SvidKey: key,
+			Bundle:      concatDER(bundles[ca.CA.TrustDomain]),
+			Hint:        rule.Hint,
+		})
+	}
+	for td, certs := range bundles {
+		if td != ca.CA.TrustDomain {
+			resp.FederatedBundles[trustDomainID(td)] = concatDER(certs)
+		}
+	}
+	return resp, nil
+}
+
+func trustDomainID(td string) string {
+	return "spiffe://" + td
+}
+
+func concatDER(certs []*cx509.Certificate) []byte {
+	var der []byte
+	for _, cert := range certs {
+		der = append(der, cert.Raw...)
+	}
+	return der
+}